@@ -1,15 +1,18 @@
 package main
 
 import (
+	"context"
 	"log"
 	"log/slog"
 	"os"
 	"strings"
+	"time"
 
 	"oas-cloud-go/internal/cache"
 	"oas-cloud-go/internal/config"
 	"oas-cloud-go/internal/models"
 	"oas-cloud-go/internal/server"
+	"oas-cloud-go/internal/tracing"
 
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
@@ -39,10 +42,25 @@ func main() {
 	}
 	slog.SetDefault(slog.New(handler))
 
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg)
+	if err != nil {
+		log.Fatalf("failed to set up tracing: %v", err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			slog.Warn("failed to flush traces", "error", err)
+		}
+	}()
+
 	db, err := gorm.Open(postgres.Open(cfg.DatabaseURL), &gorm.Config{})
 	if err != nil {
 		log.Fatalf("failed to connect database: %v", err)
 	}
+	if err := tracing.InstrumentGORM(db); err != nil {
+		log.Fatalf("failed to instrument database: %v", err)
+	}
 
 	sqlDB, err := db.DB()
 	if err != nil {
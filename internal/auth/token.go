@@ -30,11 +30,18 @@ func NewTokenManager(secret string) *TokenManager {
 
 func (m *TokenManager) IssueJWT(role string, subjectID uint, managerID uint, ttl time.Duration) (string, error) {
 	now := time.Now().UTC()
+	// A random ID keeps two tokens issued in the same second apart; agent
+	// sessions are keyed by the token and bound to one node each.
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
 	claims := Claims{
 		Role:      role,
 		SubjectID: subjectID,
 		ManagerID: managerID,
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        hex.EncodeToString(id),
 			IssuedAt:  jwt.NewNumericDate(now),
 			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
 		},
@@ -9,6 +9,7 @@ import (
 
 	"oas-cloud-go/internal/auth"
 	"oas-cloud-go/internal/config"
+	"oas-cloud-go/internal/tracing"
 
 	"github.com/redis/go-redis/v9"
 )
@@ -22,12 +23,20 @@ type Store interface {
 	Close() error
 	Ping(ctx context.Context) error
 	SaveAgentSession(ctx context.Context, token string, managerID uint, nodeID string, ttl time.Duration) error
-	ValidateAgentSession(ctx context.Context, token string, managerID uint) (bool, error)
+	// ValidateAgentSession returns the node an agent session logged in as,
+	// and false when the session is gone or belongs to another manager.
+	ValidateAgentSession(ctx context.Context, token string, managerID uint) (string, bool, error)
+	// RevokeAgentSessions drops every session a node logged in with and
+	// returns how many there were.
+	RevokeAgentSessions(ctx context.Context, managerID uint, nodeID string) (int, error)
 	AcquireJobLease(ctx context.Context, managerID uint, jobID uint, nodeID string, ttl time.Duration) (bool, error)
 	IsJobLeaseOwner(ctx context.Context, managerID uint, jobID uint, nodeID string) (bool, error)
 	RefreshJobLease(ctx context.Context, managerID uint, jobID uint, nodeID string, ttl time.Duration) (bool, error)
 	ReleaseJobLease(ctx context.Context, managerID uint, jobID uint, nodeID string) error
 	ClearJobLease(ctx context.Context, managerID uint, jobID uint) error
+	// Account affinity: one node at a time works on a game account.
+	AcquireAccountLease(ctx context.Context, managerID uint, userID uint, nodeID string, ttl time.Duration) (bool, error)
+	ReleaseAccountLease(ctx context.Context, managerID uint, userID uint, nodeID string) error
 	AcquireScheduleSlot(
 		ctx context.Context,
 		managerID uint,
@@ -36,6 +45,7 @@ type Store interface {
 		slot string,
 		ttl time.Duration,
 	) (bool, error)
+	ReleaseScheduleSlot(ctx context.Context, managerID uint, userID uint, taskType string, slot string) error
 	GetManagerExpiry(ctx context.Context, managerID uint) (time.Time, error)
 	SetManagerExpiry(ctx context.Context, managerID uint, expiresAt time.Time, ttl time.Duration) error
 	// Scan job methods
@@ -57,6 +67,19 @@ type Store interface {
 	ClearUserTokenCache(ctx context.Context, tokenHash string) error
 	// Rate limiting
 	CheckRateLimit(ctx context.Context, key string, limit int, window time.Duration) (allowed bool, err error)
+	// Leader election: one replica at a time runs the singleton workers.
+	AcquireLeadership(ctx context.Context, name string, holderID string, ttl time.Duration) (int64, error)
+	ReleaseLeadership(ctx context.Context, name string, holderID string) error
+	GetLeadership(ctx context.Context, name string) (holderID string, fence int64, err error)
+	// Job wake-ups: every replica hears that a manager has new pending jobs.
+	PublishJobsReady(ctx context.Context, managerID uint) error
+	// SubscribeJobsReady calls handle for each published manager until ctx
+	// is done.
+	SubscribeJobsReady(ctx context.Context, handle func(managerID uint)) error
+	// Agent log tail: every replica hears the log lines written by any of
+	// them, as an opaque JSON payload.
+	PublishAgentLogs(ctx context.Context, payload []byte) error
+	SubscribeAgentLogs(ctx context.Context, handle func(payload []byte)) error
 }
 
 func NewRedisStore(cfg config.Config) (*RedisStore, error) {
@@ -68,6 +91,7 @@ func NewRedisStore(cfg config.Config) (*RedisStore, error) {
 		MinIdleConns: cfg.RedisMinIdleConns,
 		PoolTimeout:  cfg.RedisPoolTimeout,
 	})
+	client.AddHook(tracing.RedisHook{})
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	if err := client.Ping(ctx).Err(); err != nil {
@@ -91,6 +115,11 @@ func (r *RedisStore) Ping(ctx context.Context) error {
 	return r.client.Ping(ctx).Err()
 }
 
+// PoolStats returns the connection pool stats of the Redis client.
+func (r *RedisStore) PoolStats() *redis.PoolStats {
+	return r.client.PoolStats()
+}
+
 func (r *RedisStore) key(parts ...string) string {
 	all := make([]string, 0, len(parts)+1)
 	all = append(all, r.prefix)
@@ -114,37 +143,70 @@ func (r *RedisStore) SaveAgentSession(
 	if ttl <= 0 {
 		ttl = time.Hour
 	}
-	key := r.key("agent", "session", auth.HashToken(token))
+	hash := auth.HashToken(token)
+	key := r.key("agent", "session", hash)
 	fields := map[string]any{
 		"manager_id": managerID,
 		"node_id":    nodeID,
 		"updated_at": time.Now().UTC().Format(time.RFC3339),
 	}
+	// The node's index outlives its newest session, so it covers them all.
+	indexKey := r.agentNodeSessionsKey(managerID, nodeID)
 	pipe := r.client.TxPipeline()
 	pipe.HSet(ctx, key, fields)
 	pipe.Expire(ctx, key, ttl)
+	pipe.SAdd(ctx, indexKey, hash)
+	pipe.Expire(ctx, indexKey, ttl)
 	_, err := pipe.Exec(ctx)
 	return err
 }
 
+func (r *RedisStore) agentNodeSessionsKey(managerID uint, nodeID string) string {
+	return r.key("agent", "node_sessions", strconv.FormatUint(uint64(managerID), 10), nodeID)
+}
+
+func (r *RedisStore) RevokeAgentSessions(ctx context.Context, managerID uint, nodeID string) (int, error) {
+	indexKey := r.agentNodeSessionsKey(managerID, nodeID)
+	hashes, err := r.client.SMembers(ctx, indexKey).Result()
+	if err != nil {
+		return 0, err
+	}
+	keys := make([]string, 0, len(hashes)+1)
+	for _, hash := range hashes {
+		keys = append(keys, r.key("agent", "session", hash))
+	}
+	keys = append(keys, indexKey)
+	deleted, err := r.client.Del(ctx, keys...).Result()
+	if err != nil {
+		return 0, err
+	}
+	// The index itself is one of the deleted keys.
+	if deleted > 0 {
+		deleted--
+	}
+	return int(deleted), nil
+}
+
 func (r *RedisStore) ValidateAgentSession(
 	ctx context.Context,
 	token string,
 	managerID uint,
-) (bool, error) {
+) (string, bool, error) {
 	key := r.key("agent", "session", auth.HashToken(token))
-	stored, err := r.client.HGet(ctx, key, "manager_id").Result()
-	if err == redis.Nil {
-		return false, nil
-	}
+	values, err := r.client.HMGet(ctx, key, "manager_id", "node_id").Result()
 	if err != nil {
-		return false, err
+		return "", false, err
+	}
+	stored, _ := values[0].(string)
+	nodeID, _ := values[1].(string)
+	if stored == "" {
+		return "", false, nil
 	}
 	id, err := strconv.ParseUint(stored, 10, 64)
 	if err != nil {
-		return false, fmt.Errorf("invalid redis manager_id: %w", err)
+		return "", false, fmt.Errorf("invalid redis manager_id: %w", err)
 	}
-	return uint(id) == managerID, nil
+	return nodeID, uint(id) == managerID, nil
 }
 
 func (r *RedisStore) AcquireJobLease(
@@ -244,6 +306,55 @@ func (r *RedisStore) ClearJobLease(
 	return r.client.Del(ctx, key).Err()
 }
 
+// AcquireAccountLease takes the account lease of a user for nodeID, or extends
+// it when nodeID already holds it. It fails while another node holds it.
+func (r *RedisStore) AcquireAccountLease(
+	ctx context.Context,
+	managerID uint,
+	userID uint,
+	nodeID string,
+	ttl time.Duration,
+) (bool, error) {
+	if ttl <= 0 {
+		ttl = 30 * time.Second
+	}
+	key := r.key("account", "lease", strconv.FormatUint(uint64(managerID), 10), strconv.FormatUint(uint64(userID), 10))
+	script := redis.NewScript(`
+local current = redis.call("GET", KEYS[1])
+if not current then
+  redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+  return 1
+end
+if current ~= ARGV[1] then
+  return 0
+end
+redis.call("PEXPIRE", KEYS[1], ARGV[2])
+return 1
+`)
+	res, err := script.Run(ctx, r.client, []string{key}, nodeID, ttl.Milliseconds()).Int()
+	if err != nil {
+		return false, err
+	}
+	return res == 1, nil
+}
+
+// ReleaseAccountLease drops the account lease if nodeID still holds it.
+func (r *RedisStore) ReleaseAccountLease(
+	ctx context.Context,
+	managerID uint,
+	userID uint,
+	nodeID string,
+) error {
+	key := r.key("account", "lease", strconv.FormatUint(uint64(managerID), 10), strconv.FormatUint(uint64(userID), 10))
+	script := redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+  redis.call("DEL", KEYS[1])
+end
+return 1
+`)
+	return script.Run(ctx, r.client, []string{key}, nodeID).Err()
+}
+
 func (r *RedisStore) AcquireScheduleSlot(
 	ctx context.Context,
 	managerID uint,
@@ -266,6 +377,20 @@ func (r *RedisStore) AcquireScheduleSlot(
 	return r.client.SetNX(ctx, key, "1", ttl).Result()
 }
 
+// ReleaseScheduleSlot frees a slot taken by AcquireScheduleSlot before its
+// TTL runs out.
+func (r *RedisStore) ReleaseScheduleSlot(ctx context.Context, managerID uint, userID uint, taskType string, slot string) error {
+	key := r.key(
+		"scheduler",
+		"slot",
+		strconv.FormatUint(uint64(managerID), 10),
+		strconv.FormatUint(uint64(userID), 10),
+		taskType,
+		slot,
+	)
+	return r.client.Del(ctx, key).Err()
+}
+
 func (r *RedisStore) GetManagerExpiry(ctx context.Context, managerID uint) (time.Time, error) {
 	key := r.key("manager", "expiry", strconv.FormatUint(uint64(managerID), 10))
 	val, err := r.client.Get(ctx, key).Result()
@@ -479,3 +604,116 @@ func (r *RedisStore) CheckRateLimit(ctx context.Context, key string, limit int,
 	}
 	return incr.Val() <= int64(limit), nil
 }
+
+// AcquireLeadership takes or renews the leadership lease of name for
+// holderID. It returns the fencing token of the current term, which grows by
+// one each time the lease changes hands, or 0 while another holder has it.
+func (r *RedisStore) AcquireLeadership(ctx context.Context, name string, holderID string, ttl time.Duration) (int64, error) {
+	if ttl <= 0 {
+		ttl = 10 * time.Second
+	}
+	script := redis.NewScript(`
+local current = redis.call("GET", KEYS[1])
+if current and current ~= ARGV[1] then
+  return 0
+end
+if not current then
+  redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+  return redis.call("INCR", KEYS[2])
+end
+redis.call("PEXPIRE", KEYS[1], ARGV[2])
+local fence = redis.call("GET", KEYS[2])
+if not fence then
+  return redis.call("INCR", KEYS[2])
+end
+return tonumber(fence)
+`)
+	return script.Run(ctx, r.client, []string{r.key("leader", name), r.key("leader", name, "fence")}, holderID, ttl.Milliseconds()).Int64()
+}
+
+// ReleaseLeadership gives up the leadership of name if holderID still has it,
+// so that a follower can take over without waiting for the lease to expire.
+func (r *RedisStore) ReleaseLeadership(ctx context.Context, name string, holderID string) error {
+	script := redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+  redis.call("DEL", KEYS[1])
+end
+return 1
+`)
+	return script.Run(ctx, r.client, []string{r.key("leader", name)}, holderID).Err()
+}
+
+// GetLeadership returns the current holder of name ("" if none) and the
+// latest fencing token.
+func (r *RedisStore) GetLeadership(ctx context.Context, name string) (string, int64, error) {
+	values, err := r.client.MGet(ctx, r.key("leader", name), r.key("leader", name, "fence")).Result()
+	if err != nil {
+		return "", 0, err
+	}
+	holder, _ := values[0].(string)
+	var fence int64
+	if raw, ok := values[1].(string); ok {
+		fence, _ = strconv.ParseInt(raw, 10, 64)
+	}
+	return holder, fence, nil
+}
+
+func (r *RedisStore) jobsReadyChannel() string {
+	return r.key("agent", "jobs_ready")
+}
+
+func (r *RedisStore) PublishJobsReady(ctx context.Context, managerID uint) error {
+	return r.client.Publish(ctx, r.jobsReadyChannel(), strconv.FormatUint(uint64(managerID), 10)).Err()
+}
+
+// SubscribeJobsReady listens on the jobs-ready channel. The client
+// resubscribes by itself after a dropped connection; messages published
+// meanwhile are lost, which waiting agents cover by their poll timeout.
+func (r *RedisStore) SubscribeJobsReady(ctx context.Context, handle func(managerID uint)) error {
+	sub := r.client.Subscribe(ctx, r.jobsReadyChannel())
+	defer sub.Close()
+	messages := sub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case msg, ok := <-messages:
+			if !ok {
+				return nil
+			}
+			managerID, err := strconv.ParseUint(msg.Payload, 10, 64)
+			if err != nil {
+				continue
+			}
+			handle(uint(managerID))
+		}
+	}
+}
+
+func (r *RedisStore) agentLogsChannel() string {
+	return r.key("agent", "logs")
+}
+
+func (r *RedisStore) PublishAgentLogs(ctx context.Context, payload []byte) error {
+	return r.client.Publish(ctx, r.agentLogsChannel(), payload).Err()
+}
+
+// SubscribeAgentLogs listens on the agent log channel. Lines published while
+// the connection is down are not replayed; tail clients catch up from the
+// table by resuming after the last id they saw.
+func (r *RedisStore) SubscribeAgentLogs(ctx context.Context, handle func(payload []byte)) error {
+	sub := r.client.Subscribe(ctx, r.agentLogsChannel())
+	defer sub.Close()
+	messages := sub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case msg, ok := <-messages:
+			if !ok {
+				return nil
+			}
+			handle([]byte(msg.Payload))
+		}
+	}
+}
@@ -20,6 +20,7 @@ type Config struct {
 	JWTSecret          string
 	JWTTTL             time.Duration
 	AgentJWTTTL        time.Duration
+	AgentOfflineAfter  time.Duration
 	UserTokenTTL       time.Duration
 	DefaultLeaseSecond int
 	MaxPollLimit       int
@@ -28,6 +29,11 @@ type Config struct {
 	SchedulerScanLimit int
 	SchedulerSlotTTL   time.Duration
 	SchedulerWorkers   int
+	DefaultRestWindow  string
+	SchedulerSpread    time.Duration
+	InstanceID         string
+	LeaderElection     bool
+	LeaderLeaseTTL     time.Duration
 	DBMaxOpenConns     int
 	DBMaxIdleConns     int
 	DBConnMaxLifetime  time.Duration
@@ -36,6 +42,34 @@ type Config struct {
 	RedisPoolTimeout   time.Duration
 	LogLevel           string
 	LogFormat          string
+	MetricsToken       string
+	TracingExporter    string
+	TracingEndpoint    string
+	TracingSampleRatio float64
+	RetentionEnabled   bool
+	RetentionInterval  time.Duration
+	RetentionJobDays   int
+	RetentionEventDays int
+	RetentionAuditDays int
+	RetentionAgentDays int
+	RetentionExportDir string
+	SMTPHost           string
+	SMTPPort           int
+	SMTPUsername       string
+	SMTPPassword       string
+	SMTPFrom           string
+	SMTPImplicitTLS    bool
+	EmailMinInterval   time.Duration
+	NotifyMaxAttempts  int
+	NotifyRetryBase    time.Duration
+	NotifyRetryMax     time.Duration
+	// NotifyAllowPrivate lets webhook and Bark targets use loopback and
+	// private addresses, for receivers on the same network. Off by default.
+	NotifyAllowPrivate bool
+	AlertInterval      time.Duration
+	AlertExpiryDays    int
+	AlertFailureStreak int
+	AlertInactiveHours int
 }
 
 func Load() Config {
@@ -51,6 +85,7 @@ func Load() Config {
 		JWTSecret:          getEnvOrFile("JWT_SECRET", "JWT_SECRET_FILE", "change-me-in-production"),
 		JWTTTL:             getDurationEnv("JWT_TTL", 24*time.Hour),
 		AgentJWTTTL:        getDurationEnv("AGENT_JWT_TTL", 12*time.Hour),
+		AgentOfflineAfter:  getDurationEnv("AGENT_OFFLINE_AFTER", 3*time.Minute),
 		UserTokenTTL:       getDurationEnv("USER_TOKEN_TTL", 180*24*time.Hour),
 		DefaultLeaseSecond: getIntEnv("DEFAULT_LEASE_SECONDS", 90),
 		MaxPollLimit:       getIntEnv("MAX_POLL_LIMIT", 20),
@@ -59,6 +94,11 @@ func Load() Config {
 		SchedulerScanLimit: getIntEnv("SCHEDULER_SCAN_LIMIT", 500),
 		SchedulerSlotTTL:   getDurationEnv("SCHEDULER_SLOT_TTL", 90*time.Second),
 		SchedulerWorkers:   getIntEnv("SCHEDULER_WORKERS", 4),
+		DefaultRestWindow:  getEnv("SCHEDULER_REST_WINDOW", "00:00-06:00"),
+		SchedulerSpread:    getDurationEnv("SCHEDULER_SPREAD", 30*time.Minute),
+		InstanceID:         getEnv("INSTANCE_ID", defaultInstanceID()),
+		LeaderElection:     getBoolEnv("LEADER_ELECTION_ENABLED", true),
+		LeaderLeaseTTL:     getDurationEnv("LEADER_LEASE_TTL", 10*time.Second),
 		DBMaxOpenConns:     getIntEnv("DB_MAX_OPEN_CONNS", 25),
 		DBMaxIdleConns:     getIntEnv("DB_MAX_IDLE_CONNS", 10),
 		DBConnMaxLifetime:  getDurationEnv("DB_CONN_MAX_LIFETIME", 30*time.Minute),
@@ -67,9 +107,45 @@ func Load() Config {
 		RedisPoolTimeout:   getDurationEnv("REDIS_POOL_TIMEOUT", 5*time.Second),
 		LogLevel:           getEnv("LOG_LEVEL", "info"),
 		LogFormat:          getEnv("LOG_FORMAT", "text"),
+		MetricsToken:       getEnvOrFile("METRICS_TOKEN", "METRICS_TOKEN_FILE", ""),
+		TracingExporter:    strings.ToLower(getEnv("TRACING_EXPORTER", "none")),
+		TracingEndpoint:    getEnv("TRACING_OTLP_ENDPOINT", ""),
+		TracingSampleRatio: getFloatEnv("TRACING_SAMPLE_RATIO", 1),
+		RetentionEnabled:   getBoolEnv("RETENTION_ENABLED", false),
+		RetentionInterval:  getDurationEnv("RETENTION_INTERVAL", time.Hour),
+		RetentionJobDays:   getIntEnv("RETENTION_JOB_DAYS", 30),
+		RetentionEventDays: getIntEnv("RETENTION_EVENT_DAYS", 30),
+		RetentionAuditDays: getIntEnv("RETENTION_AUDIT_DAYS", 180),
+		RetentionAgentDays: getIntEnv("RETENTION_AGENT_LOG_DAYS", 14),
+		RetentionExportDir: getEnv("RETENTION_EXPORT_DIR", ""),
+		SMTPHost:           getEnv("SMTP_HOST", ""),
+		SMTPPort:           getIntEnv("SMTP_PORT", 587),
+		SMTPUsername:       getEnv("SMTP_USERNAME", ""),
+		SMTPPassword:       getEnvOrFile("SMTP_PASSWORD", "SMTP_PASSWORD_FILE", ""),
+		SMTPFrom:           getEnv("SMTP_FROM", ""),
+		SMTPImplicitTLS:    getBoolEnv("SMTP_IMPLICIT_TLS", false),
+		EmailMinInterval:   getDurationEnv("EMAIL_MIN_INTERVAL", 60*time.Second),
+		NotifyMaxAttempts:  getIntEnv("NOTIFY_MAX_ATTEMPTS", 5),
+		NotifyRetryBase:    getDurationEnv("NOTIFY_RETRY_BASE", 30*time.Second),
+		NotifyRetryMax:     getDurationEnv("NOTIFY_RETRY_MAX", 30*time.Minute),
+		NotifyAllowPrivate: getBoolEnv("NOTIFY_ALLOW_PRIVATE_TARGETS", false),
+		AlertInterval:      getDurationEnv("ALERT_INTERVAL", 10*time.Minute),
+		AlertExpiryDays:    getIntEnv("ALERT_EXPIRY_DAYS", 3),
+		AlertFailureStreak: getIntEnv("ALERT_FAILURE_STREAK", 3),
+		AlertInactiveHours: getIntEnv("ALERT_INACTIVE_HOURS", 24),
 	}
 }
 
+// defaultInstanceID names this replica for leader election: the hostname
+// (the pod name on Kubernetes) plus the process ID.
+func defaultInstanceID() string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "oas-cloud"
+	}
+	return host + "-" + strconv.Itoa(os.Getpid())
+}
+
 func getEnvOrFile(key string, keyFile string, fallback string) string {
 	if value := os.Getenv(key); value != "" {
 		return value
@@ -105,6 +181,18 @@ func getIntEnv(key string, fallback int) int {
 	return parsed
 }
 
+func getFloatEnv(key string, fallback float64) float64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return fallback
+	}
+	return parsed
+}
+
 func getDurationEnv(key string, fallback time.Duration) time.Duration {
 	value := os.Getenv(key)
 	if value == "" {
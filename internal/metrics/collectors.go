@@ -0,0 +1,113 @@
+package metrics
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"oas-cloud-go/internal/models"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+)
+
+// JobQueueCollector reports the pending, leased and running jobs of each
+// manager, counted in the database at scrape time.
+type JobQueueCollector struct {
+	db   *gorm.DB
+	desc *prometheus.Desc
+}
+
+func NewJobQueueCollector(db *gorm.DB) *JobQueueCollector {
+	return &JobQueueCollector{
+		db: db,
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "jobs", "active"),
+			"Pending, leased and running jobs by manager and status.",
+			[]string{"manager_id", "status"}, nil,
+		),
+	}
+}
+
+func (c *JobQueueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *JobQueueCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var rows []struct {
+		ManagerID uint   `gorm:"column:manager_id"`
+		Status    string `gorm:"column:status"`
+		Count     int64  `gorm:"column:count"`
+	}
+	if err := c.db.WithContext(ctx).Model(&models.TaskJob{}).
+		Select("manager_id, status, COUNT(*) AS count").
+		Where("status IN ?", []string{models.JobStatusPending, models.JobStatusLeased, models.JobStatusRunning}).
+		Group("manager_id, status").
+		Scan(&rows).Error; err != nil {
+		ch <- prometheus.NewInvalidMetric(c.desc, err)
+		return
+	}
+	for _, row := range rows {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(row.Count),
+			strconv.FormatUint(uint64(row.ManagerID), 10), row.Status)
+	}
+}
+
+// NewWSConnectionsGauge reports the open WebSocket connections of a hub.
+func NewWSConnectionsGauge(count func() int) prometheus.Collector {
+	return prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "ws",
+		Name:      "connections",
+		Help:      "Open WebSocket connections of the scan hub.",
+	}, func() float64 { return float64(count()) })
+}
+
+// RedisPoolCollector reports the connection pool of a Redis client.
+type RedisPoolCollector struct {
+	stats func() *redis.PoolStats
+
+	hits, misses, timeouts *prometheus.Desc
+	totalConns, idleConns  *prometheus.Desc
+	staleConns             *prometheus.Desc
+}
+
+func NewRedisPoolCollector(stats func() *redis.PoolStats) *RedisPoolCollector {
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, "redis_pool", name), help, nil, nil)
+	}
+	return &RedisPoolCollector{
+		stats:      stats,
+		hits:       desc("hits_total", "Times a free connection was found in the pool."),
+		misses:     desc("misses_total", "Times a free connection was not found in the pool."),
+		timeouts:   desc("timeouts_total", "Times a wait for a connection timed out."),
+		totalConns: desc("connections", "Connections in the pool."),
+		idleConns:  desc("idle_connections", "Idle connections in the pool."),
+		staleConns: desc("stale_connections_total", "Stale connections removed from the pool."),
+	}
+}
+
+func (c *RedisPoolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.hits
+	ch <- c.misses
+	ch <- c.timeouts
+	ch <- c.totalConns
+	ch <- c.idleConns
+	ch <- c.staleConns
+}
+
+func (c *RedisPoolCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.stats()
+	if stats == nil {
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(c.hits, prometheus.CounterValue, float64(stats.Hits))
+	ch <- prometheus.MustNewConstMetric(c.misses, prometheus.CounterValue, float64(stats.Misses))
+	ch <- prometheus.MustNewConstMetric(c.timeouts, prometheus.CounterValue, float64(stats.Timeouts))
+	ch <- prometheus.MustNewConstMetric(c.totalConns, prometheus.GaugeValue, float64(stats.TotalConns))
+	ch <- prometheus.MustNewConstMetric(c.idleConns, prometheus.GaugeValue, float64(stats.IdleConns))
+	ch <- prometheus.MustNewConstMetric(c.staleConns, prometheus.CounterValue, float64(stats.StaleConns))
+}
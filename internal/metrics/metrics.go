@@ -0,0 +1,141 @@
+// Package metrics holds the Prometheus collectors of the service. Counters
+// and histograms are package globals so that any package can record into
+// them; NewRegistry gathers them together with the collectors that read a
+// server's own state at scrape time.
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+const namespace = "oas"
+
+var (
+	HTTPRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "requests_total",
+		Help:      "HTTP requests by route template and status code.",
+	}, []string{"method", "route", "status"})
+
+	HTTPDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "HTTP request latency by route template.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	SchedulerRuns = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "scheduler",
+		Name:      "runs_total",
+		Help:      "Scheduler rounds by result (ok or error).",
+	}, []string{"result"})
+
+	SchedulerRunDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "scheduler",
+		Name:      "run_duration_seconds",
+		Help:      "Duration of one scheduler round.",
+		Buckets:   []float64{.01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	})
+
+	SchedulerDueUsers = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "scheduler",
+		Name:      "due_users",
+		Help:      "Users with a due task in the last scheduler round.",
+	})
+
+	JobsGenerated = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "scheduler",
+		Name:      "jobs_generated_total",
+		Help:      "Jobs created by the scheduler by task type.",
+	}, []string{"task_type"})
+
+	LeaseExpirations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "jobs",
+		Name:      "lease_expirations_total",
+		Help:      "Job leases that expired without a report, by outcome (requeued or failed).",
+	}, []string{"outcome"})
+
+	AgentPolls = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "agent",
+		Name:      "polls_total",
+		Help:      "Job polls by agent node.",
+	}, []string{"node_id"})
+
+	AgentJobsLeased = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "agent",
+		Name:      "jobs_leased_total",
+		Help:      "Jobs leased by agent node.",
+	}, []string{"node_id"})
+
+	AgentPollsWaiting = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "agent",
+		Name:      "polls_waiting",
+		Help:      "Long polls waiting for new jobs on this replica.",
+	})
+
+	AgentLogLines = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "agent",
+		Name:      "log_lines_total",
+		Help:      "Agent log lines by outcome (stored, failed, or tail_dropped for lines a slow live tail missed).",
+	}, []string{"outcome"})
+
+	AgentLogTails = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "agent",
+		Name:      "log_tails",
+		Help:      "Live agent log tails open on this replica.",
+	})
+
+	NotificationDeliveries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "notify",
+		Name:      "deliveries_total",
+		Help:      "Notification delivery attempts by channel and result (sent, skipped, retry, dead).",
+	}, []string{"channel", "result"})
+
+	ScanPhaseDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "scan",
+		Name:      "phase_duration_seconds",
+		Help:      "Time a scan job spent in each phase.",
+		Buckets:   []float64{1, 2, 5, 10, 20, 30, 60, 120, 300, 600},
+	}, []string{"phase"})
+)
+
+// NewRegistry returns a registry with the Go runtime, process and package
+// collectors plus extra.
+func NewRegistry(extra ...prometheus.Collector) *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		HTTPRequests,
+		HTTPDuration,
+		SchedulerRuns,
+		SchedulerRunDuration,
+		SchedulerDueUsers,
+		JobsGenerated,
+		LeaseExpirations,
+		AgentPolls,
+		AgentJobsLeased,
+		AgentPollsWaiting,
+		AgentLogLines,
+		AgentLogTails,
+		NotificationDeliveries,
+		ScanPhaseDuration,
+	)
+	registry.MustRegister(extra...)
+	return registry
+}
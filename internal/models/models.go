@@ -47,11 +47,15 @@ const (
 	CodeStatusUsed    = "used"
 	CodeStatusRevoked = "revoked"
 
-	JobStatusPending  = "pending"
-	JobStatusLeased   = "leased"
-	JobStatusRunning  = "running"
-	JobStatusSuccess  = "success"
-	JobStatusFailed   = "failed"
+	JobStatusPending = "pending"
+	JobStatusLeased  = "leased"
+	JobStatusRunning = "running"
+	JobStatusSuccess = "success"
+	JobStatusFailed  = "failed"
+	// JobStatusCancelled is a pending job withdrawn by hand; it never runs.
+	JobStatusCancelled = "cancelled"
+	// JobStatusRequeued is the event type of a job put back to pending after
+	// its lease timed out; the job itself is pending again.
 	JobStatusRequeued = "timeout_requeued"
 
 	// ScanJob statuses
@@ -75,6 +79,41 @@ const (
 	ScanPhasePullingData   = "pulling_data"
 	ScanPhaseDone          = "done"
 
+	// NotificationOutbox statuses
+	NotifyStatusPending = "pending"
+	NotifyStatusSending = "sending"
+	NotifyStatusSent    = "sent"
+	NotifyStatusSkipped = "skipped"
+	NotifyStatusDead    = "dead"
+
+	// AccountAlert kinds and statuses
+	AlertKindExpiring            = "expiring"
+	AlertKindArchiveInvalid      = "archive_invalid"
+	AlertKindConsecutiveFailures = "consecutive_failures"
+	AlertKindInactive            = "inactive"
+	AlertStatusOpen              = "open"
+	AlertStatusResolved          = "resolved"
+
+	// AgentNode statuses. A node is offline once its heartbeat is older
+	// than AGENT_OFFLINE_AFTER or a manager revoked its sessions.
+	AgentStatusOnline  = "online"
+	AgentStatusOffline = "offline"
+
+	// AgentCommand statuses. pending and delivered commands expire at
+	// ExpiresAt; the agent moves a delivered command on by acknowledging it
+	// and reporting its result.
+	AgentCommandPending      = "pending"
+	AgentCommandDelivered    = "delivered"
+	AgentCommandAcknowledged = "acknowledged"
+	AgentCommandSucceeded    = "succeeded"
+	AgentCommandFailed       = "failed"
+	AgentCommandExpired      = "expired"
+	AgentCommandCancelled    = "cancelled"
+
+	// AgentVersionPolicy enforcement for nodes below the minimum version.
+	AgentVersionReject = "reject"
+	AgentVersionLimit  = "limit"
+
 	ActorTypeSuper   = "super"
 	ActorTypeManager = "manager"
 	ActorTypeUser    = "user"
@@ -96,8 +135,13 @@ type Manager struct {
 	Alias        string     `gorm:"size:64;not null;default:''"`
 	ManagerType  string     `gorm:"size:20;not null;default:all;index"`
 	ExpiresAt    *time.Time `gorm:"index"`
-	CreatedAt    time.Time  `gorm:"not null"`
-	UpdatedAt    time.Time  `gorm:"not null"`
+	// RestConfig is the default rest schedule of users without their own.
+	RestConfig datatypes.JSONMap `gorm:"type:jsonb;not null;default:'{}'"`
+	// ScheduleSpread spreads the users' clock-aligned runs and rest ends over
+	// this many minutes; nil uses SCHEDULER_SPREAD.
+	ScheduleSpread *int      `gorm:"column:schedule_spread"`
+	CreatedAt      time.Time `gorm:"not null"`
+	UpdatedAt      time.Time `gorm:"not null"`
 }
 
 type ManagerRenewalKey struct {
@@ -132,6 +176,7 @@ type User struct {
 	CanViewLogs       bool              `gorm:"not null;default:false"`
 	DuiyiAnswerSource string            `gorm:"size:20;not null;default:'manager'"` // "manager" | "blogger"
 	DuiyiBloggerID    *uint             `gorm:"index"`
+	RequiredLabels    string            `gorm:"size:255;not null;default:''"`
 	CreatedBy         string            `gorm:"size:30;not null"`
 	CreatedAt     time.Time         `gorm:"not null"`
 	UpdatedAt     time.Time         `gorm:"not null"`
@@ -168,21 +213,34 @@ type UserTaskConfig struct {
 	Version    int               `gorm:"not null;default:1"`
 }
 
+// UserTaskSchedule is the scheduler's due-time index: one row per enabled
+// task of a user, holding when the task is next due. It is rewritten whenever
+// the task config is written, so the scheduler reads only the rows that are
+// due instead of every user's config.
+type UserTaskSchedule struct {
+	ID        uint      `gorm:"primaryKey"`
+	UserID    uint      `gorm:"not null;uniqueIndex:idx_user_task_schedules_user_task,priority:1"`
+	TaskType  string    `gorm:"size:64;not null;uniqueIndex:idx_user_task_schedules_user_task,priority:2"`
+	NextDueAt time.Time `gorm:"not null;index"`
+	UpdatedAt time.Time `gorm:"not null"`
+}
+
 type TaskJob struct {
-	ID           uint              `gorm:"primaryKey"`
-	ManagerID    uint              `gorm:"not null;index:idx_task_jobs_manager_status_scheduled,priority:1;index:idx_task_jobs_manager_user,priority:1"`
-	UserID       uint              `gorm:"not null;index;index:idx_task_jobs_manager_user,priority:2"`
-	TaskType     string            `gorm:"size:64;not null"`
-	Payload      datatypes.JSONMap `gorm:"type:jsonb;not null;default:'{}'"`
-	Priority     int               `gorm:"not null;default:0"`
-	ScheduledAt  time.Time         `gorm:"not null;index:idx_task_jobs_manager_status_scheduled,priority:3"`
-	Status       string            `gorm:"size:24;not null;default:pending;index:idx_task_jobs_manager_status_scheduled,priority:2"`
-	LeasedByNode string            `gorm:"size:128;index"`
-	LeaseUntil   *time.Time        `gorm:"index"`
-	Attempts     int               `gorm:"not null;default:0"`
-	MaxAttempts  int               `gorm:"not null;default:3"`
-	CreatedAt    time.Time         `gorm:"not null"`
-	UpdatedAt    time.Time         `gorm:"not null"`
+	ID             uint              `gorm:"primaryKey"`
+	ManagerID      uint              `gorm:"not null;index:idx_task_jobs_manager_status_scheduled,priority:1;index:idx_task_jobs_manager_user,priority:1"`
+	UserID         uint              `gorm:"not null;index;index:idx_task_jobs_manager_user,priority:2"`
+	TaskType       string            `gorm:"size:64;not null"`
+	Payload        datatypes.JSONMap `gorm:"type:jsonb;not null;default:'{}'"`
+	Priority       int               `gorm:"not null;default:0"`
+	ScheduledAt    time.Time         `gorm:"not null;index:idx_task_jobs_manager_status_scheduled,priority:3"`
+	Status         string            `gorm:"size:24;not null;default:pending;index:idx_task_jobs_manager_status_scheduled,priority:2"`
+	LeasedByNode   string            `gorm:"size:128;index"`
+	LeaseUntil     *time.Time        `gorm:"index"`
+	Attempts       int               `gorm:"not null;default:0"`
+	MaxAttempts    int               `gorm:"not null;default:3"`
+	RequiredLabels string            `gorm:"size:255;not null;default:''"`
+	CreatedAt      time.Time         `gorm:"not null"`
+	UpdatedAt      time.Time         `gorm:"not null"`
 }
 
 type TaskJobEvent struct {
@@ -194,17 +252,151 @@ type TaskJobEvent struct {
 	EventAt   time.Time `gorm:"not null;index"`
 }
 
+// TaskJobDailyStat counts the finished jobs of a user and task type per
+// Beijing day. Retention adds jobs here before it deletes them, so the counts
+// cover history that task_jobs no longer holds.
+type TaskJobDailyStat struct {
+	ID        uint      `gorm:"primaryKey"`
+	Date      string    `gorm:"size:10;not null;uniqueIndex:idx_task_job_daily_stats_key,priority:1"`
+	UserID    uint      `gorm:"not null;uniqueIndex:idx_task_job_daily_stats_key,priority:2"`
+	TaskType  string    `gorm:"size:64;not null;uniqueIndex:idx_task_job_daily_stats_key,priority:3"`
+	ManagerID uint      `gorm:"not null;index"`
+	Succeeded int64     `gorm:"not null;default:0"`
+	Failed    int64     `gorm:"not null;default:0"`
+	Cancelled int64     `gorm:"not null;default:0"`
+	Attempts  int64     `gorm:"not null;default:0"`
+	UpdatedAt time.Time `gorm:"not null"`
+}
+
+// TaskJobDependency makes a job wait until another job of the same user has
+// succeeded. Rows are written by the scheduler from the depends_on task config.
+type TaskJobDependency struct {
+	ID             uint      `gorm:"primaryKey"`
+	JobID          uint      `gorm:"not null;uniqueIndex:idx_task_job_dependencies_pair,priority:1"`
+	DependsOnJobID uint      `gorm:"not null;index;uniqueIndex:idx_task_job_dependencies_pair,priority:2"`
+	CreatedAt      time.Time `gorm:"not null"`
+}
+
+// AgentNode is an agent process, keyed by the node_id it reports. LastHeartbeat
+// moves on login, poll and job reports. A draining node keeps its leases but
+// polls no new jobs. TaskTypes and Labels are the comma-separated capabilities
+// the node declared, TaskTypes empty for every task type; MaxConcurrency 0
+// means no limit on the jobs it holds at once.
 type AgentNode struct {
+	ID             uint      `gorm:"primaryKey"`
+	ManagerID      uint      `gorm:"not null;index"`
+	NodeID         string    `gorm:"size:128;not null;uniqueIndex"`
+	LastHeartbeat  time.Time `gorm:"not null;index"`
+	Status         string    `gorm:"size:20;not null;default:online"`
+	Draining       bool      `gorm:"not null;default:false"`
+	Version        string    `gorm:"size:64"`
+	TaskTypes      string    `gorm:"type:text;not null;default:''"`
+	MaxConcurrency int       `gorm:"not null;default:0"`
+	Labels         string    `gorm:"type:text;not null;default:''"`
+	CreatedAt      time.Time `gorm:"not null"`
+	UpdatedAt      time.Time `gorm:"not null"`
+}
+
+// AgentKey is an API key an agent logs in with instead of the manager's
+// password. A key belongs to one node_id; only its SHA-256 is stored and
+// KeyPrefix identifies it in the console. AllowedIPs is a comma-separated
+// list of IPs and CIDRs, empty for any address.
+type AgentKey struct {
+	ID         uint   `gorm:"primaryKey"`
+	ManagerID  uint   `gorm:"not null;index"`
+	NodeID     string `gorm:"size:128;not null;index"`
+	Name       string `gorm:"size:64;not null;default:''"`
+	KeyPrefix  string `gorm:"size:16;not null"`
+	KeyHash    string `gorm:"size:64;not null;uniqueIndex"`
+	AllowedIPs string `gorm:"type:text;not null;default:''"`
+	ExpiresAt  *time.Time
+	RevokedAt  *time.Time
+	LastUsedAt *time.Time
+	LastUsedIP string    `gorm:"size:64;not null;default:''"`
+	CreatedAt  time.Time `gorm:"not null"`
+	UpdatedAt  time.Time `gorm:"not null"`
+}
+
+// AgentCommand is a command a manager queued for one node, such as a
+// screenshot or an emulator restart. The node receives it on its next poll or
+// job heartbeat and reports back; the rows are the node's command history.
+type AgentCommand struct {
+	ID          uint              `gorm:"primaryKey"`
+	ManagerID   uint              `gorm:"not null;index:idx_agent_commands_node,priority:1"`
+	NodeID      string            `gorm:"size:128;not null;index:idx_agent_commands_node,priority:2"`
+	Command     string            `gorm:"size:32;not null"`
+	Args        datatypes.JSONMap `gorm:"type:jsonb;not null;default:'{}'"`
+	Status      string            `gorm:"size:20;not null;default:pending;index:idx_agent_commands_node,priority:3"`
+	Message     string            `gorm:"type:text"`
+	Result      datatypes.JSONMap `gorm:"type:jsonb;not null;default:'{}'"`
+	ExpiresAt   time.Time         `gorm:"not null"`
+	DeliveredAt *time.Time
+	AckedAt     *time.Time
+	FinishedAt  *time.Time
+	CreatedAt   time.Time `gorm:"not null"`
+	UpdatedAt   time.Time `gorm:"not null"`
+}
+
+// AgentVersionPolicy sets which agent versions may run jobs. The row with
+// ManagerID 0 is the global policy of the super admin; a manager's own row
+// can raise MinVersion and choose its own upgrade rollout. Enforcement is
+// reject (below MinVersion logins and polls are refused) or limit (they log
+// in and keep reporting leased jobs but get no new ones). Nodes below
+// RecommendedVersion are offered Manifest once they fall within
+// RolloutPercent of the manager's nodes.
+type AgentVersionPolicy struct {
+	ID                 uint              `gorm:"primaryKey"`
+	ManagerID          uint              `gorm:"not null;uniqueIndex"`
+	MinVersion         string            `gorm:"size:32;not null;default:''"`
+	Enforcement        string            `gorm:"size:10;not null;default:reject"`
+	RecommendedVersion string            `gorm:"size:32;not null;default:''"`
+	RolloutPercent     int               `gorm:"not null"`
+	Manifest           datatypes.JSONMap `gorm:"type:jsonb;not null;default:'{}'"`
+	CreatedAt          time.Time         `gorm:"not null"`
+	UpdatedAt          time.Time         `gorm:"not null"`
+}
+
+// NotificationOutbox is a durable per-channel notification delivery. Rows are
+// retried with backoff until sent, or moved to dead after MaxAttempts.
+type NotificationOutbox struct {
 	ID            uint      `gorm:"primaryKey"`
 	ManagerID     uint      `gorm:"not null;index"`
-	NodeID        string    `gorm:"size:128;not null;uniqueIndex"`
-	LastHeartbeat time.Time `gorm:"not null;index"`
-	Status        string    `gorm:"size:20;not null;default:online"`
-	Version       string    `gorm:"size:64"`
-	CreatedAt     time.Time `gorm:"not null"`
+	UserID        uint      `gorm:"not null;index:idx_notification_outbox_user_created,priority:1"`
+	JobID         uint      `gorm:"not null;default:0;index"`
+	Channel       string    `gorm:"size:32;not null"`
+	TaskType      string    `gorm:"size:64;not null;default:''"`
+	EventType     string    `gorm:"size:24;not null"`
+	Message       string    `gorm:"type:text"`
+	Status        string    `gorm:"size:20;not null;default:pending;index:idx_notification_outbox_status_next,priority:1"`
+	Attempts      int       `gorm:"not null;default:0"`
+	MaxAttempts   int       `gorm:"not null;default:5"`
+	NextAttemptAt time.Time `gorm:"not null;index:idx_notification_outbox_status_next,priority:2"`
+	LastError     string    `gorm:"size:500"`
+	DigestPeriod  string    `gorm:"size:40;not null;default:'';index"`
+	TraceParent   string    `gorm:"size:64;not null;default:''"`
+	SentAt        *time.Time
+	CreatedAt     time.Time `gorm:"not null;index:idx_notification_outbox_user_created,priority:2"`
 	UpdatedAt     time.Time `gorm:"not null"`
 }
 
+// AccountAlert is an account-level condition raised by the alert evaluator.
+// At most one row per (user, kind, subject) is open; it is resolved once the
+// condition clears so the next occurrence notifies again.
+type AccountAlert struct {
+	ID         uint              `gorm:"primaryKey"`
+	ManagerID  uint              `gorm:"not null;index:idx_account_alerts_manager_status,priority:1"`
+	UserID     uint              `gorm:"not null;index:idx_account_alerts_user_kind,priority:1"`
+	Kind       string            `gorm:"size:32;not null;index:idx_account_alerts_user_kind,priority:2"`
+	Subject    string            `gorm:"size:64;not null;default:'';index:idx_account_alerts_user_kind,priority:3"`
+	Status     string            `gorm:"size:20;not null;default:open;index:idx_account_alerts_manager_status,priority:2"`
+	Message    string            `gorm:"size:500;not null;default:''"`
+	Detail     datatypes.JSONMap `gorm:"type:jsonb;not null;default:'{}'"`
+	FiredAt    time.Time         `gorm:"not null"`
+	ResolvedAt *time.Time
+	CreatedAt  time.Time `gorm:"not null"`
+	UpdatedAt  time.Time `gorm:"not null"`
+}
+
 type DuiyiAnswerConfig struct {
 	ID        uint              `gorm:"primaryKey"`
 	ManagerID uint              `gorm:"not null;uniqueIndex"`
@@ -244,23 +436,42 @@ type AuditLog struct {
 	CreatedAt  time.Time         `gorm:"not null;index"`
 }
 
+// AgentLog is a line of execution log an agent reported for a user's
+// account, optionally tied to the job and node that produced it. Type is the
+// agent's own category, Fields any structured context. LoggedAt is the time
+// on the agent, CreatedAt when the server stored the line.
+type AgentLog struct {
+	ID        uint              `gorm:"primaryKey;index:idx_agent_logs_user,priority:3"`
+	ManagerID uint              `gorm:"not null;index:idx_agent_logs_user,priority:1"`
+	UserID    uint              `gorm:"not null;index:idx_agent_logs_user,priority:2"`
+	JobID     uint              `gorm:"not null;default:0;index"`
+	NodeID    string            `gorm:"size:128;not null;default:''"`
+	Level     string            `gorm:"size:10;not null;default:info"`
+	Type      string            `gorm:"size:64;not null;default:''"`
+	Message   string            `gorm:"type:text;not null;default:''"`
+	Fields    datatypes.JSONMap `gorm:"type:jsonb;not null;default:'{}'"`
+	LoggedAt  time.Time         `gorm:"not null"`
+	CreatedAt time.Time         `gorm:"not null;index"`
+}
+
 type ScanJob struct {
-	ID            uint           `gorm:"primaryKey"`
-	ManagerID     uint           `gorm:"not null;index;index:idx_scan_jobs_manager_status,priority:1"`
-	UserID        uint           `gorm:"not null;index;index:idx_scan_jobs_user_status,priority:1"`
-	LoginID       string         `gorm:"size:64;not null;default:''"`
-	Status        string         `gorm:"size:30;not null;default:pending;index;index:idx_scan_jobs_manager_status,priority:2;index:idx_scan_jobs_user_status,priority:2"`
-	Phase         string         `gorm:"size:30;not null;default:waiting"`
-	LeasedByNode  string         `gorm:"size:128"`
-	LeaseUntil    *time.Time
-	Screenshots   datatypes.JSON `gorm:"type:jsonb;not null;default:'{}'"`
-	UserChoice    datatypes.JSON `gorm:"type:jsonb;not null;default:'{}'"`
-	ErrorMessage  string         `gorm:"size:500"`
-	Attempts      int            `gorm:"not null;default:0"`
-	MaxAttempts   int            `gorm:"not null;default:3"`
-	UserHeartbeat *time.Time
-	CreatedAt     time.Time `gorm:"not null"`
-	UpdatedAt     time.Time `gorm:"not null"`
+	ID             uint   `gorm:"primaryKey"`
+	ManagerID      uint   `gorm:"not null;index;index:idx_scan_jobs_manager_status,priority:1"`
+	UserID         uint   `gorm:"not null;index;index:idx_scan_jobs_user_status,priority:1"`
+	LoginID        string `gorm:"size:64;not null;default:''"`
+	Status         string `gorm:"size:30;not null;default:pending;index;index:idx_scan_jobs_manager_status,priority:2;index:idx_scan_jobs_user_status,priority:2"`
+	Phase          string `gorm:"size:30;not null;default:waiting"`
+	PhaseStartedAt *time.Time
+	LeasedByNode   string `gorm:"size:128"`
+	LeaseUntil     *time.Time
+	Screenshots    datatypes.JSON `gorm:"type:jsonb;not null;default:'{}'"`
+	UserChoice     datatypes.JSON `gorm:"type:jsonb;not null;default:'{}'"`
+	ErrorMessage   string         `gorm:"size:500"`
+	Attempts       int            `gorm:"not null;default:0"`
+	MaxAttempts    int            `gorm:"not null;default:3"`
+	UserHeartbeat  *time.Time
+	CreatedAt      time.Time `gorm:"not null"`
+	UpdatedAt      time.Time `gorm:"not null"`
 }
 
 type Friendship struct {
@@ -297,10 +508,19 @@ func AutoMigrate(db *gorm.DB) error {
 		&UserToken{},
 		&UserActivationCode{},
 		&UserTaskConfig{},
+		&UserTaskSchedule{},
 		&TaskJob{},
 		&TaskJobEvent{},
+		&TaskJobDependency{},
+		&TaskJobDailyStat{},
 		&AgentNode{},
+		&AgentKey{},
+		&AgentCommand{},
+		&AgentVersionPolicy{},
+		&NotificationOutbox{},
+		&AccountAlert{},
 		&AuditLog{},
+		&AgentLog{},
 		&DuiyiAnswerConfig{},
 		&Blogger{},
 		&BloggerAnswerConfig{},
@@ -310,7 +530,41 @@ func AutoMigrate(db *gorm.DB) error {
 	); err != nil {
 		return err
 	}
-	return backfillLoginIDs(db)
+	if err := backfillLoginIDs(db); err != nil {
+		return err
+	}
+	if err := ensureOpenAlertIndex(db); err != nil {
+		return err
+	}
+	ensureAgentLogSearchIndex(db)
+	return nil
+}
+
+// ensureOpenAlertIndex makes (user_id, kind, subject) unique among open
+// account alerts, so that concurrent raises open one alert. Duplicates left
+// by older versions are resolved first, keeping the oldest open.
+func ensureOpenAlertIndex(db *gorm.DB) error {
+	if err := db.Exec(`UPDATE account_alerts SET status = ?, resolved_at = updated_at
+		WHERE status = ? AND id NOT IN (
+			SELECT keep_id FROM (SELECT MIN(id) AS keep_id FROM account_alerts WHERE status = ? GROUP BY user_id, kind, subject) AS kept
+		)`, AlertStatusResolved, AlertStatusOpen, AlertStatusOpen).Error; err != nil {
+		return err
+	}
+	return db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_account_alerts_open ON account_alerts(user_id, kind, subject) WHERE status = 'open'").Error
+}
+
+// ensureAgentLogSearchIndex adds a trigram index for substring search in
+// agent log messages on PostgreSQL, which also serves Chinese text. Without
+// the pg_trgm extension (it may need a privileged role) search still works,
+// only slower.
+func ensureAgentLogSearchIndex(db *gorm.DB) {
+	if db.Dialector.Name() != "postgres" {
+		return
+	}
+	if err := db.Exec("CREATE EXTENSION IF NOT EXISTS pg_trgm").Error; err != nil {
+		return
+	}
+	_ = db.Exec("CREATE INDEX IF NOT EXISTS idx_agent_logs_message_trgm ON agent_logs USING gin (message gin_trgm_ops)").Error
 }
 
 // backfillLoginIDs assigns sequential login_id to existing users that have an
@@ -0,0 +1,94 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const defaultBarkServer = "https://api.day.app"
+
+// Bark sends notifications to the Bark iOS app, either through the public
+// server or a self-hosted one.
+type Bark struct {
+	client       *http.Client
+	limiter      sendLimiter // per server + device key
+	allowPrivate bool        // accept self-hosted servers on internal addresses
+}
+
+// NewBark creates the Bark channel.
+func NewBark(client *http.Client) *Bark {
+	return &Bark{client: client, limiter: sendLimiter{interval: 15 * time.Second}}
+}
+
+func (b *Bark) Name() string    { return "bark" }
+func (b *Bark) Available() bool { return true }
+
+// Validate requires a device key when enabled; server defaults to api.day.app.
+func (b *Bark) Validate(settings map[string]any) (map[string]any, error) {
+	enabled, _ := settings["enabled"].(bool)
+	deviceKey := settingString(settings, "device_key", 64)
+	server := strings.TrimRight(settingString(settings, "server", 256), "/")
+	if deviceKey != "" && !isAlnum(deviceKey) {
+		return nil, fmt.Errorf("Bark 设备码只能包含字母和数字")
+	}
+	if server != "" {
+		if err := validateHTTPURL(server, b.allowPrivate); err != nil {
+			if errors.Is(err, errPrivateAddress) {
+				return nil, fmt.Errorf("Bark 服务器地址不能指向内网或本机地址")
+			}
+			return nil, fmt.Errorf("Bark 服务器地址必须是 http 或 https 链接")
+		}
+	}
+	if enabled && deviceKey == "" {
+		return nil, fmt.Errorf("启用 Bark 通知需要填写设备码")
+	}
+	return map[string]any{"enabled": enabled, "device_key": deviceKey, "server": server}, nil
+}
+
+type barkResponse struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// Send pushes the notification to the user's Bark device.
+func (b *Bark) Send(ctx context.Context, settings map[string]any, req NotifyRequest) error {
+	deviceKey, _ := settings["device_key"].(string)
+	if deviceKey == "" {
+		return fmt.Errorf("bark device key is empty")
+	}
+	server, _ := settings["server"].(string)
+	if server == "" {
+		server = defaultBarkServer
+	}
+	limitKey := server + "/" + deviceKey
+	if err := b.limiter.limit(limitKey); err != nil {
+		slog.Debug("bark notification rate limited", "device_key", deviceKey)
+		return err
+	}
+
+	body, err := postJSON(ctx, b.client, "bark", server+"/push", map[string]any{
+		"device_key": deviceKey,
+		"title":      BuildNotificationTitle(req),
+		"body":       BuildNotificationText(req),
+		"group":      "OAS",
+	}, nil)
+	if err != nil {
+		return err
+	}
+	var result barkResponse
+	if err := json.Unmarshal(body, &result); err != nil {
+		return fmt.Errorf("bark parse response failed: %w", err)
+	}
+	b.limiter.mark(limitKey)
+	if result.Code != http.StatusOK {
+		return fmt.Errorf("bark error code=%d msg=%s", result.Code, result.Message)
+	}
+	slog.Debug("bark notification sent", "device_key", deviceKey)
+	return nil
+}
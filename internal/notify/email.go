@@ -0,0 +1,258 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"html"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"oas-cloud-go/internal/config"
+)
+
+// EmailSender handles sending notifications via SMTP.
+type EmailSender struct {
+	host        string
+	port        int
+	username    string
+	password    string
+	from        string
+	implicitTLS bool
+	timeout     time.Duration
+	limiter     sendLimiter // per recipient address
+}
+
+// NewEmailSender creates an EmailSender from the SMTP settings in cfg.
+// The sender is disabled (Enabled returns false) when SMTP_HOST is empty.
+func NewEmailSender(cfg config.Config) *EmailSender {
+	from := strings.TrimSpace(cfg.SMTPFrom)
+	if from == "" {
+		from = strings.TrimSpace(cfg.SMTPUsername)
+	}
+	port := cfg.SMTPPort
+	if port <= 0 {
+		port = 587
+	}
+	minInterval := cfg.EmailMinInterval
+	if minInterval < 0 {
+		minInterval = 0
+	}
+	return &EmailSender{
+		host:        strings.TrimSpace(cfg.SMTPHost),
+		port:        port,
+		username:    cfg.SMTPUsername,
+		password:    cfg.SMTPPassword,
+		from:        from,
+		implicitTLS: cfg.SMTPImplicitTLS,
+		timeout:     10 * time.Second,
+		limiter:     sendLimiter{interval: minInterval},
+	}
+}
+
+// Enabled reports whether an SMTP server and sender address are configured.
+func (e *EmailSender) Enabled() bool {
+	return e != nil && e.host != "" && e.from != ""
+}
+
+func (e *EmailSender) Name() string    { return "email" }
+func (e *EmailSender) Available() bool { return e.Enabled() }
+
+// Validate checks the recipient address when the channel is enabled.
+func (e *EmailSender) Validate(settings map[string]any) (map[string]any, error) {
+	enabled, _ := settings["enabled"].(bool)
+	email := settingString(settings, "email", 254)
+	if enabled && email != "" {
+		if _, err := mail.ParseAddress(email); err != nil {
+			return nil, fmt.Errorf("邮箱格式不正确")
+		}
+	}
+	return map[string]any{"enabled": enabled, "email": email}, nil
+}
+
+// Send emails the notification to the address in the user's settings.
+func (e *EmailSender) Send(_ context.Context, settings map[string]any, req NotifyRequest) error {
+	email, _ := settings["email"].(string)
+	if email == "" {
+		return fmt.Errorf("email address is empty")
+	}
+	return e.SendEmail(email, req)
+}
+
+// SendEmail sends the notification for req to the given address.
+// It returns ErrRateLimited if the address was notified too recently.
+func (e *EmailSender) SendEmail(to string, req NotifyRequest) error {
+	if !e.Enabled() {
+		return fmt.Errorf("smtp is not configured")
+	}
+	to = strings.TrimSpace(to)
+	if err := e.limiter.limit(to); err != nil {
+		slog.Debug("email notification rate limited", "to", to)
+		return err
+	}
+
+	msg, err := BuildEmailMessage(e.from, to, req)
+	if err != nil {
+		return fmt.Errorf("email build message failed: %w", err)
+	}
+	if err := e.deliver(to, msg); err != nil {
+		return err
+	}
+
+	e.limiter.mark(to)
+	slog.Debug("email notification sent", "to", to)
+	return nil
+}
+
+func (e *EmailSender) deliver(to string, msg []byte) error {
+	addr := net.JoinHostPort(e.host, strconv.Itoa(e.port))
+	conn, err := net.DialTimeout("tcp", addr, e.timeout)
+	if err != nil {
+		return fmt.Errorf("smtp dial failed: %w", err)
+	}
+	_ = conn.SetDeadline(time.Now().Add(2 * e.timeout))
+	if e.implicitTLS {
+		conn = tls.Client(conn, &tls.Config{ServerName: e.host})
+	}
+
+	client, err := smtp.NewClient(conn, e.host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("smtp handshake failed: %w", err)
+	}
+	defer client.Close()
+
+	if !e.implicitTLS {
+		if ok, _ := client.Extension("STARTTLS"); ok {
+			if err := client.StartTLS(&tls.Config{ServerName: e.host}); err != nil {
+				return fmt.Errorf("smtp starttls failed: %w", err)
+			}
+		}
+	}
+	if e.username != "" {
+		if ok, _ := client.Extension("AUTH"); ok {
+			if err := client.Auth(smtp.PlainAuth("", e.username, e.password, e.host)); err != nil {
+				return fmt.Errorf("smtp auth failed: %w", err)
+			}
+		}
+	}
+	if err := client.Mail(extractAddress(e.from)); err != nil {
+		return fmt.Errorf("smtp mail from failed: %w", err)
+	}
+	if err := client.Rcpt(to); err != nil {
+		return fmt.Errorf("smtp rcpt to failed: %w", err)
+	}
+	w, err := client.Data()
+	if err != nil {
+		return fmt.Errorf("smtp data failed: %w", err)
+	}
+	if _, err := w.Write(msg); err != nil {
+		w.Close()
+		return fmt.Errorf("smtp write body failed: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("smtp send failed: %w", err)
+	}
+	return client.Quit()
+}
+
+// BuildEmailHTML renders the HTML body for a NotifyRequest.
+func BuildEmailHTML(req NotifyRequest) string {
+	status := "成功 ✓"
+	color := "#67c23a"
+	if req.EventType == "fail" {
+		status = "失败 ✗"
+		color = "#f56c6c"
+	}
+	var b strings.Builder
+	b.WriteString(`<html><body style="font-family:sans-serif;font-size:14px;">`)
+	b.WriteString(`<table cellpadding="4" style="border-collapse:collapse;">`)
+	row := func(label, value string) {
+		fmt.Fprintf(&b, `<tr><td style="color:#909399;">%s</td><td>%s</td></tr>`, label, value)
+	}
+	row("账号", html.EscapeString(req.AccountNo))
+	if req.Username != "" {
+		row("角色", html.EscapeString(req.Username))
+	}
+	switch req.EventType {
+	case EventDigest, EventAlert:
+		label := "汇总"
+		if req.EventType == EventAlert {
+			label = "提醒"
+		}
+		row(label, strings.ReplaceAll(html.EscapeString(req.Message), "\n", "<br>"))
+		b.WriteString(`</table></body></html>`)
+		return b.String()
+	}
+	row("任务", html.EscapeString(req.TaskType))
+	row("结果", fmt.Sprintf(`<b style="color:%s;">%s</b>`, color, status))
+	if req.Message != "" {
+		row("详情", strings.ReplaceAll(html.EscapeString(req.Message), "\n", "<br>"))
+	}
+	b.WriteString(`</table></body></html>`)
+	return b.String()
+}
+
+// BuildEmailMessage assembles a multipart/alternative RFC 5322 message with a
+// plain-text part (same text as the push notification) and an HTML part.
+func BuildEmailMessage(from, to string, req NotifyRequest) ([]byte, error) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	parts := []struct {
+		contentType string
+		content     string
+	}{
+		{"text/plain; charset=UTF-8", BuildNotificationText(req)},
+		{"text/html; charset=UTF-8", BuildEmailHTML(req)},
+	}
+	for _, part := range parts {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", part.contentType)
+		header.Set("Content-Transfer-Encoding", "quoted-printable")
+		pw, err := mw.CreatePart(header)
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(pw)
+		if _, err := qp.Write([]byte(part.content)); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", from)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.BEncoding.Encode("UTF-8", BuildNotificationTitle(req)))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: multipart/alternative; boundary=%q\r\n", mw.Boundary())
+	msg.WriteString("\r\n")
+	msg.Write(body.Bytes())
+	return msg.Bytes(), nil
+}
+
+// extractAddress returns the bare address from a "Name <addr>" string.
+func extractAddress(value string) string {
+	if start := strings.LastIndex(value, "<"); start >= 0 {
+		if end := strings.LastIndex(value, ">"); end > start {
+			return strings.TrimSpace(value[start+1 : end])
+		}
+	}
+	return strings.TrimSpace(value)
+}
@@ -0,0 +1,204 @@
+package notify
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"oas-cloud-go/internal/config"
+)
+
+// smtpStandIn is a minimal SMTP server that accepts every message and
+// records the envelope and DATA section for assertions.
+type smtpStandIn struct {
+	listener net.Listener
+
+	mu       sync.Mutex
+	messages []smtpMessage
+}
+
+type smtpMessage struct {
+	from string
+	to   []string
+	data string
+}
+
+func startSMTPStandIn(t *testing.T) *smtpStandIn {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	srv := &smtpStandIn{listener: ln}
+	go srv.serve()
+	t.Cleanup(func() { ln.Close() })
+	return srv
+}
+
+func (s *smtpStandIn) port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (s *smtpStandIn) received() []smtpMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]smtpMessage(nil), s.messages...)
+}
+
+func (s *smtpStandIn) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *smtpStandIn) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+	reply("220 localhost ESMTP stand-in")
+
+	var msg smtpMessage
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			reply("250 localhost")
+		case strings.HasPrefix(cmd, "MAIL FROM:"):
+			msg = smtpMessage{from: strings.Trim(strings.TrimSpace(line)[10:], "<>")}
+			reply("250 OK")
+		case strings.HasPrefix(cmd, "RCPT TO:"):
+			msg.to = append(msg.to, strings.Trim(strings.TrimSpace(line)[8:], "<>"))
+			reply("250 OK")
+		case cmd == "DATA":
+			reply("354 End data with <CR><LF>.<CR><LF>")
+			var data strings.Builder
+			for {
+				dl, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if dl == ".\r\n" {
+					break
+				}
+				data.WriteString(dl)
+			}
+			msg.data = data.String()
+			s.mu.Lock()
+			s.messages = append(s.messages, msg)
+			s.mu.Unlock()
+			reply("250 OK queued")
+		case cmd == "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("250 OK")
+		}
+	}
+}
+
+func TestEmailSenderDisabledWithoutHost(t *testing.T) {
+	sender := NewEmailSender(config.Config{})
+	if sender.Enabled() {
+		t.Fatalf("sender without SMTP_HOST should be disabled")
+	}
+	if err := sender.SendEmail("user@example.com", NotifyRequest{}); err == nil {
+		t.Fatalf("expected error when smtp is not configured")
+	}
+}
+
+func TestEmailSenderDeliversMultipartMessage(t *testing.T) {
+	srv := startSMTPStandIn(t)
+	sender := NewEmailSender(config.Config{
+		SMTPHost:         "127.0.0.1",
+		SMTPPort:         srv.port(),
+		SMTPFrom:         "OAS <noreply@example.com>",
+		EmailMinInterval: time.Minute,
+	})
+
+	req := NotifyRequest{
+		UserID:    7,
+		AccountNo: "U20260101000001",
+		Username:  "<script>",
+		TaskType:  "寄养",
+		EventType: "fail",
+		Message:   "timeout",
+	}
+	if err := sender.SendEmail("user@example.com", req); err != nil {
+		t.Fatalf("send email failed: %v", err)
+	}
+
+	msgs := srv.received()
+	if len(msgs) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(msgs))
+	}
+	msg := msgs[0]
+	if msg.from != "noreply@example.com" {
+		t.Fatalf("unexpected envelope sender: %q", msg.from)
+	}
+	if len(msg.to) != 1 || msg.to[0] != "user@example.com" {
+		t.Fatalf("unexpected envelope recipients: %v", msg.to)
+	}
+	for _, want := range []string{
+		"To: user@example.com",
+		"Subject: =?UTF-8?b?",
+		"multipart/alternative",
+		"text/plain; charset=UTF-8",
+		"text/html; charset=UTF-8",
+		"&lt;script&gt;",
+		"U20260101000001",
+	} {
+		if !strings.Contains(msg.data, want) {
+			t.Fatalf("message missing %q:\n%s", want, msg.data)
+		}
+	}
+
+	// Second send to the same address inside the interval is skipped.
+	if err := sender.SendEmail("user@example.com", req); !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("expected ErrRateLimited, got %v", err)
+	}
+	if got := len(srv.received()); got != 1 {
+		t.Fatalf("expected rate limiter to skip second send, got %d messages", got)
+	}
+
+	// A different address has its own limiter slot.
+	if err := sender.SendEmail("other@example.com", req); err != nil {
+		t.Fatalf("send to other address failed: %v", err)
+	}
+	if got := len(srv.received()); got != 2 {
+		t.Fatalf("expected 2 messages, got %d", got)
+	}
+}
+
+func TestEmailSenderReportsDialError(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	sender := NewEmailSender(config.Config{
+		SMTPHost: "127.0.0.1",
+		SMTPPort: port,
+		SMTPFrom: "noreply@example.com",
+	})
+	err = sender.SendEmail("user@example.com", NotifyRequest{AccountNo: "U1", TaskType: "签到", EventType: "success"})
+	if err == nil || !strings.Contains(err.Error(), "smtp dial failed") {
+		t.Fatalf("expected dial error, got %v", err)
+	}
+	if sender.limiter.limit("user@example.com") != nil {
+		t.Fatalf("failed send should not be recorded by the rate limiter")
+	}
+}
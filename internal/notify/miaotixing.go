@@ -1,46 +1,46 @@
 package notify
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
 	"net/url"
-	"sync"
 	"time"
 )
 
-// NotifyRequest carries the information needed to send a notification.
-type NotifyRequest struct {
-	UserID    uint
-	AccountNo string
-	Username  string
-	TaskType  string
-	EventType string // "success" or "fail"
-	Message   string
+// MiaoTiXing sends notifications via MiaoTiXing (喵提醒).
+type MiaoTiXing struct {
+	client  *http.Client
+	baseURL string
+	limiter sendLimiter // per miao code
 }
 
-// Notifier handles sending notifications via MiaoTiXing (喵提醒).
-type Notifier struct {
-	client      *http.Client
-	rateLimiter sync.Map      // key=miaoCode, value=time.Time
-	minInterval time.Duration // minimum interval between sends per miaoCode
+// NewMiaoTiXing creates the MiaoTiXing channel.
+func NewMiaoTiXing(client *http.Client) *MiaoTiXing {
+	return &MiaoTiXing{
+		client:  client,
+		baseURL: "https://miaotixing.com/trigger",
+		limiter: sendLimiter{interval: 15 * time.Second},
+	}
 }
 
-// NewNotifier creates a Notifier with sensible defaults.
-func NewNotifier() *Notifier {
-	return &Notifier{
-		client: &http.Client{
-			Timeout: 10 * time.Second,
-			Transport: &http.Transport{
-				MaxIdleConns:        20,
-				MaxIdleConnsPerHost: 10,
-				IdleConnTimeout:     90 * time.Second,
-			},
-		},
-		minInterval: 15 * time.Second,
+func (m *MiaoTiXing) Name() string    { return "miaotixing" }
+func (m *MiaoTiXing) Available() bool { return true }
+
+// Validate requires an alphanumeric miao code when the channel is enabled.
+func (m *MiaoTiXing) Validate(settings map[string]any) (map[string]any, error) {
+	enabled, _ := settings["enabled"].(bool)
+	miaoCode := settingString(settings, "miao_code", 64)
+	if miaoCode != "" && !isAlnum(miaoCode) {
+		return nil, fmt.Errorf("喵码只能包含字母和数字")
+	}
+	if enabled && miaoCode == "" {
+		return nil, fmt.Errorf("启用微信通知需要填写喵码")
 	}
+	return map[string]any{"enabled": enabled, "miao_code": miaoCode}, nil
 }
 
 type miaoResponse struct {
@@ -48,23 +48,27 @@ type miaoResponse struct {
 	Msg  string `json:"msg"`
 }
 
-// SendMiaoTiXing sends a notification via the MiaoTiXing API.
-// It returns nil if the request is rate-limited (silent skip).
-func (n *Notifier) SendMiaoTiXing(miaoCode string, text string) error {
-	if lastSend, ok := n.rateLimiter.Load(miaoCode); ok {
-		if time.Since(lastSend.(time.Time)) < n.minInterval {
-			slog.Debug("notification rate limited", "miao_code", miaoCode)
-			return nil
-		}
+// Send triggers the user's miao code with the plain-text notification.
+func (m *MiaoTiXing) Send(ctx context.Context, settings map[string]any, req NotifyRequest) error {
+	miaoCode, _ := settings["miao_code"].(string)
+	if miaoCode == "" {
+		return fmt.Errorf("miaotixing miao code is empty")
+	}
+	if err := m.limiter.limit(miaoCode); err != nil {
+		slog.Debug("notification rate limited", "miao_code", miaoCode)
+		return err
 	}
 
 	params := url.Values{}
 	params.Set("id", miaoCode)
-	params.Set("text", text)
+	params.Set("text", BuildNotificationText(req))
 	params.Set("type", "json")
 
-	reqURL := "https://miaotixing.com/trigger?" + params.Encode()
-	resp, err := n.client.Get(reqURL)
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, m.baseURL+"?"+params.Encode(), nil)
+	if err != nil {
+		return fmt.Errorf("miaotixing build request failed: %w", err)
+	}
+	resp, err := m.client.Do(httpReq)
 	if err != nil {
 		return fmt.Errorf("miaotixing request failed: %w", err)
 	}
@@ -80,7 +84,7 @@ func (n *Notifier) SendMiaoTiXing(miaoCode string, text string) error {
 		return fmt.Errorf("miaotixing parse response failed: %w", err)
 	}
 
-	n.rateLimiter.Store(miaoCode, time.Now())
+	m.limiter.mark(miaoCode)
 
 	if result.Code != 0 {
 		return fmt.Errorf("miaotixing error code=%d msg=%s", result.Code, result.Msg)
@@ -88,20 +92,3 @@ func (n *Notifier) SendMiaoTiXing(miaoCode string, text string) error {
 	slog.Debug("miaotixing notification sent", "miao_code", miaoCode)
 	return nil
 }
-
-// BuildNotificationText constructs the push notification text from a NotifyRequest.
-func BuildNotificationText(req NotifyRequest) string {
-	status := "成功 ✓"
-	if req.EventType == "fail" {
-		status = "失败 ✗"
-	}
-	text := fmt.Sprintf("账号: %s\n", req.AccountNo)
-	if req.Username != "" {
-		text += fmt.Sprintf("角色: %s\n", req.Username)
-	}
-	text += fmt.Sprintf("任务: %s\n结果: %s", req.TaskType, status)
-	if req.Message != "" {
-		text += fmt.Sprintf("\n详情: %s", req.Message)
-	}
-	return text
-}
@@ -0,0 +1,504 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"oas-cloud-go/internal/config"
+)
+
+// ErrRateLimited is returned by a channel that skipped a send because the
+// same destination was notified too recently.
+var ErrRateLimited = errors.New("notification rate limited")
+
+// RateLimitedError is the ErrRateLimited returned by a channel, with how long
+// until the destination accepts sends again.
+type RateLimitedError struct {
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitedError) Error() string { return ErrRateLimited.Error() }
+
+func (e *RateLimitedError) Is(target error) bool { return target == ErrRateLimited }
+
+// RetryAfter returns how long to wait before retrying a send that failed with
+// err because of a rate limit, falling back to fallback when err carries no
+// delay.
+func RetryAfter(err error, fallback time.Duration) time.Duration {
+	var limited *RateLimitedError
+	if errors.As(err, &limited) && limited.RetryAfter > 0 {
+		return limited.RetryAfter
+	}
+	return fallback
+}
+
+// errPrivateAddress is returned for destinations on loopback, private,
+// link-local or other internal addresses, which user settings must not reach.
+var errPrivateAddress = errors.New("destination is not a public address")
+
+// ErrChannelDisabled is returned by SendTo when the user no longer has the
+// channel enabled.
+var ErrChannelDisabled = errors.New("notification channel disabled")
+
+// NotifyRequest carries the information needed to send a notification.
+type NotifyRequest struct {
+	UserID    uint
+	AccountNo string
+	Username  string
+	TaskType  string
+	EventType string // "success" or "fail"
+	Message   string
+}
+
+// Channel is a push destination a user can enable in notify_config.
+// Per-user settings are stored under notify_config.channels[Name()].
+type Channel interface {
+	// Name is the stable key of the channel in notify_config.
+	Name() string
+	// Available reports whether the server is configured to use the channel.
+	Available() bool
+	// Validate checks user supplied settings and returns the normalized
+	// copy to persist. Error messages are shown to the user as-is.
+	Validate(settings map[string]any) (map[string]any, error)
+	// Send delivers req using the user's settings. Rate-limited sends are
+	// skipped and return a *RateLimitedError, which matches ErrRateLimited.
+	Send(ctx context.Context, settings map[string]any, req NotifyRequest) error
+}
+
+// SendResult is the outcome of one channel delivery attempt.
+type SendResult struct {
+	Channel string
+	Err     error
+}
+
+// Target is a channel enabled in a user's notify_config. Reason is set when
+// the channel cannot be used, e.g. it is unknown or not configured on the server.
+type Target struct {
+	Channel string `json:"channel"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// ChannelInfo describes a registered channel for API listings.
+type ChannelInfo struct {
+	Name      string `json:"name"`
+	Available bool   `json:"available"`
+}
+
+// legacyChannelKeys maps channels that predate the registry to the flat
+// notify_config keys the user frontend still reads and writes.
+var legacyChannelKeys = map[string]struct {
+	enabledKey string
+	valueKey   string
+	settingKey string
+}{
+	"miaotixing": {enabledKey: "wechat_enabled", valueKey: "wechat_miao_code", settingKey: "miao_code"},
+	"email":      {enabledKey: "email_enabled", valueKey: "email", settingKey: "email"},
+}
+
+// Notifier is the channel registry used to fan a NotifyRequest out to every
+// channel a user has enabled.
+type Notifier struct {
+	channels map[string]Channel
+	order    []string
+}
+
+// NewNotifier creates a Notifier with all built-in channels registered.
+func NewNotifier(cfg config.Config) *Notifier {
+	client := newHTTPClient(cfg.NotifyAllowPrivate)
+	webhook := NewWebhook(client)
+	webhook.allowPrivate = cfg.NotifyAllowPrivate
+	bark := NewBark(client)
+	bark.allowPrivate = cfg.NotifyAllowPrivate
+	n := &Notifier{channels: map[string]Channel{}}
+	n.Register(NewMiaoTiXing(client))
+	n.Register(NewEmailSender(cfg))
+	n.Register(webhook)
+	n.Register(bark)
+	n.Register(NewServerChan(client))
+	n.Register(NewPushPlus(client))
+	return n
+}
+
+// Register adds ch to the registry, replacing any channel with the same name.
+func (n *Notifier) Register(ch Channel) {
+	name := ch.Name()
+	if _, exists := n.channels[name]; !exists {
+		n.order = append(n.order, name)
+	}
+	n.channels[name] = ch
+}
+
+// Channel returns the registered channel with the given name.
+func (n *Notifier) Channel(name string) (Channel, bool) {
+	ch, ok := n.channels[name]
+	return ch, ok
+}
+
+// Channels lists registered channels in registration order.
+func (n *Notifier) Channels() []ChannelInfo {
+	items := make([]ChannelInfo, 0, len(n.order))
+	for _, name := range n.order {
+		items = append(items, ChannelInfo{Name: name, Available: n.channels[name].Available()})
+	}
+	return items
+}
+
+// ChannelSettings resolves the effective per-channel settings from a stored
+// notify_config, folding the legacy flat keys into their channels.
+func ChannelSettings(nc map[string]any) map[string]map[string]any {
+	out := map[string]map[string]any{}
+	if raw, ok := nc["channels"].(map[string]any); ok {
+		for name, value := range raw {
+			if settings, ok := value.(map[string]any); ok {
+				out[name] = settings
+			}
+		}
+	}
+	for name, keys := range legacyChannelKeys {
+		if _, ok := out[name]; ok {
+			continue
+		}
+		enabled, _ := nc[keys.enabledKey].(bool)
+		value, _ := nc[keys.valueKey].(string)
+		out[name] = map[string]any{"enabled": enabled, keys.settingKey: value}
+	}
+	return out
+}
+
+// ValidateConfig validates a user's notify_config and returns the normalized
+// form to store. MiaoTiXing and email keep their legacy flat keys; every
+// other channel is stored under "channels" and the filters under "rules".
+func (n *Notifier) ValidateConfig(nc map[string]any) (map[string]any, error) {
+	if raw, ok := nc["channels"]; ok && raw != nil {
+		if _, ok := raw.(map[string]any); !ok {
+			return nil, fmt.Errorf("channels 必须是对象")
+		}
+	}
+	resolved := ChannelSettings(nc)
+	names := make([]string, 0, len(resolved))
+	for name := range resolved {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	out := map[string]any{}
+	channels := map[string]any{}
+	for _, name := range names {
+		ch, ok := n.channels[name]
+		if !ok {
+			return nil, fmt.Errorf("不支持的通知渠道: %s", name)
+		}
+		settings, err := ch.Validate(resolved[name])
+		if err != nil {
+			return nil, err
+		}
+		if keys, legacy := legacyChannelKeys[name]; legacy {
+			out[keys.enabledKey] = settings["enabled"]
+			out[keys.valueKey] = settings[keys.settingKey]
+			continue
+		}
+		channels[name] = settings
+	}
+	out["channels"] = channels
+
+	rules, err := ValidateRules(nc["rules"])
+	if err != nil {
+		return nil, err
+	}
+	out["rules"] = rules
+	return out, nil
+}
+
+// Targets lists the channels enabled in nc in registration order, followed
+// by enabled channels this server does not know about.
+func (n *Notifier) Targets(nc map[string]any) []Target {
+	resolved := ChannelSettings(nc)
+	var targets []Target
+	for _, name := range n.order {
+		if enabled, _ := resolved[name]["enabled"].(bool); !enabled {
+			continue
+		}
+		target := Target{Channel: name}
+		if !n.channels[name].Available() {
+			target.Reason = "channel not configured on server"
+		}
+		targets = append(targets, target)
+	}
+	var unknown []string
+	for name, settings := range resolved {
+		if _, ok := n.channels[name]; ok {
+			continue
+		}
+		if enabled, _ := settings["enabled"].(bool); enabled {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	for _, name := range unknown {
+		targets = append(targets, Target{Channel: name, Reason: "unknown channel"})
+	}
+	return targets
+}
+
+// SendTo delivers req through a single channel using the settings in nc.
+func (n *Notifier) SendTo(ctx context.Context, name string, nc map[string]any, req NotifyRequest) error {
+	ch, ok := n.channels[name]
+	if !ok {
+		return fmt.Errorf("unknown notification channel %q", name)
+	}
+	settings := ChannelSettings(nc)[name]
+	if enabled, _ := settings["enabled"].(bool); !enabled {
+		return ErrChannelDisabled
+	}
+	if !ch.Available() {
+		return fmt.Errorf("notification channel %q is not configured on server", name)
+	}
+	return ch.Send(ctx, settings, req)
+}
+
+// Send delivers req to every available channel enabled in nc and reports
+// the outcome of each attempt.
+func (n *Notifier) Send(ctx context.Context, nc map[string]any, req NotifyRequest) []SendResult {
+	var results []SendResult
+	for _, target := range n.Targets(nc) {
+		if target.Reason != "" {
+			continue
+		}
+		results = append(results, SendResult{Channel: target.Channel, Err: n.SendTo(ctx, target.Channel, nc, req)})
+	}
+	return results
+}
+
+// BuildNotificationTitle constructs a one-line title for channels that show
+// a title separately from the body.
+func BuildNotificationTitle(req NotifyRequest) string {
+	switch req.EventType {
+	case EventDigest:
+		return fmt.Sprintf("[OAS] %s 任务汇总", req.AccountNo)
+	case EventAlert:
+		return fmt.Sprintf("[OAS] %s 账号提醒", req.AccountNo)
+	}
+	status := "成功"
+	if req.EventType == "fail" {
+		status = "失败"
+	}
+	return fmt.Sprintf("[OAS] %s %s - %s", req.AccountNo, req.TaskType, status)
+}
+
+// BuildNotificationText constructs the push notification text from a NotifyRequest.
+func BuildNotificationText(req NotifyRequest) string {
+	text := fmt.Sprintf("账号: %s\n", req.AccountNo)
+	if req.Username != "" {
+		text += fmt.Sprintf("角色: %s\n", req.Username)
+	}
+	if req.EventType == EventDigest || req.EventType == EventAlert {
+		return text + req.Message
+	}
+	status := "成功 ✓"
+	if req.EventType == "fail" {
+		status = "失败 ✗"
+	}
+	text += fmt.Sprintf("任务: %s\n结果: %s", req.TaskType, status)
+	if req.Message != "" {
+		text += fmt.Sprintf("\n详情: %s", req.Message)
+	}
+	return text
+}
+
+// sendLimiter enforces a minimum interval between sends per destination.
+type sendLimiter struct {
+	last     sync.Map // key=destination, value=time.Time
+	interval time.Duration
+}
+
+// limit returns a *RateLimitedError when key was sent to less than interval
+// ago, and nil otherwise.
+func (l *sendLimiter) limit(key string) error {
+	lastSend, ok := l.last.Load(key)
+	if !ok {
+		return nil
+	}
+	if wait := l.interval - time.Since(lastSend.(time.Time)); wait > 0 {
+		return &RateLimitedError{RetryAfter: wait}
+	}
+	return nil
+}
+
+func (l *sendLimiter) mark(key string) {
+	l.last.Store(key, time.Now())
+}
+
+// settingString returns a trimmed string setting, truncated to maxLen bytes.
+func settingString(settings map[string]any, key string, maxLen int) string {
+	value, _ := settings[key].(string)
+	value = strings.TrimSpace(value)
+	if len(value) > maxLen {
+		value = value[:maxLen]
+	}
+	return value
+}
+
+func isAlnum(value string) bool {
+	for _, r := range value {
+		if !((r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9')) {
+			return false
+		}
+	}
+	return true
+}
+
+// validateHTTPURL checks that value is an absolute http(s) URL and, unless
+// allowPrivate is set, that its host is not an internal address.
+func validateHTTPURL(value string, allowPrivate bool) error {
+	parsed, err := url.Parse(value)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("invalid url")
+	}
+	if allowPrivate {
+		return nil
+	}
+	return checkPublicHost(parsed.Hostname())
+}
+
+// nonPublicNets are the internal ranges the net.IP predicates do not cover:
+// "this network", carrier-grade NAT, IETF protocol assignments, benchmarking
+// and reserved space.
+var nonPublicNets = func() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range []string{"0.0.0.0/8", "100.64.0.0/10", "192.0.0.0/24", "198.18.0.0/15", "240.0.0.0/4"} {
+		_, ipNet, _ := net.ParseCIDR(cidr)
+		nets = append(nets, ipNet)
+	}
+	return nets
+}()
+
+// isPublicIP reports whether ip is a routable public address. Loopback,
+// private, link-local (including the 169.254.169.254 metadata service),
+// multicast and unspecified addresses are not.
+func isPublicIP(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, ipNet := range nonPublicNets {
+		if ipNet.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkPublicHost refuses a host that is, or resolves to, an internal
+// address. A failed lookup is let through: the dialer checks the address it
+// actually connects to.
+func checkPublicHost(host string) error {
+	lower := strings.ToLower(strings.TrimSuffix(host, "."))
+	if lower == "localhost" || strings.HasSuffix(lower, ".localhost") {
+		return errPrivateAddress
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if !isPublicIP(ip) {
+			return errPrivateAddress
+		}
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil
+	}
+	for _, addr := range addrs {
+		if !isPublicIP(addr.IP) {
+			return errPrivateAddress
+		}
+	}
+	return nil
+}
+
+// publicOnlyControl is a net.Dialer Control hook refusing connections to
+// internal addresses. It runs on the resolved address, so a name that
+// rebinds to an internal address after validation is still stopped.
+func publicOnlyControl(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+		return fmt.Errorf("%w: %s", errPrivateAddress, host)
+	}
+	return nil
+}
+
+// newHTTPClient returns the client shared by the HTTP channels. Redirects are
+// not followed, so a receiver cannot bounce a send to an internal address,
+// and unless allowPrivate is set the dialer refuses internal addresses.
+func newHTTPClient(allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{Timeout: 5 * time.Second, KeepAlive: 30 * time.Second}
+	if !allowPrivate {
+		dialer.Control = publicOnlyControl
+	}
+	return &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: 5 * time.Second,
+			MaxIdleConns:        20,
+			MaxIdleConnsPerHost: 10,
+			IdleConnTimeout:     90 * time.Second,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// postJSON sends payload as a JSON POST and returns the response body. Non-2xx
+// statuses are reported as errors prefixed with the channel name.
+func postJSON(ctx context.Context, client *http.Client, channel, target string, payload any, header http.Header) ([]byte, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("%s encode payload failed: %w", channel, err)
+	}
+	return doPost(ctx, client, channel, target, "application/json", data, header)
+}
+
+func doPost(ctx context.Context, client *http.Client, channel, target, contentType string, body []byte, header http.Header) ([]byte, error) {
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("%s build request failed: %w", channel, err)
+	}
+	for key, values := range header {
+		httpReq.Header[key] = values
+	}
+	httpReq.Header.Set("Content-Type", contentType)
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("%s request failed: %w", channel, err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return nil, fmt.Errorf("%s read response failed: %w", channel, err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return respBody, fmt.Errorf("%s http status %d", channel, resp.StatusCode)
+	}
+	return respBody, nil
+}
@@ -0,0 +1,261 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"oas-cloud-go/internal/config"
+)
+
+type capturedRequest struct {
+	path   string
+	header http.Header
+	body   []byte
+}
+
+// startPushStandIn returns a server that records requests and replies with
+// the given JSON body.
+func startPushStandIn(t *testing.T, reply string) (*httptest.Server, func() []capturedRequest) {
+	t.Helper()
+	var mu sync.Mutex
+	var captured []capturedRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		captured = append(captured, capturedRequest{path: r.URL.RequestURI(), header: r.Header.Clone(), body: body})
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, reply)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, func() []capturedRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]capturedRequest(nil), captured...)
+	}
+}
+
+var sampleRequest = NotifyRequest{
+	UserID:    9,
+	AccountNo: "U20260101000009",
+	Username:  "tester",
+	TaskType:  "探索突破",
+	EventType: "fail",
+	Message:   "timeout",
+}
+
+func TestValidateConfigKeepsLegacyKeysAndChannels(t *testing.T) {
+	n := NewNotifier(config.Config{})
+	out, err := n.ValidateConfig(map[string]any{
+		"email_enabled":    false,
+		"email":            "",
+		"wechat_enabled":   true,
+		"wechat_miao_code": " abc123 ",
+		"channels": map[string]any{
+			"bark": map[string]any{"enabled": true, "device_key": "key1", "server": "https://bark.example.com/"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("validate failed: %v", err)
+	}
+	if out["wechat_enabled"] != true || out["wechat_miao_code"] != "abc123" {
+		t.Fatalf("legacy wechat keys not normalized: %v", out)
+	}
+	channels := out["channels"].(map[string]any)
+	bark := channels["bark"].(map[string]any)
+	if bark["server"] != "https://bark.example.com" {
+		t.Fatalf("bark server not normalized: %v", bark)
+	}
+	if _, ok := channels["miaotixing"]; ok {
+		t.Fatalf("legacy channels should not be duplicated under channels: %v", channels)
+	}
+
+	cases := []struct {
+		name string
+		nc   map[string]any
+		want string
+	}{
+		{"bad miao code", map[string]any{"wechat_miao_code": "a-b"}, "喵码只能包含字母和数字"},
+		{"wechat without code", map[string]any{"wechat_enabled": true}, "启用微信通知需要填写喵码"},
+		{"bad email", map[string]any{"email_enabled": true, "email": "nope"}, "邮箱格式不正确"},
+		{"unknown channel", map[string]any{"channels": map[string]any{"fax": map[string]any{}}}, "不支持的通知渠道"},
+		{"webhook scheme", map[string]any{"channels": map[string]any{"webhook": map[string]any{"url": "ftp://x"}}}, "http 或 https"},
+		{"pushplus without token", map[string]any{"channels": map[string]any{"pushplus": map[string]any{"enabled": true}}}, "Token"},
+	}
+	for _, tc := range cases {
+		if _, err := n.ValidateConfig(tc.nc); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Fatalf("%s: expected error containing %q, got %v", tc.name, tc.want, err)
+		}
+	}
+}
+
+func TestWebhookSignsPayload(t *testing.T) {
+	srv, captured := startPushStandIn(t, `{}`)
+	hook := NewWebhook(srv.Client())
+	settings := map[string]any{"enabled": true, "url": srv.URL + "/hook", "secret": "s3cret"}
+	if err := hook.Send(context.Background(), settings, sampleRequest); err != nil {
+		t.Fatalf("webhook send failed: %v", err)
+	}
+
+	reqs := captured()
+	if len(reqs) != 1 {
+		t.Fatalf("expected 1 request, got %d", len(reqs))
+	}
+	got := reqs[0]
+	timestamp := got.header.Get(WebhookTimestampHeader)
+	want := "sha256=" + SignWebhook("s3cret", timestamp, got.body)
+	if got.header.Get(WebhookSignatureHeader) != want {
+		t.Fatalf("signature mismatch: got %q want %q", got.header.Get(WebhookSignatureHeader), want)
+	}
+	var payload WebhookPayload
+	if err := json.Unmarshal(got.body, &payload); err != nil {
+		t.Fatalf("decode payload failed: %v", err)
+	}
+	if payload.AccountNo != sampleRequest.AccountNo || payload.EventType != "fail" || payload.TaskType != "探索突破" {
+		t.Fatalf("unexpected payload: %+v", payload)
+	}
+}
+
+func TestWebhookReportsHTTPStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer srv.Close()
+	err := NewWebhook(srv.Client()).Send(context.Background(), map[string]any{"url": srv.URL}, sampleRequest)
+	if err == nil || !strings.Contains(err.Error(), "http status 502") {
+		t.Fatalf("expected http status error, got %v", err)
+	}
+}
+
+func TestHTTPTargetsRefuseInternalAddresses(t *testing.T) {
+	hook := NewWebhook(http.DefaultClient)
+	bark := NewBark(http.DefaultClient)
+	for _, target := range []string{
+		"http://127.0.0.1:8080/hook",
+		"http://localhost/hook",
+		"http://10.1.2.3/hook",
+		"http://192.168.0.10/hook",
+		"http://169.254.169.254/latest/meta-data",
+		"http://[::1]/hook",
+		"http://100.64.0.1/hook",
+	} {
+		if _, err := hook.Validate(map[string]any{"enabled": true, "url": target}); err == nil || !strings.Contains(err.Error(), "内网") {
+			t.Fatalf("webhook %s should be refused, got %v", target, err)
+		}
+		if _, err := bark.Validate(map[string]any{"enabled": true, "device_key": "k", "server": target}); err == nil {
+			t.Fatalf("bark server %s should be refused", target)
+		}
+	}
+	if _, err := hook.Validate(map[string]any{"enabled": true, "url": "https://8.8.8.8/hook"}); err != nil {
+		t.Fatalf("public webhook should be accepted: %v", err)
+	}
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer target.Close()
+	guarded := NewWebhook(newHTTPClient(false))
+	err := guarded.Send(context.Background(), map[string]any{"url": target.URL}, sampleRequest)
+	if !errors.Is(err, errPrivateAddress) {
+		t.Fatalf("guarded client should refuse a loopback dial, got %v", err)
+	}
+
+	redirect := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, target.URL, http.StatusFound)
+	}))
+	defer redirect.Close()
+	open := NewWebhook(newHTTPClient(true))
+	err = open.Send(context.Background(), map[string]any{"url": redirect.URL}, sampleRequest)
+	if err == nil || !strings.Contains(err.Error(), "http status 302") {
+		t.Fatalf("redirects should not be followed, got %v", err)
+	}
+}
+
+func TestWebhookRateLimitedPerURL(t *testing.T) {
+	srv, captured := startPushStandIn(t, `{}`)
+	hook := NewWebhook(srv.Client())
+	settings := map[string]any{"url": srv.URL + "/hook"}
+	if err := hook.Send(context.Background(), settings, sampleRequest); err != nil {
+		t.Fatalf("first send failed: %v", err)
+	}
+	if err := hook.Send(context.Background(), settings, sampleRequest); !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("second send should be rate limited, got %v", err)
+	}
+	if err := hook.Send(context.Background(), map[string]any{"url": srv.URL + "/other"}, sampleRequest); err != nil {
+		t.Fatalf("another URL should not share the limit: %v", err)
+	}
+	if len(captured()) != 2 {
+		t.Fatalf("expected 2 delivered requests, got %d", len(captured()))
+	}
+}
+
+func TestBarkServerChanPushPlusSend(t *testing.T) {
+	barkSrv, barkReqs := startPushStandIn(t, `{"code":200,"message":"success"}`)
+	bark := NewBark(barkSrv.Client())
+	if err := bark.Send(context.Background(), map[string]any{"device_key": "dev1", "server": barkSrv.URL}, sampleRequest); err != nil {
+		t.Fatalf("bark send failed: %v", err)
+	}
+	// Rate limited within the interval.
+	if err := bark.Send(context.Background(), map[string]any{"device_key": "dev1", "server": barkSrv.URL}, sampleRequest); !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("expected ErrRateLimited, got %v", err)
+	}
+	if reqs := barkReqs(); len(reqs) != 1 || reqs[0].path != "/push" || !strings.Contains(string(reqs[0].body), `"device_key":"dev1"`) {
+		t.Fatalf("unexpected bark requests: %+v", reqs)
+	}
+
+	scSrv, scReqs := startPushStandIn(t, `{"code":0,"message":""}`)
+	sc := NewServerChan(scSrv.Client())
+	sc.baseURL = scSrv.URL
+	if err := sc.Send(context.Background(), map[string]any{"send_key": "SCT1abc"}, sampleRequest); err != nil {
+		t.Fatalf("serverchan send failed: %v", err)
+	}
+	reqs := scReqs()
+	if len(reqs) != 1 || reqs[0].path != "/SCT1abc.send" {
+		t.Fatalf("unexpected serverchan requests: %+v", reqs)
+	}
+	form, _ := url.ParseQuery(string(reqs[0].body))
+	if form.Get("title") != BuildNotificationTitle(sampleRequest) {
+		t.Fatalf("unexpected serverchan title: %q", form.Get("title"))
+	}
+	if got := NewServerChan(nil).endpoint("sctp123tabc"); got != "https://123.push.ft07.com/send/sctp123tabc.send" {
+		t.Fatalf("unexpected Server酱³ endpoint: %s", got)
+	}
+
+	ppSrv, _ := startPushStandIn(t, `{"code":903,"msg":"invalid token"}`)
+	pp := NewPushPlus(ppSrv.Client())
+	pp.baseURL = ppSrv.URL
+	err := pp.Send(context.Background(), map[string]any{"token": "tok"}, sampleRequest)
+	if err == nil || !strings.Contains(err.Error(), "code=903") {
+		t.Fatalf("expected pushplus error code, got %v", err)
+	}
+}
+
+func TestNotifierSendSkipsDisabledAndUnavailableChannels(t *testing.T) {
+	srv, captured := startPushStandIn(t, `{}`)
+	n := NewNotifier(config.Config{})
+	n.Register(NewWebhook(srv.Client()))
+
+	nc := map[string]any{
+		"email_enabled": true,
+		"email":         "user@example.com",
+		"channels": map[string]any{
+			"webhook": map[string]any{"enabled": true, "url": srv.URL},
+			"bark":    map[string]any{"enabled": false, "device_key": "dev1"},
+		},
+	}
+	results := n.Send(context.Background(), nc, sampleRequest)
+	if len(results) != 1 || results[0].Channel != "webhook" || results[0].Err != nil {
+		t.Fatalf("expected only webhook delivery, got %+v", results)
+	}
+	if len(captured()) != 1 {
+		t.Fatalf("expected webhook to be called once")
+	}
+}
@@ -0,0 +1,86 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// PushPlus sends notifications via PushPlus (推送加), optionally to a group topic.
+type PushPlus struct {
+	client  *http.Client
+	baseURL string
+	limiter sendLimiter // per token + topic
+}
+
+// NewPushPlus creates the PushPlus channel.
+func NewPushPlus(client *http.Client) *PushPlus {
+	return &PushPlus{
+		client:  client,
+		baseURL: "https://www.pushplus.plus/send",
+		limiter: sendLimiter{interval: 15 * time.Second},
+	}
+}
+
+func (p *PushPlus) Name() string    { return "pushplus" }
+func (p *PushPlus) Available() bool { return true }
+
+// Validate requires an alphanumeric token when enabled.
+func (p *PushPlus) Validate(settings map[string]any) (map[string]any, error) {
+	enabled, _ := settings["enabled"].(bool)
+	token := settingString(settings, "token", 64)
+	topic := settingString(settings, "topic", 64)
+	if token != "" && !isAlnum(token) {
+		return nil, fmt.Errorf("PushPlus Token 只能包含字母和数字")
+	}
+	if enabled && token == "" {
+		return nil, fmt.Errorf("启用 PushPlus 通知需要填写 Token")
+	}
+	return map[string]any{"enabled": enabled, "token": token, "topic": topic}, nil
+}
+
+type pushPlusResponse struct {
+	Code int    `json:"code"`
+	Msg  string `json:"msg"`
+}
+
+// Send posts the notification as a plain-text PushPlus message.
+func (p *PushPlus) Send(ctx context.Context, settings map[string]any, req NotifyRequest) error {
+	token, _ := settings["token"].(string)
+	if token == "" {
+		return fmt.Errorf("pushplus token is empty")
+	}
+	topic, _ := settings["topic"].(string)
+	limitKey := token + "/" + topic
+	if err := p.limiter.limit(limitKey); err != nil {
+		slog.Debug("pushplus notification rate limited")
+		return err
+	}
+
+	payload := map[string]any{
+		"token":    token,
+		"title":    BuildNotificationTitle(req),
+		"content":  BuildNotificationText(req),
+		"template": "txt",
+	}
+	if topic != "" {
+		payload["topic"] = topic
+	}
+	body, err := postJSON(ctx, p.client, "pushplus", p.baseURL, payload, nil)
+	if err != nil {
+		return err
+	}
+	var result pushPlusResponse
+	if err := json.Unmarshal(body, &result); err != nil {
+		return fmt.Errorf("pushplus parse response failed: %w", err)
+	}
+	p.limiter.mark(limitKey)
+	if result.Code != http.StatusOK {
+		return fmt.Errorf("pushplus error code=%d msg=%s", result.Code, result.Msg)
+	}
+	slog.Debug("pushplus notification sent")
+	return nil
+}
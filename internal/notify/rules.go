@@ -0,0 +1,275 @@
+package notify
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"oas-cloud-go/internal/taskmeta"
+)
+
+const (
+	// EventDigest is the NotifyRequest.EventType of an aggregated digest.
+	EventDigest = "digest"
+	// EventAlert is the NotifyRequest.EventType of an account-level alert.
+	EventAlert = "alert"
+
+	DigestOff    = ""
+	DigestHourly = "hourly"
+	DigestDaily  = "daily"
+)
+
+// ErrFilteredByRule is returned when a user's rules suppress a notification.
+var ErrFilteredByRule = errors.New("filtered by notify rule")
+
+// Rules are the per-user filters stored under notify_config.rules.
+type Rules struct {
+	TaskTypes    []string // empty means every task type
+	FailuresOnly bool
+	QuietEnabled bool
+	QuietStart   int // minutes after Beijing midnight
+	QuietEnd     int
+	Digest       string // DigestOff, DigestHourly or DigestDaily
+	DigestHour   int    // Beijing hour the daily digest is sent
+}
+
+// ParseRules reads the rules from a stored notify_config. Invalid values fall
+// back to "notify everything immediately".
+func ParseRules(nc map[string]any) Rules {
+	raw, _ := nc["rules"].(map[string]any)
+	var rules Rules
+	if raw == nil {
+		return rules
+	}
+	if items, ok := raw["task_types"].([]any); ok {
+		for _, item := range items {
+			if name, ok := item.(string); ok && name != "" {
+				rules.TaskTypes = append(rules.TaskTypes, name)
+			}
+		}
+	}
+	rules.FailuresOnly, _ = raw["failures_only"].(bool)
+	if quiet, ok := raw["quiet_hours"].(map[string]any); ok {
+		enabled, _ := quiet["enabled"].(bool)
+		start, startOK := parseClock(quiet["start"])
+		end, endOK := parseClock(quiet["end"])
+		if enabled && startOK && endOK && start != end {
+			rules.QuietEnabled = true
+			rules.QuietStart = start
+			rules.QuietEnd = end
+		}
+	}
+	switch digest, _ := raw["digest"].(string); digest {
+	case DigestHourly, DigestDaily:
+		rules.Digest = digest
+	}
+	rules.DigestHour = 21
+	if hour, ok := taskmeta.WholeNumber(raw["digest_hour"]); ok && hour >= 0 && hour <= 23 {
+		rules.DigestHour = hour
+	}
+	return rules
+}
+
+// ValidateRules checks user supplied notify_config.rules and returns the
+// normalized copy to store.
+func ValidateRules(raw any) (map[string]any, error) {
+	if raw == nil {
+		raw = map[string]any{}
+	}
+	input, ok := raw.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("rules 必须是对象")
+	}
+
+	known := map[string]struct{}{}
+	for _, name := range taskmeta.DefaultTaskOrder() {
+		known[name] = struct{}{}
+	}
+	taskTypes := []string{}
+	if rawTypes, exists := input["task_types"]; exists && rawTypes != nil {
+		items, ok := rawTypes.([]any)
+		if !ok {
+			return nil, fmt.Errorf("task_types 必须是数组")
+		}
+		seen := map[string]struct{}{}
+		for _, item := range items {
+			name, _ := item.(string)
+			name = strings.TrimSpace(name)
+			if _, ok := known[name]; !ok {
+				return nil, fmt.Errorf("未知的任务类型: %v", item)
+			}
+			if _, dup := seen[name]; dup {
+				continue
+			}
+			seen[name] = struct{}{}
+			taskTypes = append(taskTypes, name)
+		}
+	}
+
+	failuresOnly, _ := input["failures_only"].(bool)
+
+	quiet := map[string]any{"enabled": false, "start": "", "end": ""}
+	if rawQuiet, exists := input["quiet_hours"]; exists && rawQuiet != nil {
+		q, ok := rawQuiet.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("quiet_hours 必须是对象")
+		}
+		enabled, _ := q["enabled"].(bool)
+		start, _ := q["start"].(string)
+		end, _ := q["end"].(string)
+		start, end = strings.TrimSpace(start), strings.TrimSpace(end)
+		if enabled || start != "" || end != "" {
+			startMin, startOK := parseClock(start)
+			endMin, endOK := parseClock(end)
+			if !startOK || !endOK {
+				return nil, fmt.Errorf("免打扰时间格式应为 HH:MM")
+			}
+			if startMin == endMin {
+				return nil, fmt.Errorf("免打扰开始和结束时间不能相同")
+			}
+		}
+		quiet = map[string]any{"enabled": enabled, "start": start, "end": end}
+	}
+
+	digest, _ := input["digest"].(string)
+	digest = strings.TrimSpace(digest)
+	switch digest {
+	case DigestOff, "off":
+		digest = "off"
+	case DigestHourly, DigestDaily:
+	default:
+		return nil, fmt.Errorf("digest 仅支持 off / hourly / daily")
+	}
+	digestHour := 21
+	if rawHour, exists := input["digest_hour"]; exists && rawHour != nil {
+		hour, ok := taskmeta.WholeNumber(rawHour)
+		if !ok || hour < 0 || hour > 23 {
+			return nil, fmt.Errorf("digest_hour 必须是 0-23 的整数")
+		}
+		digestHour = hour
+	}
+
+	return map[string]any{
+		"task_types":    taskTypes,
+		"failures_only": failuresOnly,
+		"quiet_hours":   quiet,
+		"digest":        digest,
+		"digest_hour":   digestHour,
+	}, nil
+}
+
+// Allows reports whether a single job outcome should notify. The returned
+// error wraps ErrFilteredByRule and names the rule that suppressed it.
+func (r Rules) Allows(taskType, eventType string) error {
+	if r.FailuresOnly && eventType != "fail" {
+		return fmt.Errorf("%w: failures only", ErrFilteredByRule)
+	}
+	if len(r.TaskTypes) > 0 && !r.coversTask(taskType) {
+		return fmt.Errorf("%w: task type %s not selected", ErrFilteredByRule, taskType)
+	}
+	if r.Digest != DigestOff {
+		return fmt.Errorf("%w: aggregated into %s digest", ErrFilteredByRule, r.Digest)
+	}
+	return nil
+}
+
+func (r Rules) coversTask(taskType string) bool {
+	for _, name := range r.TaskTypes {
+		if name == taskType {
+			return true
+		}
+	}
+	return false
+}
+
+// QuietUntil returns the end of the current quiet period when now falls in
+// the user's Beijing-time quiet hours.
+func (r Rules) QuietUntil(now time.Time) (time.Time, bool) {
+	if !r.QuietEnabled {
+		return time.Time{}, false
+	}
+	bj := now.In(taskmeta.BJLoc)
+	minute := bj.Hour()*60 + bj.Minute()
+	var inQuiet bool
+	if r.QuietStart < r.QuietEnd {
+		inQuiet = minute >= r.QuietStart && minute < r.QuietEnd
+	} else {
+		inQuiet = minute >= r.QuietStart || minute < r.QuietEnd
+	}
+	if !inQuiet {
+		return time.Time{}, false
+	}
+	midnight := time.Date(bj.Year(), bj.Month(), bj.Day(), 0, 0, 0, 0, taskmeta.BJLoc)
+	end := midnight.Add(time.Duration(r.QuietEnd) * time.Minute)
+	if !end.After(bj) {
+		end = end.AddDate(0, 0, 1)
+	}
+	return end.UTC(), true
+}
+
+// DigestWindow returns the period the digest due at now covers and a stable
+// key for it. ok is false when digests are off.
+func (r Rules) DigestWindow(now time.Time) (start, end time.Time, key string, ok bool) {
+	bj := now.In(taskmeta.BJLoc)
+	switch r.Digest {
+	case DigestHourly:
+		end = time.Date(bj.Year(), bj.Month(), bj.Day(), bj.Hour(), 0, 0, 0, taskmeta.BJLoc)
+		start = end.Add(-time.Hour)
+		return start.UTC(), end.UTC(), "hourly:" + end.Format("2006-01-02 15:04"), true
+	case DigestDaily:
+		end = time.Date(bj.Year(), bj.Month(), bj.Day(), r.DigestHour, 0, 0, 0, taskmeta.BJLoc)
+		if end.After(bj) {
+			end = end.AddDate(0, 0, -1)
+		}
+		start = end.AddDate(0, 0, -1)
+		return start.UTC(), end.UTC(), "daily:" + end.Format("2006-01-02 15:04"), true
+	}
+	return time.Time{}, time.Time{}, "", false
+}
+
+// DigestEntry is the outcome count of one task type inside a digest window.
+type DigestEntry struct {
+	TaskType string
+	Success  int
+	Fail     int
+}
+
+// BuildDigestMessage renders the digest body shown after the account line.
+func BuildDigestMessage(start, end time.Time, entries []DigestEntry, recentFailures []string) string {
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Fail != entries[j].Fail {
+			return entries[i].Fail > entries[j].Fail
+		}
+		return entries[i].TaskType < entries[j].TaskType
+	})
+	var success, fail int
+	for _, entry := range entries {
+		success += entry.Success
+		fail += entry.Fail
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "时段: %s ~ %s\n", start.In(taskmeta.BJLoc).Format("01-02 15:04"), end.In(taskmeta.BJLoc).Format("01-02 15:04"))
+	fmt.Fprintf(&b, "成功 %d 次, 失败 %d 次", success, fail)
+	for _, entry := range entries {
+		fmt.Fprintf(&b, "\n- %s: 成功 %d / 失败 %d", entry.TaskType, entry.Success, entry.Fail)
+	}
+	if len(recentFailures) > 0 {
+		b.WriteString("\n最近失败:")
+		for _, item := range recentFailures {
+			fmt.Fprintf(&b, "\n- %s", item)
+		}
+	}
+	return b.String()
+}
+
+// parseClock parses "HH:MM" into minutes after midnight.
+func parseClock(value any) (int, bool) {
+	text, _ := value.(string)
+	parsed, err := time.Parse("15:04", strings.TrimSpace(text))
+	if err != nil {
+		return 0, false
+	}
+	return parsed.Hour()*60 + parsed.Minute(), true
+}
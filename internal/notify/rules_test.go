@@ -0,0 +1,150 @@
+package notify
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"oas-cloud-go/internal/taskmeta"
+)
+
+func TestValidateRulesNormalizesAndRejects(t *testing.T) {
+	rules, err := ValidateRules(map[string]any{
+		"task_types":    []any{"探索突破", "探索突破", "签到"},
+		"failures_only": true,
+		"quiet_hours":   map[string]any{"enabled": true, "start": "23:00", "end": "07:30"},
+		"digest":        "daily",
+		"digest_hour":   float64(8),
+	})
+	if err != nil {
+		t.Fatalf("validate failed: %v", err)
+	}
+	if types := rules["task_types"].([]string); len(types) != 2 {
+		t.Fatalf("duplicate task types should be dropped: %v", types)
+	}
+	if rules["digest"] != "daily" || rules["digest_hour"] != 8 {
+		t.Fatalf("unexpected digest settings: %v", rules)
+	}
+
+	defaults, err := ValidateRules(nil)
+	if err != nil || defaults["digest"] != "off" || defaults["digest_hour"] != 21 {
+		t.Fatalf("unexpected defaults: %v err=%v", defaults, err)
+	}
+
+	cases := []struct {
+		name string
+		raw  map[string]any
+		want string
+	}{
+		{"unknown task", map[string]any{"task_types": []any{"不存在"}}, "未知的任务类型"},
+		{"bad clock", map[string]any{"quiet_hours": map[string]any{"enabled": true, "start": "25:00", "end": "07:00"}}, "HH:MM"},
+		{"same clock", map[string]any{"quiet_hours": map[string]any{"enabled": true, "start": "07:00", "end": "07:00"}}, "不能相同"},
+		{"bad digest", map[string]any{"digest": "weekly"}, "digest"},
+		{"bad hour", map[string]any{"digest_hour": float64(24)}, "digest_hour"},
+	}
+	for _, tc := range cases {
+		if _, err := ValidateRules(tc.raw); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Fatalf("%s: expected error containing %q, got %v", tc.name, tc.want, err)
+		}
+	}
+}
+
+func TestRulesAllows(t *testing.T) {
+	rules := ParseRules(map[string]any{"rules": map[string]any{
+		"task_types":    []any{"探索突破"},
+		"failures_only": true,
+	}})
+	if err := rules.Allows("探索突破", "fail"); err != nil {
+		t.Fatalf("selected failure should notify: %v", err)
+	}
+	if err := rules.Allows("探索突破", "success"); !errors.Is(err, ErrFilteredByRule) {
+		t.Fatalf("success should be filtered, got %v", err)
+	}
+	if err := rules.Allows("签到", "fail"); !errors.Is(err, ErrFilteredByRule) {
+		t.Fatalf("unselected task should be filtered, got %v", err)
+	}
+
+	digest := ParseRules(map[string]any{"rules": map[string]any{"digest": "hourly"}})
+	if err := digest.Allows("签到", "fail"); err == nil || !strings.Contains(err.Error(), "hourly digest") {
+		t.Fatalf("digest mode should hold individual notifications, got %v", err)
+	}
+
+	if err := ParseRules(nil).Allows("签到", "success"); err != nil {
+		t.Fatalf("empty rules should allow everything: %v", err)
+	}
+}
+
+func TestRulesQuietUntilWrapsMidnight(t *testing.T) {
+	rules := ParseRules(map[string]any{"rules": map[string]any{
+		"quiet_hours": map[string]any{"enabled": true, "start": "23:00", "end": "07:00"},
+	}})
+	bj := func(day, hour, minute int) time.Time {
+		return time.Date(2026, 3, day, hour, minute, 0, 0, taskmeta.BJLoc)
+	}
+
+	until, quiet := rules.QuietUntil(bj(10, 23, 30))
+	if !quiet || !until.Equal(bj(11, 7, 0)) {
+		t.Fatalf("23:30 should be quiet until next 07:00, got %v %v", until, quiet)
+	}
+	until, quiet = rules.QuietUntil(bj(11, 6, 59))
+	if !quiet || !until.Equal(bj(11, 7, 0)) {
+		t.Fatalf("06:59 should be quiet until 07:00, got %v %v", until, quiet)
+	}
+	if _, quiet := rules.QuietUntil(bj(11, 7, 0)); quiet {
+		t.Fatalf("07:00 should not be quiet")
+	}
+	if _, quiet := rules.QuietUntil(bj(11, 12, 0)); quiet {
+		t.Fatalf("noon should not be quiet")
+	}
+}
+
+func TestRulesDigestWindow(t *testing.T) {
+	now := time.Date(2026, 3, 10, 8, 20, 0, 0, taskmeta.BJLoc)
+
+	hourly := ParseRules(map[string]any{"rules": map[string]any{"digest": "hourly"}})
+	start, end, key, ok := hourly.DigestWindow(now)
+	if !ok || key != "hourly:2026-03-10 08:00" || end.Sub(start) != time.Hour ||
+		!end.Equal(time.Date(2026, 3, 10, 8, 0, 0, 0, taskmeta.BJLoc)) {
+		t.Fatalf("unexpected hourly window: %v %v %q", start, end, key)
+	}
+
+	daily := ParseRules(map[string]any{"rules": map[string]any{"digest": "daily", "digest_hour": float64(21)}})
+	start, end, key, ok = daily.DigestWindow(now)
+	if !ok || key != "daily:2026-03-09 21:00" || end.Sub(start) != 24*time.Hour {
+		t.Fatalf("before 21:00 the previous day's digest is due: %v %v %q", start, end, key)
+	}
+
+	if _, _, _, ok := ParseRules(nil).DigestWindow(now); ok {
+		t.Fatalf("digest off should have no window")
+	}
+}
+
+func TestBuildDigestMessage(t *testing.T) {
+	start := time.Date(2026, 3, 10, 7, 0, 0, 0, taskmeta.BJLoc)
+	msg := BuildDigestMessage(start, start.Add(time.Hour), []DigestEntry{
+		{TaskType: "签到", Success: 1},
+		{TaskType: "探索突破", Success: 2, Fail: 1},
+	}, []string{"探索突破: timeout"})
+	for _, want := range []string{"03-10 07:00 ~ 03-10 08:00", "成功 3 次, 失败 1 次", "- 探索突破: 成功 2 / 失败 1", "最近失败:\n- 探索突破: timeout"} {
+		if !strings.Contains(msg, want) {
+			t.Fatalf("digest missing %q:\n%s", want, msg)
+		}
+	}
+	if strings.Index(msg, "探索突破: 成功") > strings.Index(msg, "签到: 成功") {
+		t.Fatalf("entries with failures should be listed first:\n%s", msg)
+	}
+
+	text := BuildNotificationText(NotifyRequest{AccountNo: "U1", EventType: EventDigest, Message: msg})
+	if !strings.HasPrefix(text, "账号: U1\n时段:") {
+		t.Fatalf("unexpected digest text:\n%s", text)
+	}
+
+	alert := NotifyRequest{AccountNo: "U1", TaskType: "签到", EventType: EventAlert, Message: "任务「签到」已连续失败 3 次"}
+	if title := BuildNotificationTitle(alert); title != "[OAS] U1 账号提醒" {
+		t.Fatalf("unexpected alert title: %q", title)
+	}
+	if text := BuildNotificationText(alert); text != "账号: U1\n任务「签到」已连续失败 3 次" {
+		t.Fatalf("unexpected alert text:\n%s", text)
+	}
+}
@@ -0,0 +1,90 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// serverChan3Key matches Server酱³ send keys, which route to a per-uid host.
+var serverChan3Key = regexp.MustCompile(`^sctp(\d+)t`)
+
+// ServerChan sends notifications via Server酱 (Turbo and Server酱³ keys).
+type ServerChan struct {
+	client  *http.Client
+	baseURL string      // overrides the endpoint host in tests
+	limiter sendLimiter // per send key
+}
+
+// NewServerChan creates the ServerChan channel.
+func NewServerChan(client *http.Client) *ServerChan {
+	return &ServerChan{client: client, limiter: sendLimiter{interval: 15 * time.Second}}
+}
+
+func (s *ServerChan) Name() string    { return "serverchan" }
+func (s *ServerChan) Available() bool { return true }
+
+// Validate requires an alphanumeric send key when enabled.
+func (s *ServerChan) Validate(settings map[string]any) (map[string]any, error) {
+	enabled, _ := settings["enabled"].(bool)
+	sendKey := settingString(settings, "send_key", 128)
+	if sendKey != "" && !isAlnum(sendKey) {
+		return nil, fmt.Errorf("Server酱 SendKey 只能包含字母和数字")
+	}
+	if enabled && sendKey == "" {
+		return nil, fmt.Errorf("启用 Server酱 通知需要填写 SendKey")
+	}
+	return map[string]any{"enabled": enabled, "send_key": sendKey}, nil
+}
+
+func (s *ServerChan) endpoint(sendKey string) string {
+	if s.baseURL != "" {
+		return s.baseURL + "/" + sendKey + ".send"
+	}
+	if m := serverChan3Key.FindStringSubmatch(sendKey); m != nil {
+		return fmt.Sprintf("https://%s.push.ft07.com/send/%s.send", m[1], sendKey)
+	}
+	return "https://sctapi.ftqq.com/" + sendKey + ".send"
+}
+
+type serverChanResponse struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// Send posts the notification to the user's Server酱 key.
+func (s *ServerChan) Send(ctx context.Context, settings map[string]any, req NotifyRequest) error {
+	sendKey, _ := settings["send_key"].(string)
+	if sendKey == "" {
+		return fmt.Errorf("serverchan send key is empty")
+	}
+	if err := s.limiter.limit(sendKey); err != nil {
+		slog.Debug("serverchan notification rate limited")
+		return err
+	}
+
+	form := url.Values{}
+	form.Set("title", BuildNotificationTitle(req))
+	// desp is rendered as markdown; two trailing spaces keep the line breaks.
+	form.Set("desp", strings.ReplaceAll(BuildNotificationText(req), "\n", "  \n"))
+	body, err := doPost(ctx, s.client, "serverchan", s.endpoint(sendKey), "application/x-www-form-urlencoded", []byte(form.Encode()), nil)
+	if err != nil {
+		return err
+	}
+	var result serverChanResponse
+	if err := json.Unmarshal(body, &result); err != nil {
+		return fmt.Errorf("serverchan parse response failed: %w", err)
+	}
+	s.limiter.mark(sendKey)
+	if result.Code != 0 {
+		return fmt.Errorf("serverchan error code=%d msg=%s", result.Code, result.Message)
+	}
+	slog.Debug("serverchan notification sent")
+	return nil
+}
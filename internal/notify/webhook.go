@@ -0,0 +1,125 @@
+package notify
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// WebhookTimestampHeader carries the unix timestamp used in the signature.
+	WebhookTimestampHeader = "X-OAS-Timestamp"
+	// WebhookSignatureHeader carries "sha256=<hex hmac>" when a secret is set.
+	WebhookSignatureHeader = "X-OAS-Signature"
+)
+
+// Webhook posts notifications as JSON to a user supplied URL. When the user
+// sets a secret, the body is signed with HMAC-SHA256 over "<timestamp>.<body>".
+type Webhook struct {
+	client       *http.Client
+	limiter      sendLimiter // per URL
+	allowPrivate bool        // accept URLs on internal addresses
+}
+
+// NewWebhook creates the generic webhook channel.
+func NewWebhook(client *http.Client) *Webhook {
+	return &Webhook{client: client, limiter: sendLimiter{interval: 15 * time.Second}}
+}
+
+func (w *Webhook) Name() string    { return "webhook" }
+func (w *Webhook) Available() bool { return true }
+
+// Validate requires an http(s) URL on a public address when the channel is
+// enabled.
+func (w *Webhook) Validate(settings map[string]any) (map[string]any, error) {
+	enabled, _ := settings["enabled"].(bool)
+	target := settingString(settings, "url", 512)
+	secret := settingString(settings, "secret", 128)
+	if target != "" {
+		if err := validateHTTPURL(target, w.allowPrivate); err != nil {
+			if errors.Is(err, errPrivateAddress) {
+				return nil, fmt.Errorf("Webhook 地址不能指向内网或本机地址")
+			}
+			return nil, fmt.Errorf("Webhook 地址必须是 http 或 https 链接")
+		}
+	}
+	if enabled && target == "" {
+		return nil, fmt.Errorf("启用 Webhook 通知需要填写地址")
+	}
+	return map[string]any{"enabled": enabled, "url": target, "secret": secret}, nil
+}
+
+// WebhookPayload is the JSON body posted to webhook receivers.
+type WebhookPayload struct {
+	Event     string `json:"event"`
+	UserID    uint   `json:"user_id"`
+	AccountNo string `json:"account_no"`
+	Username  string `json:"username"`
+	TaskType  string `json:"task_type"`
+	EventType string `json:"event_type"`
+	Message   string `json:"message"`
+	Title     string `json:"title"`
+	Text      string `json:"text"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// Send posts the signed payload to the configured URL.
+func (w *Webhook) Send(ctx context.Context, settings map[string]any, req NotifyRequest) error {
+	target, _ := settings["url"].(string)
+	if target == "" {
+		return fmt.Errorf("webhook url is empty")
+	}
+	secret, _ := settings["secret"].(string)
+	if err := w.limiter.limit(target); err != nil {
+		slog.Debug("webhook notification rate limited", "user_id", req.UserID)
+		return err
+	}
+
+	ts := time.Now().Unix()
+	body, err := json.Marshal(WebhookPayload{
+		Event:     "task_notification",
+		UserID:    req.UserID,
+		AccountNo: req.AccountNo,
+		Username:  req.Username,
+		TaskType:  req.TaskType,
+		EventType: req.EventType,
+		Message:   req.Message,
+		Title:     BuildNotificationTitle(req),
+		Text:      BuildNotificationText(req),
+		Timestamp: ts,
+	})
+	if err != nil {
+		return fmt.Errorf("webhook encode payload failed: %w", err)
+	}
+
+	timestamp := strconv.FormatInt(ts, 10)
+	header := http.Header{}
+	header.Set(WebhookTimestampHeader, timestamp)
+	if secret != "" {
+		header.Set(WebhookSignatureHeader, "sha256="+SignWebhook(secret, timestamp, body))
+	}
+	if _, err := doPost(ctx, w.client, "webhook", target, "application/json", body, header); err != nil {
+		return err
+	}
+	w.limiter.mark(target)
+	slog.Debug("webhook notification sent", "user_id", req.UserID)
+	return nil
+}
+
+// SignWebhook returns the hex HMAC-SHA256 of "<timestamp>.<body>" so
+// receivers can verify a delivery with the shared secret.
+func SignWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,66 @@
+package retention
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// exporter writes each purged batch to its own gzip-compressed NDJSON file,
+// <dir>/<table>/<table>-<run stamp>-<seq>.ndjson.gz.
+type exporter struct {
+	dir   string
+	stamp string
+	seq   int
+	files int
+}
+
+func newExporter(dir string, now time.Time) *exporter {
+	return &exporter{dir: dir, stamp: now.UTC().Format("20060102T150405Z")}
+}
+
+// writeExport writes rows as one JSON object per line. The file is synced and
+// closed before it returns, so the rows are on disk before they are deleted.
+func writeExport[T any](exp *exporter, table string, rows []T) (err error) {
+	if len(rows) == 0 {
+		return nil
+	}
+	dir := filepath.Join(exp.dir, table)
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return fmt.Errorf("create export dir: %w", err)
+	}
+	exp.seq++
+	path := filepath.Join(dir, fmt.Sprintf("%s-%s-%04d.ndjson.gz", table, exp.stamp, exp.seq))
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o640)
+	if err != nil {
+		return fmt.Errorf("create export file: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = file.Close()
+			_ = os.Remove(path)
+		}
+	}()
+
+	zw := gzip.NewWriter(file)
+	enc := json.NewEncoder(zw)
+	for _, row := range rows {
+		if err := enc.Encode(row); err != nil {
+			return fmt.Errorf("write export %s: %w", path, err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("write export %s: %w", path, err)
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("sync export %s: %w", path, err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("close export %s: %w", path, err)
+	}
+	exp.files++
+	return nil
+}
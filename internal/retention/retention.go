@@ -0,0 +1,279 @@
+// Package retention purges old task jobs, job events and audit logs in
+// batches. Finished jobs are rolled up into task_job_daily_stats in the same
+// transaction that deletes them, and every purged row can be exported to
+// gzip-compressed NDJSON before it goes.
+package retention
+
+import (
+	"context"
+	"time"
+
+	"oas-cloud-go/internal/config"
+	"oas-cloud-go/internal/models"
+	"oas-cloud-go/internal/taskmeta"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const defaultBatchSize = 1000
+
+// finishedStatuses are the job statuses that no longer change on their own.
+var finishedStatuses = []string{models.JobStatusSuccess, models.JobStatusFailed, models.JobStatusCancelled}
+
+// Policy says how many days each table keeps; 0 keeps rows forever.
+type Policy struct {
+	JobDays      int    `json:"job_days"`       // finished task_jobs, with their events and dependency rows
+	EventDays    int    `json:"event_days"`     // task_job_events of jobs that are kept
+	AuditDays    int    `json:"audit_days"`     // audit_logs, only purged with an ExportDir
+	AgentLogDays int    `json:"agent_log_days"` // agent_logs reported by agents
+	ExportDir    string `json:"export_dir"`     // "" purges without exporting, audit logs aside
+	BatchSize    int    `json:"-"`
+}
+
+// PolicyFromConfig reads the RETENTION_* settings.
+func PolicyFromConfig(cfg config.Config) Policy {
+	return Policy{
+		JobDays:      cfg.RetentionJobDays,
+		EventDays:    cfg.RetentionEventDays,
+		AuditDays:    cfg.RetentionAuditDays,
+		AgentLogDays: cfg.RetentionAgentDays,
+		ExportDir:    cfg.RetentionExportDir,
+	}
+}
+
+// Result counts the rows one run removed.
+type Result struct {
+	StartedAt     time.Time `json:"started_at"`
+	FinishedAt    time.Time `json:"finished_at"`
+	Jobs          int64     `json:"jobs"`
+	Events        int64     `json:"events"`
+	AuditLogs     int64     `json:"audit_logs"`
+	AgentLogs     int64     `json:"agent_logs"`
+	ExportedFiles int       `json:"exported_files"`
+	Error         string    `json:"error,omitempty"`
+}
+
+// Run applies policy once. Each batch is exported, then deleted; a failed
+// export stops the run before anything unexported is lost. Audit logs are
+// never deleted without an export.
+func Run(ctx context.Context, db *gorm.DB, policy Policy, now time.Time) (Result, error) {
+	result := Result{StartedAt: now}
+	batch := policy.BatchSize
+	if batch <= 0 {
+		batch = defaultBatchSize
+	}
+	db = db.WithContext(ctx)
+	var exp *exporter
+	if policy.ExportDir != "" {
+		exp = newExporter(policy.ExportDir, now)
+	}
+
+	err := func() error {
+		var err error
+		if cutoff, ok := cutoffFor(policy.JobDays, now); ok {
+			if result.Jobs, err = purgeJobs(ctx, db, exp, cutoff, batch); err != nil {
+				return err
+			}
+		}
+		if cutoff, ok := cutoffFor(policy.EventDays, now); ok {
+			if result.Events, err = purge[models.TaskJobEvent](ctx, db, exp, "task_job_events", batch, func(q *gorm.DB) *gorm.DB {
+				return q.Where("event_at < ?", cutoff)
+			}); err != nil {
+				return err
+			}
+		}
+		if cutoff, ok := cutoffFor(policy.AuditDays, now); ok && exp != nil {
+			if result.AuditLogs, err = purge[models.AuditLog](ctx, db, exp, "audit_logs", batch, func(q *gorm.DB) *gorm.DB {
+				return q.Where("created_at < ?", cutoff)
+			}); err != nil {
+				return err
+			}
+		}
+		if cutoff, ok := cutoffFor(policy.AgentLogDays, now); ok {
+			if result.AgentLogs, err = purge[models.AgentLog](ctx, db, exp, "agent_logs", batch, func(q *gorm.DB) *gorm.DB {
+				return q.Where("created_at < ?", cutoff)
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}()
+	if exp != nil {
+		result.ExportedFiles = exp.files
+	}
+	result.FinishedAt = time.Now().UTC()
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return result, err
+}
+
+func cutoffFor(days int, now time.Time) (time.Time, bool) {
+	if days <= 0 {
+		return time.Time{}, false
+	}
+	return now.AddDate(0, 0, -days), true
+}
+
+// purgeJobs removes finished jobs last updated before cutoff together with
+// their events and dependency rows, adding them to the daily stats first.
+// The export is taken from the rows locked for deletion, so that what is
+// written out is exactly what goes.
+func purgeJobs(ctx context.Context, db *gorm.DB, exp *exporter, cutoff time.Time, batch int) (int64, error) {
+	var total int64
+	for {
+		if err := ctx.Err(); err != nil {
+			return total, err
+		}
+		var jobs []models.TaskJob
+		if err := db.Where("status IN ? AND updated_at < ?", finishedStatuses, cutoff).
+			Order("id asc").Limit(batch).Find(&jobs).Error; err != nil {
+			return total, err
+		}
+		if len(jobs) == 0 {
+			return total, nil
+		}
+		ids := make([]uint, 0, len(jobs))
+		for _, job := range jobs {
+			ids = append(ids, job.ID)
+		}
+
+		var purged int64
+		err := db.Transaction(func(tx *gorm.DB) error {
+			// A job requeued since it was read is no longer finished and
+			// stays; only rows still matching are counted and deleted.
+			var locked []models.TaskJob
+			if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+				Where("id IN ? AND status IN ? AND updated_at < ?", ids, finishedStatuses, cutoff).
+				Find(&locked).Error; err != nil {
+				return err
+			}
+			if len(locked) == 0 {
+				return nil
+			}
+			lockedIDs := make([]uint, 0, len(locked))
+			for _, job := range locked {
+				lockedIDs = append(lockedIDs, job.ID)
+			}
+			events := tx.Where("job_id IN ?", lockedIDs)
+			if exp != nil {
+				var exported []models.TaskJobEvent
+				if err := tx.Where("job_id IN ?", lockedIDs).Order("id asc").Find(&exported).Error; err != nil {
+					return err
+				}
+				if err := writeExport(exp, "task_jobs", locked); err != nil {
+					return err
+				}
+				if err := writeExport(exp, "task_job_events", exported); err != nil {
+					return err
+				}
+				// Events written since the read stay for the event policy
+				// to export and remove.
+				var lastID uint
+				if len(exported) > 0 {
+					lastID = exported[len(exported)-1].ID
+				}
+				events = events.Where("id <= ?", lastID)
+			}
+			if err := rollUp(tx, locked); err != nil {
+				return err
+			}
+			if err := tx.Where("job_id IN ? OR depends_on_job_id IN ?", lockedIDs, lockedIDs).Delete(&models.TaskJobDependency{}).Error; err != nil {
+				return err
+			}
+			if err := events.Delete(&models.TaskJobEvent{}).Error; err != nil {
+				return err
+			}
+			result := tx.Where("id IN ?", lockedIDs).Delete(&models.TaskJob{})
+			purged = result.RowsAffected
+			return result.Error
+		})
+		if err != nil {
+			return total, err
+		}
+		total += purged
+		if len(jobs) < batch {
+			return total, nil
+		}
+	}
+}
+
+type statKey struct {
+	date     string
+	userID   uint
+	taskType string
+}
+
+// rollUp adds finished jobs to the stats of the Beijing day they finished on.
+func rollUp(tx *gorm.DB, jobs []models.TaskJob) error {
+	stats := make(map[statKey]*models.TaskJobDailyStat)
+	order := make([]statKey, 0)
+	now := time.Now().UTC()
+	for _, job := range jobs {
+		key := statKey{date: job.UpdatedAt.In(taskmeta.BJLoc).Format("2006-01-02"), userID: job.UserID, taskType: job.TaskType}
+		stat, ok := stats[key]
+		if !ok {
+			stat = &models.TaskJobDailyStat{Date: key.date, UserID: job.UserID, TaskType: job.TaskType, ManagerID: job.ManagerID, UpdatedAt: now}
+			stats[key] = stat
+			order = append(order, key)
+		}
+		switch job.Status {
+		case models.JobStatusSuccess:
+			stat.Succeeded++
+		case models.JobStatusFailed:
+			stat.Failed++
+		case models.JobStatusCancelled:
+			stat.Cancelled++
+		}
+		stat.Attempts += int64(job.Attempts)
+	}
+	rows := make([]models.TaskJobDailyStat, 0, len(order))
+	for _, key := range order {
+		rows = append(rows, *stats[key])
+	}
+	add := func(column string) clause.Assignment {
+		return clause.Assignment{Column: clause.Column{Name: column}, Value: gorm.Expr("task_job_daily_stats." + column + " + excluded." + column)}
+	}
+	return tx.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "date"}, {Name: "user_id"}, {Name: "task_type"}},
+		DoUpdates: clause.Set{
+			add("succeeded"), add("failed"), add("cancelled"), add("attempts"),
+			{Column: clause.Column{Name: "updated_at"}, Value: now},
+		},
+	}).Create(&rows).Error
+}
+
+// purge removes the rows of T matched by where in batches of ids.
+func purge[T any](ctx context.Context, db *gorm.DB, exp *exporter, exportName string, batch int, where func(*gorm.DB) *gorm.DB) (int64, error) {
+	var total int64
+	for {
+		if err := ctx.Err(); err != nil {
+			return total, err
+		}
+		var ids []uint
+		if err := where(db.Model(new(T))).Order("id asc").Limit(batch).Pluck("id", &ids).Error; err != nil {
+			return total, err
+		}
+		if len(ids) == 0 {
+			return total, nil
+		}
+		if exp != nil {
+			var rows []T
+			if err := db.Where("id IN ?", ids).Order("id asc").Find(&rows).Error; err != nil {
+				return total, err
+			}
+			if err := writeExport(exp, exportName, rows); err != nil {
+				return total, err
+			}
+		}
+		result := db.Where("id IN ?", ids).Delete(new(T))
+		if result.Error != nil {
+			return total, result.Error
+		}
+		total += result.RowsAffected
+		if len(ids) < batch {
+			return total, nil
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package retention
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"oas-cloud-go/internal/models"
+	"oas-cloud-go/internal/taskmeta"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+)
+
+func setupDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open("file:"+t.Name()+"?mode=memory&cache=shared"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("open sqlite failed: %v", err)
+	}
+	if err := models.AutoMigrate(db); err != nil {
+		t.Fatalf("auto migrate failed: %v", err)
+	}
+	return db
+}
+
+func createJob(t *testing.T, db *gorm.DB, userID uint, status string, updatedAt time.Time) models.TaskJob {
+	t.Helper()
+	job := models.TaskJob{
+		ManagerID:   1,
+		UserID:      userID,
+		TaskType:    "sign_in",
+		ScheduledAt: updatedAt,
+		Status:      status,
+		Attempts:    1,
+		MaxAttempts: 3,
+		CreatedAt:   updatedAt,
+		UpdatedAt:   updatedAt,
+	}
+	if err := db.Create(&job).Error; err != nil {
+		t.Fatalf("create job failed: %v", err)
+	}
+	return job
+}
+
+func countRows(t *testing.T, db *gorm.DB, model any) int64 {
+	t.Helper()
+	var n int64
+	if err := db.Model(model).Count(&n).Error; err != nil {
+		t.Fatalf("count failed: %v", err)
+	}
+	return n
+}
+
+func countExportedLines(t *testing.T, dir string) int {
+	t.Helper()
+	paths, err := filepath.Glob(filepath.Join(dir, "*.ndjson.gz"))
+	if err != nil {
+		t.Fatalf("glob failed: %v", err)
+	}
+	lines := 0
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatalf("open export failed: %v", err)
+		}
+		zr, err := gzip.NewReader(file)
+		if err != nil {
+			t.Fatalf("read gzip failed: %v", err)
+		}
+		scanner := bufio.NewScanner(zr)
+		for scanner.Scan() {
+			lines++
+		}
+		_ = file.Close()
+	}
+	return lines
+}
+
+func TestRunPurgesAndRollsUpFinishedJobs(t *testing.T) {
+	db := setupDB(t)
+	now := time.Now().UTC()
+	old := now.AddDate(0, 0, -40)
+
+	succeeded := createJob(t, db, 10, models.JobStatusSuccess, old)
+	failed := createJob(t, db, 10, models.JobStatusFailed, old)
+	stalePending := createJob(t, db, 10, models.JobStatusPending, old)
+	recent := createJob(t, db, 11, models.JobStatusSuccess, now)
+	if err := db.Create(&models.TaskJobDependency{JobID: failed.ID, DependsOnJobID: succeeded.ID, CreatedAt: old}).Error; err != nil {
+		t.Fatalf("create dependency failed: %v", err)
+	}
+	events := []models.TaskJobEvent{
+		{JobID: succeeded.ID, EventType: "success", EventAt: old},
+		{JobID: recent.ID, EventType: "leased", EventAt: old},
+		{JobID: recent.ID, EventType: "success", EventAt: now},
+	}
+	if err := db.Create(&events).Error; err != nil {
+		t.Fatalf("create events failed: %v", err)
+	}
+	logs := []models.AuditLog{
+		{ActorType: models.ActorTypeManager, ActorID: 1, Action: "old", TargetType: "user", CreatedAt: now.AddDate(0, 0, -200)},
+		{ActorType: models.ActorTypeManager, ActorID: 1, Action: "new", TargetType: "user", CreatedAt: now},
+		{ActorType: models.ActorTypeAgent, ActorID: 1, Action: "agent_command_result", TargetType: "agent_command", CreatedAt: now.AddDate(0, 0, -20)},
+	}
+	if err := db.Create(&logs).Error; err != nil {
+		t.Fatalf("create audit logs failed: %v", err)
+	}
+	agentLogs := []models.AgentLog{
+		{ManagerID: 1, UserID: 10, Message: "old", LoggedAt: now.AddDate(0, 0, -20), CreatedAt: now.AddDate(0, 0, -20)},
+		{ManagerID: 1, UserID: 10, Message: "new", LoggedAt: now, CreatedAt: now},
+	}
+	if err := db.Create(&agentLogs).Error; err != nil {
+		t.Fatalf("create agent logs failed: %v", err)
+	}
+
+	exportDir := t.TempDir()
+	policy := Policy{JobDays: 30, EventDays: 30, AuditDays: 180, AgentLogDays: 14, ExportDir: exportDir, BatchSize: 1}
+	result, err := Run(context.Background(), db, policy, now)
+	if err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+	if result.Jobs != 2 || result.Events != 1 || result.AuditLogs != 1 || result.AgentLogs != 1 {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+
+	var kept []uint
+	db.Model(&models.TaskJob{}).Order("id asc").Pluck("id", &kept)
+	if len(kept) != 2 || kept[0] != stalePending.ID || kept[1] != recent.ID {
+		t.Fatalf("unfinished and recent jobs should stay, got %v", kept)
+	}
+	if n := countRows(t, db, &models.TaskJobEvent{}); n != 1 {
+		t.Fatalf("only the recent event should stay, got %d", n)
+	}
+	if n := countRows(t, db, &models.TaskJobDependency{}); n != 0 {
+		t.Fatalf("dependencies of purged jobs should go, got %d", n)
+	}
+	var actions []string
+	db.Model(&models.AuditLog{}).Order("id asc").Pluck("action", &actions)
+	if len(actions) != 2 || actions[0] != "new" || actions[1] != "agent_command_result" {
+		t.Fatalf("unexpected audit logs left: %v", actions)
+	}
+	var messages []string
+	db.Model(&models.AgentLog{}).Pluck("message", &messages)
+	if len(messages) != 1 || messages[0] != "new" {
+		t.Fatalf("unexpected agent logs left: %v", messages)
+	}
+
+	var stats []models.TaskJobDailyStat
+	db.Find(&stats)
+	if len(stats) != 1 {
+		t.Fatalf("expected one rollup row, got %d", len(stats))
+	}
+	stat := stats[0]
+	if stat.Date != old.In(taskmeta.BJLoc).Format("2006-01-02") || stat.UserID != 10 || stat.ManagerID != 1 ||
+		stat.Succeeded != 1 || stat.Failed != 1 || stat.Attempts != 2 {
+		t.Fatalf("unexpected rollup: %+v", stat)
+	}
+
+	if got := countExportedLines(t, filepath.Join(exportDir, "task_jobs")); got != 2 {
+		t.Fatalf("expected 2 exported jobs, got %d", got)
+	}
+	if got := countExportedLines(t, filepath.Join(exportDir, "task_job_events")); got != 2 {
+		t.Fatalf("expected 2 exported events, got %d", got)
+	}
+	if got := countExportedLines(t, filepath.Join(exportDir, "agent_logs")); got != 1 {
+		t.Fatalf("expected 1 exported agent log, got %d", got)
+	}
+
+	// A later run adds to the same day instead of overwriting it.
+	createJob(t, db, 10, models.JobStatusSuccess, old)
+	if _, err := Run(context.Background(), db, Policy{JobDays: 30}, now); err != nil {
+		t.Fatalf("second run failed: %v", err)
+	}
+	db.Find(&stats)
+	if len(stats) != 1 || stats[0].Succeeded != 2 || stats[0].Attempts != 3 {
+		t.Fatalf("second run should accumulate, got %+v", stats)
+	}
+}
+
+func TestRunWithZeroDaysKeepsEverything(t *testing.T) {
+	db := setupDB(t)
+	now := time.Now().UTC()
+	createJob(t, db, 10, models.JobStatusSuccess, now.AddDate(-1, 0, 0))
+
+	result, err := Run(context.Background(), db, Policy{}, now)
+	if err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+	if result.Jobs != 0 || countRows(t, db, &models.TaskJob{}) != 1 {
+		t.Fatalf("a zero policy should keep rows, got %+v", result)
+	}
+}
+
+func TestRunKeepsAuditLogsWithoutExport(t *testing.T) {
+	db := setupDB(t)
+	now := time.Now().UTC()
+	if err := db.Create(&models.AuditLog{ActorType: models.ActorTypeManager, ActorID: 1, Action: "old", TargetType: "user", CreatedAt: now.AddDate(0, 0, -400)}).Error; err != nil {
+		t.Fatalf("create audit log failed: %v", err)
+	}
+
+	result, err := Run(context.Background(), db, Policy{AuditDays: 180}, now)
+	if err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+	if result.AuditLogs != 0 || countRows(t, db, &models.AuditLog{}) != 1 {
+		t.Fatalf("audit logs should not be purged without an export dir, got %+v", result)
+	}
+}
@@ -0,0 +1,169 @@
+package scheduler
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"oas-cloud-go/internal/models"
+	"oas-cloud-go/internal/taskmeta"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// dueRecheckDelay is how long a due task that could not be enqueued for a
+	// reason outside its config (no 对弈竞猜 answer yet, schedule slot taken)
+	// waits before the scheduler looks at it again.
+	dueRecheckDelay = time.Minute
+
+	// dueIndexRebuildInterval bounds how long the index may drift from the
+	// task configs, e.g. after a config was written without a sync.
+	dueIndexRebuildInterval = time.Hour
+)
+
+// TaskDueAt returns when a task is due by its config, the way evaluateDue
+// reads it: next_time HH:MM at that time of the current Beijing day, a
+// datetime at that time and a task without next_time right away. Disabled
+// tasks and tasks with an unparsable next_time (except 放卡) are never due.
+func TaskDueAt(taskType string, taskMap map[string]any, now time.Time) (time.Time, bool) {
+	if enabled, _ := taskMap["enabled"].(bool); !enabled {
+		return time.Time{}, false
+	}
+	nextRaw, _ := taskMap["next_time"].(string)
+	nextRaw = strings.TrimSpace(nextRaw)
+	if nextRaw == "" {
+		return now, true
+	}
+	if hhmm, ok := parseHHMM(nextRaw); ok {
+		bjNow := now.In(taskmeta.BJLoc)
+		return time.Date(bjNow.Year(), bjNow.Month(), bjNow.Day(), hhmm.hour, hhmm.minute, 0, 0, taskmeta.BJLoc).UTC(), true
+	}
+	if parsed := parseDateTime(nextRaw); !parsed.IsZero() {
+		return parsed.UTC(), true
+	}
+	if taskType == "放卡" {
+		return now, true
+	}
+	return time.Time{}, false
+}
+
+// SyncDueIndex rewrites the due index of a user from its whole task config,
+// normalized for the user's type. Call it in the transaction that writes the
+// config.
+func SyncDueIndex(db *gorm.DB, userID uint, taskConfig map[string]any, now time.Time) error {
+	return syncDueIndex(db, userID, taskConfig, nil, nil, now)
+}
+
+// SyncDueEntries rewrites the due index of the given tasks only, for writes
+// that change a few tasks of a config such as a new next_time.
+func SyncDueEntries(db *gorm.DB, userID uint, taskConfig map[string]any, taskTypes []string, now time.Time) error {
+	if len(taskTypes) == 0 {
+		return nil
+	}
+	return syncDueIndex(db, userID, taskConfig, taskTypes, nil, now)
+}
+
+// syncDueIndex writes the index rows of taskTypes, or of the whole config
+// when taskTypes is nil. notBefore holds the earliest time a task may be
+// looked at again, overriding an earlier due time from the config.
+func syncDueIndex(db *gorm.DB, userID uint, taskConfig map[string]any, taskTypes []string, notBefore map[string]time.Time, now time.Time) error {
+	whole := taskTypes == nil
+	if whole {
+		taskTypes = make([]string, 0, len(taskConfig))
+		for taskType := range taskConfig {
+			taskTypes = append(taskTypes, taskType)
+		}
+	}
+	// A stable order keeps concurrent upserts of one user from deadlocking.
+	sort.Strings(taskTypes)
+
+	rows := make([]models.UserTaskSchedule, 0, len(taskTypes))
+	keep := make([]string, 0, len(taskTypes))
+	drop := make([]string, 0)
+	for _, taskType := range taskTypes {
+		taskMap, _ := taskConfig[taskType].(map[string]any)
+		dueAt, ok := TaskDueAt(taskType, taskMap, now)
+		if !ok {
+			drop = append(drop, taskType)
+			continue
+		}
+		if at, deferred := notBefore[taskType]; deferred && at.After(dueAt) {
+			dueAt = at
+		}
+		rows = append(rows, models.UserTaskSchedule{UserID: userID, TaskType: taskType, NextDueAt: dueAt, UpdatedAt: now})
+		keep = append(keep, taskType)
+	}
+
+	stale := db.Where("user_id = ?", userID)
+	switch {
+	case whole && len(keep) > 0:
+		stale = stale.Where("task_type NOT IN ?", keep)
+	case !whole && len(drop) > 0:
+		stale = stale.Where("task_type IN ?", drop)
+	case !whole:
+		stale = nil
+	}
+	if stale != nil {
+		if err := stale.Delete(&models.UserTaskSchedule{}).Error; err != nil {
+			return err
+		}
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+	return db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}, {Name: "task_type"}},
+		DoUpdates: clause.AssignmentColumns([]string{"next_due_at", "updated_at"}),
+	}).Create(&rows).Error
+}
+
+// deferDueIndex pushes the due tasks of a user back to until, e.g. to the
+// end of the user's rest.
+func deferDueIndex(db *gorm.DB, userID uint, until time.Time, now time.Time) error {
+	return db.Model(&models.UserTaskSchedule{}).
+		Where("user_id = ? AND next_due_at < ?", userID, until).
+		Updates(map[string]any{"next_due_at": until, "updated_at": now}).Error
+}
+
+// RebuildDueIndex resyncs the due index from the stored task configs, which
+// also drops deferrals such as the wait for the end of a rest. scopes narrow
+// the user_task_configs query; without them every user is synced and rows of
+// users without a config are dropped. It returns the number of users synced.
+func RebuildDueIndex(db *gorm.DB, now time.Time, scopes ...func(*gorm.DB) *gorm.DB) (int, error) {
+	synced := 0
+	var configs []models.UserTaskConfig
+	result := db.Scopes(scopes...).Select("id, user_id, task_config").FindInBatches(&configs, 200, func(tx *gorm.DB, batch int) error {
+		userIDs := make([]uint, 0, len(configs))
+		for _, cfg := range configs {
+			userIDs = append(userIDs, cfg.UserID)
+		}
+		var users []models.User
+		if err := db.Select("id, user_type").Where("id IN ?", userIDs).Find(&users).Error; err != nil {
+			return err
+		}
+		userTypes := make(map[uint]string, len(users))
+		for _, user := range users {
+			userTypes[user.ID] = user.UserType
+		}
+		for _, cfg := range configs {
+			userType, ok := userTypes[cfg.UserID]
+			if !ok {
+				continue
+			}
+			taskConfig := taskmeta.NormalizeTaskConfigByType(map[string]any(cfg.TaskConfig), userType)
+			if err := SyncDueIndex(db, cfg.UserID, taskConfig, now); err != nil {
+				return err
+			}
+			synced++
+		}
+		return nil
+	})
+	if result.Error != nil || len(scopes) > 0 {
+		return synced, result.Error
+	}
+	err := db.Where("user_id NOT IN (?)", db.Model(&models.UserTaskConfig{}).Select("user_id")).
+		Delete(&models.UserTaskSchedule{}).Error
+	return synced, err
+}
@@ -0,0 +1,109 @@
+package scheduler
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"oas-cloud-go/internal/models"
+	"oas-cloud-go/internal/taskmeta"
+
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+)
+
+func TestTaskDueAt(t *testing.T) {
+	now := time.Date(2026, 2, 27, 2, 0, 0, 0, time.UTC) // 10:00 Beijing
+	cases := []struct {
+		name     string
+		taskType string
+		task     map[string]any
+		want     time.Time
+		ok       bool
+	}{
+		{"disabled", "悬赏", map[string]any{"enabled": false}, time.Time{}, false},
+		{"no next_time", "悬赏", map[string]any{"enabled": true}, now, true},
+		{"daily", "悬赏", map[string]any{"enabled": true, "next_time": "08:30"}, time.Date(2026, 2, 27, 0, 30, 0, 0, time.UTC), true},
+		{"datetime", "悬赏", map[string]any{"enabled": true, "next_time": "2026-02-28 09:00"}, time.Date(2026, 2, 28, 1, 0, 0, 0, time.UTC), true},
+		{"invalid", "寄养", map[string]any{"enabled": true, "next_time": "2026/02/27 09:00"}, time.Time{}, false},
+		{"invalid 放卡", "放卡", map[string]any{"enabled": true, "next_time": "2026/02/27 09:00"}, now, true},
+	}
+	for _, tc := range cases {
+		got, ok := TaskDueAt(tc.taskType, tc.task, now)
+		if ok != tc.ok || !got.Equal(tc.want) {
+			t.Fatalf("%s: got %s %v, want %s %v", tc.name, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func loadUserSchedules(t *testing.T, db *gorm.DB, userID uint) map[string]time.Time {
+	t.Helper()
+	var rows []models.UserTaskSchedule
+	if err := db.Where("user_id = ?", userID).Find(&rows).Error; err != nil {
+		t.Fatalf("load schedules failed: %v", err)
+	}
+	result := make(map[string]time.Time, len(rows))
+	for _, row := range rows {
+		result[row.TaskType] = row.NextDueAt
+	}
+	return result
+}
+
+func TestRunOnce_PicksUsersFromDueIndex(t *testing.T) {
+	g, db := setupGeneratorTest(t)
+
+	seed := func(nextTime string) (models.User, map[string]any) {
+		taskConfig := taskmeta.BuildDefaultTaskConfigByType(models.UserTypeFoster)
+		disableAllTasksExcept(taskConfig, "放卡")
+		taskConfig["放卡"].(map[string]any)["next_time"] = nextTime
+		user, _ := seedUserAndConfig(t, db, models.UserTypeFoster, taskConfig)
+		return user, taskConfig
+	}
+	later := time.Now().Add(2 * time.Hour).In(taskmeta.BJLoc).Truncate(time.Minute)
+	due, _ := seed("2026-01-01 08:00")
+	notDue, _ := seed(later.Format("2006-01-02 15:04"))
+	resting, _ := seed("2026-01-01 08:00")
+	if err := db.Model(&models.User{}).Where("id = ?", resting.ID).
+		Update("rest_config", datatypes.JSONMap{"enabled": true, "days_off": []any{0, 1, 2, 3, 4, 5, 6}}).Error; err != nil {
+		t.Fatalf("update rest config failed: %v", err)
+	}
+
+	// The first round builds the index from the stored configs.
+	g.runOnce(context.Background())
+	if count := countPendingJobs(t, db, due.ID, "放卡"); count != 1 {
+		t.Fatalf("due user should get 1 job, got %d", count)
+	}
+	if ready := g.store.(*schedulerStoreStub).ready; len(ready) != 1 || ready[0] != due.ManagerID {
+		t.Fatalf("waiting agents of the manager should be woken once, got %v", ready)
+	}
+	if count := countPendingJobs(t, db, notDue.ID, "放卡"); count != 0 {
+		t.Fatalf("user with a later next_time should get no job, got %d", count)
+	}
+	if got := loadUserSchedules(t, db, notDue.ID); len(got) != 1 || !got["放卡"].Equal(later.UTC()) {
+		t.Fatalf("index should hold the configured next_time %s: %v", later.UTC(), got)
+	}
+	if got := loadUserSchedules(t, db, resting.ID); !got["放卡"].After(time.Now()) {
+		t.Fatalf("resting user's task should wait for the end of the rest: %v", got)
+	}
+	if g.Snapshot().LastIndexRebuild.IsZero() {
+		t.Fatalf("expected the rebuild in stats")
+	}
+
+	// Later rounds read the index only: a config written without a sync is
+	// not seen until the index is updated.
+	unsynced, taskConfig := seed("2026-01-01 08:00")
+	g.runOnce(context.Background())
+	if count := countPendingJobs(t, db, unsynced.ID, "放卡"); count != 0 {
+		t.Fatalf("user missing from the index should not be scanned, got %d jobs", count)
+	}
+	if err := SyncDueIndex(db, unsynced.ID, taskConfig, time.Now().UTC()); err != nil {
+		t.Fatalf("sync due index failed: %v", err)
+	}
+	g.runOnce(context.Background())
+	if count := countPendingJobs(t, db, unsynced.ID, "放卡"); count != 1 {
+		t.Fatalf("synced user should get 1 job, got %d", count)
+	}
+	if count := countPendingJobs(t, db, due.ID, "放卡"); count != 1 {
+		t.Fatalf("a task with an active job should not get another, got %d", count)
+	}
+}
@@ -2,6 +2,7 @@ package scheduler
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"log/slog"
 	"reflect"
@@ -13,11 +14,16 @@ import (
 
 	"oas-cloud-go/internal/cache"
 	"oas-cloud-go/internal/config"
+	"oas-cloud-go/internal/metrics"
 	"oas-cloud-go/internal/models"
 	"oas-cloud-go/internal/taskmeta"
+	"oas-cloud-go/internal/tracing"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 	"gorm.io/datatypes"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type Stats struct {
@@ -25,13 +31,24 @@ type Stats struct {
 	LastRunAt        time.Time `json:"last_run_at"`
 	LastGenerated    int       `json:"last_generated"`
 	LastScannedUsers int       `json:"last_scanned_users"`
+	LastRestingUsers int       `json:"last_resting_users"`
 	LastError        string    `json:"last_error"`
+	// LastIndexRebuild is when the due index was last resynced from all
+	// task configs.
+	LastIndexRebuild time.Time `json:"last_index_rebuild"`
 }
 
 type Generator struct {
 	cfg   config.Config
 	db    *gorm.DB
 	store cache.Store
+	rest  RestConfig // global fallback rest window
+
+	elector *Elector // nil runs on every replica
+
+	onJobFailed FailedJobHandler // nil leaves timed-out jobs without follow-up
+
+	indexRebuiltAt time.Time // touched by the loop goroutine only
 
 	running atomic.Bool
 	stopCh  chan struct{}
@@ -46,11 +63,24 @@ func NewGenerator(cfg config.Config, db *gorm.DB, store cache.Store) *Generator
 		cfg:    cfg,
 		db:     db,
 		store:  store,
+		rest:   GlobalRestConfig(cfg.DefaultRestWindow),
 		stopCh: make(chan struct{}),
 		doneCh: make(chan struct{}),
 	}
 }
 
+// UseElector makes the generator run only while this replica leads the
+// election. Call it before Start.
+func (g *Generator) UseElector(elector *Elector) {
+	g.elector = elector
+}
+
+// HandleFailedJobs sets what runs for a job that an expired lease failed for
+// good. Call it before Start.
+func (g *Generator) HandleFailedJobs(handler FailedJobHandler) {
+	g.onJobFailed = handler
+}
+
 func (g *Generator) Start() {
 	if !g.cfg.SchedulerEnabled {
 		return
@@ -86,70 +116,142 @@ func (g *Generator) loop() {
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
-	g.runOnce(context.Background())
+	g.runAsLeader()
 	for {
 		select {
 		case <-ticker.C:
-			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-			g.runOnce(ctx)
-			cancel()
+			g.runAsLeader()
 		case <-g.stopCh:
 			return
 		}
 	}
 }
 
+// runAsLeader runs one round unless another replica leads. The round is
+// cancelled if leadership is lost half way.
+func (g *Generator) runAsLeader() {
+	parent := context.Background()
+	if g.elector != nil {
+		parent = g.elector.Context()
+	}
+	ctx, cancel := context.WithTimeout(parent, 30*time.Second)
+	defer cancel()
+	if g.elector != nil && !g.elector.Confirm(ctx) {
+		return
+	}
+	start := time.Now()
+	ctx, span := tracing.Start(ctx, "scheduler.run")
+	g.runOnce(ctx)
+	stats := g.Snapshot()
+	result := "ok"
+	if stats.LastError != "" {
+		result = "error"
+		span.SetStatus(codes.Error, stats.LastError)
+	}
+	span.SetAttributes(
+		attribute.Int("scheduler.due_users", stats.LastScannedUsers),
+		attribute.Int("scheduler.generated", stats.LastGenerated),
+	)
+	span.End()
+	metrics.SchedulerRuns.WithLabelValues(result).Inc()
+	metrics.SchedulerRunDuration.Observe(time.Since(start).Seconds())
+	metrics.SchedulerDueUsers.Set(float64(stats.LastScannedUsers))
+}
+
 func (g *Generator) runOnce(ctx context.Context) {
+	db := g.db.WithContext(ctx)
 	now := time.Now().UTC()
 	generated := 0
 	scanned := 0
 	var runErr error
 
 	// Expire stale 对弈竞猜 pending jobs whose window has passed (runs even during rest window)
-	if expired, err := g.expireStaleDuiyiJobs(now); err != nil {
+	if expired, err := g.expireStaleDuiyiJobs(ctx, now); err != nil {
 		slog.Warn("expire stale duiyi jobs failed", "error", err)
 	} else if expired > 0 {
 		slog.Info("expired stale duiyi jobs", "count", expired)
 	}
 
 	// Reset expired job leases (leased/running jobs whose lease has timed out)
-	if reset, err := g.resetAllExpiredJobLeases(now); err != nil {
+	if requeued, failed, err := g.resetAllExpiredJobLeases(ctx, now); err != nil {
 		slog.Warn("reset expired job leases failed", "error", err)
-	} else if reset > 0 {
-		slog.Info("reset expired job leases", "count", reset)
+	} else if requeued > 0 || failed > 0 {
+		slog.Info("reset expired job leases", "requeued", requeued, "failed", failed)
 	}
 
-	// Rest window: skip generation during Beijing time 00:00–05:59
-	bjLoc := time.FixedZone("Asia/Shanghai", 8*60*60)
-	bjHour := now.In(bjLoc).Hour()
-	if bjHour >= 0 && bjHour < 6 {
-		g.updateStats(now, 0, 0, nil)
-		return
+	// Fail pending jobs whose prerequisite ended without success; they would
+	// otherwise wait forever.
+	if failed, err := g.failJobsWithFailedDependencies(ctx, now); err != nil {
+		slog.Warn("fail jobs with failed dependencies failed", "error", err)
+	} else if failed > 0 {
+		slog.Info("failed jobs with failed dependencies", "count", failed)
 	}
 
-	users := make([]models.User, 0, g.cfg.SchedulerScanLimit)
-	query := g.db.Where("status = ? AND expires_at IS NOT NULL AND expires_at > ?", models.UserStatusActive, now).Order("id asc")
-	if g.cfg.SchedulerScanLimit > 0 {
-		query = query.Limit(g.cfg.SchedulerScanLimit)
+	if now.Sub(g.indexRebuiltAt) >= dueIndexRebuildInterval {
+		if synced, err := RebuildDueIndex(db, now); err != nil {
+			slog.Warn("rebuild due index failed", "error", err)
+		} else {
+			g.indexRebuiltAt = now
+			g.statsMu.Lock()
+			g.stats.LastIndexRebuild = now
+			g.statsMu.Unlock()
+			slog.Info("rebuilt due index", "users", synced)
+		}
 	}
-	if err := query.Find(&users).Error; err != nil {
+
+	bjLoc := time.FixedZone("Asia/Shanghai", 8*60*60)
+
+	// Only users with a due task are loaded; the index says which.
+	dueIDs, err := g.dueUserIDs(ctx, now)
+	if err != nil {
 		runErr = err
 		g.updateStats(now, generated, scanned, runErr)
 		return
 	}
+	users := make([]models.User, 0, len(dueIDs))
+	if len(dueIDs) > 0 {
+		if err := db.Where("id IN ?", dueIDs).Order("id asc").Find(&users).Error; err != nil {
+			runErr = err
+			g.updateStats(now, generated, scanned, runErr)
+			return
+		}
+	}
 	scanned = len(users)
 	if scanned == 0 {
 		g.updateStats(now, generated, scanned, nil)
 		return
 	}
 
+	// Rest: users resting right now (own config, manager default or the
+	// global window) get no new jobs this round. Their due tasks wait in
+	// the index until the rest ends.
+	restPolicies, err := g.loadRestPolicies(ctx, users)
+	if err != nil {
+		runErr = err
+		g.updateStats(now, generated, scanned, runErr)
+		return
+	}
+	awake := make([]models.User, 0, len(users))
+	for _, user := range users {
+		state := restPolicies[user.ID].StateAt(user.ID, now)
+		if !state.Resting {
+			awake = append(awake, user)
+			continue
+		}
+		if err := deferDueIndex(db, user.ID, state.Until, now); err != nil {
+			slog.Warn("defer due index failed", "user_id", user.ID, "error", err)
+		}
+	}
+	resting := len(users) - len(awake)
+	users = awake
+
 	// Batch preload: user task configs (replaces N individual SELECT queries)
 	userIDs := make([]uint, len(users))
 	for i, u := range users {
 		userIDs[i] = u.ID
 	}
 	var configs []models.UserTaskConfig
-	if err := g.db.Where("user_id IN ?", userIDs).Find(&configs).Error; err != nil {
+	if err := db.Where("user_id IN ?", userIDs).Find(&configs).Error; err != nil {
 		runErr = err
 		g.updateStats(now, generated, scanned, runErr)
 		return
@@ -167,7 +269,7 @@ func (g *Generator) runOnce(ctx context.Context) {
 	}
 	var jobCounts []jobCountRow
 	activeStatuses := []string{models.JobStatusPending, models.JobStatusLeased, models.JobStatusRunning}
-	if err := g.db.Model(&models.TaskJob{}).
+	if err := db.Model(&models.TaskJob{}).
 		Select("user_id, task_type, COUNT(*) as cnt").
 		Where("user_id IN ? AND status IN ?", userIDs, activeStatuses).
 		Group("user_id, task_type").
@@ -197,7 +299,7 @@ func (g *Generator) runOnce(ctx context.Context) {
 	var duiyiConfigs []models.DuiyiAnswerConfig
 	todayBJ := now.In(bjLoc).Format("2006-01-02")
 	if len(managerIDs) > 0 {
-		if err := g.db.Where("manager_id IN ? AND date = ?", managerIDs, todayBJ).
+		if err := db.Where("manager_id IN ? AND date = ?", managerIDs, todayBJ).
 			Find(&duiyiConfigs).Error; err != nil {
 			runErr = err
 			g.updateStats(now, generated, scanned, runErr)
@@ -223,7 +325,7 @@ func (g *Generator) runOnce(ctx context.Context) {
 			bloggerIDs = append(bloggerIDs, bid)
 		}
 		var bloggerConfigs []models.BloggerAnswerConfig
-		if err := g.db.Where("blogger_id IN ? AND date = ?", bloggerIDs, todayBJ).
+		if err := db.Where("blogger_id IN ? AND date = ?", bloggerIDs, todayBJ).
 			Find(&bloggerConfigs).Error; err != nil {
 			slog.Warn("preload blogger answer configs failed", "error", err)
 		} else {
@@ -250,6 +352,7 @@ func (g *Generator) runOnce(ctx context.Context) {
 	sem := make(chan struct{}, workers)
 	var wg sync.WaitGroup
 	var mu sync.Mutex
+	woken := make(map[uint]struct{})
 
 	for _, user := range users {
 		cfg, hasCfg := configMap[user.ID]
@@ -268,10 +371,16 @@ func (g *Generator) runOnce(ctx context.Context) {
 				runErr = err
 			}
 			generated += userGenerated
+			if userGenerated > 0 {
+				woken[u.ManagerID] = struct{}{}
+			}
 			mu.Unlock()
 		}(user, cfg, userJobCounts, userDuiyiAnswers[user.ID])
 	}
 	wg.Wait()
+	for managerID := range woken {
+		g.wakeAgents(ctx, managerID)
+	}
 
 	// Generate team yuhun tasks from accepted requests
 	teamGenerated, teamErr := g.generateTeamYuhunJobs(ctx, now)
@@ -283,20 +392,35 @@ func (g *Generator) runOnce(ctx context.Context) {
 	}
 	generated += teamGenerated
 
-	g.updateStats(now, generated, scanned, runErr)
+	g.updateStatsWithRest(now, generated, scanned, resting, runErr)
+}
+
+// wakeAgents tells the agents of a manager that wait in a long poll that new
+// jobs are pending.
+func (g *Generator) wakeAgents(ctx context.Context, managerID uint) {
+	if err := g.store.PublishJobsReady(ctx, managerID); err != nil {
+		slog.Warn("publish jobs ready failed", "manager_id", managerID, "error", err)
+	}
 }
 
 func (g *Generator) processUser(ctx context.Context, user models.User, cfg models.UserTaskConfig, activeJobCounts map[string]int64, duiyiAnswers map[string]any, now time.Time) (int, error) {
+	db := g.db.WithContext(ctx)
 	storedTaskConfig := map[string]any(cfg.TaskConfig)
 	if storedTaskConfig == nil {
 		return 0, nil
 	}
 	taskConfig := taskmeta.NormalizeTaskConfigByType(storedTaskConfig, user.UserType)
+	// Due tasks held back for a reason outside their config are looked at
+	// again at these times.
+	notBefore := make(map[string]time.Time)
 
 	generated := 0
 	changed := !jsonMapEqual(storedTaskConfig, taskConfig)
-	for taskType, rawTaskCfg := range taskConfig {
-		taskMap, ok := rawTaskCfg.(map[string]any)
+	// Prerequisites come first so that a dependent task created in the same
+	// round can wait for the job just created for its depends_on tasks.
+	createdJobs := make(map[string]uint)
+	for _, taskType := range taskmeta.OrderTasksByDependencies(taskConfig) {
+		taskMap, ok := taskConfig[taskType].(map[string]any)
 		if !ok {
 			continue
 		}
@@ -307,13 +431,15 @@ func (g *Generator) processUser(ctx context.Context, user models.User, cfg model
 
 		// 对弈竞猜: skip if no answer configured for current window
 		if taskType == "对弈竞猜" {
-			bjHour := now.In(time.FixedZone("Asia/Shanghai", 8*60*60)).Hour()
-			window := currentDuiyiWindow(bjHour)
+			bjNow := now.In(time.FixedZone("Asia/Shanghai", 8*60*60))
+			window := currentDuiyiWindow(bjNow.Hour())
 			if window == "" {
+				notBefore[taskType] = time.Date(bjNow.Year(), bjNow.Month(), bjNow.Day(), 10, 0, 0, 0, bjNow.Location()).UTC()
 				continue
 			}
 			ans, _ := duiyiAnswers[window].(string)
 			if ans != "左" && ans != "右" {
+				notBefore[taskType] = now.Add(dueRecheckDelay)
 				continue
 			}
 		}
@@ -349,15 +475,22 @@ func (g *Generator) processUser(ctx context.Context, user models.User, cfg model
 			if err != nil {
 				return generated, err
 			}
+			notBefore[taskType] = now.Add(dueRecheckDelay)
 			continue
 		}
 
-		created, err := g.createJobIfNeeded(user, taskType, taskMap, nextTime, activeJobCounts, duiyiAnswers, now)
+		dependsOn, err := g.prerequisiteJobIDs(ctx, user.ID, taskmeta.TaskDependencies(taskMap), activeJobCounts, createdJobs)
+		if err != nil {
+			return generated, err
+		}
+		jobID, err := g.createJobIfNeeded(ctx, user, taskType, taskMap, nextTime, activeJobCounts, duiyiAnswers, dependsOn, now)
 		if err != nil {
 			return generated, err
 		}
-		if created {
+		if jobID != 0 {
+			createdJobs[taskType] = jobID
 			generated += 1
+			metrics.JobsGenerated.WithLabelValues(taskType).Inc()
 			if !nextTime.IsZero() {
 				taskMap["next_time"] = nextTime.In(taskmeta.BJLoc).Format("2006-01-02 15:04")
 				taskConfig[taskType] = taskMap
@@ -367,7 +500,7 @@ func (g *Generator) processUser(ctx context.Context, user models.User, cfg model
 	}
 
 	if changed {
-		if err := g.db.Model(&models.UserTaskConfig{}).
+		if err := db.Model(&models.UserTaskConfig{}).
 			Where("id = ?", cfg.ID).
 			Updates(map[string]any{
 				"task_config": datatypes.JSONMap(taskConfig),
@@ -377,20 +510,100 @@ func (g *Generator) processUser(ctx context.Context, user models.User, cfg model
 			return generated, err
 		}
 	}
+	if err := syncDueIndex(db, user.ID, taskConfig, nil, notBefore, now); err != nil {
+		return generated, err
+	}
 
 	return generated, nil
 }
 
+// dueUserIDs returns the active users with a due task that has no pending,
+// leased or running job, longest waiting first, at most SchedulerScanLimit.
+func (g *Generator) dueUserIDs(ctx context.Context, now time.Time) ([]uint, error) {
+	db := g.db.WithContext(ctx)
+	query := db.Table("user_task_schedules AS s").
+		Joins("JOIN users u ON u.id = s.user_id").
+		Where("s.next_due_at <= ? AND u.status = ? AND u.expires_at IS NOT NULL AND u.expires_at > ?", now, models.UserStatusActive, now).
+		Where("NOT EXISTS (SELECT 1 FROM task_jobs j WHERE j.user_id = s.user_id AND j.task_type = s.task_type AND j.status IN ?)",
+			[]string{models.JobStatusPending, models.JobStatusLeased, models.JobStatusRunning}).
+		Group("s.user_id").
+		Order("MIN(s.next_due_at) asc")
+	if g.cfg.SchedulerScanLimit > 0 {
+		query = query.Limit(g.cfg.SchedulerScanLimit)
+	}
+	var ids []uint
+	if err := query.Pluck("s.user_id", &ids).Error; err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
 func jsonMapEqual(left map[string]any, right map[string]any) bool {
 	return reflect.DeepEqual(left, right)
 }
 
-func (g *Generator) createJobIfNeeded(user models.User, taskType string, taskMap map[string]any, nextTime time.Time, activeJobCounts map[string]int64, duiyiAnswers map[string]any, now time.Time) (bool, error) {
+// prerequisiteJobIDs resolves the depends_on tasks of a user to the jobs of
+// the current cycle: the job created for the task in this round, or else the
+// task's job that is still pending, leased or running. A task without such a
+// job has nothing to wait for.
+func (g *Generator) prerequisiteJobIDs(ctx context.Context, userID uint, deps []string, activeJobCounts map[string]int64, createdJobs map[string]uint) ([]uint, error) {
+	db := g.db.WithContext(ctx)
+	ids := make([]uint, 0, len(deps))
+	waiting := make([]string, 0, len(deps))
+	for _, dep := range deps {
+		if jobID, ok := createdJobs[dep]; ok {
+			ids = append(ids, jobID)
+			continue
+		}
+		if activeJobCounts[dep] > 0 {
+			waiting = append(waiting, dep)
+		}
+	}
+	if len(waiting) == 0 {
+		return ids, nil
+	}
+	var activeIDs []uint
+	if err := db.Model(&models.TaskJob{}).
+		Where("user_id = ? AND task_type IN ? AND status IN ?", userID, waiting,
+			[]string{models.JobStatusPending, models.JobStatusLeased, models.JobStatusRunning}).
+		Pluck("id", &activeIDs).Error; err != nil {
+		return nil, err
+	}
+	return append(ids, activeIDs...), nil
+}
+
+// createJobIfNeeded creates a pending job and its dependency rows, returning
+// the new job ID, or 0 when the task already has an active job.
+func (g *Generator) createJobIfNeeded(ctx context.Context, user models.User, taskType string, taskMap map[string]any, nextTime time.Time, activeJobCounts map[string]int64, duiyiAnswers map[string]any, dependsOn []uint, now time.Time) (uint, error) {
+	db := g.db.WithContext(ctx)
 	// Use preloaded active job counts instead of individual COUNT query
 	if activeJobCounts != nil && activeJobCounts[taskType] > 0 {
-		return false, nil
+		return 0, nil
 	}
 
+	job := NewTaskJob(user, taskType, taskMap, duiyiAnswers, now)
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&job).Error; err != nil {
+			return err
+		}
+		if len(dependsOn) == 0 {
+			return nil
+		}
+		deps := make([]models.TaskJobDependency, 0, len(dependsOn))
+		for _, prerequisite := range dependsOn {
+			deps = append(deps, models.TaskJobDependency{JobID: job.ID, DependsOnJobID: prerequisite, CreatedAt: now})
+		}
+		return tx.Create(&deps).Error
+	})
+	if err != nil {
+		return 0, err
+	}
+	return job.ID, nil
+}
+
+// NewTaskJob builds a pending job of a user's task from its task config, the
+// way the scheduler enqueues it. duiyiAnswers may be nil.
+func NewTaskJob(user models.User, taskType string, taskMap map[string]any, duiyiAnswers map[string]any, now time.Time) models.TaskJob {
 	priority := toInt(taskMap["priority"], 50)
 	payload := map[string]any{
 		"user_id": user.ID,
@@ -412,22 +625,19 @@ func (g *Generator) createJobIfNeeded(user models.User, taskType string, taskMap
 		}
 	}
 
-	job := models.TaskJob{
-		ManagerID:   user.ManagerID,
-		UserID:      user.ID,
-		TaskType:    taskType,
-		Payload:     datatypes.JSONMap(payload),
-		Priority:    priority,
-		ScheduledAt: now,
-		Status:      models.JobStatusPending,
-		MaxAttempts: toInt(taskMap["max_attempts"], 3),
-		CreatedAt:   now,
-		UpdatedAt:   now,
+	return models.TaskJob{
+		ManagerID:      user.ManagerID,
+		UserID:         user.ID,
+		TaskType:       taskType,
+		Payload:        datatypes.JSONMap(payload),
+		Priority:       priority,
+		ScheduledAt:    now,
+		Status:         models.JobStatusPending,
+		MaxAttempts:    taskmeta.RetryPolicyFor(taskType, taskMap).MaxAttempts,
+		RequiredLabels: taskmeta.RequiredLabels(taskMap),
+		CreatedAt:      now,
+		UpdatedAt:      now,
 	}
-	if err := g.db.Create(&job).Error; err != nil {
-		return false, err
-	}
-	return true, nil
 }
 
 func (g *Generator) evaluateDue(taskType string, task map[string]any, now time.Time) (bool, string, time.Duration, time.Time, bool) {
@@ -486,11 +696,16 @@ func (g *Generator) evaluateDue(taskType string, task map[string]any, now time.T
 }
 
 func (g *Generator) updateStats(now time.Time, generated int, scanned int, err error) {
+	g.updateStatsWithRest(now, generated, scanned, 0, err)
+}
+
+func (g *Generator) updateStatsWithRest(now time.Time, generated int, scanned int, resting int, err error) {
 	g.statsMu.Lock()
 	defer g.statsMu.Unlock()
 	g.stats.LastRunAt = now
 	g.stats.LastGenerated = generated
 	g.stats.LastScannedUsers = scanned
+	g.stats.LastRestingUsers = resting
 	if err != nil {
 		g.stats.LastError = err.Error()
 	} else {
@@ -510,6 +725,12 @@ func toInt(value any, fallback int) int {
 		return int(typed)
 	case float32:
 		return int(typed)
+	case json.Number:
+		parsed, err := typed.Int64()
+		if err != nil {
+			return fallback
+		}
+		return int(parsed)
 	case string:
 		parsed, err := strconv.Atoi(strings.TrimSpace(typed))
 		if err != nil {
@@ -598,70 +819,103 @@ func duiyiWindowStartForTime(bjTime time.Time) time.Time {
 	return time.Date(bjTime.Year(), bjTime.Month(), bjTime.Day(), windowHour, 0, 0, 0, taskmeta.BJLoc)
 }
 
-// resetAllExpiredJobLeases resets leased/running jobs whose lease has expired
-// back to pending status. This runs periodically in the scheduler to ensure
-// jobs are not stuck in running state when an agent crashes or disconnects.
-func (g *Generator) resetAllExpiredJobLeases(now time.Time) (int64, error) {
-	var expiredJobs []models.TaskJob
-	if err := g.db.Where("status IN ? AND lease_until IS NOT NULL AND lease_until < ?",
-		[]string{models.JobStatusLeased, models.JobStatusRunning}, now).
-		Find(&expiredJobs).Error; err != nil {
-		return 0, err
-	}
-	if len(expiredJobs) == 0 {
-		return 0, nil
-	}
-
-	expiredIDs := make([]uint, 0, len(expiredJobs))
-	for _, job := range expiredJobs {
-		expiredIDs = append(expiredIDs, job.ID)
-	}
+// resetAllExpiredJobLeases handles leased/running jobs whose lease has
+// expired, so jobs are not stuck when an agent crashes or disconnects. Each
+// expiry counts as a failed attempt under the task's retry policy.
+func (g *Generator) resetAllExpiredJobLeases(ctx context.Context, now time.Time) (int64, int64, error) {
+	return ExpireJobLeases(ctx, g.db, g.store, 0, now, g.onJobFailed)
+}
 
-	if err := g.db.Model(&models.TaskJob{}).
-		Where("id IN ?", expiredIDs).
-		Updates(map[string]any{
-			"status":         models.JobStatusPending,
-			"leased_by_node": "",
-			"lease_until":    nil,
-			"updated_at":     now,
-			"attempts":       gorm.Expr("attempts + 1"),
-		}).Error; err != nil {
-		return 0, err
-	}
+// failJobsWithFailedDependencies fails pending jobs that depend on a job which
+// ended in any status other than success. Chains are followed so that the
+// dependents of a job failed here are failed in the same run.
+func (g *Generator) failJobsWithFailedDependencies(ctx context.Context, now time.Time) (int64, error) {
+	db := g.db.WithContext(ctx)
+	settled := []string{models.JobStatusPending, models.JobStatusLeased, models.JobStatusRunning, models.JobStatusSuccess}
+	var total int64
+	for {
+		type blockedRow struct {
+			JobID    uint   `gorm:"column:job_id"`
+			TaskType string `gorm:"column:task_type"`
+		}
+		var rows []blockedRow
+		if err := db.Table("task_job_dependencies AS d").
+			Select("d.job_id, p.task_type").
+			Joins("JOIN task_jobs j ON j.id = d.job_id").
+			Joins("JOIN task_jobs p ON p.id = d.depends_on_job_id").
+			Where("j.status = ? AND p.status NOT IN ?", models.JobStatusPending, settled).
+			Order("d.job_id asc").
+			Scan(&rows).Error; err != nil {
+			return total, err
+		}
+		if len(rows) == 0 {
+			return total, nil
+		}
 
-	// Record lease_expired events for audit trail
-	events := make([]models.TaskJobEvent, 0, len(expiredIDs))
-	for _, id := range expiredIDs {
-		events = append(events, models.TaskJobEvent{
-			JobID:     id,
-			EventType: "lease_expired",
-			Message:   "租约超时，自动重置为待执行",
-			EventAt:   now,
+		blockedIDs := make([]uint, 0, len(rows))
+		prerequisite := make(map[uint]string, len(rows))
+		for _, row := range rows {
+			if _, ok := prerequisite[row.JobID]; ok {
+				continue
+			}
+			prerequisite[row.JobID] = row.TaskType
+			blockedIDs = append(blockedIDs, row.JobID)
+		}
+		// The status change and the event explaining it go together; jobs
+		// picked up since the read are left alone.
+		var failed int64
+		err := db.Transaction(func(tx *gorm.DB) error {
+			var pendingIDs []uint
+			if err := tx.Model(&models.TaskJob{}).Clauses(clause.Locking{Strength: "UPDATE"}).
+				Where("id IN ? AND status = ?", blockedIDs, models.JobStatusPending).
+				Order("id asc").
+				Pluck("id", &pendingIDs).Error; err != nil {
+				return err
+			}
+			if len(pendingIDs) == 0 {
+				return nil
+			}
+			if err := tx.Model(&models.TaskJob{}).
+				Where("id IN ?", pendingIDs).
+				Updates(map[string]any{"status": models.JobStatusFailed, "updated_at": now}).Error; err != nil {
+				return err
+			}
+			events := make([]models.TaskJobEvent, 0, len(pendingIDs))
+			for _, id := range pendingIDs {
+				events = append(events, models.TaskJobEvent{
+					JobID:     id,
+					EventType: "dependency_failed",
+					Message:   fmt.Sprintf("前置任务「%s」未成功，自动失败", prerequisite[id]),
+					EventAt:   now,
+				})
+			}
+			if err := tx.Create(&events).Error; err != nil {
+				return err
+			}
+			failed = int64(len(pendingIDs))
+			return nil
 		})
+		if err != nil {
+			return total, err
+		}
+		total += failed
+		if failed == 0 {
+			return total, nil
+		}
 	}
-	if len(events) > 0 {
-		_ = g.db.Create(&events).Error
-	}
-
-	// Clear Redis leases
-	ctx := context.Background()
-	for _, job := range expiredJobs {
-		_ = g.store.ClearJobLease(ctx, job.ManagerID, job.ID)
-	}
-
-	return int64(len(expiredIDs)), nil
 }
 
 // expireStaleDuiyiJobs expires pending/leased/running 对弈竞猜 tasks whose
 // execution window has passed. For leased/running tasks, only those with an
 // expired lease are cleaned up (to avoid interrupting active agent work).
-func (g *Generator) expireStaleDuiyiJobs(now time.Time) (int64, error) {
+func (g *Generator) expireStaleDuiyiJobs(ctx context.Context, now time.Time) (int64, error) {
+	db := g.db.WithContext(ctx)
 	bjNow := now.In(taskmeta.BJLoc)
 	currentWindowStart := duiyiWindowStartForTime(bjNow)
 
 	activeStatuses := []string{models.JobStatusPending, models.JobStatusLeased, models.JobStatusRunning}
 	var staleTasks []models.TaskJob
-	if err := g.db.Where("status IN ? AND task_type = ?",
+	if err := db.Where("status IN ? AND task_type = ?",
 		activeStatuses, "对弈竞猜").
 		Find(&staleTasks).Error; err != nil {
 		return 0, err
@@ -690,7 +944,7 @@ func (g *Generator) expireStaleDuiyiJobs(now time.Time) (int64, error) {
 		return 0, nil
 	}
 
-	if err := g.db.Model(&models.TaskJob{}).
+	if err := db.Model(&models.TaskJob{}).
 		Where("id IN ?", staleIDs).
 		Updates(map[string]any{
 			"status":         models.JobStatusFailed,
@@ -706,7 +960,6 @@ func (g *Generator) expireStaleDuiyiJobs(now time.Time) (int64, error) {
 	for _, id := range staleIDs {
 		staleIDSet[id] = struct{}{}
 	}
-	ctx := context.Background()
 	for _, job := range staleTasks {
 		if _, ok := staleIDSet[job.ID]; !ok {
 			continue
@@ -726,17 +979,24 @@ func (g *Generator) expireStaleDuiyiJobs(now time.Time) (int64, error) {
 		})
 	}
 	if len(events) > 0 {
-		_ = g.db.Create(&events).Error
+		_ = db.Create(&events).Error
 	}
 
 	return int64(len(staleIDs)), nil
 }
 
+// loadRestPolicies resolves the effective rest policy of each user.
+func (g *Generator) loadRestPolicies(ctx context.Context, users []models.User) (map[uint]RestPolicy, error) {
+	return LoadRestPolicies(g.db.WithContext(ctx), users, g.rest, g.cfg.SchedulerSpread)
+}
+
 // generateTeamYuhunJobs finds accepted TeamYuhunRequests whose scheduled_at
-// has passed and creates paired TaskJobs for both players.
+// has passed and creates paired TaskJobs for both players. A request waits
+// while either player is resting.
 func (g *Generator) generateTeamYuhunJobs(ctx context.Context, now time.Time) (int, error) {
+	db := g.db.WithContext(ctx)
 	var requests []models.TeamYuhunRequest
-	if err := g.db.Where("status = ? AND scheduled_at <= ?",
+	if err := db.Where("status = ? AND scheduled_at <= ?",
 		models.TeamYuhunStatusAccepted, now,
 	).Find(&requests).Error; err != nil {
 		return 0, err
@@ -745,8 +1005,29 @@ func (g *Generator) generateTeamYuhunJobs(ctx context.Context, now time.Time) (i
 		return 0, nil
 	}
 
+	playerIDs := make([]uint, 0, len(requests)*2)
+	for _, req := range requests {
+		playerIDs = append(playerIDs, req.RequesterID, req.ReceiverID)
+	}
+	var players []models.User
+	if err := db.Select("id, manager_id, rest_config").Where("id IN ?", playerIDs).Find(&players).Error; err != nil {
+		return 0, err
+	}
+	restPolicies, err := g.loadRestPolicies(ctx, players)
+	if err != nil {
+		return 0, err
+	}
+	isResting := func(userID uint) bool {
+		policy, ok := restPolicies[userID]
+		return ok && policy.StateAt(userID, now).Resting
+	}
+
 	generated := 0
 	for _, req := range requests {
+		if isResting(req.RequesterID) || isResting(req.ReceiverID) {
+			continue
+		}
+
 		// Redis dedup slot
 		slotKey := fmt.Sprintf("team_yuhun:%d", req.ID)
 		acquired, err := g.store.AcquireScheduleSlot(ctx, req.ManagerID, req.RequesterID, "组队御魂", slotKey, 24*time.Hour)
@@ -798,17 +1079,17 @@ func (g *Generator) generateTeamYuhunJobs(ctx context.Context, now time.Time) (i
 			UpdatedAt:   now,
 		}
 
-		if err := g.db.Create(&requesterJob).Error; err != nil {
+		if err := db.Create(&requesterJob).Error; err != nil {
 			slog.Warn("create team yuhun requester job failed", "request_id", req.ID, "error", err)
 			continue
 		}
-		if err := g.db.Create(&receiverJob).Error; err != nil {
+		if err := db.Create(&receiverJob).Error; err != nil {
 			slog.Warn("create team yuhun receiver job failed", "request_id", req.ID, "error", err)
 			continue
 		}
 
 		// Mark request as completed
-		if err := g.db.Model(&req).Updates(map[string]any{
+		if err := db.Model(&req).Updates(map[string]any{
 			"status":     models.TeamYuhunStatusCompleted,
 			"updated_at": now,
 		}).Error; err != nil {
@@ -816,6 +1097,8 @@ func (g *Generator) generateTeamYuhunJobs(ctx context.Context, now time.Time) (i
 		}
 
 		generated += 2
+		metrics.JobsGenerated.WithLabelValues("组队御魂").Add(2)
+		g.wakeAgents(ctx, req.ManagerID)
 	}
 
 	return generated, nil
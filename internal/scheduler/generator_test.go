@@ -22,6 +22,7 @@ type schedulerStoreStub struct {
 
 	mu    sync.Mutex
 	slots map[string]time.Time
+	ready []uint
 }
 
 func newSchedulerStoreStub() *schedulerStoreStub {
@@ -53,6 +54,17 @@ func (s *schedulerStoreStub) AcquireScheduleSlot(
 	return true, nil
 }
 
+func (s *schedulerStoreStub) ClearJobLease(ctx context.Context, managerID uint, jobID uint) error {
+	return nil
+}
+
+func (s *schedulerStoreStub) PublishJobsReady(ctx context.Context, managerID uint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ready = append(s.ready, managerID)
+	return nil
+}
+
 func setupGeneratorTest(t *testing.T) (*Generator, *gorm.DB) {
 	t.Helper()
 	db, err := gorm.Open(sqlite.Open("file::memory:?cache=shared"), &gorm.Config{})
@@ -220,3 +232,58 @@ func TestParseDateTime_SupportsISOWithoutTimezone(t *testing.T) {
 		t.Fatalf("unexpected parsed time: got %s want %s", parsed, expected)
 	}
 }
+
+func TestProcessUser_LinksDependentJobsAndFailsOrphans(t *testing.T) {
+	now := time.Date(2026, 2, 27, 10, 0, 0, 0, time.UTC)
+	g, db := setupGeneratorTest(t)
+
+	taskConfig := taskmeta.BuildDefaultTaskConfigByType(models.UserTypeDaily)
+	disableAllTasksExcept(taskConfig, "探索突破")
+	taskConfig["结界卡合成"].(map[string]any)["enabled"] = true
+
+	user, cfg := seedUserAndConfig(t, db, models.UserTypeDaily, taskConfig)
+	generated, err := g.processUser(context.Background(), user, cfg, map[string]int64{}, nil, now)
+	if err != nil {
+		t.Fatalf("process user failed: %v", err)
+	}
+	if generated != 2 {
+		t.Fatalf("expected generated=2, got %d", generated)
+	}
+
+	var explore, card models.TaskJob
+	if err := db.Where("user_id = ? AND task_type = ?", user.ID, "探索突破").First(&explore).Error; err != nil {
+		t.Fatalf("load 探索突破 job failed: %v", err)
+	}
+	if err := db.Where("user_id = ? AND task_type = ?", user.ID, "结界卡合成").First(&card).Error; err != nil {
+		t.Fatalf("load 结界卡合成 job failed: %v", err)
+	}
+	var deps []models.TaskJobDependency
+	if err := db.Where("job_id = ?", card.ID).Find(&deps).Error; err != nil {
+		t.Fatalf("load dependencies failed: %v", err)
+	}
+	if len(deps) != 1 || deps[0].DependsOnJobID != explore.ID {
+		t.Fatalf("结界卡合成 should depend on the 探索突破 job %d: %+v", explore.ID, deps)
+	}
+
+	if failed, err := g.failJobsWithFailedDependencies(context.Background(), now); err != nil || failed != 0 {
+		t.Fatalf("pending prerequisite should keep the dependent waiting: failed=%d err=%v", failed, err)
+	}
+	if err := db.Model(&models.TaskJob{}).Where("id = ?", explore.ID).Update("status", models.JobStatusFailed).Error; err != nil {
+		t.Fatalf("fail prerequisite failed: %v", err)
+	}
+	if failed, err := g.failJobsWithFailedDependencies(context.Background(), now); err != nil || failed != 1 {
+		t.Fatalf("dependent should be failed: failed=%d err=%v", failed, err)
+	}
+	var reloaded models.TaskJob
+	if err := db.Where("id = ?", card.ID).First(&reloaded).Error; err != nil {
+		t.Fatalf("reload dependent failed: %v", err)
+	}
+	if reloaded.Status != models.JobStatusFailed {
+		t.Fatalf("expected dependent status failed, got %s", reloaded.Status)
+	}
+	var events int64
+	db.Model(&models.TaskJobEvent{}).Where("job_id = ? AND event_type = ?", card.ID, "dependency_failed").Count(&events)
+	if events != 1 {
+		t.Fatalf("expected a dependency_failed event, got %d", events)
+	}
+}
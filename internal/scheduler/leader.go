@@ -0,0 +1,202 @@
+package scheduler
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"oas-cloud-go/internal/cache"
+)
+
+// LeaderName is the leadership lease shared by the replicas that run the
+// scheduler and the other singleton workers.
+const LeaderName = "scheduler"
+
+// LeaderStatus describes the leadership as seen by one replica.
+type LeaderStatus struct {
+	InstanceID      string `json:"instance_id"`
+	LeaderID        string `json:"leader_id"`
+	IsLeader        bool   `json:"is_leader"`
+	Fence           int64  `json:"fence"`
+	LeaseTTLSeconds int    `json:"lease_ttl_seconds"`
+	Error           string `json:"error,omitempty"`
+}
+
+// Elector keeps a Redis leadership lease for one replica. The leader renews
+// the lease every third of its TTL; followers try to take it on the same
+// beat, so a dead leader is replaced within about one TTL. Each term carries
+// a fencing token: singleton work checks with Confirm that its term is still
+// current right before it runs, so a replica that stalled past its lease
+// cannot act next to the new leader.
+type Elector struct {
+	store cache.Store
+	name  string
+	id    string
+	ttl   time.Duration
+
+	mu        sync.RWMutex
+	fence     int64 // 0 while following
+	renewedAt time.Time
+	ctx       context.Context
+	cancel    context.CancelFunc
+
+	running atomic.Bool
+	stopCh  chan struct{}
+	doneCh  chan struct{}
+}
+
+func NewElector(store cache.Store, name string, id string, ttl time.Duration) *Elector {
+	if ttl < 3*time.Second {
+		ttl = 10 * time.Second
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	return &Elector{
+		store:  store,
+		name:   name,
+		id:     id,
+		ttl:    ttl,
+		ctx:    ctx,
+		cancel: cancel,
+		stopCh: make(chan struct{}),
+		doneCh: make(chan struct{}),
+	}
+}
+
+func (e *Elector) Start() {
+	if !e.running.CompareAndSwap(false, true) {
+		return
+	}
+	go e.loop()
+}
+
+// Stop ends the election and hands the lease back so a follower can take
+// over right away.
+func (e *Elector) Stop() {
+	if e.running.CompareAndSwap(true, false) {
+		close(e.stopCh)
+		<-e.doneCh
+	}
+	if e.IsLeader() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		_ = e.store.ReleaseLeadership(ctx, e.name, e.id)
+	}
+	e.stepDown("stopped")
+}
+
+func (e *Elector) IsLeader() bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.fence != 0
+}
+
+// Context is cancelled when the current term ends. While following it is
+// already cancelled.
+func (e *Elector) Context() context.Context {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.ctx
+}
+
+// Confirm renews the lease and reports whether this replica still leads the
+// term it started. Call it before each run of singleton work.
+func (e *Elector) Confirm(ctx context.Context) bool {
+	e.mu.RLock()
+	fence := e.fence
+	e.mu.RUnlock()
+	if fence == 0 {
+		return false
+	}
+	current, err := e.store.AcquireLeadership(ctx, e.name, e.id, e.ttl)
+	if err != nil || current != fence {
+		e.stepDown("fence check failed")
+		return false
+	}
+	e.mu.Lock()
+	e.renewedAt = time.Now()
+	e.mu.Unlock()
+	return true
+}
+
+// Status reports the leader recorded in Redis next to this replica's view.
+func (e *Elector) Status(ctx context.Context) LeaderStatus {
+	e.mu.RLock()
+	status := LeaderStatus{
+		InstanceID:      e.id,
+		IsLeader:        e.fence != 0,
+		Fence:           e.fence,
+		LeaseTTLSeconds: int(e.ttl.Seconds()),
+	}
+	e.mu.RUnlock()
+	holder, fence, err := e.store.GetLeadership(ctx, e.name)
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	status.LeaderID = holder
+	status.Fence = fence
+	return status
+}
+
+func (e *Elector) loop() {
+	defer close(e.doneCh)
+	ticker := time.NewTicker(e.ttl / 3)
+	defer ticker.Stop()
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), e.ttl/3)
+		e.tick(ctx, time.Now())
+		cancel()
+		select {
+		case <-ticker.C:
+		case <-e.stopCh:
+			return
+		}
+	}
+}
+
+// tick takes or renews the lease. A leader that cannot reach Redis keeps
+// leading until its lease would have expired, then steps down.
+func (e *Elector) tick(ctx context.Context, now time.Time) {
+	fence, err := e.store.AcquireLeadership(ctx, e.name, e.id, e.ttl)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	switch {
+	case err != nil:
+		if e.fence != 0 && now.Sub(e.renewedAt) >= e.ttl {
+			slog.Warn("leader lease lost", "name", e.name, "instance", e.id, "error", err)
+			e.stepDownLocked()
+		}
+	case fence == 0:
+		if e.fence != 0 {
+			slog.Warn("leadership taken over", "name", e.name, "instance", e.id)
+			e.stepDownLocked()
+		}
+	case fence != e.fence:
+		if e.fence != 0 {
+			e.stepDownLocked()
+		}
+		e.fence = fence
+		e.renewedAt = now
+		e.ctx, e.cancel = context.WithCancel(context.Background())
+		slog.Info("became leader", "name", e.name, "instance", e.id, "fence", fence)
+	default:
+		e.renewedAt = now
+	}
+}
+
+func (e *Elector) stepDown(reason string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.fence != 0 {
+		slog.Info("stepped down as leader", "name", e.name, "instance", e.id, "reason", reason)
+	}
+	e.stepDownLocked()
+}
+
+func (e *Elector) stepDownLocked() {
+	e.fence = 0
+	e.cancel()
+}
@@ -0,0 +1,108 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"oas-cloud-go/internal/cache"
+)
+
+// leaderStoreStub keeps leadership leases in memory. Leases never expire on
+// their own; expire simulates a lease running out.
+type leaderStoreStub struct {
+	cache.Store
+	mu     sync.Mutex
+	holder string
+	fence  int64
+	err    error
+}
+
+func (s *leaderStoreStub) AcquireLeadership(ctx context.Context, name string, holderID string, ttl time.Duration) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return 0, s.err
+	}
+	if s.holder != "" && s.holder != holderID {
+		return 0, nil
+	}
+	if s.holder == "" {
+		s.holder = holderID
+		s.fence++
+	}
+	return s.fence, nil
+}
+
+func (s *leaderStoreStub) ReleaseLeadership(ctx context.Context, name string, holderID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.holder == holderID {
+		s.holder = ""
+	}
+	return nil
+}
+
+func (s *leaderStoreStub) GetLeadership(ctx context.Context, name string) (string, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.holder, s.fence, nil
+}
+
+func (s *leaderStoreStub) expire() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.holder = ""
+}
+
+func TestElectorFailoverAndFencing(t *testing.T) {
+	ctx := context.Background()
+	store := &leaderStoreStub{}
+	a := NewElector(store, LeaderName, "replica-a", 3*time.Second)
+	b := NewElector(store, LeaderName, "replica-b", 3*time.Second)
+	now := time.Now()
+
+	a.tick(ctx, now)
+	b.tick(ctx, now)
+	if !a.IsLeader() || b.IsLeader() {
+		t.Fatalf("first replica should lead: a=%v b=%v", a.IsLeader(), b.IsLeader())
+	}
+	if !a.Confirm(ctx) || a.Context().Err() != nil {
+		t.Fatalf("leader should confirm its term")
+	}
+	if b.Confirm(ctx) || b.Context().Err() == nil {
+		t.Fatalf("follower should not run singleton work")
+	}
+
+	// A stalls past its lease: B takes over with a new fence and A's next
+	// confirmation fails even though it never noticed losing the lease.
+	termA := a.Context()
+	store.expire()
+	b.tick(ctx, now.Add(time.Second))
+	if status := b.Status(ctx); !status.IsLeader || status.LeaderID != "replica-b" || status.Fence != 2 {
+		t.Fatalf("follower should take over, got %+v", status)
+	}
+	if a.Confirm(ctx) || a.IsLeader() || termA.Err() == nil {
+		t.Fatalf("stale leader should be fenced off")
+	}
+
+	// A clean shutdown hands the lease over right away.
+	b.Stop()
+	a.tick(ctx, now.Add(2*time.Second))
+	if !a.IsLeader() || b.IsLeader() {
+		t.Fatalf("leadership should move back after stop: a=%v b=%v", a.IsLeader(), b.IsLeader())
+	}
+
+	// Without Redis the leader keeps its term until the lease would expire.
+	store.err = errors.New("redis down")
+	a.tick(ctx, now.Add(3*time.Second))
+	if !a.IsLeader() {
+		t.Fatalf("leader should survive a short Redis outage")
+	}
+	a.tick(ctx, now.Add(6*time.Second))
+	if a.IsLeader() {
+		t.Fatalf("leader should step down once its lease has run out")
+	}
+}
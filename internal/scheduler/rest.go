@@ -0,0 +1,460 @@
+package scheduler
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+
+	"oas-cloud-go/internal/models"
+	"oas-cloud-go/internal/taskmeta"
+
+	"gorm.io/gorm"
+)
+
+const (
+	RestModeFixed  = "fixed"
+	RestModeRandom = "random"
+
+	// Where the effective rest config of a user comes from.
+	RestSourceUser    = "user"
+	RestSourceManager = "manager"
+	RestSourceGlobal  = "global"
+
+	// Why a user is resting.
+	RestReasonDateOff = "date_off"
+	RestReasonDayOff  = "day_off"
+	RestReasonDaily   = "daily_rest"
+	RestReasonPeriod  = "rest_period"
+
+	defaultRandomRange = 60
+	maxRandomRange     = 180
+	maxRestPeriods     = 8
+	maxRestDatesOff    = 62
+	minutesPerDay      = 24 * 60
+)
+
+type restPeriod struct {
+	start int // minutes after Beijing midnight
+	end   int // end <= start wraps past midnight
+}
+
+func (p restPeriod) length() int {
+	if p.end > p.start {
+		return p.end - p.start
+	}
+	return p.end + minutesPerDay - p.start
+}
+
+// RestConfig is a parsed rest schedule, stored as User.RestConfig or as a
+// manager default in Manager.RestConfig. All times are Beijing time.
+type RestConfig struct {
+	Enabled bool
+	Mode    string
+	// Daily rest block: Start minutes after midnight, lasting Duration
+	// minutes. In random mode the start moves by up to ±RandomRange minutes,
+	// differently per user and per day.
+	Start       int
+	Duration    int
+	RandomRange int
+	Periods     []restPeriod
+	DaysOff     []time.Weekday
+	DatesOff    []string // YYYY-MM-DD
+}
+
+// ParseRestConfig reads a stored rest config. Invalid parts are ignored; an
+// empty map yields a disabled config.
+func ParseRestConfig(raw map[string]any) RestConfig {
+	var cfg RestConfig
+	if len(raw) == 0 {
+		return cfg
+	}
+	cfg.Enabled, _ = raw["enabled"].(bool)
+	cfg.Mode = RestModeFixed
+	if mode, _ := raw["mode"].(string); mode == RestModeRandom {
+		cfg.Mode = RestModeRandom
+		cfg.RandomRange = defaultRandomRange
+		if value, exists := raw["random_range"]; exists {
+			if minutes := toInt(value, -1); minutes >= 0 && minutes <= maxRandomRange {
+				cfg.RandomRange = minutes
+			}
+		}
+	}
+	if start, ok := parseHHMM(strings.TrimSpace(toString(raw["rest_start"]))); ok {
+		if hours := toInt(raw["rest_duration"], 0); hours > 0 && hours < 24 {
+			cfg.Start = start.hour*60 + start.minute
+			cfg.Duration = hours * 60
+		}
+	}
+	if items, ok := raw["periods"].([]any); ok {
+		for _, item := range items {
+			period, _ := item.(map[string]any)
+			start, startOK := parseHHMM(strings.TrimSpace(toString(period["start"])))
+			end, endOK := parseHHMM(strings.TrimSpace(toString(period["end"])))
+			if startOK && endOK && start != end {
+				cfg.Periods = append(cfg.Periods, restPeriod{start.hour*60 + start.minute, end.hour*60 + end.minute})
+			}
+		}
+	}
+	if items, ok := raw["days_off"].([]any); ok {
+		for _, item := range items {
+			if day := toInt(item, -1); day >= 0 && day <= 6 {
+				cfg.DaysOff = append(cfg.DaysOff, time.Weekday(day))
+			}
+		}
+	}
+	if items, ok := raw["dates_off"].([]any); ok {
+		for _, item := range items {
+			if date, ok := item.(string); ok {
+				cfg.DatesOff = append(cfg.DatesOff, date)
+			}
+		}
+	}
+	return cfg
+}
+
+// ValidateRestConfig checks a rest config submitted through the API and
+// returns the normalized copy to store. An empty input stays empty, meaning
+// "inherit the manager default".
+func ValidateRestConfig(raw map[string]any) (map[string]any, error) {
+	if len(raw) == 0 {
+		return map[string]any{}, nil
+	}
+	enabled, _ := raw["enabled"].(bool)
+
+	mode, _ := raw["mode"].(string)
+	mode = strings.TrimSpace(mode)
+	switch mode {
+	case "":
+		mode = RestModeFixed
+	case RestModeFixed, RestModeRandom:
+	default:
+		return nil, fmt.Errorf("mode 仅支持 fixed / random")
+	}
+
+	restStart := strings.TrimSpace(toString(raw["rest_start"]))
+	restDuration := 0
+	if value, exists := raw["rest_duration"]; exists && value != nil {
+		hours, ok := taskmeta.WholeNumber(value)
+		if !ok || hours < 0 || hours > 23 {
+			return nil, fmt.Errorf("rest_duration 必须是 0-23 的整数（小时）")
+		}
+		restDuration = hours
+	}
+	if restDuration > 0 || restStart != "" {
+		if _, ok := parseHHMM(restStart); !ok {
+			return nil, fmt.Errorf("rest_start 格式应为 HH:MM")
+		}
+	}
+
+	randomRange := 0
+	if mode == RestModeRandom {
+		randomRange = defaultRandomRange
+		if value, exists := raw["random_range"]; exists && value != nil {
+			minutes, ok := taskmeta.WholeNumber(value)
+			if !ok || minutes < 0 || minutes > maxRandomRange {
+				return nil, fmt.Errorf("random_range 必须是 0-%d 的整数（分钟）", maxRandomRange)
+			}
+			randomRange = minutes
+		}
+		if restDuration == 0 {
+			return nil, fmt.Errorf("随机休息需要设置 rest_start 和 rest_duration")
+		}
+	}
+
+	periods := []any{}
+	if value, exists := raw["periods"]; exists && value != nil {
+		items, ok := value.([]any)
+		if !ok {
+			return nil, fmt.Errorf("periods 必须是数组")
+		}
+		if len(items) > maxRestPeriods {
+			return nil, fmt.Errorf("最多设置 %d 个休息时段", maxRestPeriods)
+		}
+		for _, item := range items {
+			period, _ := item.(map[string]any)
+			start := strings.TrimSpace(toString(period["start"]))
+			end := strings.TrimSpace(toString(period["end"]))
+			startValue, startOK := parseHHMM(start)
+			endValue, endOK := parseHHMM(end)
+			if !startOK || !endOK {
+				return nil, fmt.Errorf("休息时段格式应为 HH:MM")
+			}
+			if startValue == endValue {
+				return nil, fmt.Errorf("休息时段开始和结束时间不能相同")
+			}
+			periods = append(periods, map[string]any{"start": start, "end": end})
+		}
+	}
+
+	daysOff := []int{}
+	if value, exists := raw["days_off"]; exists && value != nil {
+		items, ok := value.([]any)
+		if !ok {
+			return nil, fmt.Errorf("days_off 必须是数组")
+		}
+		seen := map[int]struct{}{}
+		for _, item := range items {
+			day, ok := taskmeta.WholeNumber(item)
+			if !ok || day < 0 || day > 6 {
+				return nil, fmt.Errorf("days_off 只能包含 0-6（0 表示周日）")
+			}
+			if _, dup := seen[day]; dup {
+				continue
+			}
+			seen[day] = struct{}{}
+			daysOff = append(daysOff, day)
+		}
+		sort.Ints(daysOff)
+		if len(daysOff) == 7 {
+			return nil, fmt.Errorf("不能把每天都设为休息日")
+		}
+	}
+
+	datesOff := []string{}
+	if value, exists := raw["dates_off"]; exists && value != nil {
+		items, ok := value.([]any)
+		if !ok {
+			return nil, fmt.Errorf("dates_off 必须是数组")
+		}
+		if len(items) > maxRestDatesOff {
+			return nil, fmt.Errorf("最多设置 %d 个休息日期", maxRestDatesOff)
+		}
+		seen := map[string]struct{}{}
+		for _, item := range items {
+			date, _ := item.(string)
+			date = strings.TrimSpace(date)
+			if _, err := time.ParseInLocation("2006-01-02", date, taskmeta.BJLoc); err != nil {
+				return nil, fmt.Errorf("dates_off 日期格式应为 YYYY-MM-DD")
+			}
+			if _, dup := seen[date]; dup {
+				continue
+			}
+			seen[date] = struct{}{}
+			datesOff = append(datesOff, date)
+		}
+		sort.Strings(datesOff)
+	}
+
+	if enabled && restDuration == 0 && len(periods) == 0 && len(daysOff) == 0 && len(datesOff) == 0 {
+		return nil, fmt.Errorf("启用休息后至少需要设置休息时段或休息日")
+	}
+
+	// Slices are []any so the result reads the same before and after a
+	// round trip through the jsonb column.
+	days := make([]any, 0, len(daysOff))
+	for _, day := range daysOff {
+		days = append(days, day)
+	}
+	dates := make([]any, 0, len(datesOff))
+	for _, date := range datesOff {
+		dates = append(dates, date)
+	}
+	return map[string]any{
+		"enabled":       enabled,
+		"mode":          mode,
+		"rest_start":    restStart,
+		"rest_duration": restDuration,
+		"random_range":  randomRange,
+		"periods":       periods,
+		"days_off":      days,
+		"dates_off":     dates,
+	}, nil
+}
+
+// ParseRestWindow parses the global fallback window "HH:MM-HH:MM". An empty
+// value or "off" disables it.
+func ParseRestWindow(window string) (RestConfig, error) {
+	window = strings.TrimSpace(window)
+	if window == "" || window == "off" {
+		return RestConfig{}, nil
+	}
+	startText, endText, found := strings.Cut(window, "-")
+	start, startOK := parseHHMM(strings.TrimSpace(startText))
+	end, endOK := parseHHMM(strings.TrimSpace(endText))
+	if !found || !startOK || !endOK || start == end {
+		return RestConfig{}, fmt.Errorf("invalid rest window %q, want HH:MM-HH:MM", window)
+	}
+	return RestConfig{
+		Enabled: true,
+		Mode:    RestModeFixed,
+		Periods: []restPeriod{{start.hour*60 + start.minute, end.hour*60 + end.minute}},
+	}, nil
+}
+
+// GlobalRestConfig parses SCHEDULER_REST_WINDOW, falling back to the
+// historical 00:00-06:00 window when the value is malformed.
+func GlobalRestConfig(window string) RestConfig {
+	rest, err := ParseRestWindow(window)
+	if err != nil {
+		slog.Warn("invalid SCHEDULER_REST_WINDOW, falling back to 00:00-06:00", "error", err)
+		rest, _ = ParseRestWindow("00:00-06:00")
+	}
+	return rest
+}
+
+// Map renders the config in the stored/API shape.
+func (c RestConfig) Map() map[string]any {
+	restStart := ""
+	if c.Duration > 0 {
+		restStart = fmt.Sprintf("%02d:%02d", c.Start/60, c.Start%60)
+	}
+	mode := c.Mode
+	if mode == "" {
+		mode = RestModeFixed
+	}
+	periods := make([]map[string]any, 0, len(c.Periods))
+	for _, period := range c.Periods {
+		periods = append(periods, map[string]any{
+			"start": fmt.Sprintf("%02d:%02d", period.start/60, period.start%60),
+			"end":   fmt.Sprintf("%02d:%02d", period.end/60, period.end%60),
+		})
+	}
+	daysOff := make([]int, 0, len(c.DaysOff))
+	for _, day := range c.DaysOff {
+		daysOff = append(daysOff, int(day))
+	}
+	datesOff := append([]string{}, c.DatesOff...)
+	return map[string]any{
+		"enabled":       c.Enabled,
+		"mode":          mode,
+		"rest_start":    restStart,
+		"rest_duration": c.Duration / 60,
+		"random_range":  c.RandomRange,
+		"periods":       periods,
+		"days_off":      daysOff,
+		"dates_off":     datesOff,
+	}
+}
+
+// RestPolicy is the rest config in effect for a user and where it came from.
+type RestPolicy struct {
+	Config RestConfig
+	Source string
+	// Offset delays every rest of this user, so that users sharing a rest
+	// window do not all wake up at the same minute.
+	Offset time.Duration
+}
+
+// ResolveRestPolicy picks the user's own rest config, then the manager
+// default, then the global window.
+func ResolveRestPolicy(userRest, managerRest map[string]any, global RestConfig) RestPolicy {
+	if len(userRest) > 0 {
+		return RestPolicy{Config: ParseRestConfig(userRest), Source: RestSourceUser}
+	}
+	if len(managerRest) > 0 {
+		return RestPolicy{Config: ParseRestConfig(managerRest), Source: RestSourceManager}
+	}
+	return RestPolicy{Config: global, Source: RestSourceGlobal}
+}
+
+// LoadRestPolicies resolves the effective rest policy of each user, preloading
+// the manager defaults in one query. Users need id, manager_id and
+// rest_config loaded. Each policy is offset inside the manager's spread window.
+func LoadRestPolicies(db *gorm.DB, users []models.User, global RestConfig, defaultSpread time.Duration) (map[uint]RestPolicy, error) {
+	managerIDSet := make(map[uint]struct{}, len(users))
+	for _, u := range users {
+		managerIDSet[u.ManagerID] = struct{}{}
+	}
+	managerIDs := make([]uint, 0, len(managerIDSet))
+	for mid := range managerIDSet {
+		managerIDs = append(managerIDs, mid)
+	}
+	var managers []models.Manager
+	if len(managerIDs) > 0 {
+		if err := db.Select("id, rest_config, schedule_spread").Where("id IN ?", managerIDs).Find(&managers).Error; err != nil {
+			return nil, err
+		}
+	}
+	managerByID := make(map[uint]models.Manager, len(managers))
+	for _, m := range managers {
+		managerByID[m.ID] = m
+	}
+	policies := make(map[uint]RestPolicy, len(users))
+	for _, u := range users {
+		manager := managerByID[u.ManagerID]
+		policy := ResolveRestPolicy(map[string]any(u.RestConfig), map[string]any(manager.RestConfig), global)
+		policy.Offset = taskmeta.SpreadOffset(u.ID, taskmeta.ResolveSpread(manager.ScheduleSpread, defaultSpread))
+		policies[u.ID] = policy
+	}
+	return policies, nil
+}
+
+// RestState explains whether a user is resting at a given moment.
+type RestState struct {
+	Resting bool
+	Reason  string
+	Source  string
+	Until   time.Time // end of the current rest, adjacent rests merged
+}
+
+// StateAt evaluates the policy for userID at now. The user ID seeds the
+// random-mode offset so every caller sees the same window for the same day.
+func (p RestPolicy) StateAt(userID uint, now time.Time) RestState {
+	if !p.Config.Enabled {
+		return RestState{Source: p.Source}
+	}
+	reason, until, ok := p.Config.restAt(userID, now.Add(-p.Offset))
+	if !ok {
+		return RestState{Source: p.Source}
+	}
+	for i := 0; i < 14; i++ {
+		_, next, ok := p.Config.restAt(userID, until)
+		if !ok || !next.After(until) {
+			break
+		}
+		until = next
+	}
+	return RestState{Resting: true, Reason: reason, Source: p.Source, Until: until.Add(p.Offset).UTC()}
+}
+
+// restAt reports the rest rule covering t and when that rest ends.
+func (c RestConfig) restAt(userID uint, t time.Time) (string, time.Time, bool) {
+	bj := t.In(taskmeta.BJLoc)
+	today := time.Date(bj.Year(), bj.Month(), bj.Day(), 0, 0, 0, 0, taskmeta.BJLoc)
+	tomorrow := today.AddDate(0, 0, 1)
+
+	date := today.Format("2006-01-02")
+	for _, item := range c.DatesOff {
+		if item == date {
+			return RestReasonDateOff, tomorrow, true
+		}
+	}
+	for _, day := range c.DaysOff {
+		if day == today.Weekday() {
+			return RestReasonDayOff, tomorrow, true
+		}
+	}
+
+	// A block that started yesterday may still be running after midnight.
+	for _, day := range []time.Time{today.AddDate(0, 0, -1), today} {
+		if c.Duration > 0 {
+			start := day.Add(time.Duration(c.Start+c.randomOffset(userID, day)) * time.Minute)
+			end := start.Add(time.Duration(c.Duration) * time.Minute)
+			if !bj.Before(start) && bj.Before(end) {
+				return RestReasonDaily, end, true
+			}
+		}
+		for _, period := range c.Periods {
+			start := day.Add(time.Duration(period.start) * time.Minute)
+			end := start.Add(time.Duration(period.length()) * time.Minute)
+			if !bj.Before(start) && bj.Before(end) {
+				return RestReasonPeriod, end, true
+			}
+		}
+	}
+	return "", time.Time{}, false
+}
+
+// randomOffset returns a stable per-user, per-day shift in
+// [-RandomRange, +RandomRange] minutes.
+func (c RestConfig) randomOffset(userID uint, day time.Time) int {
+	if c.Mode != RestModeRandom || c.RandomRange <= 0 {
+		return 0
+	}
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%d:%s", userID, day.Format("2006-01-02"))
+	return int(h.Sum64()%uint64(2*c.RandomRange+1)) - c.RandomRange
+}
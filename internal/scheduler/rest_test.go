@@ -0,0 +1,224 @@
+package scheduler
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"oas-cloud-go/internal/models"
+	"oas-cloud-go/internal/taskmeta"
+
+	"gorm.io/datatypes"
+)
+
+func bjTime(day, hour, minute int) time.Time {
+	// 2026-03-01 is a Sunday.
+	return time.Date(2026, 3, day, hour, minute, 0, 0, taskmeta.BJLoc)
+}
+
+func TestValidateRestConfigNormalizesAndRejects(t *testing.T) {
+	normalized, err := ValidateRestConfig(map[string]any{
+		"enabled":       true,
+		"rest_start":    "01:30",
+		"rest_duration": float64(4),
+		"periods":       []any{map[string]any{"start": "23:00", "end": "01:00"}},
+		"days_off":      []any{float64(6), float64(0), float64(6)},
+		"dates_off":     []any{"2026-03-09", "2026-03-08"},
+	})
+	if err != nil {
+		t.Fatalf("validate failed: %v", err)
+	}
+	if normalized["mode"] != RestModeFixed || normalized["random_range"] != 0 {
+		t.Fatalf("unexpected mode defaults: %v", normalized)
+	}
+	if days := normalized["days_off"].([]any); len(days) != 2 || days[0] != 0 || days[1] != 6 {
+		t.Fatalf("days_off should be deduplicated and sorted: %v", days)
+	}
+	if dates := normalized["dates_off"].([]any); dates[0] != "2026-03-08" {
+		t.Fatalf("dates_off should be sorted: %v", dates)
+	}
+	parsed := ParseRestConfig(normalized)
+	if !parsed.Enabled || parsed.Duration != 240 || len(parsed.Periods) != 1 || len(parsed.DaysOff) != 2 {
+		t.Fatalf("normalized config should parse back: %+v", parsed)
+	}
+
+	if empty, err := ValidateRestConfig(nil); err != nil || len(empty) != 0 {
+		t.Fatalf("empty config should stay empty: %v err=%v", empty, err)
+	}
+
+	cases := []struct {
+		name string
+		raw  map[string]any
+		want string
+	}{
+		{"bad mode", map[string]any{"mode": "weekly"}, "mode"},
+		{"bad start", map[string]any{"rest_start": "25:00", "rest_duration": float64(2)}, "rest_start"},
+		{"bad duration", map[string]any{"rest_start": "01:00", "rest_duration": float64(24)}, "rest_duration"},
+		{"random without block", map[string]any{"mode": "random"}, "随机休息"},
+		{"bad range", map[string]any{"mode": "random", "rest_start": "01:00", "rest_duration": float64(2), "random_range": float64(181)}, "random_range"},
+		{"same period", map[string]any{"periods": []any{map[string]any{"start": "08:00", "end": "08:00"}}}, "不能相同"},
+		{"bad weekday", map[string]any{"days_off": []any{float64(7)}}, "days_off"},
+		{"every day", map[string]any{"days_off": []any{0.0, 1.0, 2.0, 3.0, 4.0, 5.0, 6.0}}, "每天"},
+		{"bad date", map[string]any{"dates_off": []any{"2026/03/08"}}, "YYYY-MM-DD"},
+		{"enabled without rest", map[string]any{"enabled": true}, "至少需要"},
+	}
+	for _, tc := range cases {
+		if _, err := ValidateRestConfig(tc.raw); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Fatalf("%s: expected error containing %q, got %v", tc.name, tc.want, err)
+		}
+	}
+}
+
+func TestRestPolicyStateAt(t *testing.T) {
+	policy := RestPolicy{Source: RestSourceUser, Config: ParseRestConfig(map[string]any{
+		"enabled":   true,
+		"periods":   []any{map[string]any{"start": "23:00", "end": "07:00"}},
+		"days_off":  []any{float64(3)},
+		"dates_off": []any{"2026-03-06"},
+	})}
+
+	state := policy.StateAt(1, bjTime(2, 23, 30))
+	if !state.Resting || state.Reason != RestReasonPeriod || !state.Until.Equal(bjTime(3, 7, 0).UTC()) {
+		t.Fatalf("period should wrap past midnight: %+v", state)
+	}
+	if state := policy.StateAt(1, bjTime(3, 6, 59)); !state.Resting || state.Reason != RestReasonPeriod {
+		t.Fatalf("early morning should still be resting: %+v", state)
+	}
+	if state := policy.StateAt(1, bjTime(2, 12, 0)); state.Resting || state.Source != RestSourceUser {
+		t.Fatalf("noon should be awake: %+v", state)
+	}
+
+	// Wednesday off runs into Thursday's 00:00-07:00 part of the period.
+	state = policy.StateAt(1, bjTime(4, 12, 0))
+	if !state.Resting || state.Reason != RestReasonDayOff || !state.Until.Equal(bjTime(5, 7, 0).UTC()) {
+		t.Fatalf("day off should merge with the following period: %+v", state)
+	}
+	if state := policy.StateAt(1, bjTime(6, 15, 0)); !state.Resting || state.Reason != RestReasonDateOff {
+		t.Fatalf("date off should rest: %+v", state)
+	}
+
+	disabled := RestPolicy{Source: RestSourceUser, Config: ParseRestConfig(map[string]any{
+		"enabled":  false,
+		"days_off": []any{float64(3)},
+	})}
+	if state := disabled.StateAt(1, bjTime(4, 12, 0)); state.Resting {
+		t.Fatalf("disabled config should never rest: %+v", state)
+	}
+}
+
+func TestRestPolicyRandomOffsetIsStable(t *testing.T) {
+	cfg := ParseRestConfig(map[string]any{
+		"enabled":       true,
+		"mode":          RestModeRandom,
+		"rest_start":    "02:00",
+		"rest_duration": float64(3),
+		"random_range":  float64(30),
+	})
+	day := bjTime(10, 0, 0)
+	varied := false
+	for userID := uint(1); userID <= 50; userID++ {
+		offset := cfg.randomOffset(userID, day)
+		if offset < -30 || offset > 30 {
+			t.Fatalf("offset %d out of range for user %d", offset, userID)
+		}
+		if offset != cfg.randomOffset(userID, day) {
+			t.Fatalf("offset should be stable for user %d", userID)
+		}
+		if offset != cfg.randomOffset(1, day) {
+			varied = true
+		}
+	}
+	if !varied {
+		t.Fatalf("offsets should differ between users")
+	}
+
+	policy := RestPolicy{Config: cfg, Source: RestSourceManager}
+	state := policy.StateAt(7, bjTime(10, 3, 30))
+	if !state.Resting || state.Reason != RestReasonDaily {
+		t.Fatalf("03:30 is inside any shifted 02:00+3h block: %+v", state)
+	}
+	start := bjTime(10, 2, 0).Add(time.Duration(cfg.randomOffset(7, day)) * time.Minute)
+	if !state.Until.Equal(start.Add(3 * time.Hour).UTC()) {
+		t.Fatalf("unexpected rest end %v", state.Until)
+	}
+}
+
+func TestRestPolicyOffsetDelaysWakeUp(t *testing.T) {
+	policy, err := ParseRestWindow("00:00-06:00")
+	if err != nil {
+		t.Fatalf("parse window failed: %v", err)
+	}
+	shifted := RestPolicy{Config: policy, Source: RestSourceGlobal, Offset: 25 * time.Minute}
+
+	state := shifted.StateAt(1, bjTime(2, 6, 10))
+	if !state.Resting || !state.Until.Equal(bjTime(2, 6, 25).UTC()) {
+		t.Fatalf("offset user should still rest until 06:25: %+v", state)
+	}
+	if state := shifted.StateAt(1, bjTime(2, 6, 25)); state.Resting {
+		t.Fatalf("offset user should be awake at 06:25: %+v", state)
+	}
+	if state := shifted.StateAt(1, bjTime(2, 0, 10)); state.Resting {
+		t.Fatalf("offset user starts resting at 00:25: %+v", state)
+	}
+}
+
+func TestResolveRestPolicyPrecedence(t *testing.T) {
+	global, err := ParseRestWindow("00:00-06:00")
+	if err != nil {
+		t.Fatalf("parse window failed: %v", err)
+	}
+	managerRest := map[string]any{"enabled": true, "days_off": []any{float64(0)}}
+
+	if policy := ResolveRestPolicy(nil, nil, global); policy.Source != RestSourceGlobal || !policy.Config.Enabled {
+		t.Fatalf("expected global fallback: %+v", policy)
+	}
+	if policy := ResolveRestPolicy(nil, managerRest, global); policy.Source != RestSourceManager {
+		t.Fatalf("expected manager default: %+v", policy)
+	}
+	policy := ResolveRestPolicy(map[string]any{"enabled": false}, managerRest, global)
+	if policy.Source != RestSourceUser || policy.StateAt(1, bjTime(1, 3, 0)).Resting {
+		t.Fatalf("explicitly disabled user config should override defaults: %+v", policy)
+	}
+
+	if _, err := ParseRestWindow("06:00"); err == nil {
+		t.Fatalf("malformed window should fail")
+	}
+	if off, err := ParseRestWindow("off"); err != nil || off.Enabled {
+		t.Fatalf("off should disable the window: %+v err=%v", off, err)
+	}
+}
+
+func TestRunOnce_SkipsRestingUsers(t *testing.T) {
+	g, db := setupGeneratorTest(t)
+
+	seed := func() (models.User, models.UserTaskConfig) {
+		taskConfig := taskmeta.BuildDefaultTaskConfigByType(models.UserTypeFoster)
+		disableAllTasksExcept(taskConfig, "放卡")
+		fangkaCfg := taskConfig["放卡"].(map[string]any)
+		fangkaCfg["next_time"] = "2026/02/27 09:00"
+		taskConfig["放卡"] = fangkaCfg
+		return seedUserAndConfig(t, db, models.UserTypeFoster, taskConfig)
+	}
+	awake, _ := seed()
+	resting, _ := seed()
+	if err := db.Model(&models.User{}).Where("id = ?", resting.ID).
+		Update("rest_config", datatypes.JSONMap{
+			"enabled":  true,
+			"days_off": []any{0, 1, 2, 3, 4, 5, 6},
+		}).Error; err != nil {
+		t.Fatalf("update rest config failed: %v", err)
+	}
+
+	g.runOnce(context.Background())
+
+	if count := countPendingJobs(t, db, awake.ID, "放卡"); count != 1 {
+		t.Fatalf("awake user should get 1 job, got %d", count)
+	}
+	if count := countPendingJobs(t, db, resting.ID, "放卡"); count != 0 {
+		t.Fatalf("resting user should get no job, got %d", count)
+	}
+	if stats := g.Snapshot(); stats.LastRestingUsers < 1 {
+		t.Fatalf("expected resting users in stats: %+v", stats)
+	}
+}
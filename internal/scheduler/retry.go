@@ -0,0 +1,130 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"oas-cloud-go/internal/cache"
+	"oas-cloud-go/internal/metrics"
+	"oas-cloud-go/internal/models"
+	"oas-cloud-go/internal/taskmeta"
+
+	"gorm.io/gorm"
+)
+
+// LoadJobRetryPolicies returns the retry policy of each job, read from the
+// task config of the job's user.
+func LoadJobRetryPolicies(db *gorm.DB, jobs []models.TaskJob) (map[uint]taskmeta.RetryPolicy, error) {
+	userIDs := make([]uint, 0, len(jobs))
+	seen := make(map[uint]struct{}, len(jobs))
+	for _, job := range jobs {
+		if _, ok := seen[job.UserID]; !ok {
+			seen[job.UserID] = struct{}{}
+			userIDs = append(userIDs, job.UserID)
+		}
+	}
+	configs := make(map[uint]map[string]any, len(userIDs))
+	if len(userIDs) > 0 {
+		var rows []models.UserTaskConfig
+		if err := db.Select("user_id, task_config").Where("user_id IN ?", userIDs).Find(&rows).Error; err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			configs[row.UserID] = map[string]any(row.TaskConfig)
+		}
+	}
+	policies := make(map[uint]taskmeta.RetryPolicy, len(jobs))
+	for _, job := range jobs {
+		taskMap, _ := configs[job.UserID][job.TaskType].(map[string]any)
+		policies[job.ID] = taskmeta.RetryPolicyFor(job.TaskType, taskMap)
+	}
+	return policies, nil
+}
+
+// FailedJobHandler finishes a job that an expired lease failed for good, as
+// an agent's final failure report would: next_time, notification, failure
+// streak and the account lease. job is as it was before the expiry, so that
+// LeasedByNode still names the node that held it.
+type FailedJobHandler func(ctx context.Context, job models.TaskJob, message string, now time.Time)
+
+// ExpireJobLeases handles leased/running jobs whose lease has expired. Each
+// expiry counts as a failed attempt with error code LEASE_TIMEOUT: a job with
+// attempts left goes back to pending after the retry backoff, a job out of
+// attempts fails for good and is handed to onFailed, which may be nil.
+// managerID 0 covers every manager.
+func ExpireJobLeases(ctx context.Context, db *gorm.DB, store cache.Store, managerID uint, now time.Time, onFailed FailedJobHandler) (int64, int64, error) {
+	db = db.WithContext(ctx)
+	query := db.Where("status IN ? AND lease_until IS NOT NULL AND lease_until < ?",
+		[]string{models.JobStatusLeased, models.JobStatusRunning}, now)
+	if managerID != 0 {
+		query = query.Where("manager_id = ?", managerID)
+	}
+	var expiredJobs []models.TaskJob
+	if err := query.Find(&expiredJobs).Error; err != nil {
+		return 0, 0, err
+	}
+	if len(expiredJobs) == 0 {
+		return 0, 0, nil
+	}
+	policies, err := LoadJobRetryPolicies(db, expiredJobs)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var requeued, failed int64
+	events := make([]models.TaskJobEvent, 0, len(expiredJobs))
+	var failedJobs []models.TaskJob
+	var failedMessages []string
+	for _, job := range expiredJobs {
+		attempts := job.Attempts + 1
+		retry, delay := policies[job.ID].Decide(attempts, job.MaxAttempts, taskmeta.ErrorCodeLeaseTimeout)
+		updates := map[string]any{
+			"leased_by_node": "",
+			"lease_until":    nil,
+			"updated_at":     now,
+			"attempts":       attempts,
+		}
+		event := models.TaskJobEvent{JobID: job.ID, ErrorCode: taskmeta.ErrorCodeLeaseTimeout, EventAt: now}
+		if retry {
+			updates["status"] = models.JobStatusPending
+			updates["scheduled_at"] = now.Add(delay)
+			event.EventType = models.JobStatusRequeued
+			event.Message = fmt.Sprintf("租约超时（第 %d/%d 次尝试），%s后重试", attempts, job.MaxAttempts, taskmeta.FormatRetryDelay(delay))
+		} else {
+			updates["status"] = models.JobStatusFailed
+			event.EventType = "lease_expired"
+			event.Message = fmt.Sprintf("租约超时，已达最大尝试次数 %d，任务失败", job.MaxAttempts)
+		}
+		// Guard on the lease so that a report racing with the expiry wins.
+		result := db.Model(&models.TaskJob{}).
+			Where("id = ? AND status = ? AND lease_until < ?", job.ID, job.Status, now).
+			Updates(updates)
+		if result.Error != nil {
+			return requeued, failed, result.Error
+		}
+		if result.RowsAffected == 0 {
+			continue
+		}
+		if retry {
+			requeued++
+			metrics.LeaseExpirations.WithLabelValues("requeued").Inc()
+		} else {
+			failed++
+			metrics.LeaseExpirations.WithLabelValues("failed").Inc()
+			failedJobs = append(failedJobs, job)
+			failedMessages = append(failedMessages, event.Message)
+		}
+		events = append(events, event)
+		_ = store.ClearJobLease(ctx, job.ManagerID, job.ID)
+	}
+	if len(events) > 0 {
+		_ = db.Create(&events).Error
+	}
+	if onFailed != nil {
+		for i, job := range failedJobs {
+			onFailed(ctx, job, failedMessages[i], now)
+		}
+	}
+	return requeued, failed, nil
+}
@@ -0,0 +1,77 @@
+package scheduler
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"oas-cloud-go/internal/models"
+	"oas-cloud-go/internal/taskmeta"
+)
+
+func TestExpireJobLeasesRetriesThenFails(t *testing.T) {
+	g, db := setupGeneratorTest(t)
+	now := time.Date(2026, 3, 2, 10, 0, 0, 0, time.UTC)
+
+	taskConfig := taskmeta.BuildDefaultTaskConfigByType(models.UserTypeDaily)
+	taskConfig["悬赏"].(map[string]any)["retry"] = map[string]any{"base_delay_seconds": 120}
+	user, _ := seedUserAndConfig(t, db, models.UserTypeDaily, taskConfig)
+
+	expired := now.Add(-time.Minute)
+	newJob := func(status string, attempts int) models.TaskJob {
+		job := models.TaskJob{
+			ManagerID:    user.ManagerID,
+			UserID:       user.ID,
+			TaskType:     "悬赏",
+			ScheduledAt:  now.Add(-time.Hour),
+			Status:       status,
+			LeasedByNode: "node-retry",
+			LeaseUntil:   &expired,
+			Attempts:     attempts,
+			MaxAttempts:  3,
+			CreatedAt:    now,
+			UpdatedAt:    now,
+		}
+		if err := db.Create(&job).Error; err != nil {
+			t.Fatalf("create job failed: %v", err)
+		}
+		return job
+	}
+	first := newJob(models.JobStatusRunning, 1)
+	last := newJob(models.JobStatusLeased, 2)
+
+	requeued, failed, err := g.resetAllExpiredJobLeases(context.Background(), now)
+	if err != nil || requeued != 1 || failed != 1 {
+		t.Fatalf("expected 1 requeued and 1 failed, got %d %d err=%v", requeued, failed, err)
+	}
+
+	var retried models.TaskJob
+	if err := db.Where("id = ?", first.ID).First(&retried).Error; err != nil {
+		t.Fatalf("reload job failed: %v", err)
+	}
+	if retried.Status != models.JobStatusPending || retried.Attempts != 2 || retried.LeaseUntil != nil {
+		t.Fatalf("job with attempts left should be pending again: %+v", retried)
+	}
+	// Second failure doubles the 2m base delay.
+	if !retried.ScheduledAt.Equal(now.Add(4 * time.Minute)) {
+		t.Fatalf("expected backoff to %v, got %v", now.Add(4*time.Minute), retried.ScheduledAt)
+	}
+	var exhausted models.TaskJob
+	if err := db.Where("id = ?", last.ID).First(&exhausted).Error; err != nil {
+		t.Fatalf("reload job failed: %v", err)
+	}
+	if exhausted.Status != models.JobStatusFailed || exhausted.Attempts != 3 {
+		t.Fatalf("job out of attempts should fail: %+v", exhausted)
+	}
+
+	var requeueEvents, expiredEvents int64
+	db.Model(&models.TaskJobEvent{}).Where("job_id = ? AND event_type = ?", first.ID, models.JobStatusRequeued).Count(&requeueEvents)
+	db.Model(&models.TaskJobEvent{}).Where("job_id = ? AND event_type = ?", last.ID, "lease_expired").Count(&expiredEvents)
+	if requeueEvents != 1 || expiredEvents != 1 {
+		t.Fatalf("expected requeue and expiry events, got %d %d", requeueEvents, expiredEvents)
+	}
+
+	if requeued, failed, err := ExpireJobLeases(context.Background(), db, g.store, 0, now, nil); err != nil || requeued+failed != 0 {
+		t.Fatalf("nothing should be left to expire, got %d %d err=%v", requeued, failed, err)
+	}
+}
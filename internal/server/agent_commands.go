@@ -0,0 +1,324 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"oas-cloud-go/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// defaultAgentCommandTTL is how long a command waits for its node when the
+// manager gives no expiry.
+const defaultAgentCommandTTL = 10 * time.Minute
+
+func agentCommandView(cmd models.AgentCommand) gin.H {
+	return gin.H{
+		"id":              cmd.ID,
+		"node_id":         cmd.NodeID,
+		"command":         cmd.Command,
+		"args":            cmd.Args,
+		"status":          cmd.Status,
+		"message":         cmd.Message,
+		"result":          cmd.Result,
+		"expires_at":      cmd.ExpiresAt,
+		"delivered_at":    cmd.DeliveredAt,
+		"acknowledged_at": cmd.AckedAt,
+		"finished_at":     cmd.FinishedAt,
+		"created_at":      cmd.CreatedAt,
+	}
+}
+
+// expireAgentCommands marks the node's commands that were not acknowledged
+// before their expiry.
+func (s *Server) expireAgentCommands(db *gorm.DB, managerID uint, nodeID string, now time.Time) error {
+	return db.Model(&models.AgentCommand{}).
+		Where("manager_id = ? AND node_id = ? AND status IN ? AND expires_at <= ?", managerID, nodeID,
+			[]string{models.AgentCommandPending, models.AgentCommandDelivered}, now).
+		Updates(map[string]any{"status": models.AgentCommandExpired, "updated_at": now}).Error
+}
+
+// deliverAgentCommands hands the node its pending commands, oldest first, and
+// marks them delivered. Errors are logged so that a poll or heartbeat still
+// goes through; the commands stay pending for the next one.
+func (s *Server) deliverAgentCommands(ctx context.Context, managerID uint, nodeID string, now time.Time) []gin.H {
+	var commands []models.AgentCommand
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := s.expireAgentCommands(tx, managerID, nodeID, now); err != nil {
+			return err
+		}
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("manager_id = ? AND node_id = ? AND status = ?", managerID, nodeID, models.AgentCommandPending).
+			Order("id asc").Find(&commands).Error; err != nil {
+			return err
+		}
+		if len(commands) == 0 {
+			return nil
+		}
+		ids := make([]uint, 0, len(commands))
+		for _, cmd := range commands {
+			ids = append(ids, cmd.ID)
+		}
+		return tx.Model(&models.AgentCommand{}).Where("id IN ?", ids).Updates(map[string]any{
+			"status":       models.AgentCommandDelivered,
+			"delivered_at": now,
+			"updated_at":   now,
+		}).Error
+	})
+	items := make([]gin.H, 0, len(commands))
+	if err != nil {
+		slog.Warn("deliver agent commands failed", "node_id", nodeID, "error", err)
+		return items
+	}
+	for _, cmd := range commands {
+		items = append(items, gin.H{
+			"id":         cmd.ID,
+			"command":    cmd.Command,
+			"args":       cmd.Args,
+			"expires_at": cmd.ExpiresAt,
+			"created_at": cmd.CreatedAt,
+		})
+	}
+	return items
+}
+
+// managerListAgentCommands shows the command history of a node, newest first.
+func (s *Server) managerListAgentCommands(c *gin.Context) {
+	managerID := getUint(c, ctxActorIDKey)
+	node, ok := s.loadManagerAgentNode(c, managerID)
+	if !ok {
+		return
+	}
+	now := time.Now().UTC()
+	if err := s.expireAgentCommands(s.db, managerID, node.NodeID, now); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "查询节点命令失败"})
+		return
+	}
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if limit <= 0 || limit > 200 {
+		limit = 50
+	}
+	query := s.db.Where("manager_id = ? AND node_id = ?", managerID, node.NodeID)
+	if status := strings.TrimSpace(c.Query("status")); status != "" {
+		query = query.Where("status = ?", status)
+	}
+	var commands []models.AgentCommand
+	if err := query.Order("id desc").Limit(limit).Find(&commands).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "查询节点命令失败"})
+		return
+	}
+	items := make([]gin.H, 0, len(commands))
+	for _, cmd := range commands {
+		items = append(items, agentCommandView(cmd))
+	}
+	c.JSON(http.StatusOK, gin.H{"items": items, "total": len(items)})
+}
+
+// managerCreateAgentCommand queues a command for a node and wakes its long
+// poll so that it arrives right away.
+func (s *Server) managerCreateAgentCommand(c *gin.Context) {
+	managerID := getUint(c, ctxActorIDKey)
+	node, ok := s.loadManagerAgentNode(c, managerID)
+	if !ok {
+		return
+	}
+	var req createAgentCommandRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"detail": err.Error()})
+		return
+	}
+	now := time.Now().UTC()
+	ttl := defaultAgentCommandTTL
+	if req.ExpiresInSeconds > 0 {
+		ttl = time.Duration(req.ExpiresInSeconds) * time.Second
+	}
+	args := req.Args
+	if args == nil {
+		args = map[string]any{}
+	}
+	cmd := models.AgentCommand{
+		ManagerID: managerID,
+		NodeID:    node.NodeID,
+		Command:   req.Command,
+		Args:      datatypes.JSONMap(args),
+		Status:    models.AgentCommandPending,
+		Result:    datatypes.JSONMap{},
+		ExpiresAt: now.Add(ttl),
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if err := s.db.Create(&cmd).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "创建节点命令失败"})
+		return
+	}
+	s.wakeAgents(c.Request.Context(), managerID)
+	s.audit(models.ActorTypeManager, managerID, "create_agent_command", "agent_command", cmd.ID, datatypes.JSONMap{
+		"node_id": cmd.NodeID,
+		"command": cmd.Command,
+		"args":    args,
+	}, c.ClientIP())
+	c.JSON(http.StatusCreated, agentCommandView(cmd))
+}
+
+// managerCancelAgentCommand withdraws a command the node has not
+// acknowledged yet.
+func (s *Server) managerCancelAgentCommand(c *gin.Context) {
+	managerID := getUint(c, ctxActorIDKey)
+	node, ok := s.loadManagerAgentNode(c, managerID)
+	if !ok {
+		return
+	}
+	commandID, ok := parseUintParam(c, "command_id")
+	if !ok {
+		return
+	}
+	now := time.Now().UTC()
+	result := s.db.Model(&models.AgentCommand{}).
+		Where("id = ? AND manager_id = ? AND node_id = ? AND status IN ?", commandID, managerID, node.NodeID,
+			[]string{models.AgentCommandPending, models.AgentCommandDelivered}).
+		Updates(map[string]any{"status": models.AgentCommandCancelled, "finished_at": now, "updated_at": now})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "取消节点命令失败"})
+		return
+	}
+	var cmd models.AgentCommand
+	if err := s.db.Where("id = ? AND manager_id = ? AND node_id = ?", commandID, managerID, node.NodeID).First(&cmd).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"detail": "命令不存在"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusConflict, gin.H{"detail": "只能取消未确认的命令"})
+		return
+	}
+	s.audit(models.ActorTypeManager, managerID, "cancel_agent_command", "agent_command", cmd.ID, datatypes.JSONMap{
+		"node_id": cmd.NodeID,
+		"command": cmd.Command,
+	}, c.ClientIP())
+	c.JSON(http.StatusOK, agentCommandView(cmd))
+}
+
+// agentAckCommand confirms that the node received a command and is carrying
+// it out. Acknowledging twice is harmless.
+func (s *Server) agentAckCommand(c *gin.Context) {
+	var req agentCommandAckRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"detail": err.Error()})
+		return
+	}
+	managerID := getUint(c, ctxManagerIDKey)
+	cmd, ok := s.loadNodeAgentCommand(c, managerID, req.NodeID)
+	if !ok {
+		return
+	}
+	now := time.Now().UTC()
+	if cmd.Status == models.AgentCommandDelivered && !cmd.ExpiresAt.After(now) {
+		if err := s.expireAgentCommands(s.db, managerID, cmd.NodeID, now); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"detail": "确认命令失败"})
+			return
+		}
+		cmd.Status = models.AgentCommandExpired
+	}
+	switch cmd.Status {
+	case models.AgentCommandAcknowledged:
+	case models.AgentCommandDelivered:
+		if err := s.db.Model(&models.AgentCommand{}).Where("id = ? AND status = ?", cmd.ID, models.AgentCommandDelivered).
+			Updates(map[string]any{"status": models.AgentCommandAcknowledged, "acked_at": now, "updated_at": now}).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"detail": "确认命令失败"})
+			return
+		}
+		cmd.Status = models.AgentCommandAcknowledged
+		cmd.AckedAt = &now
+	default:
+		c.JSON(http.StatusConflict, gin.H{"detail": "命令状态为 " + cmd.Status + "，不能确认"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"id": cmd.ID, "status": cmd.Status})
+}
+
+// agentReportCommandResult finishes a command with the node's outcome.
+func (s *Server) agentReportCommandResult(c *gin.Context) {
+	var req agentCommandResultRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"detail": err.Error()})
+		return
+	}
+	managerID := getUint(c, ctxManagerIDKey)
+	cmd, ok := s.loadNodeAgentCommand(c, managerID, req.NodeID)
+	if !ok {
+		return
+	}
+	if cmd.Status != models.AgentCommandDelivered && cmd.Status != models.AgentCommandAcknowledged {
+		c.JSON(http.StatusConflict, gin.H{"detail": "命令状态为 " + cmd.Status + "，不能上报结果"})
+		return
+	}
+	now := time.Now().UTC()
+	status := models.AgentCommandFailed
+	if *req.Success {
+		status = models.AgentCommandSucceeded
+	}
+	result := req.Result
+	if result == nil {
+		result = map[string]any{}
+	}
+	updates := map[string]any{
+		"status":      status,
+		"message":     req.Message,
+		"result":      datatypes.JSONMap(result),
+		"finished_at": now,
+		"updated_at":  now,
+	}
+	if cmd.AckedAt == nil {
+		updates["acked_at"] = now
+	}
+	update := s.db.Model(&models.AgentCommand{}).
+		Where("id = ? AND status IN ?", cmd.ID, []string{models.AgentCommandDelivered, models.AgentCommandAcknowledged}).
+		Updates(updates)
+	if update.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "上报命令结果失败"})
+		return
+	}
+	if update.RowsAffected == 0 {
+		c.JSON(http.StatusConflict, gin.H{"detail": "命令已结束"})
+		return
+	}
+	s.audit(models.ActorTypeAgent, managerID, "agent_command_result", "agent_command", cmd.ID, datatypes.JSONMap{
+		"node_id": cmd.NodeID,
+		"command": cmd.Command,
+		"status":  status,
+		"message": req.Message,
+	}, c.ClientIP())
+	c.JSON(http.StatusOK, gin.H{"id": cmd.ID, "status": status})
+}
+
+func (s *Server) loadNodeAgentCommand(c *gin.Context, managerID uint, nodeID string) (models.AgentCommand, bool) {
+	var cmd models.AgentCommand
+	if !agentNodeMatches(c, nodeID) {
+		return cmd, false
+	}
+	commandID, ok := parseUintParam(c, "command_id")
+	if !ok {
+		return cmd, false
+	}
+	if err := s.db.Where("id = ? AND manager_id = ?", commandID, managerID).First(&cmd).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"detail": "命令不存在"})
+			return cmd, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "查询命令失败"})
+		return cmd, false
+	}
+	if cmd.NodeID != nodeID {
+		c.JSON(http.StatusForbidden, gin.H{"detail": "命令不属于该节点"})
+		return cmd, false
+	}
+	return cmd, true
+}
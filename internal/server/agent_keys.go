@@ -0,0 +1,327 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"oas-cloud-go/internal/auth"
+	"oas-cloud-go/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+)
+
+// Agent API keys are shown once, when created or rotated. The prefix that
+// stays visible in the console is long enough to tell keys apart.
+const (
+	agentKeyTokenPrefix = "oak"
+	agentKeyPrefixLen   = 12
+)
+
+func newAgentKeySecret() (raw string, prefix string, err error) {
+	raw, err = auth.GenerateOpaqueToken(agentKeyTokenPrefix, 24)
+	if err != nil {
+		return "", "", err
+	}
+	return raw, raw[:agentKeyPrefixLen], nil
+}
+
+// normalizeAllowedIPs checks an IP allowlist and returns it in the stored
+// comma-separated form.
+func normalizeAllowedIPs(entries []string) (string, error) {
+	normalized := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if strings.Contains(entry, "/") {
+			_, network, err := net.ParseCIDR(entry)
+			if err != nil {
+				return "", fmt.Errorf("无效的网段 %q", entry)
+			}
+			normalized = append(normalized, network.String())
+			continue
+		}
+		ip := net.ParseIP(entry)
+		if ip == nil {
+			return "", fmt.Errorf("无效的IP %q", entry)
+		}
+		normalized = append(normalized, ip.String())
+	}
+	return strings.Join(normalized, ","), nil
+}
+
+func splitAllowedIPs(stored string) []string {
+	if stored == "" {
+		return []string{}
+	}
+	return strings.Split(stored, ",")
+}
+
+// agentKeyAllowsIP reports whether clientIP may use a key with the stored
+// allowlist. An empty allowlist allows any address.
+func agentKeyAllowsIP(stored string, clientIP string) bool {
+	if stored == "" {
+		return true
+	}
+	ip := net.ParseIP(clientIP)
+	if ip == nil {
+		return false
+	}
+	for _, entry := range splitAllowedIPs(stored) {
+		if strings.Contains(entry, "/") {
+			if _, network, err := net.ParseCIDR(entry); err == nil && network.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		if allowed := net.ParseIP(entry); allowed != nil && allowed.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticateAgentKey resolves an agent login by API key to the key and its
+// manager, writing the error response when the key may not be used.
+func (s *Server) authenticateAgentKey(c *gin.Context, raw string, nodeID string, now time.Time) (*models.AgentKey, models.Manager, bool) {
+	var manager models.Manager
+	var key models.AgentKey
+	if err := s.db.Where("key_hash = ?", auth.HashToken(raw)).First(&key).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusUnauthorized, gin.H{"detail": "API Key 无效"})
+			return nil, manager, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "查询API Key失败"})
+		return nil, manager, false
+	}
+	if key.RevokedAt != nil || (key.ExpiresAt != nil && !key.ExpiresAt.After(now)) {
+		c.JSON(http.StatusUnauthorized, gin.H{"detail": "API Key 已吊销或已过期"})
+		return nil, manager, false
+	}
+	if key.NodeID != nodeID {
+		c.JSON(http.StatusForbidden, gin.H{"detail": "API Key 不属于该节点"})
+		return nil, manager, false
+	}
+	if !agentKeyAllowsIP(key.AllowedIPs, c.ClientIP()) {
+		c.JSON(http.StatusForbidden, gin.H{"detail": "当前IP不在API Key允许范围内"})
+		return nil, manager, false
+	}
+	if err := s.db.Where("id = ?", key.ManagerID).First(&manager).Error; err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"detail": "API Key 无效"})
+		return nil, manager, false
+	}
+	return &key, manager, true
+}
+
+func (s *Server) markAgentKeyUsed(keyID uint, clientIP string, now time.Time) {
+	if err := s.db.Model(&models.AgentKey{}).Where("id = ?", keyID).Updates(map[string]any{
+		"last_used_at": now,
+		"last_used_ip": clientIP,
+	}).Error; err != nil {
+		slog.Warn("update agent key last use failed", "key_id", keyID, "error", err)
+	}
+}
+
+func agentKeyView(key models.AgentKey, now time.Time) gin.H {
+	status := "active"
+	switch {
+	case key.RevokedAt != nil:
+		status = "revoked"
+	case key.ExpiresAt != nil && !key.ExpiresAt.After(now):
+		status = "expired"
+	}
+	return gin.H{
+		"id":           key.ID,
+		"node_id":      key.NodeID,
+		"name":         key.Name,
+		"key_prefix":   key.KeyPrefix,
+		"allowed_ips":  splitAllowedIPs(key.AllowedIPs),
+		"status":       status,
+		"expires_at":   key.ExpiresAt,
+		"revoked_at":   key.RevokedAt,
+		"last_used_at": key.LastUsedAt,
+		"last_used_ip": key.LastUsedIP,
+		"created_at":   key.CreatedAt,
+	}
+}
+
+func (s *Server) managerListAgentKeys(c *gin.Context) {
+	managerID := getUint(c, ctxActorIDKey)
+	query := s.db.Where("manager_id = ?", managerID)
+	if nodeID := strings.TrimSpace(c.Query("node_id")); nodeID != "" {
+		query = query.Where("node_id = ?", nodeID)
+	}
+	var keys []models.AgentKey
+	if err := query.Order("id desc").Find(&keys).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "查询API Key失败"})
+		return
+	}
+	now := time.Now().UTC()
+	items := make([]gin.H, 0, len(keys))
+	for _, key := range keys {
+		items = append(items, agentKeyView(key, now))
+	}
+	c.JSON(http.StatusOK, gin.H{"items": items, "total": len(items)})
+}
+
+func (s *Server) managerCreateAgentKey(c *gin.Context) {
+	var req createAgentKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"detail": err.Error()})
+		return
+	}
+	managerID := getUint(c, ctxActorIDKey)
+	nodeID := strings.TrimSpace(req.NodeID)
+	allowed, err := normalizeAllowedIPs(req.AllowedIPs)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"detail": err.Error()})
+		return
+	}
+	// Node IDs are unique across managers; a key must not claim another
+	// manager's node, registered or promised to it by an active key.
+	var taken int64
+	if err := s.db.Model(&models.AgentNode{}).Where("node_id = ? AND manager_id <> ?", nodeID, managerID).Count(&taken).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "查询节点失败"})
+		return
+	}
+	if taken == 0 {
+		if err := s.db.Model(&models.AgentKey{}).Where("node_id = ? AND manager_id <> ? AND revoked_at IS NULL", nodeID, managerID).Count(&taken).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"detail": "查询节点失败"})
+			return
+		}
+	}
+	if taken > 0 {
+		c.JSON(http.StatusConflict, gin.H{"detail": "该节点已属于其他管理员"})
+		return
+	}
+	raw, prefix, err := newAgentKeySecret()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "生成API Key失败"})
+		return
+	}
+	now := time.Now().UTC()
+	key := models.AgentKey{
+		ManagerID:  managerID,
+		NodeID:     nodeID,
+		Name:       strings.TrimSpace(req.Name),
+		KeyPrefix:  prefix,
+		KeyHash:    auth.HashToken(raw),
+		AllowedIPs: allowed,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+	if req.ExpiresInDays > 0 {
+		expiresAt := now.AddDate(0, 0, req.ExpiresInDays)
+		key.ExpiresAt = &expiresAt
+	}
+	if err := s.db.Create(&key).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "创建API Key失败"})
+		return
+	}
+	s.audit(models.ActorTypeManager, managerID, "create_agent_key", "agent_key", key.ID, datatypes.JSONMap{
+		"node_id":     key.NodeID,
+		"key_prefix":  key.KeyPrefix,
+		"allowed_ips": allowed,
+	}, c.ClientIP())
+	view := agentKeyView(key, now)
+	view["api_key"] = raw
+	c.JSON(http.StatusCreated, view)
+}
+
+// managerRotateAgentKey replaces the secret of a key and keeps its node,
+// allowlist and expiry. Sessions logged in with the old secret stay valid
+// until they expire; revoke the key to end them at once.
+func (s *Server) managerRotateAgentKey(c *gin.Context) {
+	managerID := getUint(c, ctxActorIDKey)
+	key, ok := s.loadManagerAgentKey(c, managerID)
+	if !ok {
+		return
+	}
+	now := time.Now().UTC()
+	if key.RevokedAt != nil {
+		c.JSON(http.StatusConflict, gin.H{"detail": "API Key 已吊销"})
+		return
+	}
+	raw, prefix, err := newAgentKeySecret()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "生成API Key失败"})
+		return
+	}
+	key.KeyPrefix = prefix
+	key.KeyHash = auth.HashToken(raw)
+	key.UpdatedAt = now
+	if err := s.db.Model(&models.AgentKey{}).Where("id = ?", key.ID).Updates(map[string]any{
+		"key_prefix": key.KeyPrefix,
+		"key_hash":   key.KeyHash,
+		"updated_at": now,
+	}).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "轮换API Key失败"})
+		return
+	}
+	s.audit(models.ActorTypeManager, managerID, "rotate_agent_key", "agent_key", key.ID, datatypes.JSONMap{
+		"node_id":    key.NodeID,
+		"key_prefix": key.KeyPrefix,
+	}, c.ClientIP())
+	view := agentKeyView(key, now)
+	view["api_key"] = raw
+	c.JSON(http.StatusOK, view)
+}
+
+// managerRevokeAgentKey disables a key for good and ends the Redis sessions
+// of its node.
+func (s *Server) managerRevokeAgentKey(c *gin.Context) {
+	managerID := getUint(c, ctxActorIDKey)
+	key, ok := s.loadManagerAgentKey(c, managerID)
+	if !ok {
+		return
+	}
+	now := time.Now().UTC()
+	if key.RevokedAt == nil {
+		key.RevokedAt = &now
+		if err := s.db.Model(&models.AgentKey{}).Where("id = ?", key.ID).Updates(map[string]any{
+			"revoked_at": now,
+			"updated_at": now,
+		}).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"detail": "吊销API Key失败"})
+			return
+		}
+	}
+	sessions, err := s.redisStore.RevokeAgentSessions(c.Request.Context(), managerID, key.NodeID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "吊销Redis Agent会话失败"})
+		return
+	}
+	s.audit(models.ActorTypeManager, managerID, "revoke_agent_key", "agent_key", key.ID, datatypes.JSONMap{
+		"node_id":    key.NodeID,
+		"key_prefix": key.KeyPrefix,
+		"sessions":   sessions,
+	}, c.ClientIP())
+	view := agentKeyView(key, now)
+	view["revoked_sessions"] = sessions
+	c.JSON(http.StatusOK, view)
+}
+
+func (s *Server) loadManagerAgentKey(c *gin.Context, managerID uint) (models.AgentKey, bool) {
+	var key models.AgentKey
+	id, ok := parseUintParam(c, "id")
+	if !ok {
+		return key, false
+	}
+	if err := s.db.Where("id = ? AND manager_id = ?", id, managerID).First(&key).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"detail": "API Key 不存在"})
+			return key, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "查询API Key失败"})
+		return key, false
+	}
+	return key, true
+}
@@ -0,0 +1,711 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"oas-cloud-go/internal/metrics"
+	"oas-cloud-go/internal/models"
+	"oas-cloud-go/internal/taskmeta"
+	"oas-cloud-go/internal/tracing"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+)
+
+const (
+	agentLogQueueSize         = 4096
+	agentLogBatchSize         = 200
+	agentLogFlushInterval     = 500 * time.Millisecond
+	maxAgentLogFieldsBytes    = 4096
+	maxAgentLogSearchTerms    = 5
+	agentLogTailDefault       = 50
+	agentLogTailMax           = 500
+	agentLogTailBuffer        = 256
+	agentLogTailPing          = 15 * time.Second
+	agentLogsResubscribeDelay = 5 * time.Second
+)
+
+// agentLogLevels lists the stored levels from least to most severe. A level
+// filter keeps that level and everything above it.
+var agentLogLevels = []string{"debug", "info", "warn", "error"}
+
+var agentLogFieldKeyPattern = regexp.MustCompile(`^[A-Za-z0-9_]{1,64}$`)
+
+func agentLogLevelRank(level string) int {
+	for i, known := range agentLogLevels {
+		if known == level {
+			return i
+		}
+	}
+	return -1
+}
+
+// normalizeAgentLogLevel maps what agents send, Python logging names
+// included, onto the stored levels. Anything unknown is kept as info.
+func normalizeAgentLogLevel(raw string) string {
+	switch strings.ToLower(strings.TrimSpace(raw)) {
+	case "debug", "trace":
+		return "debug"
+	case "warn", "warning":
+		return "warn"
+	case "error", "err", "critical", "fatal":
+		return "error"
+	default:
+		return "info"
+	}
+}
+
+// parseAgentLogTime reads the timestamp an agent put on a line: RFC 3339, or
+// a Beijing wall clock without a zone. Lines without a usable stamp take the
+// receive time.
+func parseAgentLogTime(raw string, now time.Time) time.Time {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return now
+	}
+	if t, err := time.Parse(time.RFC3339Nano, raw); err == nil {
+		return t.UTC()
+	}
+	for _, layout := range []string{"2006-01-02T15:04:05.999999999", "2006-01-02 15:04:05.999999999"} {
+		if t, err := time.ParseInLocation(layout, raw, taskmeta.BJLoc); err == nil {
+			return t.UTC()
+		}
+	}
+	return now
+}
+
+// agentLogItem is the API and pub/sub shape of a stored log line.
+type agentLogItem struct {
+	ID        uint           `json:"id"`
+	ManagerID uint           `json:"manager_id"`
+	UserID    uint           `json:"user_id"`
+	JobID     uint           `json:"job_id"`
+	NodeID    string         `json:"node_id"`
+	Level     string         `json:"level"`
+	Type      string         `json:"type"`
+	Message   string         `json:"message"`
+	Fields    map[string]any `json:"fields"`
+	LoggedAt  time.Time      `json:"logged_at"`
+	CreatedAt time.Time      `json:"created_at"`
+}
+
+func toAgentLogItem(row models.AgentLog) agentLogItem {
+	fields := map[string]any(row.Fields)
+	if fields == nil {
+		fields = map[string]any{}
+	}
+	return agentLogItem{
+		ID:        row.ID,
+		ManagerID: row.ManagerID,
+		UserID:    row.UserID,
+		JobID:     row.JobID,
+		NodeID:    row.NodeID,
+		Level:     row.Level,
+		Type:      row.Type,
+		Message:   row.Message,
+		Fields:    fields,
+		LoggedAt:  row.LoggedAt,
+		CreatedAt: row.CreatedAt,
+	}
+}
+
+// agentLogFilter selects log lines, both in the table and on the live tail.
+type agentLogFilter struct {
+	ManagerID  uint
+	UserID     uint // 0 covers every user of the manager
+	JobID      uint
+	NodeID     string
+	Type       string
+	MinLevel   int
+	Terms      []string // all must appear in the message, case-insensitively
+	FieldKey   string
+	FieldValue string
+	Since      time.Time // listing only, on logged_at
+	Until      time.Time
+}
+
+// parseAgentLogFilter reads the shared query parameters of the agent log
+// endpoints. It answers 400 itself and returns false on bad input.
+func parseAgentLogFilter(c *gin.Context, managerID, userID uint) (agentLogFilter, bool) {
+	filter := agentLogFilter{
+		ManagerID: managerID,
+		UserID:    userID,
+		NodeID:    strings.TrimSpace(c.Query("node_id")),
+		Type:      strings.TrimSpace(c.Query("type")),
+	}
+	if raw := c.Query("job_id"); raw != "" {
+		jobID, err := strconv.ParseUint(raw, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"detail": "job_id 无效"})
+			return filter, false
+		}
+		filter.JobID = uint(jobID)
+	}
+	if raw := strings.TrimSpace(c.Query("level")); raw != "" {
+		level := strings.ToLower(raw)
+		if level == "warning" {
+			level = "warn"
+		}
+		filter.MinLevel = agentLogLevelRank(level)
+		if filter.MinLevel < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"detail": "level 应为 debug、info、warn 或 error"})
+			return filter, false
+		}
+	}
+	if q := c.Query("q"); q != "" {
+		filter.Terms = strings.Fields(q)
+		if len(q) > 200 || len(filter.Terms) > maxAgentLogSearchTerms {
+			c.JSON(http.StatusBadRequest, gin.H{"detail": "搜索词过长"})
+			return filter, false
+		}
+	}
+	if raw := c.Query("field"); raw != "" {
+		key, value, found := strings.Cut(raw, "=")
+		if !found || !agentLogFieldKeyPattern.MatchString(key) {
+			c.JSON(http.StatusBadRequest, gin.H{"detail": "field 格式应为 key=value"})
+			return filter, false
+		}
+		filter.FieldKey, filter.FieldValue = key, value
+	}
+	for name, dst := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		raw := c.Query(name)
+		if raw == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"detail": name + " 时间格式无效"})
+			return filter, false
+		}
+		*dst = parsed.UTC()
+	}
+	return filter, true
+}
+
+var agentLogLikeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// apply narrows query to the lines the filter selects. Message search runs
+// on the trigram index on Postgres.
+func (f agentLogFilter) apply(query *gorm.DB, postgres bool) *gorm.DB {
+	query = query.Where("manager_id = ?", f.ManagerID)
+	if f.UserID != 0 {
+		query = query.Where("user_id = ?", f.UserID)
+	}
+	if f.JobID != 0 {
+		query = query.Where("job_id = ?", f.JobID)
+	}
+	if f.NodeID != "" {
+		query = query.Where("node_id = ?", f.NodeID)
+	}
+	if f.Type != "" {
+		query = query.Where("type = ?", f.Type)
+	}
+	if f.MinLevel > 0 {
+		query = query.Where("level IN ?", agentLogLevels[f.MinLevel:])
+	}
+	like := "message LIKE ? ESCAPE '\\'"
+	if postgres {
+		like = "message ILIKE ? ESCAPE '\\'"
+	}
+	for _, term := range f.Terms {
+		query = query.Where(like, "%"+agentLogLikeEscaper.Replace(term)+"%")
+	}
+	if f.FieldKey != "" {
+		if postgres {
+			query = query.Where("fields ->> ? = ?", f.FieldKey, f.FieldValue)
+		} else {
+			query = query.Where("CAST(json_extract(fields, ?) AS TEXT) = ?", "$."+f.FieldKey, f.FieldValue)
+		}
+	}
+	if !f.Since.IsZero() {
+		query = query.Where("logged_at >= ?", f.Since)
+	}
+	if !f.Until.IsZero() {
+		query = query.Where("logged_at < ?", f.Until)
+	}
+	return query
+}
+
+// match is apply for a single line on the live tail; the time range does not
+// apply there.
+func (f agentLogFilter) match(item agentLogItem) bool {
+	if item.ManagerID != f.ManagerID ||
+		(f.UserID != 0 && item.UserID != f.UserID) ||
+		(f.JobID != 0 && item.JobID != f.JobID) ||
+		(f.NodeID != "" && item.NodeID != f.NodeID) ||
+		(f.Type != "" && item.Type != f.Type) ||
+		agentLogLevelRank(item.Level) < f.MinLevel {
+		return false
+	}
+	if len(f.Terms) > 0 {
+		message := strings.ToLower(item.Message)
+		for _, term := range f.Terms {
+			if !strings.Contains(message, strings.ToLower(term)) {
+				return false
+			}
+		}
+	}
+	if f.FieldKey != "" {
+		value, ok := item.Fields[f.FieldKey]
+		if !ok || fmt.Sprint(value) != f.FieldValue {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Server) isPostgres() bool {
+	return s.db.Dialector.Name() == "postgres"
+}
+
+// agentLogTail fans stored log lines out to the live tails open on this
+// replica. Lines reach every replica over the Redis agent log channel.
+type agentLogTail struct {
+	mu   sync.Mutex
+	subs map[*agentLogSub]struct{}
+}
+
+type agentLogSub struct {
+	filter agentLogFilter
+	ch     chan agentLogItem
+	// lagged is set when a line was dropped because the tail fell behind;
+	// the stream then catches up from the table.
+	lagged atomic.Bool
+}
+
+func newAgentLogTail() *agentLogTail {
+	return &agentLogTail{subs: make(map[*agentLogSub]struct{})}
+}
+
+func (t *agentLogTail) subscribe(filter agentLogFilter) (*agentLogSub, func()) {
+	sub := &agentLogSub{filter: filter, ch: make(chan agentLogItem, agentLogTailBuffer)}
+	t.mu.Lock()
+	t.subs[sub] = struct{}{}
+	t.mu.Unlock()
+	return sub, func() {
+		t.mu.Lock()
+		delete(t.subs, sub)
+		t.mu.Unlock()
+	}
+}
+
+func (t *agentLogTail) broadcast(items []agentLogItem) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for sub := range t.subs {
+		for _, item := range items {
+			if !sub.filter.match(item) {
+				continue
+			}
+			select {
+			case sub.ch <- item:
+			default:
+				sub.lagged.Store(true)
+				metrics.AgentLogLines.WithLabelValues("tail_dropped").Inc()
+			}
+		}
+	}
+}
+
+// agentLogsListener feeds the agent log channel into the local tails for the
+// lifetime of the process.
+func (s *Server) agentLogsListener() {
+	for {
+		err := s.redisStore.SubscribeAgentLogs(context.Background(), func(payload []byte) {
+			var items []agentLogItem
+			if err := json.Unmarshal(payload, &items); err != nil {
+				slog.Warn("decode agent logs failed", "error", err)
+				return
+			}
+			s.agentLogTail.broadcast(items)
+		})
+		slog.Warn("agent logs subscription ended, resubscribing", "error", err)
+		time.Sleep(agentLogsResubscribeDelay)
+	}
+}
+
+// publishAgentLogs announces stored lines to the tails on every replica.
+// When Redis is unreachable the tails on this replica still get them.
+func (s *Server) publishAgentLogs(ctx context.Context, rows []models.AgentLog) {
+	items := make([]agentLogItem, 0, len(rows))
+	for _, row := range rows {
+		items = append(items, toAgentLogItem(row))
+	}
+	payload, err := json.Marshal(items)
+	if err == nil {
+		err = s.redisStore.PublishAgentLogs(ctx, payload)
+	}
+	if err != nil {
+		slog.Warn("publish agent logs failed", "lines", len(items), "error", err)
+		s.agentLogTail.broadcast(items)
+	}
+}
+
+// writeAgentLogs stores a batch of lines and publishes them to the tails.
+func (s *Server) writeAgentLogs(ctx context.Context, rows []models.AgentLog) error {
+	ctx, span := tracing.Start(ctx, "agent_logs.flush", attribute.Int("agent_logs.entries", len(rows)))
+	err := s.db.WithContext(ctx).Create(&rows).Error
+	tracing.End(span, err)
+	if err != nil {
+		metrics.AgentLogLines.WithLabelValues("failed").Add(float64(len(rows)))
+		return err
+	}
+	metrics.AgentLogLines.WithLabelValues("stored").Add(float64(len(rows)))
+	s.publishAgentLogs(ctx, rows)
+	return nil
+}
+
+// enqueueAgentLogs hands lines to the batch writer. Once the queue is full the
+// rest of the request is written inline, which slows the reporting agent
+// down rather than dropping its logs.
+func (s *Server) enqueueAgentLogs(ctx context.Context, rows []models.AgentLog) error {
+	for i, row := range rows {
+		select {
+		case s.agentLogCh <- row:
+		default:
+			slog.Warn("agent log queue full, writing inline", "lines", len(rows)-i)
+			return s.writeAgentLogs(ctx, rows[i:])
+		}
+	}
+	return nil
+}
+
+func (s *Server) agentLogWorker() {
+	batch := make([]models.AgentLog, 0, agentLogBatchSize)
+	ticker := time.NewTicker(agentLogFlushInterval)
+	defer ticker.Stop()
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := s.writeAgentLogs(context.Background(), batch); err != nil {
+			slog.Error("agent log batch insert failed", "lines", len(batch), "error", err)
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case row, ok := <-s.agentLogCh:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, row)
+			if len(batch) >= agentLogBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+func (s *Server) agentReportLogs(c *gin.Context) {
+	userID, ok := parseUintParam(c, "user_id")
+	if !ok {
+		return
+	}
+	managerID := getUint(c, ctxManagerIDKey)
+
+	var req agentReportLogsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"detail": err.Error()})
+		return
+	}
+
+	// Verify user belongs to this manager
+	var count int64
+	if err := s.db.Model(&models.User{}).Where("id = ? AND manager_id = ?", userID, managerID).Count(&count).Error; err != nil || count == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"detail": "用户不存在"})
+		return
+	}
+
+	now := time.Now().UTC()
+	// node_id is optional; lines are always recorded under the session's node.
+	nodeID := c.GetString(ctxNodeIDKey)
+	if req.NodeID != "" && !agentNodeMatches(c, strings.TrimSpace(req.NodeID)) {
+		return
+	}
+	jobIDs := map[uint]struct{}{}
+	rows := make([]models.AgentLog, 0, len(req.Logs))
+	for _, line := range req.Logs {
+		fields := datatypes.JSONMap{}
+		if len(line.Fields) > 0 {
+			raw, err := json.Marshal(line.Fields)
+			if err != nil || len(raw) > maxAgentLogFieldsBytes {
+				c.JSON(http.StatusBadRequest, gin.H{"detail": fmt.Sprintf("fields 不能超过 %d 字节", maxAgentLogFieldsBytes)})
+				return
+			}
+			fields = datatypes.JSONMap(line.Fields)
+		}
+		if line.JobID != 0 {
+			jobIDs[line.JobID] = struct{}{}
+		}
+		rows = append(rows, models.AgentLog{
+			ManagerID: managerID,
+			UserID:    userID,
+			JobID:     line.JobID,
+			NodeID:    nodeID,
+			Level:     normalizeAgentLogLevel(line.Level),
+			Type:      line.Type,
+			Message:   line.Message,
+			Fields:    fields,
+			LoggedAt:  parseAgentLogTime(line.Ts, now),
+			CreatedAt: now,
+		})
+	}
+	if len(jobIDs) > 0 {
+		var found int64
+		if err := s.db.Model(&models.TaskJob{}).
+			Where("id IN ? AND manager_id = ? AND user_id = ?", uintSetKeys(jobIDs), managerID, userID).
+			Count(&found).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"detail": "查询任务失败"})
+			return
+		}
+		if found != int64(len(jobIDs)) {
+			c.JSON(http.StatusBadRequest, gin.H{"detail": "任务不属于该用户"})
+			return
+		}
+	}
+	if err := s.enqueueAgentLogs(c.Request.Context(), rows); err != nil {
+		slog.Error("agent log insert failed", "user_id", userID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "保存日志失败"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "ok", "count": len(req.Logs)})
+}
+
+func (s *Server) listAgentLogs(c *gin.Context, filter agentLogFilter) {
+	pg := readPagination(c, 50, 200)
+	baseQuery := filter.apply(s.db.Model(&models.AgentLog{}), s.isPostgres())
+
+	var total int64
+	if err := baseQuery.Count(&total).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "查询日志失败"})
+		return
+	}
+	var rows []models.AgentLog
+	if err := baseQuery.Order("id DESC").Offset(pg.Offset).Limit(pg.PageSize).Find(&rows).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "查询日志失败"})
+		return
+	}
+	items := make([]agentLogItem, 0, len(rows))
+	for _, row := range rows {
+		items = append(items, toAgentLogItem(row))
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"items":     items,
+		"total":     total,
+		"page":      pg.Page,
+		"page_size": pg.PageSize,
+	})
+}
+
+// managerAgentLogFilter reads the filter of the manager endpoints, which
+// cover every user of the manager unless user_id narrows them to one.
+func (s *Server) managerAgentLogFilter(c *gin.Context) (agentLogFilter, bool) {
+	managerID := getUint(c, ctxActorIDKey)
+	var userID uint
+	if raw := c.Query("user_id"); raw != "" {
+		parsed, err := strconv.ParseUint(raw, 10, 64)
+		if err != nil || parsed == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"detail": "user_id 无效"})
+			return agentLogFilter{}, false
+		}
+		userID = uint(parsed)
+		if !s.managerOwnsUser(c, managerID, userID) {
+			return agentLogFilter{}, false
+		}
+	}
+	return parseAgentLogFilter(c, managerID, userID)
+}
+
+// userAgentLogFilter reads the filter of the user endpoints, which need the
+// manager to have opened log access.
+func (s *Server) userAgentLogFilter(c *gin.Context) (agentLogFilter, bool) {
+	userID := getUint(c, ctxUserIDKey)
+	if !s.userCanViewLogs(c, userID) {
+		return agentLogFilter{}, false
+	}
+	return parseAgentLogFilter(c, getUint(c, ctxManagerIDKey), userID)
+}
+
+func (s *Server) managerListAgentLogs(c *gin.Context) {
+	if filter, ok := s.managerAgentLogFilter(c); ok {
+		s.listAgentLogs(c, filter)
+	}
+}
+
+func (s *Server) userListAgentLogs(c *gin.Context) {
+	if filter, ok := s.userAgentLogFilter(c); ok {
+		s.listAgentLogs(c, filter)
+	}
+}
+
+func (s *Server) managerStreamAgentLogs(c *gin.Context) {
+	if filter, ok := s.managerAgentLogFilter(c); ok {
+		s.streamAgentLogs(c, filter)
+	}
+}
+
+func (s *Server) userStreamAgentLogs(c *gin.Context) {
+	if filter, ok := s.userAgentLogFilter(c); ok {
+		s.streamAgentLogs(c, filter)
+	}
+}
+
+// agentLogsAfter returns up to limit lines after afterID, oldest first.
+func (s *Server) agentLogsAfter(ctx context.Context, filter agentLogFilter, afterID uint, limit int) ([]models.AgentLog, error) {
+	filter.Since, filter.Until = time.Time{}, time.Time{}
+	var rows []models.AgentLog
+	err := filter.apply(s.db.WithContext(ctx).Model(&models.AgentLog{}), s.isPostgres()).
+		Where("id > ?", afterID).Order("id ASC").Limit(limit).Find(&rows).Error
+	return rows, err
+}
+
+// lastAgentLogs returns the last limit lines, oldest first.
+func (s *Server) lastAgentLogs(ctx context.Context, filter agentLogFilter, limit int) ([]models.AgentLog, error) {
+	filter.Since, filter.Until = time.Time{}, time.Time{}
+	var rows []models.AgentLog
+	if err := filter.apply(s.db.WithContext(ctx).Model(&models.AgentLog{}), s.isPostgres()).
+		Order("id DESC").Limit(limit).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	slices.Reverse(rows)
+	return rows, nil
+}
+
+// streamAgentLogs serves a live tail as server-sent events. It starts with
+// the last `tail` lines, or the lines after Last-Event-ID / after_id when a
+// client resumes, then follows new lines until the client goes away.
+func (s *Server) streamAgentLogs(c *gin.Context, filter agentLogFilter) {
+	var afterID uint
+	resume := c.GetHeader("Last-Event-ID")
+	if resume == "" {
+		resume = c.Query("after_id")
+	}
+	if resume != "" {
+		parsed, err := strconv.ParseUint(resume, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"detail": "after_id 无效"})
+			return
+		}
+		afterID = uint(parsed)
+	}
+	tail := readQueryInt(c, "tail", agentLogTailDefault, 0, agentLogTailMax)
+	ctx := c.Request.Context()
+
+	// Subscribe before reading the backlog so that no line falls in between;
+	// lines that show up in both are sent once.
+	sub, cancel := s.agentLogTail.subscribe(filter)
+	defer cancel()
+	var backlog []models.AgentLog
+	var err error
+	switch {
+	case afterID > 0:
+		backlog, err = s.agentLogsAfter(ctx, filter, afterID, agentLogTailMax)
+	case tail > 0:
+		backlog, err = s.lastAgentLogs(ctx, filter, tail)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "查询日志失败"})
+		return
+	}
+
+	// The stream outlives the server's write timeout.
+	_ = http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{})
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	metrics.AgentLogTails.Inc()
+	defer metrics.AgentLogTails.Dec()
+
+	// lastID is the highest id sent, which is what a resuming client passes
+	// back. fromTable remembers the ids read from the table so that the same
+	// lines arriving live are skipped.
+	lastID := afterID
+	fromTable := map[uint]struct{}{}
+	send := func(item agentLogItem) bool {
+		if _, seen := fromTable[item.ID]; seen {
+			return true
+		}
+		lastID = max(lastID, item.ID)
+		data, err := json.Marshal(item)
+		if err != nil {
+			return true
+		}
+		_, err = fmt.Fprintf(c.Writer, "id: %d\nevent: log\ndata: %s\n\n", lastID, data)
+		return err == nil
+	}
+	sendRows := func(rows []models.AgentLog) bool {
+		for _, row := range rows {
+			if !send(toAgentLogItem(row)) {
+				return false
+			}
+			fromTable[row.ID] = struct{}{}
+		}
+		return true
+	}
+	// catchUp reads the lines a lagging tail dropped back from the table.
+	catchUp := func() bool {
+		if !sub.lagged.Swap(false) {
+			return true
+		}
+		clear(fromTable)
+		for {
+			rows, err := s.agentLogsAfter(ctx, filter, lastID, agentLogTailMax)
+			if err != nil {
+				slog.Warn("agent log tail catch-up failed", "error", err)
+				return true
+			}
+			if !sendRows(rows) {
+				return false
+			}
+			if len(rows) < agentLogTailMax {
+				return true
+			}
+		}
+	}
+
+	if !sendRows(backlog) {
+		return
+	}
+	c.Writer.Flush()
+	ping := time.NewTicker(agentLogTailPing)
+	defer ping.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case item := <-sub.ch:
+			if !catchUp() || !send(item) {
+				return
+			}
+		case <-ping.C:
+			if !catchUp() {
+				return
+			}
+			if _, err := fmt.Fprint(c.Writer, ": ping\n\n"); err != nil {
+				return
+			}
+		}
+		c.Writer.Flush()
+	}
+}
@@ -0,0 +1,344 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"oas-cloud-go/internal/models"
+	"oas-cloud-go/internal/taskmeta"
+	"oas-cloud-go/internal/tracing"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const agentOfflineSweepInterval = 30 * time.Second
+
+// managerListAgentNodes lists the manager's nodes with the jobs each one
+// holds a lease on right now.
+func (s *Server) managerListAgentNodes(c *gin.Context) {
+	managerID := getUint(c, ctxActorIDKey)
+	var nodes []models.AgentNode
+	if err := s.db.Where("manager_id = ?", managerID).Order("node_id asc").Find(&nodes).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "查询节点失败"})
+		return
+	}
+	var jobs []models.TaskJob
+	if err := s.db.Select("id, user_id, task_type, status, leased_by_node, lease_until").
+		Where("manager_id = ? AND status IN ? AND leased_by_node <> ''", managerID, []string{models.JobStatusLeased, models.JobStatusRunning}).
+		Order("id asc").Find(&jobs).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "查询节点任务失败"})
+		return
+	}
+	jobsByNode := make(map[string][]gin.H, len(nodes))
+	for _, job := range jobs {
+		jobsByNode[job.LeasedByNode] = append(jobsByNode[job.LeasedByNode], gin.H{
+			"id":          job.ID,
+			"user_id":     job.UserID,
+			"task_type":   job.TaskType,
+			"status":      job.Status,
+			"lease_until": job.LeaseUntil,
+		})
+	}
+	policy, err := s.loadAgentVersionPolicy(s.db, managerID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "查询版本策略失败"})
+		return
+	}
+	items := make([]gin.H, 0, len(nodes))
+	for _, node := range nodes {
+		leased := jobsByNode[node.NodeID]
+		if leased == nil {
+			leased = []gin.H{}
+		}
+		items = append(items, gin.H{
+			"id":              node.ID,
+			"node_id":         node.NodeID,
+			"version":         node.Version,
+			"version_status":  policy.status(node.NodeID, node.Version),
+			"status":          node.Status,
+			"draining":        node.Draining,
+			"task_types":      taskmeta.SplitLabels(node.TaskTypes),
+			"max_concurrency": node.MaxConcurrency,
+			"labels":          taskmeta.SplitLabels(node.Labels),
+			"last_heartbeat":  node.LastHeartbeat,
+			"created_at":      node.CreatedAt,
+			"leased_jobs":     leased,
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"items": items, "total": len(items)})
+}
+
+// managerPatchAgentDrain stops or resumes handing new jobs to a node. Jobs
+// it already holds run to completion.
+func (s *Server) managerPatchAgentDrain(c *gin.Context) {
+	managerID := getUint(c, ctxActorIDKey)
+	node, ok := s.loadManagerAgentNode(c, managerID)
+	if !ok {
+		return
+	}
+	var req patchAgentDrainRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"detail": err.Error()})
+		return
+	}
+	now := time.Now().UTC()
+	if err := s.db.Model(&models.AgentNode{}).Where("id = ?", node.ID).Updates(map[string]any{
+		"draining":   *req.Draining,
+		"updated_at": now,
+	}).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "更新节点失败"})
+		return
+	}
+	action := "drain_agent_node"
+	if !*req.Draining {
+		action = "undrain_agent_node"
+	}
+	s.audit(models.ActorTypeManager, managerID, action, "agent_node", node.ID, datatypes.JSONMap{"node_id": node.NodeID}, c.ClientIP())
+	c.JSON(http.StatusOK, gin.H{"id": node.ID, "node_id": node.NodeID, "draining": *req.Draining})
+}
+
+// managerRevokeAgentNode logs a node out and takes its work away: its Redis
+// sessions are dropped, its jobs go back to pending and its leases are
+// released. The node has to log in again before it can poll.
+func (s *Server) managerRevokeAgentNode(c *gin.Context) {
+	managerID := getUint(c, ctxActorIDKey)
+	node, ok := s.loadManagerAgentNode(c, managerID)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+	now := time.Now().UTC()
+	sessions, err := s.redisStore.RevokeAgentSessions(ctx, managerID, node.NodeID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "吊销Redis Agent会话失败"})
+		return
+	}
+	if err := s.db.Model(&models.AgentNode{}).Where("id = ?", node.ID).Updates(map[string]any{
+		"status":     models.AgentStatusOffline,
+		"updated_at": now,
+	}).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "更新节点失败"})
+		return
+	}
+	requeued, err := s.requeueNodeJobs(ctx, managerID, node.NodeID, "node_revoked",
+		fmt.Sprintf("管理员吊销节点 %s，任务重新待执行", node.NodeID), now)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "释放节点任务失败"})
+		return
+	}
+	s.audit(models.ActorTypeManager, managerID, "revoke_agent_node", "agent_node", node.ID, datatypes.JSONMap{
+		"node_id":  node.NodeID,
+		"sessions": sessions,
+		"requeued": requeued,
+	}, c.ClientIP())
+	c.JSON(http.StatusOK, gin.H{"id": node.ID, "node_id": node.NodeID, "revoked_sessions": sessions, "requeued_jobs": requeued})
+}
+
+func (s *Server) loadManagerAgentNode(c *gin.Context, managerID uint) (models.AgentNode, bool) {
+	var node models.AgentNode
+	id, ok := parseUintParam(c, "id")
+	if !ok {
+		return node, false
+	}
+	if err := s.db.Where("id = ? AND manager_id = ?", id, managerID).First(&node).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"detail": "节点不存在"})
+			return node, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "查询节点失败"})
+		return node, false
+	}
+	return node, true
+}
+
+// normalizeAgentCapabilities checks the capabilities a node declared and
+// sorts and deduplicates its lists in place.
+func normalizeAgentCapabilities(caps *agentCapabilities) error {
+	if caps == nil {
+		return nil
+	}
+	taskTypes, err := taskmeta.NormalizeLabels(caps.TaskTypes)
+	if err != nil {
+		return fmt.Errorf("task_types 无效: %v", err)
+	}
+	for _, taskType := range taskTypes {
+		if !taskmeta.IsKnownTaskType(taskType) {
+			return fmt.Errorf("未知任务类型 %q", taskType)
+		}
+	}
+	labels, err := taskmeta.NormalizeLabels(caps.Labels)
+	if err != nil {
+		return fmt.Errorf("labels 无效: %v", err)
+	}
+	caps.TaskTypes = taskTypes
+	caps.Labels = labels
+	return nil
+}
+
+// pollScope narrows the pending jobs of a manager to those one node may
+// lease on this poll.
+type pollScope struct {
+	restingIDs []uint
+	taskTypes  []string
+	// Required label sets, in stored form, the node lacks a label of.
+	jobLabelSets  []string
+	userLabelSets []string
+	// Free job slots under the node's max_concurrency, -1 for no limit.
+	slots int
+}
+
+// nodePollScope works out which pending jobs a node's capabilities rule out.
+// Label requirements are few distinct sets per manager, so they are checked
+// here and excluded by value in the candidate query.
+func (s *Server) nodePollScope(db *gorm.DB, managerID uint, node models.AgentNode) (pollScope, error) {
+	scope := pollScope{taskTypes: taskmeta.SplitLabels(node.TaskTypes), slots: -1}
+	var jobSets []string
+	if err := db.Model(&models.TaskJob{}).
+		Where("manager_id = ? AND status = ? AND required_labels <> ''", managerID, models.JobStatusPending).
+		Distinct().Pluck("required_labels", &jobSets).Error; err != nil {
+		return scope, err
+	}
+	var userSets []string
+	if err := db.Model(&models.User{}).
+		Where("manager_id = ? AND required_labels <> ''", managerID).
+		Distinct().Pluck("required_labels", &userSets).Error; err != nil {
+		return scope, err
+	}
+	for _, set := range jobSets {
+		if !taskmeta.LabelsSatisfied(set, node.Labels) {
+			scope.jobLabelSets = append(scope.jobLabelSets, set)
+		}
+	}
+	for _, set := range userSets {
+		if !taskmeta.LabelsSatisfied(set, node.Labels) {
+			scope.userLabelSets = append(scope.userLabelSets, set)
+		}
+	}
+	if node.MaxConcurrency > 0 {
+		var held int64
+		if err := db.Model(&models.TaskJob{}).
+			Where("manager_id = ? AND leased_by_node = ? AND status IN ?", managerID, node.NodeID, []string{models.JobStatusLeased, models.JobStatusRunning}).
+			Count(&held).Error; err != nil {
+			return scope, err
+		}
+		scope.slots = max(node.MaxConcurrency-int(held), 0)
+	}
+	return scope, nil
+}
+
+// touchAgentNode moves the heartbeat of a node that reported on a job.
+func (s *Server) touchAgentNode(ctx context.Context, managerID uint, nodeID string, now time.Time) {
+	if err := s.db.WithContext(ctx).Model(&models.AgentNode{}).
+		Where("node_id = ? AND manager_id = ?", nodeID, managerID).
+		Updates(map[string]any{"last_heartbeat": now, "status": models.AgentStatusOnline, "updated_at": now}).Error; err != nil {
+		slog.Warn("touch agent node failed", "node_id", nodeID, "error", err)
+	}
+}
+
+// requeueNodeJobs puts the leased and running jobs of a node back to pending
+// without counting an attempt, like a manager revoking each of them, and
+// drops the Redis job and account leases the node held for them.
+func (s *Server) requeueNodeJobs(ctx context.Context, managerID uint, nodeID string, eventType string, message string, now time.Time) (int, error) {
+	var jobs []models.TaskJob
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("manager_id = ? AND leased_by_node = ? AND status IN ?", managerID, nodeID, []string{models.JobStatusLeased, models.JobStatusRunning}).
+			Find(&jobs).Error; err != nil {
+			return err
+		}
+		if len(jobs) == 0 {
+			return nil
+		}
+		ids := make([]uint, 0, len(jobs))
+		events := make([]models.TaskJobEvent, 0, len(jobs))
+		for _, job := range jobs {
+			ids = append(ids, job.ID)
+			events = append(events, models.TaskJobEvent{JobID: job.ID, EventType: eventType, Message: message, EventAt: now})
+		}
+		if err := tx.Model(&models.TaskJob{}).Where("id IN ?", ids).Updates(map[string]any{
+			"status":         models.JobStatusPending,
+			"leased_by_node": "",
+			"lease_until":    nil,
+			"scheduled_at":   now,
+			"updated_at":     now,
+		}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&events).Error
+	})
+	if err != nil {
+		return 0, err
+	}
+	released := make(map[uint]struct{}, len(jobs))
+	for _, job := range jobs {
+		_ = s.redisStore.ClearJobLease(ctx, managerID, job.ID)
+		if _, ok := released[job.UserID]; !ok {
+			released[job.UserID] = struct{}{}
+			_ = s.redisStore.ReleaseAccountLease(ctx, managerID, job.UserID, nodeID)
+		}
+	}
+	if len(jobs) > 0 {
+		s.wakeAgents(ctx, managerID)
+	}
+	return len(jobs), nil
+}
+
+// agentOfflineWorker marks nodes offline once their heartbeat is older than
+// AGENT_OFFLINE_AFTER and requeues their jobs right away, instead of leaving
+// them until their leases run out.
+func (s *Server) agentOfflineWorker() {
+	ticker := time.NewTicker(agentOfflineSweepInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !s.leading() {
+			continue
+		}
+		s.detectOfflineAgents(time.Now().UTC())
+	}
+}
+
+func (s *Server) detectOfflineAgents(now time.Time) {
+	after := s.cfg.AgentOfflineAfter
+	if after <= 0 {
+		return
+	}
+	ctx, span := tracing.Start(context.Background(), "agent.offline_sweep")
+	cutoff := now.Add(-after)
+	var stale []models.AgentNode
+	err := s.db.WithContext(ctx).Where("status <> ? AND last_heartbeat < ?", models.AgentStatusOffline, cutoff).Find(&stale).Error
+	offline := 0
+	for _, node := range stale {
+		// The heartbeat guard keeps a node that came back meanwhile online.
+		result := s.db.WithContext(ctx).Model(&models.AgentNode{}).
+			Where("id = ? AND status <> ? AND last_heartbeat < ?", node.ID, models.AgentStatusOffline, cutoff).
+			Updates(map[string]any{"status": models.AgentStatusOffline, "updated_at": now})
+		if result.Error != nil {
+			err = result.Error
+			break
+		}
+		if result.RowsAffected == 0 {
+			continue
+		}
+		offline++
+		requeued, requeueErr := s.requeueNodeJobs(ctx, node.ManagerID, node.NodeID, "node_offline",
+			fmt.Sprintf("节点 %s 已离线（最后心跳 %s），任务重新待执行", node.NodeID, node.LastHeartbeat.In(taskmeta.BJLoc).Format("2006-01-02 15:04:05")), now)
+		if requeueErr != nil {
+			slog.Warn("requeue jobs of offline agent failed", "node_id", node.NodeID, "error", requeueErr)
+			continue
+		}
+		slog.Info("agent node went offline", "node_id", node.NodeID, "manager_id", node.ManagerID, "requeued_jobs", requeued)
+	}
+	span.SetAttributes(attribute.Int("agent.offline", offline))
+	tracing.End(span, err)
+	if err != nil {
+		slog.Warn("agent offline sweep failed", "error", err)
+	}
+}
@@ -0,0 +1,451 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"oas-cloud-go/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// agentVersionOutdatedCode is the error_code of logins and polls refused for a
+// version below the minimum.
+const agentVersionOutdatedCode = "agent_version_outdated"
+
+// Version status of a node under its manager's policy.
+const (
+	agentVersionCurrent          = "current"
+	agentVersionOutdated         = "outdated"
+	agentVersionUpgradeAvailable = "upgrade_available"
+	agentVersionRolloutPending   = "rollout_pending"
+)
+
+const maxAgentManifestBytes = 4096
+
+// agentVersion is a parsed release number such as 1.4.2 or v1.5.0-beta.1.
+type agentVersion struct {
+	core []int
+	pre  []string
+}
+
+func parseAgentVersion(raw string) (agentVersion, bool) {
+	text := strings.TrimPrefix(strings.TrimPrefix(strings.TrimSpace(raw), "v"), "V")
+	if i := strings.IndexByte(text, '+'); i >= 0 {
+		text = text[:i]
+	}
+	var version agentVersion
+	if i := strings.IndexByte(text, '-'); i >= 0 {
+		version.pre = strings.Split(text[i+1:], ".")
+		text = text[:i]
+		for _, part := range version.pre {
+			if part == "" {
+				return agentVersion{}, false
+			}
+		}
+	}
+	parts := strings.Split(text, ".")
+	if len(parts) > 4 {
+		return agentVersion{}, false
+	}
+	for _, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 || part[0] == '+' {
+			return agentVersion{}, false
+		}
+		version.core = append(version.core, n)
+	}
+	return version, true
+}
+
+// compareAgentVersions orders versions like semver: missing numbers count as
+// 0 and a pre-release comes before its release.
+func compareAgentVersions(a, b agentVersion) int {
+	for i := 0; i < len(a.core) || i < len(b.core); i++ {
+		var x, y int
+		if i < len(a.core) {
+			x = a.core[i]
+		}
+		if i < len(b.core) {
+			y = b.core[i]
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case len(a.pre) == 0 && len(b.pre) == 0:
+		return 0
+	case len(a.pre) == 0:
+		return 1
+	case len(b.pre) == 0:
+		return -1
+	}
+	for i := 0; i < len(a.pre) && i < len(b.pre); i++ {
+		x, errX := strconv.Atoi(a.pre[i])
+		y, errY := strconv.Atoi(b.pre[i])
+		switch {
+		case errX == nil && errY == nil:
+			if x != y {
+				if x < y {
+					return -1
+				}
+				return 1
+			}
+		case errX == nil:
+			return -1
+		case errY == nil:
+			return 1
+		default:
+			if c := strings.Compare(a.pre[i], b.pre[i]); c != 0 {
+				return c
+			}
+		}
+	}
+	switch {
+	case len(a.pre) < len(b.pre):
+		return -1
+	case len(a.pre) > len(b.pre):
+		return 1
+	}
+	return 0
+}
+
+// versionBelow reports whether version is older than floor. A version that
+// does not parse, including none at all, is older than any floor.
+func versionBelow(version string, floor string) bool {
+	lowest, ok := parseAgentVersion(floor)
+	if !ok {
+		return false
+	}
+	v, ok := parseAgentVersion(version)
+	return !ok || compareAgentVersions(v, lowest) < 0
+}
+
+// agentRolloutBucket places a node in 0-99. It only depends on the node, so
+// raising the rollout percentage keeps the nodes that already upgraded.
+func agentRolloutBucket(nodeID string) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(nodeID))
+	return int(h.Sum32() % 100)
+}
+
+// agentVersionFloor is one minimum version with its enforcement.
+type agentVersionFloor struct {
+	MinVersion  string
+	Enforcement string
+}
+
+// agentVersionPolicy is the policy in effect for one manager's nodes.
+// MinVersion and Enforcement describe the highest floor; floors keeps every
+// floor so that a manager's looser setting cannot weaken the global one.
+type agentVersionPolicy struct {
+	MinVersion         string
+	Enforcement        string
+	RecommendedVersion string
+	RolloutPercent     int
+	Manifest           map[string]any
+	floors             []agentVersionFloor
+}
+
+// loadAgentVersionPolicy merges the global policy with the manager's. Both
+// minimums apply, each with its own enforcement; the manager's recommended
+// version, rollout and manifest replace the global ones when set.
+func (s *Server) loadAgentVersionPolicy(db *gorm.DB, managerID uint) (agentVersionPolicy, error) {
+	policy := agentVersionPolicy{Enforcement: models.AgentVersionReject, RolloutPercent: 100, Manifest: map[string]any{}}
+	var rows []models.AgentVersionPolicy
+	if err := db.Where("manager_id IN ?", []uint{0, managerID}).Order("manager_id asc").Find(&rows).Error; err != nil {
+		return policy, err
+	}
+	for _, row := range rows {
+		if row.MinVersion != "" {
+			policy.floors = append(policy.floors, agentVersionFloor{MinVersion: row.MinVersion, Enforcement: row.Enforcement})
+		}
+		if row.MinVersion != "" && (policy.MinVersion == "" || versionBelow(policy.MinVersion, row.MinVersion)) {
+			policy.MinVersion = row.MinVersion
+			policy.Enforcement = row.Enforcement
+		}
+		if row.RecommendedVersion != "" {
+			policy.RecommendedVersion = row.RecommendedVersion
+			policy.RolloutPercent = row.RolloutPercent
+			if row.Manifest != nil {
+				policy.Manifest = map[string]any(row.Manifest)
+			}
+		}
+	}
+	return policy, nil
+}
+
+// status places a node's version under the policy.
+func (p agentVersionPolicy) status(nodeID string, version string) string {
+	if p.MinVersion != "" && versionBelow(version, p.MinVersion) {
+		return agentVersionOutdated
+	}
+	if p.RecommendedVersion != "" && versionBelow(version, p.RecommendedVersion) {
+		if agentRolloutBucket(nodeID) < p.RolloutPercent {
+			return agentVersionUpgradeAvailable
+		}
+		return agentVersionRolloutPending
+	}
+	return agentVersionCurrent
+}
+
+// enforcement is the strictest enforcement among the floors version is
+// below, or "" when it meets all of them.
+func (p agentVersionPolicy) enforcement(version string) string {
+	result := ""
+	for _, floor := range p.floors {
+		if !versionBelow(version, floor.MinVersion) {
+			continue
+		}
+		if floor.Enforcement == models.AgentVersionReject {
+			return models.AgentVersionReject
+		}
+		result = floor.Enforcement
+	}
+	return result
+}
+
+// upgrade is the upgrade offer sent to a node on version with the given
+// status, or nil when the node should stay on its version for now.
+func (p agentVersionPolicy) upgrade(version string, status string) gin.H {
+	if status != agentVersionOutdated && status != agentVersionUpgradeAvailable {
+		return nil
+	}
+	enforcement := p.Enforcement
+	if status == agentVersionOutdated {
+		enforcement = p.enforcement(version)
+	}
+	return gin.H{
+		"required":            status == agentVersionOutdated,
+		"min_version":         p.MinVersion,
+		"enforcement":         enforcement,
+		"recommended_version": p.RecommendedVersion,
+		"manifest":            p.Manifest,
+	}
+}
+
+// rejectOutdatedAgent writes the refusal for a node below the minimum
+// version.
+func (p agentVersionPolicy) rejectOutdatedAgent(c *gin.Context, version string) {
+	if version == "" {
+		version = "未知"
+	}
+	c.JSON(http.StatusUpgradeRequired, gin.H{
+		"detail":     fmt.Sprintf("Agent 版本 %s 低于最低版本 %s，请升级", version, p.MinVersion),
+		"error_code": agentVersionOutdatedCode,
+		"upgrade":    p.upgrade(version, agentVersionOutdated),
+	})
+}
+
+func (p agentVersionPolicy) view() gin.H {
+	return gin.H{
+		"min_version":         p.MinVersion,
+		"enforcement":         p.Enforcement,
+		"recommended_version": p.RecommendedVersion,
+		"rollout_percent":     p.RolloutPercent,
+		"manifest":            p.Manifest,
+	}
+}
+
+func agentVersionPolicyRowView(row *models.AgentVersionPolicy) gin.H {
+	if row == nil {
+		return nil
+	}
+	manifest := row.Manifest
+	if manifest == nil {
+		manifest = datatypes.JSONMap{}
+	}
+	return gin.H{
+		"min_version":         row.MinVersion,
+		"enforcement":         row.Enforcement,
+		"recommended_version": row.RecommendedVersion,
+		"rollout_percent":     row.RolloutPercent,
+		"manifest":            manifest,
+		"updated_at":          row.UpdatedAt,
+	}
+}
+
+// normalizeAgentVersionPolicy checks a policy update and returns the row to
+// store for managerID.
+func normalizeAgentVersionPolicy(req putAgentVersionPolicyRequest, managerID uint) (models.AgentVersionPolicy, error) {
+	row := models.AgentVersionPolicy{
+		ManagerID:          managerID,
+		MinVersion:         strings.TrimSpace(req.MinVersion),
+		Enforcement:        req.Enforcement,
+		RecommendedVersion: strings.TrimSpace(req.RecommendedVersion),
+		RolloutPercent:     100,
+		Manifest:           datatypes.JSONMap(req.Manifest),
+	}
+	if row.Enforcement == "" {
+		row.Enforcement = models.AgentVersionReject
+	}
+	if req.RolloutPercent != nil {
+		row.RolloutPercent = *req.RolloutPercent
+	}
+	if row.Manifest == nil {
+		row.Manifest = datatypes.JSONMap{}
+	}
+	for _, version := range []string{row.MinVersion, row.RecommendedVersion} {
+		if _, ok := parseAgentVersion(version); version != "" && !ok {
+			return row, fmt.Errorf("版本号 %q 无效，应为 1.2.3 形式", version)
+		}
+	}
+	if row.MinVersion != "" && row.RecommendedVersion != "" && versionBelow(row.RecommendedVersion, row.MinVersion) {
+		return row, fmt.Errorf("recommended_version 不能低于 min_version")
+	}
+	if len(row.Manifest) > 0 {
+		if row.RecommendedVersion == "" {
+			return row, fmt.Errorf("设置 manifest 时必须指定 recommended_version")
+		}
+		url, _ := row.Manifest["url"].(string)
+		if !strings.HasPrefix(url, "https://") && !strings.HasPrefix(url, "http://") {
+			return row, fmt.Errorf("manifest.url 必须是 http(s) 地址")
+		}
+		if raw, err := json.Marshal(row.Manifest); err != nil || len(raw) > maxAgentManifestBytes {
+			return row, fmt.Errorf("manifest 不能超过 %d 字节", maxAgentManifestBytes)
+		}
+	}
+	return row, nil
+}
+
+// saveAgentVersionPolicy validates the request and stores it as the policy
+// of managerID, 0 for the global one. The error result is already written to
+// the response.
+func (s *Server) saveAgentVersionPolicy(c *gin.Context, managerID uint) (models.AgentVersionPolicy, bool) {
+	var req putAgentVersionPolicyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"detail": err.Error()})
+		return models.AgentVersionPolicy{}, false
+	}
+	row, err := normalizeAgentVersionPolicy(req, managerID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"detail": err.Error()})
+		return row, false
+	}
+	now := time.Now().UTC()
+	row.CreatedAt = now
+	row.UpdatedAt = now
+	if err := s.db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "manager_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{
+			"min_version", "enforcement", "recommended_version", "rollout_percent", "manifest", "updated_at",
+		}),
+	}).Create(&row).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "保存版本策略失败"})
+		return row, false
+	}
+	return row, true
+}
+
+func (s *Server) loadAgentVersionPolicyRow(managerID uint) (*models.AgentVersionPolicy, error) {
+	var rows []models.AgentVersionPolicy
+	if err := s.db.Where("manager_id = ?", managerID).Limit(1).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	return &rows[0], nil
+}
+
+func (s *Server) superGetAgentVersionPolicy(c *gin.Context) {
+	row, err := s.loadAgentVersionPolicyRow(0)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "查询版本策略失败"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"policy": agentVersionPolicyRowView(row)})
+}
+
+func (s *Server) superPutAgentVersionPolicy(c *gin.Context) {
+	actorID := getUint(c, ctxActorIDKey)
+	row, ok := s.saveAgentVersionPolicy(c, 0)
+	if !ok {
+		return
+	}
+	s.audit(models.ActorTypeSuper, actorID, "super_update_agent_version_policy", "agent_version_policy", 0, datatypes.JSONMap{
+		"min_version":         row.MinVersion,
+		"enforcement":         row.Enforcement,
+		"recommended_version": row.RecommendedVersion,
+		"rollout_percent":     row.RolloutPercent,
+	}, c.ClientIP())
+	c.JSON(http.StatusOK, gin.H{"policy": agentVersionPolicyRowView(&row)})
+}
+
+// managerAgentVersionPolicyView shows the manager's own policy, the global
+// one, the merged result and how many nodes are at each version status.
+func (s *Server) managerAgentVersionPolicyView(managerID uint) (gin.H, error) {
+	own, err := s.loadAgentVersionPolicyRow(managerID)
+	if err != nil {
+		return nil, err
+	}
+	global, err := s.loadAgentVersionPolicyRow(0)
+	if err != nil {
+		return nil, err
+	}
+	policy, err := s.loadAgentVersionPolicy(s.db, managerID)
+	if err != nil {
+		return nil, err
+	}
+	var nodes []models.AgentNode
+	if err := s.db.Select("node_id, version").Where("manager_id = ?", managerID).Find(&nodes).Error; err != nil {
+		return nil, err
+	}
+	counts := gin.H{
+		agentVersionCurrent:          0,
+		agentVersionOutdated:         0,
+		agentVersionUpgradeAvailable: 0,
+		agentVersionRolloutPending:   0,
+	}
+	for _, node := range nodes {
+		status := policy.status(node.NodeID, node.Version)
+		counts[status] = counts[status].(int) + 1
+	}
+	return gin.H{
+		"policy":    agentVersionPolicyRowView(own),
+		"global":    agentVersionPolicyRowView(global),
+		"effective": policy.view(),
+		"nodes":     counts,
+	}, nil
+}
+
+func (s *Server) managerGetAgentVersionPolicy(c *gin.Context) {
+	view, err := s.managerAgentVersionPolicyView(getUint(c, ctxActorIDKey))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "查询版本策略失败"})
+		return
+	}
+	c.JSON(http.StatusOK, view)
+}
+
+func (s *Server) managerPutAgentVersionPolicy(c *gin.Context) {
+	managerID := getUint(c, ctxActorIDKey)
+	row, ok := s.saveAgentVersionPolicy(c, managerID)
+	if !ok {
+		return
+	}
+	s.audit(models.ActorTypeManager, managerID, "manager_update_agent_version_policy", "agent_version_policy", row.ManagerID, datatypes.JSONMap{
+		"min_version":         row.MinVersion,
+		"enforcement":         row.Enforcement,
+		"recommended_version": row.RecommendedVersion,
+		"rollout_percent":     row.RolloutPercent,
+	}, c.ClientIP())
+	view, err := s.managerAgentVersionPolicyView(managerID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "查询版本策略失败"})
+		return
+	}
+	c.JSON(http.StatusOK, view)
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const jobsReadyResubscribeDelay = 5 * time.Second
+
+// jobWaiters holds the long polls that wait for new jobs, by manager. Wake-ups
+// come over the Redis jobs-ready channel, so a job created on any replica
+// reaches agents waiting on every replica.
+type jobWaiters struct {
+	mu      sync.Mutex
+	waiting map[uint]map[chan struct{}]struct{}
+}
+
+func newJobWaiters() *jobWaiters {
+	return &jobWaiters{waiting: make(map[uint]map[chan struct{}]struct{})}
+}
+
+// wait registers a waiter for managerID. The channel is closed by the next
+// wake-up of that manager; cancel drops a waiter that was not woken.
+func (w *jobWaiters) wait(managerID uint) (<-chan struct{}, func()) {
+	ch := make(chan struct{})
+	w.mu.Lock()
+	if w.waiting[managerID] == nil {
+		w.waiting[managerID] = make(map[chan struct{}]struct{})
+	}
+	w.waiting[managerID][ch] = struct{}{}
+	w.mu.Unlock()
+	return ch, func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		if _, ok := w.waiting[managerID][ch]; ok {
+			delete(w.waiting[managerID], ch)
+			if len(w.waiting[managerID]) == 0 {
+				delete(w.waiting, managerID)
+			}
+		}
+	}
+}
+
+// wake releases every waiter of managerID and returns how many there were.
+func (w *jobWaiters) wake(managerID uint) int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	waiters := w.waiting[managerID]
+	for ch := range waiters {
+		close(ch)
+	}
+	delete(w.waiting, managerID)
+	return len(waiters)
+}
+
+// jobsReadyListener feeds the jobs-ready channel into the local waiters for
+// the lifetime of the process.
+func (s *Server) jobsReadyListener() {
+	for {
+		err := s.redisStore.SubscribeJobsReady(context.Background(), func(managerID uint) {
+			s.jobWaiters.wake(managerID)
+		})
+		slog.Warn("jobs ready subscription ended, resubscribing", "error", err)
+		time.Sleep(jobsReadyResubscribeDelay)
+	}
+}
+
+// wakeAgents announces that a manager has new pending jobs. When Redis is
+// unreachable the waiters on this replica are still woken.
+func (s *Server) wakeAgents(ctx context.Context, managerID uint) {
+	if err := s.redisStore.PublishJobsReady(ctx, managerID); err != nil {
+		slog.Warn("publish jobs ready failed", "manager_id", managerID, "error", err)
+		s.jobWaiters.wake(managerID)
+	}
+}
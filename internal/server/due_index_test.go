@@ -0,0 +1,56 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"oas-cloud-go/internal/models"
+	"oas-cloud-go/internal/taskmeta"
+
+	"gorm.io/datatypes"
+)
+
+func TestTaskConfigWritesSyncDueIndex(t *testing.T) {
+	srv, db := setupTestServer(t)
+	manager := createActiveManager(t, db, "manager_dueindex", "passwordDueindex123")
+	user := createNotifyTestUser(t, srv, manager.ID, "U_DUEINDEX_001", datatypes.JSONMap{})
+	token := loginManagerToken(t, srv, "manager_dueindex", "passwordDueindex123")
+
+	schedules := func() map[string]time.Time {
+		var rows []models.UserTaskSchedule
+		if err := db.Where("user_id = ?", user.ID).Find(&rows).Error; err != nil {
+			t.Fatalf("load schedules failed: %v", err)
+		}
+		result := make(map[string]time.Time, len(rows))
+		for _, row := range rows {
+			result[row.TaskType] = row.NextDueAt
+		}
+		return result
+	}
+	putTasks := func(taskConfig map[string]any) {
+		resp := doJSONRequest(t, srv.router, http.MethodPut, "/api/v1/manager/users/"+itoa(user.ID)+"/tasks", map[string]any{"task_config": taskConfig}, token)
+		if resp.Code != http.StatusOK {
+			t.Fatalf("put tasks failed, status=%d body=%s", resp.Code, resp.Body.String())
+		}
+	}
+
+	later := time.Now().Add(3 * time.Hour).In(taskmeta.BJLoc).Truncate(time.Minute)
+	putTasks(map[string]any{"悬赏": map[string]any{"next_time": later.Format("2006-01-02 15:04")}})
+	got := schedules()
+	if !got["悬赏"].Equal(later.UTC()) {
+		t.Fatalf("悬赏 should be due at its next_time %s: %v", later.UTC(), got)
+	}
+	if _, ok := got["签到"]; ok {
+		t.Fatalf("disabled tasks should not be indexed: %v", got)
+	}
+
+	putTasks(map[string]any{"签到": map[string]any{"enabled": true}, "悬赏": map[string]any{"enabled": false}})
+	got = schedules()
+	if _, ok := got["签到"]; !ok {
+		t.Fatalf("enabled task should be indexed: %v", got)
+	}
+	if _, ok := got["悬赏"]; ok {
+		t.Fatalf("disabled task should be dropped from the index: %v", got)
+	}
+}
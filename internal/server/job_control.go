@@ -0,0 +1,490 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"oas-cloud-go/internal/models"
+	"oas-cloud-go/internal/scheduler"
+	"oas-cloud-go/internal/taskmeta"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Manual control over single jobs of the task pool. Every action is written
+// to the job's events and to the audit log.
+const (
+	jobActionCancel   = "cancel"
+	jobActionRevoke   = "revoke"
+	jobActionPriority = "priority"
+	jobActionRequeue  = "requeue"
+)
+
+var jobActionAuditNames = map[string]string{
+	jobActionCancel:   "cancel_job",
+	jobActionRevoke:   "revoke_job",
+	jobActionPriority: "update_job_priority",
+	jobActionRequeue:  "requeue_job",
+}
+
+// jobControlError is a job action refused because of the job's state.
+type jobControlError struct {
+	status int
+	detail string
+}
+
+func (e *jobControlError) Error() string { return e.detail }
+
+// jobControlResult describes the outcome of an action on one job.
+type jobControlResult struct {
+	JobID    uint   `json:"job_id"`
+	Status   string `json:"status,omitempty"`
+	NewJobID uint   `json:"new_job_id,omitempty"`
+	Detail   string `json:"detail,omitempty"`
+}
+
+// controlJob applies a manual action to a job of the manager. A non-zero
+// userID limits it to that user's jobs and records the user as the actor.
+// revoke also drops the Redis leases the node held for the job.
+func (s *Server) controlJob(ctx context.Context, managerID uint, userID uint, jobID uint, action string, priority int, now time.Time) (jobControlResult, error) {
+	result := jobControlResult{JobID: jobID}
+	var revoked models.TaskJob
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		query := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ? AND manager_id = ?", jobID, managerID)
+		if userID != 0 {
+			query = query.Where("user_id = ?", userID)
+		}
+		var job models.TaskJob
+		if err := query.First(&job).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return &jobControlError{status: http.StatusNotFound, detail: "任务不存在"}
+			}
+			return err
+		}
+		result.Status = job.Status
+
+		updates := map[string]any{"updated_at": now}
+		event := models.TaskJobEvent{JobID: job.ID, EventAt: now}
+		switch action {
+		case jobActionCancel:
+			if job.Status != models.JobStatusPending {
+				return &jobControlError{status: http.StatusConflict, detail: "只能取消待执行的任务"}
+			}
+			updates["status"] = models.JobStatusCancelled
+			event.EventType = "manager_cancelled"
+			event.Message = "管理员取消任务"
+			if userID != 0 {
+				event.EventType = "user_cancelled"
+				event.Message = "用户取消任务"
+			}
+		case jobActionRevoke:
+			if job.Status != models.JobStatusLeased && job.Status != models.JobStatusRunning {
+				return &jobControlError{status: http.StatusConflict, detail: "只能收回已租约或执行中的任务"}
+			}
+			updates["status"] = models.JobStatusPending
+			updates["leased_by_node"] = ""
+			updates["lease_until"] = nil
+			updates["scheduled_at"] = now
+			event.EventType = "manager_revoked"
+			event.Message = fmt.Sprintf("管理员收回节点 %s 的租约，任务重新待执行", job.LeasedByNode)
+			revoked = job
+		case jobActionPriority:
+			if job.Status != models.JobStatusPending && job.Status != models.JobStatusLeased && job.Status != models.JobStatusRunning {
+				return &jobControlError{status: http.StatusConflict, detail: "只能调整未结束任务的优先级"}
+			}
+			updates["priority"] = priority
+			event.EventType = "manager_priority"
+			event.Message = fmt.Sprintf("管理员调整优先级 %d → %d", job.Priority, priority)
+		case jobActionRequeue:
+			if job.Status != models.JobStatusFailed && job.Status != models.JobStatusCancelled {
+				return &jobControlError{status: http.StatusConflict, detail: "只能重新入队失败或已取消的任务"}
+			}
+			var active models.TaskJob
+			err := tx.Select("id").
+				Where("user_id = ? AND task_type = ? AND status IN ?", job.UserID, job.TaskType, []string{models.JobStatusPending, models.JobStatusLeased, models.JobStatusRunning}).
+				First(&active).Error
+			if err == nil {
+				return &jobControlError{status: http.StatusConflict, detail: fmt.Sprintf("该用户已有未结束的同类任务 #%d", active.ID)}
+			}
+			if !errors.Is(err, gorm.ErrRecordNotFound) {
+				return err
+			}
+			requeued := models.TaskJob{
+				ManagerID:      job.ManagerID,
+				UserID:         job.UserID,
+				TaskType:       job.TaskType,
+				Payload:        job.Payload,
+				Priority:       job.Priority,
+				ScheduledAt:    now,
+				Status:         models.JobStatusPending,
+				MaxAttempts:    job.MaxAttempts,
+				RequiredLabels: job.RequiredLabels,
+				CreatedAt:      now,
+				UpdatedAt:      now,
+			}
+			if err := tx.Create(&requeued).Error; err != nil {
+				return err
+			}
+			result.NewJobID = requeued.ID
+			event.EventType = "manager_requeued"
+			event.Message = fmt.Sprintf("管理员重新入队为任务 #%d", requeued.ID)
+			if err := tx.Create(&models.TaskJobEvent{
+				JobID:     requeued.ID,
+				EventType: "manager_requeued",
+				Message:   fmt.Sprintf("由任务 #%d 重新入队", job.ID),
+				EventAt:   now,
+			}).Error; err != nil {
+				return err
+			}
+			// The failed job itself stays as it is.
+			updates = nil
+		default:
+			return &jobControlError{status: http.StatusBadRequest, detail: "未知的任务操作"}
+		}
+
+		if updates != nil {
+			if err := tx.Model(&models.TaskJob{}).Where("id = ?", job.ID).Updates(updates).Error; err != nil {
+				return err
+			}
+			if status, ok := updates["status"].(string); ok {
+				result.Status = status
+			}
+		}
+		return tx.Create(&event).Error
+	})
+	if err != nil {
+		return result, err
+	}
+
+	if revoked.ID != 0 {
+		_ = s.redisStore.ClearJobLease(ctx, managerID, revoked.ID)
+		if revoked.LeasedByNode != "" && !s.nodeHoldsAccountJobs(managerID, revoked.LeasedByNode, revoked.UserID) {
+			_ = s.redisStore.ReleaseAccountLease(ctx, managerID, revoked.UserID, revoked.LeasedByNode)
+		}
+	}
+	if revoked.ID != 0 || result.NewJobID != 0 {
+		s.wakeAgents(ctx, managerID)
+	}
+	return result, nil
+}
+
+// managerJobAction serves the single-job actions under /task-pool/jobs/:job_id.
+func (s *Server) managerJobAction(action string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		managerID := getUint(c, ctxActorIDKey)
+		jobID, ok := parseUintParam(c, "job_id")
+		if !ok {
+			return
+		}
+		priority := 0
+		if action == jobActionPriority {
+			var req putJobPriorityRequest
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"detail": err.Error()})
+				return
+			}
+			priority = req.Priority
+		}
+
+		result, err := s.controlJob(c.Request.Context(), managerID, 0, jobID, action, priority, time.Now().UTC())
+		if err != nil {
+			var controlErr *jobControlError
+			if errors.As(err, &controlErr) {
+				c.JSON(controlErr.status, gin.H{"detail": controlErr.detail})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"detail": "操作任务失败"})
+			return
+		}
+
+		detail := datatypes.JSONMap{"status": result.Status}
+		if action == jobActionPriority {
+			detail["priority"] = priority
+		}
+		if result.NewJobID != 0 {
+			detail["new_job_id"] = result.NewJobID
+		}
+		s.audit(models.ActorTypeManager, managerID, jobActionAuditNames[action], "task_job", jobID, detail, c.ClientIP())
+		c.JSON(http.StatusOK, result)
+	}
+}
+
+// managerBatchJobAction applies an action to each job of the request. Jobs
+// that cannot take the action are reported and skipped.
+func (s *Server) managerBatchJobAction(action string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		managerID := getUint(c, ctxActorIDKey)
+		var req batchJobControlRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"detail": err.Error()})
+			return
+		}
+
+		ctx := c.Request.Context()
+		now := time.Now().UTC()
+		results := make([]jobControlResult, 0, len(req.JobIDs))
+		failed := make([]jobControlResult, 0)
+		seen := make(map[uint]struct{}, len(req.JobIDs))
+		for _, jobID := range req.JobIDs {
+			if _, dup := seen[jobID]; dup {
+				continue
+			}
+			seen[jobID] = struct{}{}
+			result, err := s.controlJob(ctx, managerID, 0, jobID, action, req.Priority, now)
+			if err != nil {
+				var controlErr *jobControlError
+				if !errors.As(err, &controlErr) {
+					c.JSON(http.StatusInternalServerError, gin.H{"detail": "批量操作任务失败"})
+					return
+				}
+				result.Detail = controlErr.detail
+				failed = append(failed, result)
+				continue
+			}
+			results = append(results, result)
+		}
+
+		detail := datatypes.JSONMap{"job_ids": req.JobIDs, "updated": len(results)}
+		if action == jobActionPriority {
+			detail["priority"] = req.Priority
+		}
+		s.audit(models.ActorTypeManager, managerID, "batch_"+jobActionAuditNames[action], "task_job", 0, detail, c.ClientIP())
+		c.JSON(http.StatusOK, gin.H{"updated": len(results), "items": results, "failed": failed})
+	}
+}
+
+// managerRunTaskNow enqueues a user's task right away, ignoring its
+// next_time. Rest periods still hold the job like any other.
+func (s *Server) managerRunTaskNow(c *gin.Context) {
+	managerID := getUint(c, ctxActorIDKey)
+	userID, ok := parseUintParam(c, "user_id")
+	if !ok {
+		return
+	}
+	if !s.managerOwnsUser(c, managerID, userID) {
+		return
+	}
+	var req runTaskNowRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"detail": err.Error()})
+		return
+	}
+
+	job, err := s.enqueueTaskNow(userID, req.TaskType, "manager_run_now", "管理员立即执行（忽略 next_time）", time.Now().UTC())
+	if err != nil {
+		var controlErr *jobControlError
+		if errors.As(err, &controlErr) {
+			c.JSON(controlErr.status, gin.H{"detail": controlErr.detail})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "创建任务失败"})
+		return
+	}
+	s.audit(models.ActorTypeManager, managerID, "run_task_now", "user", userID, datatypes.JSONMap{
+		"task_type": job.TaskType,
+		"job_id":    job.ID,
+	}, c.ClientIP())
+	c.JSON(http.StatusOK, gin.H{"job_id": job.ID, "task_type": job.TaskType, "status": job.Status, "priority": job.Priority})
+}
+
+// enqueueTaskNow creates a pending job of an enabled task of the user,
+// unless the task already has a job that has not finished.
+func (s *Server) enqueueTaskNow(userID uint, taskType string, source string, message string, now time.Time) (models.TaskJob, error) {
+	user, taskMap, err := s.checkTaskNow(userID, taskType, now)
+	if err != nil {
+		return models.TaskJob{}, err
+	}
+	return s.createTaskNow(user, taskType, taskMap, source, message, now)
+}
+
+// checkTaskNow loads the user and task config of a run-now request and
+// checks that the task can run now.
+func (s *Server) checkTaskNow(userID uint, taskType string, now time.Time) (models.User, map[string]any, error) {
+	var user models.User
+	if err := s.db.Where("id = ?", userID).First(&user).Error; err != nil {
+		return user, nil, &jobControlError{status: http.StatusNotFound, detail: "用户不存在"}
+	}
+	if user.Status != models.UserStatusActive || user.ExpiresAt == nil || !user.ExpiresAt.After(now) {
+		return user, nil, &jobControlError{status: http.StatusBadRequest, detail: "用户未激活或已过期"}
+	}
+	if !taskmeta.IsTaskAllowedForType(taskType, user.UserType) {
+		return user, nil, &jobControlError{status: http.StatusBadRequest, detail: fmt.Sprintf("任务「%s」不适用于该用户类型", taskType)}
+	}
+	if taskType == "对弈竞猜" {
+		return user, nil, &jobControlError{status: http.StatusBadRequest, detail: "对弈竞猜按竞猜时段调度，不支持立即执行"}
+	}
+	cfg, err := s.getOrCreateTaskConfig(userID)
+	if err != nil {
+		return user, nil, err
+	}
+	taskMap, ok := cfg.TaskConfig[taskType].(map[string]any)
+	if !ok {
+		return user, nil, &jobControlError{status: http.StatusBadRequest, detail: fmt.Sprintf("任务「%s」不在该用户的任务池中", taskType)}
+	}
+	if enabled, _ := taskMap["enabled"].(bool); !enabled {
+		return user, nil, &jobControlError{status: http.StatusBadRequest, detail: fmt.Sprintf("任务「%s」未启用", taskType)}
+	}
+	return user, taskMap, nil
+}
+
+// createTaskNow enqueues the job checked by checkTaskNow.
+func (s *Server) createTaskNow(user models.User, taskType string, taskMap map[string]any, source string, message string, now time.Time) (models.TaskJob, error) {
+	userID := user.ID
+	job := scheduler.NewTaskJob(user, taskType, taskMap, nil, now)
+	job.Payload["source"] = source
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var active models.TaskJob
+		err := tx.Select("id").
+			Where("user_id = ? AND task_type = ? AND status IN ?", userID, taskType, []string{models.JobStatusPending, models.JobStatusLeased, models.JobStatusRunning}).
+			First(&active).Error
+		if err == nil {
+			return &jobControlError{status: http.StatusConflict, detail: fmt.Sprintf("该任务已有未结束的任务 #%d", active.ID)}
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		if err := tx.Create(&job).Error; err != nil {
+			return err
+		}
+		return tx.Create(&models.TaskJobEvent{JobID: job.ID, EventType: source, Message: message, EventAt: now}).Error
+	})
+	if err == nil {
+		s.wakeAgents(context.Background(), user.ManagerID)
+	}
+	return job, err
+}
+
+// userRunNowCooldown is how long a user waits before the same task can be run
+// again by hand. It is kept as a schedule slot so that concurrent requests
+// enqueue one job. userRunNowPerMinute caps the tasks one user runs by hand
+// per minute, whatever their type.
+const (
+	userRunNowCooldown  = time.Minute
+	userRunNowPerMinute = 3
+)
+
+func (s *Server) userRunTaskNow(c *gin.Context) {
+	userID := getUint(c, ctxUserIDKey)
+	managerID := getUint(c, ctxManagerIDKey)
+	var req runTaskNowRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"detail": err.Error()})
+		return
+	}
+
+	// Requests that are refused do not count against the limits below.
+	now := time.Now().UTC()
+	user, taskMap, err := s.checkTaskNow(userID, req.TaskType, now)
+	if err != nil {
+		var controlErr *jobControlError
+		if errors.As(err, &controlErr) {
+			c.JSON(controlErr.status, gin.H{"detail": controlErr.detail})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "创建任务失败"})
+		return
+	}
+	ctx := c.Request.Context()
+	acquired, err := s.redisStore.AcquireScheduleSlot(ctx, managerID, userID, req.TaskType, "run_now", userRunNowCooldown)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "获取调度槽失败"})
+		return
+	}
+	if !acquired {
+		c.Header("Retry-After", strconv.Itoa(int(userRunNowCooldown.Seconds())))
+		c.JSON(http.StatusTooManyRequests, gin.H{"detail": "该任务刚刚触发过，请稍后再试"})
+		return
+	}
+	windowKey := strconv.FormatInt(now.Unix()/int64(time.Minute.Seconds()), 10)
+	allowed, _ := s.redisStore.CheckRateLimit(ctx, fmt.Sprintf("user_run_now_jobs:user:%d:%s", userID, windowKey), userRunNowPerMinute, time.Minute)
+	if !allowed {
+		_ = s.redisStore.ReleaseScheduleSlot(ctx, managerID, userID, req.TaskType, "run_now")
+		c.Header("Retry-After", strconv.Itoa(int(time.Minute.Seconds())))
+		c.JSON(http.StatusTooManyRequests, gin.H{"detail": "立即执行的任务过多，请稍后再试"})
+		return
+	}
+
+	job, err := s.createTaskNow(user, req.TaskType, taskMap, "user_run_now", "用户立即执行（忽略 next_time）", now)
+	if err != nil {
+		_ = s.redisStore.ReleaseScheduleSlot(ctx, managerID, userID, req.TaskType, "run_now")
+		var controlErr *jobControlError
+		if errors.As(err, &controlErr) {
+			c.JSON(controlErr.status, gin.H{"detail": controlErr.detail})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "创建任务失败"})
+		return
+	}
+	s.audit(models.ActorTypeUser, userID, "user_run_task_now", "task_job", job.ID, datatypes.JSONMap{
+		"task_type": job.TaskType,
+	}, c.ClientIP())
+	c.JSON(http.StatusOK, gin.H{"job_id": job.ID, "task_type": job.TaskType, "status": job.Status, "priority": job.Priority})
+}
+
+// userGetMeJobs lists the user's jobs that have not finished yet.
+func (s *Server) userGetMeJobs(c *gin.Context) {
+	userID := getUint(c, ctxUserIDKey)
+	type userJobRow struct {
+		ID          uint       `json:"id"`
+		TaskType    string     `json:"task_type"`
+		Status      string     `json:"status"`
+		Priority    int        `json:"priority"`
+		ScheduledAt time.Time  `json:"scheduled_at"`
+		CreatedAt   time.Time  `json:"created_at"`
+		Attempts    int        `json:"attempts"`
+		MaxAttempts int        `json:"max_attempts"`
+		LeaseUntil  *time.Time `json:"lease_until"`
+		Cancellable bool       `json:"cancellable" gorm:"-"`
+		WaitingFor  []gin.H    `json:"waiting_for,omitempty" gorm:"-"`
+	}
+	var rows []userJobRow
+	if err := s.db.Model(&models.TaskJob{}).
+		Select("id, task_type, status, priority, scheduled_at, created_at, attempts, max_attempts, lease_until").
+		Where("user_id = ? AND status IN ?", userID, []string{models.JobStatusPending, models.JobStatusLeased, models.JobStatusRunning}).
+		Order("scheduled_at asc, id asc").
+		Scan(&rows).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "查询任务失败"})
+		return
+	}
+	pendingIDs := make([]uint, 0, len(rows))
+	for _, row := range rows {
+		if row.Status == models.JobStatusPending {
+			pendingIDs = append(pendingIDs, row.ID)
+		}
+	}
+	waiting := s.unmetJobDependencies(pendingIDs)
+	for i := range rows {
+		rows[i].Cancellable = rows[i].Status == models.JobStatusPending
+		rows[i].WaitingFor = waiting[rows[i].ID]
+	}
+	c.JSON(http.StatusOK, gin.H{"items": rows})
+}
+
+// userCancelMeJob cancels one of the user's jobs that no node has taken yet.
+func (s *Server) userCancelMeJob(c *gin.Context) {
+	userID := getUint(c, ctxUserIDKey)
+	managerID := getUint(c, ctxManagerIDKey)
+	jobID, ok := parseUintParam(c, "job_id")
+	if !ok {
+		return
+	}
+	result, err := s.controlJob(c.Request.Context(), managerID, userID, jobID, jobActionCancel, 0, time.Now().UTC())
+	if err != nil {
+		var controlErr *jobControlError
+		if errors.As(err, &controlErr) {
+			c.JSON(controlErr.status, gin.H{"detail": controlErr.detail})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "取消任务失败"})
+		return
+	}
+	s.audit(models.ActorTypeUser, userID, "user_cancel_job", "task_job", jobID, datatypes.JSONMap{}, c.ClientIP())
+	c.JSON(http.StatusOK, result)
+}
@@ -0,0 +1,231 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"oas-cloud-go/internal/models"
+
+	"gorm.io/datatypes"
+)
+
+func loadJobEventTypes(t *testing.T, srv *Server, jobID uint) []string {
+	t.Helper()
+	var events []models.TaskJobEvent
+	if err := srv.db.Where("job_id = ?", jobID).Order("id asc").Find(&events).Error; err != nil {
+		t.Fatalf("load job events failed: %v", err)
+	}
+	types := make([]string, 0, len(events))
+	for _, event := range events {
+		types = append(types, event.EventType)
+	}
+	return types
+}
+
+func TestManagerJobControlActions(t *testing.T) {
+	srv, db := setupTestServer(t)
+	manager := createActiveManager(t, db, "manager_jobctl", "passwordJobctl123")
+	user := createNotifyTestUser(t, srv, manager.ID, "U_JOBCTL_001", datatypes.JSONMap{})
+	managerToken := loginManagerToken(t, srv, "manager_jobctl", "passwordJobctl123")
+	agentToken := loginAgentToken(t, srv, "manager_jobctl", "passwordJobctl123", "node-jobctl")
+
+	at := time.Now().UTC().Add(-time.Minute)
+	pending := createAlertTestJob(t, srv, user, "悬赏", models.JobStatusPending, at)
+	leased := createAlertTestJob(t, srv, user, "弥助", models.JobStatusPending, at)
+	db.Model(&models.TaskJob{}).Where("id = ?", leased.ID).Update("priority", 90)
+	if jobs := pollAs(t, srv, agentToken, map[string]any{"node_id": "node-jobctl", "limit": 1})["jobs"].([]any); len(jobs) != 1 {
+		t.Fatalf("expected one leased job, got %v", jobs)
+	}
+
+	action := func(method, path string, body map[string]any) (int, map[string]any) {
+		resp := doJSONRequest(t, srv.router, method, "/api/v1/manager/task-pool/"+path, body, managerToken)
+		return resp.Code, decodeBodyMap(t, resp.Body.Bytes())
+	}
+
+	if code, body := action(http.MethodPost, "jobs/"+itoa(leased.ID)+"/cancel", nil); code != http.StatusConflict {
+		t.Fatalf("leased jobs should not be cancellable, status=%d body=%v", code, body)
+	}
+	if code, body := action(http.MethodPut, "jobs/"+itoa(pending.ID)+"/priority", map[string]any{"priority": 200}); code != http.StatusOK || body["status"] != models.JobStatusPending {
+		t.Fatalf("priority update failed, status=%d body=%v", code, body)
+	}
+
+	// Revoking drops the lease: the node can no longer report, another poll
+	// picks the job up again.
+	if code, body := action(http.MethodPost, "jobs/"+itoa(leased.ID)+"/revoke", nil); code != http.StatusOK || body["status"] != models.JobStatusPending {
+		t.Fatalf("revoke failed, status=%d body=%v", code, body)
+	}
+	resp := doJSONRequest(t, srv.router, http.MethodPost, "/api/v1/agent/jobs/"+itoa(leased.ID)+"/complete", map[string]any{"node_id": "node-jobctl"}, agentToken)
+	if resp.Code != http.StatusForbidden {
+		t.Fatalf("revoked lease should reject reports, status=%d body=%s", resp.Code, resp.Body.String())
+	}
+
+	if code, body := action(http.MethodPost, "jobs/"+itoa(pending.ID)+"/cancel", nil); code != http.StatusOK || body["status"] != models.JobStatusCancelled {
+		t.Fatalf("cancel failed, status=%d body=%v", code, body)
+	}
+	if code, body := action(http.MethodPost, "jobs/"+itoa(pending.ID)+"/requeue", nil); code != http.StatusOK || body["new_job_id"] == nil {
+		t.Fatalf("requeue failed, status=%d body=%v", code, body)
+	} else {
+		var requeued models.TaskJob
+		if err := db.Where("id = ?", uint(body["new_job_id"].(float64))).First(&requeued).Error; err != nil {
+			t.Fatalf("load requeued job failed: %v", err)
+		}
+		if requeued.Status != models.JobStatusPending || requeued.TaskType != "悬赏" || requeued.Priority != 200 || requeued.Attempts != 0 {
+			t.Fatalf("requeued job should copy the original: %+v", requeued)
+		}
+	}
+	if code, _ := action(http.MethodPost, "jobs/"+itoa(pending.ID)+"/requeue", nil); code != http.StatusConflict {
+		t.Fatalf("requeue with an active job of the same task should conflict, status=%d", code)
+	}
+
+	if got := loadJobEventTypes(t, srv, pending.ID); len(got) != 3 || got[0] != "manager_priority" || got[1] != "manager_cancelled" || got[2] != "manager_requeued" {
+		t.Fatalf("unexpected events %v", got)
+	}
+	if got := loadJobEventTypes(t, srv, leased.ID); len(got) != 2 || got[1] != "manager_revoked" {
+		t.Fatalf("unexpected events %v", got)
+	}
+
+	other := createNotifyTestUser(t, srv, createActiveManager(t, db, "manager_jobctl_other", "passwordJobctl123").ID, "U_JOBCTL_002", datatypes.JSONMap{})
+	foreign := createAlertTestJob(t, srv, other, "悬赏", models.JobStatusPending, at)
+	code, body := action(http.MethodPost, "batch-cancel", map[string]any{"job_ids": []uint{leased.ID, foreign.ID}})
+	if code != http.StatusOK || body["updated"] != float64(1) {
+		t.Fatalf("batch cancel failed, status=%d body=%v", code, body)
+	}
+	if failed := body["failed"].([]any); len(failed) != 1 || failed[0].(map[string]any)["detail"] != "任务不存在" {
+		t.Fatalf("jobs of other managers should be reported as missing: %v", failed)
+	}
+}
+
+func TestManagerRunTaskNow(t *testing.T) {
+	srv, db := setupTestServer(t)
+	manager := createActiveManager(t, db, "manager_runnow", "passwordRunnow123")
+	user := createNotifyTestUser(t, srv, manager.ID, "U_RUNNOW_001", datatypes.JSONMap{})
+	token := loginManagerToken(t, srv, "manager_runnow", "passwordRunnow123")
+
+	runNow := func(taskType string) (int, map[string]any) {
+		resp := doJSONRequest(t, srv.router, http.MethodPost, "/api/v1/manager/users/"+itoa(user.ID)+"/tasks/run-now", map[string]any{"task_type": taskType}, token)
+		return resp.Code, decodeBodyMap(t, resp.Body.Bytes())
+	}
+
+	code, body := runNow("悬赏")
+	if code != http.StatusOK || body["status"] != models.JobStatusPending {
+		t.Fatalf("run now failed, status=%d body=%v", code, body)
+	}
+	var job models.TaskJob
+	if err := db.Where("id = ?", uint(body["job_id"].(float64))).First(&job).Error; err != nil {
+		t.Fatalf("load job failed: %v", err)
+	}
+	if job.Payload["source"] != "manager_run_now" || job.ScheduledAt.After(time.Now().UTC()) {
+		t.Fatalf("run now should enqueue a due job: %+v", job)
+	}
+	if got := loadJobEventTypes(t, srv, job.ID); len(got) != 1 || got[0] != "manager_run_now" {
+		t.Fatalf("unexpected events %v", got)
+	}
+
+	if code, _ := runNow("悬赏"); code != http.StatusConflict {
+		t.Fatalf("a task with an active job should conflict, status=%d", code)
+	}
+	if code, _ := runNow("签到"); code != http.StatusBadRequest {
+		t.Fatalf("disabled tasks should be rejected, status=%d", code)
+	}
+	if code, _ := runNow("不存在的任务"); code != http.StatusBadRequest {
+		t.Fatalf("unknown tasks should be rejected, status=%d", code)
+	}
+}
+
+func TestUserRunNowListAndCancel(t *testing.T) {
+	srv, db := setupTestServer(t)
+	manager := createActiveManager(t, db, "manager_userjobs", "passwordUserjobs123")
+	user := createNotifyTestUser(t, srv, manager.ID, "U_USERJOBS_001", datatypes.JSONMap{})
+	other := createNotifyTestUser(t, srv, manager.ID, "U_USERJOBS_002", datatypes.JSONMap{})
+	token, _, err := srv.issueUserToken(user.ID, "test-device")
+	if err != nil {
+		t.Fatalf("issue user token failed: %v", err)
+	}
+
+	runNow := func(taskType string) (int, map[string]any) {
+		resp := doJSONRequest(t, srv.router, http.MethodPost, "/api/v1/user/me/tasks/run-now", map[string]any{"task_type": taskType}, token)
+		return resp.Code, decodeBodyMap(t, resp.Body.Bytes())
+	}
+
+	code, body := runNow("领取邮件")
+	if code != http.StatusOK {
+		t.Fatalf("run now failed, status=%d body=%v", code, body)
+	}
+	jobID := uint(body["job_id"].(float64))
+	if code, _ := runNow("领取邮件"); code != http.StatusTooManyRequests {
+		t.Fatalf("the same task should cool down after run now, status=%d", code)
+	}
+	if code, _ := runNow("对弈竞猜"); code != http.StatusBadRequest {
+		t.Fatalf("对弈竞猜 follows its betting windows and should be rejected, status=%d", code)
+	}
+
+	resp := doJSONRequest(t, srv.router, http.MethodGet, "/api/v1/user/me/jobs", nil, token)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("list jobs failed, status=%d body=%s", resp.Code, resp.Body.String())
+	}
+	items := decodeBodyMap(t, resp.Body.Bytes())["items"].([]any)
+	if len(items) != 1 || items[0].(map[string]any)["id"] != float64(jobID) || items[0].(map[string]any)["cancellable"] != true {
+		t.Fatalf("unexpected jobs %v", items)
+	}
+
+	foreign := createAlertTestJob(t, srv, other, "领取邮件", models.JobStatusPending, time.Now().UTC())
+	resp = doJSONRequest(t, srv.router, http.MethodPost, "/api/v1/user/me/jobs/"+itoa(foreign.ID)+"/cancel", nil, token)
+	if resp.Code != http.StatusNotFound {
+		t.Fatalf("users should not cancel jobs of others, status=%d", resp.Code)
+	}
+	resp = doJSONRequest(t, srv.router, http.MethodPost, "/api/v1/user/me/jobs/"+itoa(jobID)+"/cancel", nil, token)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("cancel failed, status=%d body=%s", resp.Code, resp.Body.String())
+	}
+	if got := loadJobEventTypes(t, srv, jobID); len(got) != 2 || got[0] != "user_run_now" || got[1] != "user_cancelled" {
+		t.Fatalf("unexpected events %v", got)
+	}
+}
+
+func TestUserRunNowLimits(t *testing.T) {
+	srv, db := setupTestServer(t)
+	manager := createActiveManager(t, db, "manager_runnow_limit", "passwordRunNow123")
+	user := createNotifyTestUser(t, srv, manager.ID, "U_RUNNOW_LIMIT_001", datatypes.JSONMap{})
+	token, _, err := srv.issueUserToken(user.ID, "test-device")
+	if err != nil {
+		t.Fatalf("issue user token failed: %v", err)
+	}
+	runNow := func(taskType string) (int, map[string]any) {
+		resp := doJSONRequest(t, srv.router, http.MethodPost, "/api/v1/user/me/tasks/run-now", map[string]any{"task_type": taskType}, token)
+		return resp.Code, decodeBodyMap(t, resp.Body.Bytes())
+	}
+
+	// A refused request leaves the task's cooldown untouched.
+	cfg, err := srv.getOrCreateTaskConfig(user.ID)
+	if err != nil {
+		t.Fatalf("load task config failed: %v", err)
+	}
+	cfg.TaskConfig["悬赏"].(map[string]any)["enabled"] = false
+	db.Model(&models.UserTaskConfig{}).Where("id = ?", cfg.ID).Update("task_config", cfg.TaskConfig)
+	if code, body := runNow("悬赏"); code != http.StatusBadRequest {
+		t.Fatalf("a disabled task should be refused, status=%d body=%v", code, body)
+	}
+	cfg.TaskConfig["悬赏"].(map[string]any)["enabled"] = true
+	db.Model(&models.UserTaskConfig{}).Where("id = ?", cfg.ID).Update("task_config", cfg.TaskConfig)
+	if code, body := runNow("悬赏"); code != http.StatusOK {
+		t.Fatalf("the task should run once enabled, status=%d body=%v", code, body)
+	}
+
+	// Different task types share one per-user budget.
+	clearRateLimits(srv)
+	for _, taskType := range []string{"弥助", "勾协", "领取邮件"} {
+		if code, body := runNow(taskType); code != http.StatusOK {
+			t.Fatalf("run now %s failed, status=%d body=%v", taskType, code, body)
+		}
+	}
+	code, body := runNow("探索突破")
+	if code != http.StatusTooManyRequests || body["detail"] != "立即执行的任务过多，请稍后再试" {
+		t.Fatalf("the per-user limit should apply across task types, status=%d body=%v", code, body)
+	}
+	// The refused task did not keep its cooldown.
+	clearRateLimits(srv)
+	if code, body := runNow("探索突破"); code != http.StatusOK {
+		t.Fatalf("a task refused by the per-user limit should run later, status=%d body=%v", code, body)
+	}
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"oas-cloud-go/internal/models"
+	"oas-cloud-go/internal/taskmeta"
+
+	"gorm.io/datatypes"
+)
+
+func TestAgentFailSchedulesRetryUntilTerminal(t *testing.T) {
+	srv, db := setupTestServer(t)
+	manager := createActiveManager(t, db, "manager_retry", "passwordRetry123")
+	user := createNotifyTestUser(t, srv, manager.ID, "U_RETRY_001", datatypes.JSONMap{})
+	token := loginAgentToken(t, srv, "manager_retry", "passwordRetry123", "node-retry")
+
+	at := time.Now().UTC().Add(-time.Minute)
+	retried := createAlertTestJob(t, srv, user, "悬赏", models.JobStatusPending, at)
+	fatal := createAlertTestJob(t, srv, user, "弥助", models.JobStatusPending, at)
+	if jobs := pollAs(t, srv, token, map[string]any{"node_id": "node-retry", "limit": 10})["jobs"].([]any); len(jobs) != 2 {
+		t.Fatalf("expected both jobs leased, got %v", jobs)
+	}
+
+	fail := func(jobID uint, code string) map[string]any {
+		resp := doJSONRequest(t, srv.router, http.MethodPost, "/api/v1/agent/jobs/"+itoa(jobID)+"/fail", map[string]any{
+			"node_id":    "node-retry",
+			"message":    "failed",
+			"error_code": code,
+		}, token)
+		if resp.Code != http.StatusOK {
+			t.Fatalf("fail report failed, status=%d body=%s", resp.Code, resp.Body.String())
+		}
+		return decodeBodyMap(t, resp.Body.Bytes())
+	}
+
+	before := time.Now().UTC()
+	if body := fail(retried.ID, "LOCAL_BATCH_FAILED"); body["retry_at"] == nil {
+		t.Fatalf("retryable failure should report retry_at: %v", body)
+	}
+	var job models.TaskJob
+	if err := db.Where("id = ?", retried.ID).First(&job).Error; err != nil {
+		t.Fatalf("reload job failed: %v", err)
+	}
+	if job.Status != models.JobStatusPending || job.Attempts != 1 || job.LeasedByNode != "" {
+		t.Fatalf("retryable failure should requeue the job: %+v", job)
+	}
+	if job.ScheduledAt.Before(before.Add(59*time.Second)) || job.ScheduledAt.After(time.Now().UTC().Add(time.Minute)) {
+		t.Fatalf("first retry should wait the 1m base delay, scheduled_at=%v", job.ScheduledAt)
+	}
+	var retryEvents int64
+	db.Model(&models.TaskJobEvent{}).Where("job_id = ? AND event_type = ?", retried.ID, "retry_scheduled").Count(&retryEvents)
+	if retryEvents != 1 {
+		t.Fatalf("expected a retry_scheduled event, got %d", retryEvents)
+	}
+	// A retried attempt is not a job failure; digests and failure counts
+	// only see the final one.
+	var attemptTypes []string
+	db.Model(&models.TaskJobEvent{}).Where("job_id = ? AND event_type IN ?", retried.ID, []string{"fail", "attempt_failed"}).Pluck("event_type", &attemptTypes)
+	if len(attemptTypes) != 1 || attemptTypes[0] != "attempt_failed" {
+		t.Fatalf("a retried attempt should be recorded as attempt_failed, got %v", attemptTypes)
+	}
+
+	if body := fail(fatal.ID, "LOCAL_ACCOUNT_NOT_MAPPED"); body["retry_at"] != nil {
+		t.Fatalf("non-retryable failure should not retry: %v", body)
+	}
+	var terminal models.TaskJob
+	if err := db.Where("id = ?", fatal.ID).First(&terminal).Error; err != nil {
+		t.Fatalf("reload job failed: %v", err)
+	}
+	if terminal.Status != models.JobStatusFailed || terminal.Attempts != 1 {
+		t.Fatalf("non-retryable failure should be terminal: %+v", terminal)
+	}
+	var failEvents int64
+	db.Model(&models.TaskJobEvent{}).Where("job_id = ? AND event_type = ?", fatal.ID, "fail").Count(&failEvents)
+	if failEvents != 1 {
+		t.Fatalf("the final failure should be recorded as fail, got %d", failEvents)
+	}
+}
+
+func TestTaskConfigRetryValidation(t *testing.T) {
+	srv, db := setupTestServer(t)
+	manager := createActiveManager(t, db, "manager_retry_cfg", "passwordRetry123")
+	token := loginManagerToken(t, srv, "manager_retry_cfg", "passwordRetry123")
+	user := createNotifyTestUser(t, srv, manager.ID, "U_RETRY_CFG_001", datatypes.JSONMap{})
+	path := "/api/v1/manager/users/" + itoa(user.ID) + "/tasks"
+
+	resp := doJSONRequest(t, srv.router, http.MethodPut, path, map[string]any{
+		"task_config": map[string]any{"对弈竞猜": map[string]any{"retry": map[string]any{"max_delay_seconds": 10}}},
+	}, token)
+	if resp.Code != http.StatusBadRequest {
+		t.Fatalf("max below the default base delay should be rejected, status=%d body=%s", resp.Code, resp.Body.String())
+	}
+
+	resp = doJSONRequest(t, srv.router, http.MethodPut, path, map[string]any{
+		"task_config": map[string]any{"悬赏": map[string]any{"max_attempts": 5, "retry": map[string]any{"non_retryable": []any{"banned"}}}},
+	}, token)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("valid retry config should be accepted, status=%d body=%s", resp.Code, resp.Body.String())
+	}
+	task := decodeBodyMap(t, resp.Body.Bytes())["task_config"].(map[string]any)["悬赏"].(map[string]any)
+	if codes := task["retry"].(map[string]any)["non_retryable"].([]any); len(codes) != 1 || codes[0] != "BANNED" {
+		t.Fatalf("codes should be stored upper-cased, got %v", codes)
+	}
+}
+
+func TestFinalLeaseTimeoutFinalizesJob(t *testing.T) {
+	srv, db := setupTestServer(t)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer hook.Close()
+	manager := createActiveManager(t, db, "manager_lease_final", "passwordLeaseFinal123")
+	user := createNotifyTestUser(t, srv, manager.ID, "U_LEASE_FINAL_001", datatypes.JSONMap{
+		"channels": map[string]any{
+			"webhook": map[string]any{"enabled": true, "url": hook.URL},
+		},
+	})
+	if _, err := srv.getOrCreateTaskConfig(user.ID); err != nil {
+		t.Fatalf("create task config failed: %v", err)
+	}
+
+	now := time.Now().UTC()
+	expired := now.Add(-time.Minute)
+	job := models.TaskJob{
+		ManagerID:    manager.ID,
+		UserID:       user.ID,
+		TaskType:     "悬赏",
+		ScheduledAt:  now.Add(-time.Hour),
+		Status:       models.JobStatusRunning,
+		LeasedByNode: "node-lease-final",
+		LeaseUntil:   &expired,
+		Attempts:     2,
+		MaxAttempts:  3,
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	}
+	if err := db.Create(&job).Error; err != nil {
+		t.Fatalf("create job failed: %v", err)
+	}
+	acquired, _ := srv.redisStore.AcquireAccountLease(context.Background(), manager.ID, user.ID, "node-lease-final", time.Hour)
+	if !acquired {
+		t.Fatalf("account lease should be free")
+	}
+
+	srv.resetExpiredJobLeases(context.Background(), manager.ID, now)
+
+	var stored models.TaskJob
+	db.First(&stored, job.ID)
+	if stored.Status != models.JobStatusFailed {
+		t.Fatalf("job out of attempts should fail, got %s", stored.Status)
+	}
+	cfg, err := srv.getOrCreateTaskConfig(user.ID)
+	if err != nil {
+		t.Fatalf("load task config failed: %v", err)
+	}
+	want := now.Add(30 * time.Minute).In(taskmeta.BJLoc).Format("2006-01-02 15:04")
+	if got := cfg.TaskConfig["悬赏"].(map[string]any)["next_time"]; got != want {
+		t.Fatalf("next_time should move by fail_delay to %s, got %v", want, got)
+	}
+	var queued []models.NotificationOutbox
+	db.Where("user_id = ? AND job_id = ?", user.ID, job.ID).Find(&queued)
+	if len(queued) != 1 || queued[0].EventType != "fail" {
+		t.Fatalf("expected one failure notification, got %+v", queued)
+	}
+	if acquired, _ := srv.redisStore.AcquireAccountLease(context.Background(), manager.ID, user.ID, "node-other", time.Minute); !acquired {
+		t.Fatalf("the account lease should be released after the final timeout")
+	}
+}
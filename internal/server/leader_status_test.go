@@ -0,0 +1,34 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"oas-cloud-go/internal/scheduler"
+)
+
+func TestSchedulerStatusReportsLeader(t *testing.T) {
+	srv, _ := setupTestServer(t)
+	srv.elector = scheduler.NewElector(srv.redisStore, scheduler.LeaderName, "replica-test", 3*time.Second)
+	srv.elector.Start()
+	defer srv.elector.Stop()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !srv.elector.IsLeader() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !srv.leading() {
+		t.Fatalf("the only replica should lead")
+	}
+
+	resp := doJSONRequest(t, srv.router, http.MethodGet, "/api/v1/scheduler/status", nil, "")
+	if resp.Code != http.StatusOK {
+		t.Fatalf("status failed, status=%d body=%s", resp.Code, resp.Body.String())
+	}
+	leader := decodeBodyMap(t, resp.Body.Bytes())["leader"].(map[string]any)
+	status := leader["status"].(map[string]any)
+	if leader["enabled"] != true || status["leader_id"] != "replica-test" || status["is_leader"] != true || status["fence"] != float64(1) {
+		t.Fatalf("unexpected leader status %v", leader)
+	}
+}
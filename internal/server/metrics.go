@@ -0,0 +1,94 @@
+package server
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"time"
+
+	"oas-cloud-go/internal/auth"
+	"oas-cloud-go/internal/metrics"
+	"oas-cloud-go/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/redis/go-redis/v9"
+)
+
+// newMetricsRegistry gathers the package metrics with the collectors that
+// read this server's state at scrape time: the job queue per manager, the
+// WebSocket hub and the DB and Redis pools.
+func (s *Server) newMetricsRegistry() *prometheus.Registry {
+	extra := []prometheus.Collector{
+		metrics.NewJobQueueCollector(s.db),
+		metrics.NewWSConnectionsGauge(s.scanWSHub.Count),
+	}
+	if sqlDB, err := s.db.DB(); err == nil {
+		extra = append(extra, collectors.NewDBStatsCollector(sqlDB, "main"))
+	}
+	if pool, ok := s.redisStore.(interface{ PoolStats() *redis.PoolStats }); ok {
+		extra = append(extra, metrics.NewRedisPoolCollector(pool.PoolStats))
+	}
+	return metrics.NewRegistry(extra...)
+}
+
+// metricsMiddleware records latency and status per route template. Requests
+// that match no route share one label so that scanners cannot blow up the
+// series count.
+func (s *Server) metricsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		method := c.Request.Method
+		metrics.HTTPRequests.WithLabelValues(method, route, strconv.Itoa(c.Writer.Status())).Inc()
+		metrics.HTTPDuration.WithLabelValues(method, route).Observe(time.Since(start).Seconds())
+	}
+}
+
+// metricsHandler serves /metrics. With METRICS_TOKEN set, scrapes must send
+// it as a Bearer token.
+func (s *Server) metricsHandler() gin.HandlerFunc {
+	handler := promhttp.HandlerFor(s.metricsRegistry, promhttp.HandlerOpts{})
+	return func(c *gin.Context) {
+		if s.cfg.MetricsToken != "" {
+			token := auth.BearerToken(c.GetHeader("Authorization"))
+			if subtle.ConstantTimeCompare([]byte(token), []byte(s.cfg.MetricsToken)) != 1 {
+				c.JSON(http.StatusUnauthorized, gin.H{"detail": "无效的令牌"})
+				return
+			}
+		}
+		handler.ServeHTTP(c.Writer, c.Request)
+	}
+}
+
+// knownScanPhases bounds the phase label of the scan metrics; agents report
+// phases as free text.
+var knownScanPhases = map[string]struct{}{
+	models.ScanPhaseWaiting:       {},
+	models.ScanPhaseLaunching:     {},
+	models.ScanPhaseQrcodeReady:   {},
+	models.ScanPhaseQrcodeScanned: {},
+	models.ScanPhaseChooseSystem:  {},
+	models.ScanPhaseChooseZone:    {},
+	models.ScanPhaseChooseRole:    {},
+	models.ScanPhaseEntering:      {},
+	models.ScanPhasePullingData:   {},
+	models.ScanPhaseDone:          {},
+}
+
+// observeScanPhase records the time a scan job spent in the phase it leaves.
+func observeScanPhase(phase string, startedAt *time.Time, now time.Time) {
+	if startedAt == nil || phase == "" {
+		return
+	}
+	if _, ok := knownScanPhases[phase]; !ok {
+		phase = "other"
+	}
+	metrics.ScanPhaseDuration.WithLabelValues(phase).Observe(now.Sub(*startedAt).Seconds())
+}
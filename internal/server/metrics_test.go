@@ -0,0 +1,50 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsEndpoint(t *testing.T) {
+	srv, db := setupTestServer(t)
+	createActiveManager(t, db, "manager_metrics", "passwordMetrics123")
+	loginManagerToken(t, srv, "manager_metrics", "passwordMetrics123")
+
+	scrape := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp := httptest.NewRecorder()
+		srv.router.ServeHTTP(resp, req)
+		return resp
+	}
+
+	resp := scrape("")
+	if resp.Code != http.StatusOK {
+		t.Fatalf("scrape failed, status=%d body=%s", resp.Code, resp.Body.String())
+	}
+	body := resp.Body.String()
+	for _, want := range []string{
+		`oas_http_requests_total{method="POST",route="/api/v1/manager/auth/login",status="200"}`,
+		"oas_ws_connections 0",
+		"go_goroutines",
+	} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("metrics should contain %q", want)
+		}
+	}
+
+	srv.cfg.MetricsToken = "scrape-secret"
+	if resp := scrape(""); resp.Code != http.StatusUnauthorized {
+		t.Fatalf("scrape without token should be rejected, status=%d", resp.Code)
+	}
+	if resp := scrape("wrong"); resp.Code != http.StatusUnauthorized {
+		t.Fatalf("scrape with a wrong token should be rejected, status=%d", resp.Code)
+	}
+	if resp := scrape("scrape-secret"); resp.Code != http.StatusOK {
+		t.Fatalf("scrape with the token failed, status=%d", resp.Code)
+	}
+}
@@ -19,6 +19,7 @@ const (
 	ctxManagerIDKey   = "manager_id"
 	ctxUserIDKey      = "user_id"
 	ctxUserTokenIDKey = "user_token_id"
+	ctxNodeIDKey      = "node_id"
 )
 
 func (s *Server) requireJWT(roles ...string) gin.HandlerFunc {
@@ -47,7 +48,7 @@ func (s *Server) requireJWT(roles ...string) gin.HandlerFunc {
 			return
 		}
 		if claims.Role == models.ActorTypeAgent {
-			ok, err := s.redisStore.ValidateAgentSession(c.Request.Context(), raw, claims.ManagerID)
+			nodeID, ok, err := s.redisStore.ValidateAgentSession(c.Request.Context(), raw, claims.ManagerID)
 			if err != nil {
 				c.JSON(http.StatusInternalServerError, gin.H{"detail": "Redis会话检查失败"})
 				c.Abort()
@@ -58,6 +59,7 @@ func (s *Server) requireJWT(roles ...string) gin.HandlerFunc {
 				c.Abort()
 				return
 			}
+			c.Set(ctxNodeIDKey, nodeID)
 		}
 
 		c.Set(ctxActorRoleKey, claims.Role)
@@ -238,6 +240,39 @@ func (s *Server) rateLimitByActor(scope string, limit int, window time.Duration)
 	}
 }
 
+// rateLimitByUser limits a user route per user; rateLimitByActor would share
+// the limit across all users of a manager.
+func (s *Server) rateLimitByUser(scope string, limit int, window time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := getUint(c, ctxUserIDKey)
+		if userID == 0 {
+			c.Next()
+			return
+		}
+		windowKey := strconv.FormatInt(time.Now().Unix()/int64(window.Seconds()), 10)
+		key := fmt.Sprintf("%s:user:%d:%s", scope, userID, windowKey)
+		allowed, _ := s.redisStore.CheckRateLimit(c.Request.Context(), key, limit, window)
+		if !allowed {
+			c.Header("Retry-After", strconv.Itoa(int(window.Seconds())))
+			c.JSON(http.StatusTooManyRequests, gin.H{"detail": "请求过于频繁，请稍后再试"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// agentNodeMatches answers 403 and returns false unless nodeID is the node
+// the agent session logged in as, so that a credential issued for one node
+// cannot poll, lease or report as another.
+func agentNodeMatches(c *gin.Context, nodeID string) bool {
+	if nodeID != c.GetString(ctxNodeIDKey) {
+		c.JSON(http.StatusForbidden, gin.H{"detail": "node_id 与登录节点不一致"})
+		return false
+	}
+	return true
+}
+
 func getUint(c *gin.Context, key string) uint {
 	value, exists := c.Get(key)
 	if !exists {
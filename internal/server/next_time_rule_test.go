@@ -0,0 +1,97 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"oas-cloud-go/internal/models"
+	"oas-cloud-go/internal/taskmeta"
+
+	"gorm.io/datatypes"
+)
+
+func TestPreviewNextTimeRule(t *testing.T) {
+	srv, _ := setupTestServer(t)
+
+	resp := doJSONRequest(t, srv.router, http.MethodGet,
+		"/api/v1/task-templates/next-time-preview?rule=coop_window&count=3&from=2026-03-02%2018:30", nil, "")
+	if resp.Code != http.StatusOK {
+		t.Fatalf("preview failed, status=%d body=%s", resp.Code, resp.Body.String())
+	}
+	body := decodeBodyMap(t, resp.Body.Bytes())
+	if body["expression"] != "cron:0 18,21 * * *" {
+		t.Fatalf("alias should be resolved: %v", body)
+	}
+	items := body["items"].([]any)
+	want := []string{"2026-03-02 21:00", "2026-03-03 18:00", "2026-03-03 21:00"}
+	if len(items) != len(want) {
+		t.Fatalf("expected %d items, got %v", len(want), items)
+	}
+	for i, raw := range items {
+		if item := raw.(map[string]any); item["earliest"] != want[i] || item["latest"] != want[i] {
+			t.Fatalf("item %d: want %s, got %v", i, want[i], item)
+		}
+	}
+
+	resp = doJSONRequest(t, srv.router, http.MethodGet,
+		"/api/v1/task-templates/next-time-preview?task_type=%E6%8E%A2%E7%B4%A2%E7%AA%81%E7%A0%B4&count=1&from=2026-03-02%2008:00", nil, "")
+	if resp.Code != http.StatusOK {
+		t.Fatalf("task_type preview failed, status=%d body=%s", resp.Code, resp.Body.String())
+	}
+	items = decodeBodyMap(t, resp.Body.Bytes())["items"].([]any)
+	if items[0].(map[string]any)["earliest"] != "2026-03-02 16:00" {
+		t.Fatalf("unexpected default-rule preview: %v", items)
+	}
+
+	for _, query := range []string{"rule=cron:bad", "rule=daily_reset&count=51", "rule=daily_reset&from=tomorrow", ""} {
+		resp = doJSONRequest(t, srv.router, http.MethodGet, "/api/v1/task-templates/next-time-preview?"+query, nil, "")
+		if resp.Code != http.StatusBadRequest {
+			t.Fatalf("%q should be rejected, status=%d", query, resp.Code)
+		}
+	}
+}
+
+func TestTaskNextTimeRuleOverride(t *testing.T) {
+	srv, db := setupTestServer(t)
+	manager := createActiveManager(t, db, "manager_next_rule", "passwordRule123")
+	token := loginManagerToken(t, srv, "manager_next_rule", "passwordRule123")
+	user := createNotifyTestUser(t, srv, manager.ID, "U_NEXT_RULE_001", datatypes.JSONMap{})
+	path := "/api/v1/manager/users/" + itoa(user.ID) + "/tasks"
+
+	resp := doJSONRequest(t, srv.router, http.MethodPut, path, map[string]any{
+		"task_config": map[string]any{"签到": map[string]any{"next_time_rule": "cron:0 25 * * *"}},
+	}, token)
+	if resp.Code != http.StatusBadRequest || !strings.Contains(resp.Body.String(), "签到") {
+		t.Fatalf("invalid rule should be rejected, status=%d body=%s", resp.Code, resp.Body.String())
+	}
+
+	resp = doJSONRequest(t, srv.router, http.MethodPut, path, map[string]any{
+		"task_config": map[string]any{"签到": map[string]any{"enabled": true, "next_time_rule": "Daily:08:30"}},
+	}, token)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("valid rule should be accepted, status=%d body=%s", resp.Code, resp.Body.String())
+	}
+	taskConfig := decodeBodyMap(t, resp.Body.Bytes())["task_config"].(map[string]any)
+	if rule := taskConfig["签到"].(map[string]any)["next_time_rule"]; rule != "daily:08:30" {
+		t.Fatalf("rule should be stored normalized, got %v", rule)
+	}
+
+	now := time.Now().UTC()
+	job := createAlertTestJob(t, srv, user, "签到", models.JobStatusRunning, now)
+	srv.updateTaskNextTime(job.ID, "success", now)
+
+	var cfg models.UserTaskConfig
+	if err := db.Where("user_id = ?", user.ID).First(&cfg).Error; err != nil {
+		t.Fatalf("load task config failed: %v", err)
+	}
+	nextTime := cfg.TaskConfig["签到"].(map[string]any)["next_time"].(string)
+	if !strings.HasSuffix(nextTime, " 08:30") {
+		t.Fatalf("next_time should follow the override, got %s", nextTime)
+	}
+	parsed, _ := time.ParseInLocation("2006-01-02 15:04", nextTime, taskmeta.BJLoc)
+	if !parsed.After(now) || parsed.Sub(now) > 24*time.Hour {
+		t.Fatalf("next_time should be the next 08:30, got %s", nextTime)
+	}
+}
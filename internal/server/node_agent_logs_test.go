@@ -0,0 +1,202 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"oas-cloud-go/internal/models"
+
+	"gorm.io/datatypes"
+)
+
+func reportAgentLogs(t *testing.T, srv *Server, token string, userID uint, body map[string]any) *httptest.ResponseRecorder {
+	t.Helper()
+	return doJSONRequest(t, srv.router, http.MethodPost, "/api/v1/agent/users/"+itoa(userID)+"/logs", body, token)
+}
+
+// waitAgentLogs waits for the batch writer to store want lines of the user.
+func waitAgentLogs(t *testing.T, srv *Server, userID uint, want int64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var count int64
+		srv.db.Model(&models.AgentLog{}).Where("user_id = ?", userID).Count(&count)
+		if count == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d stored agent logs, got %d", want, count)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestAgentLogsStoredAndSearchable(t *testing.T) {
+	srv, db := setupTestServer(t)
+	manager := createActiveManager(t, db, "manager_agent_logs", "passwordAgentLogs123")
+	user := createNotifyTestUser(t, srv, manager.ID, "U_AGENT_LOGS_001", datatypes.JSONMap{})
+	otherManager := createActiveManager(t, db, "manager_agent_logs_b", "passwordAgentLogs123")
+	other := createNotifyTestUser(t, srv, otherManager.ID, "U_AGENT_LOGS_002", datatypes.JSONMap{})
+	job := createAlertTestJob(t, srv, user, "探索", models.JobStatusRunning, time.Now().UTC())
+	otherJob := createAlertTestJob(t, srv, other, "探索", models.JobStatusRunning, time.Now().UTC())
+	agentToken := loginAgentToken(t, srv, "manager_agent_logs", "passwordAgentLogs123", "node-agent-logs")
+	managerToken := loginManagerToken(t, srv, "manager_agent_logs", "passwordAgentLogs123")
+
+	for _, body := range []map[string]any{
+		{"logs": []map[string]any{{"message": "x", "job_id": otherJob.ID}}},
+		{"logs": []map[string]any{{"message": "x", "fields": map[string]any{"blob": strings.Repeat("x", maxAgentLogFieldsBytes)}}}},
+	} {
+		if resp := reportAgentLogs(t, srv, agentToken, user.ID, body); resp.Code != http.StatusBadRequest {
+			t.Fatalf("report %v should be rejected, got %d", body, resp.Code)
+		}
+	}
+	resp := reportAgentLogs(t, srv, agentToken, user.ID, map[string]any{
+		"node_id": "node-agent-logs",
+		"logs": []map[string]any{
+			{"type": "signin", "level": "INFO", "message": "batch completed: signin", "ts": "2025-01-01T12:34:56.789000Z"},
+			{"type": "explore", "level": "WARNING", "message": "explore 100%_done", "job_id": job.ID, "fields": map[string]any{"round": 3}},
+			{"type": "explore", "level": "critical", "message": "Explore crashed"},
+		},
+	})
+	if resp.Code != http.StatusOK || decodeBodyMap(t, resp.Body.Bytes())["count"] != float64(3) {
+		t.Fatalf("report logs failed, status=%d body=%s", resp.Code, resp.Body.String())
+	}
+	waitAgentLogs(t, srv, user.ID, 3)
+
+	var stored models.AgentLog
+	db.Where("user_id = ? AND type = ?", user.ID, "signin").First(&stored)
+	if stored.Level != "info" || stored.NodeID != "node-agent-logs" || !stored.LoggedAt.Equal(time.Date(2025, 1, 1, 12, 34, 56, 789000000, time.UTC)) {
+		t.Fatalf("unexpected stored line: %+v", stored)
+	}
+	var auditRows int64
+	db.Model(&models.AuditLog{}).Where("actor_type = ? AND target_id = ?", "agent", user.ID).Count(&auditRows)
+	if auditRows != 0 {
+		t.Fatalf("agent logs should stay out of the audit log, got %d rows", auditRows)
+	}
+
+	base := "/api/v1/manager/agent-logs?user_id=" + itoa(user.ID)
+	for query, want := range map[string]float64{
+		"":                           3,
+		"&q=explore":                 2,
+		"&q=" + url.QueryEscape("%"): 1,
+		"&q=explore+crashed":         1,
+		"&level=warn":                2,
+		"&level=error":               1,
+		"&job_id=" + itoa(job.ID):    1,
+		"&field=round%3D3":           1,
+		"&type=signin":               1,
+		"&node_id=node-other":        0,
+	} {
+		resp := doJSONRequest(t, srv.router, http.MethodGet, base+query, nil, managerToken)
+		if resp.Code != http.StatusOK {
+			t.Fatalf("search %q failed, status=%d body=%s", query, resp.Code, resp.Body.String())
+		}
+		if total := decodeBodyMap(t, resp.Body.Bytes())["total"]; total != want {
+			t.Fatalf("search %q: got %v lines, want %v", query, total, want)
+		}
+	}
+	for _, path := range []string{base + "&level=loud", "/api/v1/manager/agent-logs?user_id=" + itoa(other.ID)} {
+		if resp := doJSONRequest(t, srv.router, http.MethodGet, path, nil, managerToken); resp.Code == http.StatusOK {
+			t.Fatalf("%s should be refused", path)
+		}
+	}
+
+	userToken, _, err := srv.issueUserToken(user.ID, "test-device")
+	if err != nil {
+		t.Fatalf("issue user token failed: %v", err)
+	}
+	for _, path := range []string{"/api/v1/user/me/agent-logs", "/api/v1/user/me/agent-logs/stream"} {
+		if resp := doJSONRequest(t, srv.router, http.MethodGet, path, nil, userToken); resp.Code != http.StatusForbidden {
+			t.Fatalf("%s without log access should be 403, got %d", path, resp.Code)
+		}
+	}
+	db.Model(&models.User{}).Where("id = ?", user.ID).Update("can_view_logs", true)
+	resp = doJSONRequest(t, srv.router, http.MethodGet, "/api/v1/user/me/agent-logs?level=error", nil, userToken)
+	items, _ := decodeBodyMap(t, resp.Body.Bytes())["items"].([]any)
+	if resp.Code != http.StatusOK || len(items) != 1 || items[0].(map[string]any)["message"] != "Explore crashed" {
+		t.Fatalf("user search failed, status=%d body=%s", resp.Code, resp.Body.String())
+	}
+
+	resp = doJSONRequest(t, srv.router, http.MethodDelete, "/api/v1/manager/users/"+itoa(user.ID)+"/logs", nil, managerToken)
+	if resp.Code != http.StatusOK || decodeBodyMap(t, resp.Body.Bytes())["agent_logs"] != float64(3) {
+		t.Fatalf("clear logs failed, status=%d body=%s", resp.Code, resp.Body.String())
+	}
+	waitAgentLogs(t, srv, user.ID, 0)
+}
+
+func TestAgentLogLiveTail(t *testing.T) {
+	srv, db := setupTestServer(t)
+	manager := createActiveManager(t, db, "manager_log_tail", "passwordLogTail123")
+	user := createNotifyTestUser(t, srv, manager.ID, "U_LOG_TAIL_001", datatypes.JSONMap{})
+	agentToken := loginAgentToken(t, srv, "manager_log_tail", "passwordLogTail123", "node-log-tail")
+	managerToken := loginManagerToken(t, srv, "manager_log_tail", "passwordLogTail123")
+
+	reportAgentLogs(t, srv, agentToken, user.ID, map[string]any{"logs": []map[string]any{
+		{"level": "info", "message": "tail backlog info"},
+		{"level": "warn", "message": "tail backlog warn"},
+	}})
+	waitAgentLogs(t, srv, user.ID, 2)
+
+	httpSrv := httptest.NewServer(srv.router)
+	defer httpSrv.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet,
+		httpSrv.URL+"/api/v1/manager/agent-logs/stream?level=warn&user_id="+itoa(user.ID), nil)
+	req.Header.Set("Authorization", "Bearer "+managerToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("open stream failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") || resp.Uncompressed {
+		t.Fatalf("unexpected stream response: %d %v", resp.StatusCode, resp.Header)
+	}
+
+	lines := make(chan agentLogItem, 8)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+			if !ok {
+				continue
+			}
+			var item agentLogItem
+			if json.Unmarshal([]byte(data), &item) == nil {
+				lines <- item
+			}
+		}
+		close(lines)
+	}()
+	next := func() agentLogItem {
+		t.Helper()
+		select {
+		case item, ok := <-lines:
+			if !ok {
+				t.Fatal("stream closed")
+			}
+			return item
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for a log line")
+		}
+		return agentLogItem{}
+	}
+
+	if item := next(); item.Message != "tail backlog warn" {
+		t.Fatalf("stream should start with the filtered backlog, got %+v", item)
+	}
+	reportAgentLogs(t, srv, agentToken, user.ID, map[string]any{"logs": []map[string]any{
+		{"level": "debug", "message": "tail live debug"},
+		{"level": "error", "message": "tail live error"},
+	}})
+	if item := next(); item.Message != "tail live error" || item.Level != "error" || item.ID == 0 {
+		t.Fatalf("stream should follow new lines, got %+v", item)
+	}
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"oas-cloud-go/internal/models"
+
+	"gorm.io/datatypes"
+)
+
+func TestAgentCommandLifecycle(t *testing.T) {
+	srv, db := setupTestServer(t)
+	createActiveManager(t, db, "manager_commands", "passwordCommands123")
+	managerToken := loginManagerToken(t, srv, "manager_commands", "passwordCommands123")
+	agentToken := loginAgentToken(t, srv, "manager_commands", "passwordCommands123", "node-cmd-a")
+	otherToken := loginAgentToken(t, srv, "manager_commands", "passwordCommands123", "node-cmd-b")
+	pollAs(t, srv, agentToken, map[string]any{"node_id": "node-cmd-a"})
+	node := findAgentNode(t, srv, "node-cmd-a")
+	base := "/api/v1/manager/agents/" + itoa(node.ID) + "/commands"
+
+	resp := doJSONRequest(t, srv.router, http.MethodPost, base, map[string]any{"command": "format_disk"}, managerToken)
+	if resp.Code != http.StatusBadRequest {
+		t.Fatalf("unknown command should be rejected, got %d", resp.Code)
+	}
+	resp = doJSONRequest(t, srv.router, http.MethodPost, base, map[string]any{
+		"command": "screenshot",
+		"args":    map[string]any{"emulator": 0},
+	}, managerToken)
+	if resp.Code != http.StatusCreated {
+		t.Fatalf("create command failed, status=%d body=%s", resp.Code, resp.Body.String())
+	}
+	created := decodeBodyMap(t, resp.Body.Bytes())
+	if created["status"] != models.AgentCommandPending || created["expires_at"] == nil {
+		t.Fatalf("unexpected created command: %v", created)
+	}
+	commandID := uint(created["id"].(float64))
+
+	commands := pollAs(t, srv, agentToken, map[string]any{"node_id": "node-cmd-a"})["commands"].([]any)
+	if len(commands) != 1 || commands[0].(map[string]any)["command"] != "screenshot" {
+		t.Fatalf("poll should deliver the command, got %v", commands)
+	}
+	if again := pollAs(t, srv, agentToken, map[string]any{"node_id": "node-cmd-a"})["commands"].([]any); len(again) != 0 {
+		t.Fatalf("a command is delivered once, got %v", again)
+	}
+
+	ackPath := "/api/v1/agent/commands/" + itoa(commandID) + "/ack"
+	resultPath := "/api/v1/agent/commands/" + itoa(commandID) + "/result"
+	resp = doJSONRequest(t, srv.router, http.MethodPost, ackPath, map[string]any{"node_id": "node-cmd-b"}, otherToken)
+	if resp.Code != http.StatusForbidden {
+		t.Fatalf("another node may not acknowledge the command, got %d", resp.Code)
+	}
+	for i := 0; i < 2; i++ {
+		resp = doJSONRequest(t, srv.router, http.MethodPost, ackPath, map[string]any{"node_id": "node-cmd-a"}, agentToken)
+		if resp.Code != http.StatusOK || decodeBodyMap(t, resp.Body.Bytes())["status"] != models.AgentCommandAcknowledged {
+			t.Fatalf("ack failed, status=%d body=%s", resp.Code, resp.Body.String())
+		}
+	}
+	resp = doJSONRequest(t, srv.router, http.MethodPost, resultPath, map[string]any{
+		"node_id": "node-cmd-a",
+		"success": true,
+		"message": "截图已上传",
+		"result":  map[string]any{"url": "https://example.com/shot.png"},
+	}, agentToken)
+	if resp.Code != http.StatusOK || decodeBodyMap(t, resp.Body.Bytes())["status"] != models.AgentCommandSucceeded {
+		t.Fatalf("report result failed, status=%d body=%s", resp.Code, resp.Body.String())
+	}
+	resp = doJSONRequest(t, srv.router, http.MethodPost, resultPath, map[string]any{"node_id": "node-cmd-a", "success": false}, agentToken)
+	if resp.Code != http.StatusConflict {
+		t.Fatalf("a finished command takes no second result, got %d", resp.Code)
+	}
+
+	// A cancelled command never reaches the node.
+	resp = doJSONRequest(t, srv.router, http.MethodPost, base, map[string]any{"command": "reload_config"}, managerToken)
+	cancelledID := uint(decodeBodyMap(t, resp.Body.Bytes())["id"].(float64))
+	resp = doJSONRequest(t, srv.router, http.MethodPost, base+"/"+itoa(cancelledID)+"/cancel", nil, managerToken)
+	if resp.Code != http.StatusOK || decodeBodyMap(t, resp.Body.Bytes())["status"] != models.AgentCommandCancelled {
+		t.Fatalf("cancel failed, status=%d body=%s", resp.Code, resp.Body.String())
+	}
+	resp = doJSONRequest(t, srv.router, http.MethodPost, base+"/"+itoa(commandID)+"/cancel", nil, managerToken)
+	if resp.Code != http.StatusConflict {
+		t.Fatalf("a finished command cannot be cancelled, got %d", resp.Code)
+	}
+
+	// A command nobody picked up in time expires.
+	resp = doJSONRequest(t, srv.router, http.MethodPost, base, map[string]any{"command": "pause_polling"}, managerToken)
+	expiredID := uint(decodeBodyMap(t, resp.Body.Bytes())["id"].(float64))
+	db.Model(&models.AgentCommand{}).Where("id = ?", expiredID).Update("expires_at", time.Now().UTC().Add(-time.Minute))
+	if commands := pollAs(t, srv, agentToken, map[string]any{"node_id": "node-cmd-a"})["commands"].([]any); len(commands) != 0 {
+		t.Fatalf("cancelled and expired commands should not be delivered, got %v", commands)
+	}
+
+	resp = doJSONRequest(t, srv.router, http.MethodGet, base, nil, managerToken)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("list commands failed, status=%d body=%s", resp.Code, resp.Body.String())
+	}
+	statuses := map[uint]any{}
+	for _, raw := range decodeBodyMap(t, resp.Body.Bytes())["items"].([]any) {
+		item := raw.(map[string]any)
+		statuses[uint(item["id"].(float64))] = item["status"]
+		if uint(item["id"].(float64)) == commandID && (item["message"] != "截图已上传" || item["finished_at"] == nil) {
+			t.Fatalf("unexpected finished command: %v", item)
+		}
+	}
+	if statuses[commandID] != models.AgentCommandSucceeded || statuses[cancelledID] != models.AgentCommandCancelled ||
+		statuses[expiredID] != models.AgentCommandExpired || len(statuses) != 3 {
+		t.Fatalf("unexpected command history: %v", statuses)
+	}
+}
+
+func TestAgentCommandDeliveredOnJobHeartbeat(t *testing.T) {
+	srv, db := setupTestServer(t)
+	manager := createActiveManager(t, db, "manager_cmd_hb", "passwordCmdHb123")
+	user := createNotifyTestUser(t, srv, manager.ID, "U_CMD_HB_001", datatypes.JSONMap{})
+	managerToken := loginManagerToken(t, srv, "manager_cmd_hb", "passwordCmdHb123")
+	agentToken := loginAgentToken(t, srv, "manager_cmd_hb", "passwordCmdHb123", "node-cmd-hb")
+	createAlertTestJob(t, srv, user, "悬赏", models.JobStatusPending, time.Now().UTC().Add(-time.Minute))
+	jobs := pollAs(t, srv, agentToken, map[string]any{"node_id": "node-cmd-hb", "limit": 1})["jobs"].([]any)
+	if len(jobs) != 1 {
+		t.Fatalf("expected one leased job, got %v", jobs)
+	}
+	jobID := uint(jobs[0].(map[string]any)["ID"].(float64))
+	node := findAgentNode(t, srv, "node-cmd-hb")
+
+	resp := doJSONRequest(t, srv.router, http.MethodPost, "/api/v1/manager/agents/"+itoa(node.ID)+"/commands",
+		map[string]any{"command": "restart_emulator"}, managerToken)
+	if resp.Code != http.StatusCreated {
+		t.Fatalf("create command failed, status=%d body=%s", resp.Code, resp.Body.String())
+	}
+	resp = doJSONRequest(t, srv.router, http.MethodPost, "/api/v1/agent/jobs/"+itoa(jobID)+"/heartbeat",
+		map[string]any{"node_id": "node-cmd-hb"}, agentToken)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("heartbeat failed, status=%d body=%s", resp.Code, resp.Body.String())
+	}
+	commands := decodeBodyMap(t, resp.Body.Bytes())["commands"].([]any)
+	if len(commands) != 1 || commands[0].(map[string]any)["command"] != "restart_emulator" {
+		t.Fatalf("heartbeat should deliver the command, got %v", commands)
+	}
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"oas-cloud-go/internal/models"
+
+	"gorm.io/datatypes"
+)
+
+func findAgentNode(t *testing.T, srv *Server, nodeID string) models.AgentNode {
+	t.Helper()
+	var node models.AgentNode
+	if err := srv.db.Where("node_id = ?", nodeID).First(&node).Error; err != nil {
+		t.Fatalf("load agent node failed: %v", err)
+	}
+	return node
+}
+
+func TestManagerDrainsAndRevokesAgentNode(t *testing.T) {
+	srv, db := setupTestServer(t)
+	manager := createActiveManager(t, db, "manager_fleet", "passwordFleet123")
+	user := createNotifyTestUser(t, srv, manager.ID, "U_FLEET_001", datatypes.JSONMap{})
+	agentToken := loginAgentToken(t, srv, "manager_fleet", "passwordFleet123", "node-fleet-a")
+	managerToken := loginManagerToken(t, srv, "manager_fleet", "passwordFleet123")
+
+	at := time.Now().UTC().Add(-time.Minute)
+	first := createAlertTestJob(t, srv, user, "悬赏", models.JobStatusPending, at)
+	second := createAlertTestJob(t, srv, user, "弥助", models.JobStatusPending, at)
+	jobs := pollAs(t, srv, agentToken, map[string]any{"node_id": "node-fleet-a", "limit": 1})["jobs"].([]any)
+	if len(jobs) != 1 {
+		t.Fatalf("expected one leased job, got %v", jobs)
+	}
+	leasedID := uint(jobs[0].(map[string]any)["ID"].(float64))
+
+	resp := doJSONRequest(t, srv.router, http.MethodGet, "/api/v1/manager/agents", nil, managerToken)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("list agents failed, status=%d body=%s", resp.Code, resp.Body.String())
+	}
+	items := decodeBodyMap(t, resp.Body.Bytes())["items"].([]any)
+	if len(items) != 1 {
+		t.Fatalf("expected one node, got %v", items)
+	}
+	item := items[0].(map[string]any)
+	leased := item["leased_jobs"].([]any)
+	if item["node_id"] != "node-fleet-a" || item["status"] != models.AgentStatusOnline || len(leased) != 1 ||
+		leased[0].(map[string]any)["id"] != float64(leasedID) {
+		t.Fatalf("unexpected node item: %v", item)
+	}
+	node := findAgentNode(t, srv, "node-fleet-a")
+
+	// A draining node keeps its job but gets no new ones.
+	resp = doJSONRequest(t, srv.router, http.MethodPatch, "/api/v1/manager/agents/"+itoa(node.ID)+"/drain",
+		map[string]any{"draining": true}, managerToken)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("drain failed, status=%d body=%s", resp.Code, resp.Body.String())
+	}
+	jobs = pollAs(t, srv, agentToken, map[string]any{"node_id": "node-fleet-a", "limit": 10})["jobs"].([]any)
+	if len(jobs) != 0 {
+		t.Fatalf("draining node should get no jobs, got %v", jobs)
+	}
+
+	resp = doJSONRequest(t, srv.router, http.MethodPost, "/api/v1/manager/agents/"+itoa(node.ID)+"/revoke", nil, managerToken)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("revoke failed, status=%d body=%s", resp.Code, resp.Body.String())
+	}
+	body := decodeBodyMap(t, resp.Body.Bytes())
+	if body["revoked_sessions"] != float64(1) || body["requeued_jobs"] != float64(1) {
+		t.Fatalf("unexpected revoke result: %v", body)
+	}
+	var job models.TaskJob
+	db.First(&job, leasedID)
+	if job.Status != models.JobStatusPending || job.LeasedByNode != "" || job.Attempts != 0 {
+		t.Fatalf("revoked job should be pending again without an attempt, got %+v", job)
+	}
+	if findAgentNode(t, srv, "node-fleet-a").Status != models.AgentStatusOffline {
+		t.Fatalf("revoked node should be offline")
+	}
+	resp = doJSONRequest(t, srv.router, http.MethodPost, "/api/v1/agent/poll-jobs", map[string]any{"node_id": "node-fleet-a"}, agentToken)
+	if resp.Code != http.StatusUnauthorized {
+		t.Fatalf("revoked session should be rejected, got %d", resp.Code)
+	}
+
+	// The account lease is free, so another node can take both jobs.
+	otherToken := loginAgentToken(t, srv, "manager_fleet", "passwordFleet123", "node-fleet-b")
+	jobs = pollAs(t, srv, otherToken, map[string]any{"node_id": "node-fleet-b", "limit": 10})["jobs"].([]any)
+	if len(jobs) != 2 {
+		t.Fatalf("other node should get both jobs of %d and %d, got %v", first.ID, second.ID, jobs)
+	}
+}
+
+func TestOfflineAgentJobsAreRequeued(t *testing.T) {
+	srv, db := setupTestServer(t)
+	srv.cfg.AgentOfflineAfter = time.Minute
+	manager := createActiveManager(t, db, "manager_offline", "passwordOffline123")
+	user := createNotifyTestUser(t, srv, manager.ID, "U_OFFLINE_001", datatypes.JSONMap{})
+	agentToken := loginAgentToken(t, srv, "manager_offline", "passwordOffline123", "node-offline-a")
+	job := createAlertTestJob(t, srv, user, "悬赏", models.JobStatusPending, time.Now().UTC().Add(-time.Minute))
+	jobs := pollAs(t, srv, agentToken, map[string]any{"node_id": "node-offline-a", "limit": 1})["jobs"].([]any)
+	if len(jobs) != 1 {
+		t.Fatalf("expected the job to be leased, got %v", jobs)
+	}
+
+	// Still within AGENT_OFFLINE_AFTER: nothing changes.
+	srv.detectOfflineAgents(time.Now().UTC())
+	if findAgentNode(t, srv, "node-offline-a").Status != models.AgentStatusOnline {
+		t.Fatalf("node with a fresh heartbeat should stay online")
+	}
+
+	srv.detectOfflineAgents(time.Now().UTC().Add(2 * time.Minute))
+	if findAgentNode(t, srv, "node-offline-a").Status != models.AgentStatusOffline {
+		t.Fatalf("node with a stale heartbeat should be offline")
+	}
+	var reloaded models.TaskJob
+	db.First(&reloaded, job.ID)
+	if reloaded.Status != models.JobStatusPending || reloaded.LeasedByNode != "" {
+		t.Fatalf("job of offline node should be requeued, got %+v", reloaded)
+	}
+	var event models.TaskJobEvent
+	if err := db.Where("job_id = ? AND event_type = ?", job.ID, "node_offline").First(&event).Error; err != nil {
+		t.Fatalf("expected a node_offline event: %v", err)
+	}
+
+	// Polling again brings the node back online.
+	pollAs(t, srv, agentToken, map[string]any{"node_id": "node-offline-a", "limit": 1})
+	if findAgentNode(t, srv, "node-offline-a").Status != models.AgentStatusOnline {
+		t.Fatalf("polling node should be online again")
+	}
+}
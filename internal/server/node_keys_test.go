@@ -0,0 +1,143 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func agentKeyLogin(t *testing.T, srv *Server, apiKey, nodeID string) (int, string) {
+	t.Helper()
+	resp := doJSONRequest(t, srv.router, http.MethodPost, "/api/v1/agent/auth/login", map[string]any{
+		"api_key": apiKey,
+		"node_id": nodeID,
+		"version": "1.2.0",
+	}, "")
+	if resp.Code != http.StatusOK {
+		return resp.Code, ""
+	}
+	return resp.Code, extractTokenFromBody(t, resp.Body.Bytes())
+}
+
+func TestAgentKeyLoginRotateAndRevoke(t *testing.T) {
+	srv, db := setupTestServer(t)
+	createActiveManager(t, db, "manager_agent_key", "passwordAgentKey123")
+	managerToken := loginManagerToken(t, srv, "manager_agent_key", "passwordAgentKey123")
+
+	resp := doJSONRequest(t, srv.router, http.MethodPost, "/api/v1/manager/agent-keys", map[string]any{
+		"node_id":     "node-key-a",
+		"allowed_ips": []string{"not-an-ip"},
+	}, managerToken)
+	if resp.Code != http.StatusBadRequest {
+		t.Fatalf("invalid allowlist entry should be rejected, got %d", resp.Code)
+	}
+
+	resp = doJSONRequest(t, srv.router, http.MethodPost, "/api/v1/manager/agent-keys", map[string]any{
+		"node_id":         "node-key-a",
+		"name":            "机房A",
+		"allowed_ips":     []string{"192.0.2.0/24"},
+		"expires_in_days": 30,
+	}, managerToken)
+	if resp.Code != http.StatusCreated {
+		t.Fatalf("create agent key failed, status=%d body=%s", resp.Code, resp.Body.String())
+	}
+	created := decodeBodyMap(t, resp.Body.Bytes())
+	apiKey, _ := created["api_key"].(string)
+	if !strings.HasPrefix(apiKey, "oak_") || created["key_prefix"] != apiKey[:agentKeyPrefixLen] || created["expires_at"] == nil {
+		t.Fatalf("unexpected created key: %v", created)
+	}
+	keyID := uint(created["id"].(float64))
+
+	code, agentToken := agentKeyLogin(t, srv, apiKey, "node-key-a")
+	if code != http.StatusOK {
+		t.Fatalf("agent key login failed, status=%d", code)
+	}
+	pollAs(t, srv, agentToken, map[string]any{"node_id": "node-key-a"})
+	if code, _ := agentKeyLogin(t, srv, apiKey, "node-key-b"); code != http.StatusForbidden {
+		t.Fatalf("key should only work for its node, got %d", code)
+	}
+	if resp := doJSONRequest(t, srv.router, http.MethodPost, "/api/v1/agent/auth/login", map[string]any{"node_id": "node-key-a"}, ""); resp.Code != http.StatusBadRequest {
+		t.Fatalf("login without credentials should be rejected, got %d", resp.Code)
+	}
+
+	resp = doJSONRequest(t, srv.router, http.MethodGet, "/api/v1/manager/agent-keys", nil, managerToken)
+	items := decodeBodyMap(t, resp.Body.Bytes())["items"].([]any)
+	item := items[0].(map[string]any)
+	if len(items) != 1 || item["last_used_at"] == nil || item["last_used_ip"] != "192.0.2.1" || item["status"] != "active" {
+		t.Fatalf("unexpected key listing: %v", items)
+	}
+	if _, leaked := item["api_key"]; leaked {
+		t.Fatalf("listing must not return the secret")
+	}
+
+	// A key restricted to other addresses is refused.
+	resp = doJSONRequest(t, srv.router, http.MethodPost, "/api/v1/manager/agent-keys", map[string]any{
+		"node_id":     "node-key-c",
+		"allowed_ips": []string{"10.1.2.3"},
+	}, managerToken)
+	restricted := decodeBodyMap(t, resp.Body.Bytes())["api_key"].(string)
+	if code, _ := agentKeyLogin(t, srv, restricted, "node-key-c"); code != http.StatusForbidden {
+		t.Fatalf("login from outside the allowlist should be refused, got %d", code)
+	}
+
+	resp = doJSONRequest(t, srv.router, http.MethodPost, "/api/v1/manager/agent-keys/"+itoa(keyID)+"/rotate", nil, managerToken)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("rotate failed, status=%d body=%s", resp.Code, resp.Body.String())
+	}
+	rotated := decodeBodyMap(t, resp.Body.Bytes())["api_key"].(string)
+	if code, _ := agentKeyLogin(t, srv, apiKey, "node-key-a"); code != http.StatusUnauthorized {
+		t.Fatalf("old secret should stop working after rotation, got %d", code)
+	}
+	if code, _ := agentKeyLogin(t, srv, rotated, "node-key-a"); code != http.StatusOK {
+		t.Fatalf("rotated secret should work, got %d", code)
+	}
+
+	resp = doJSONRequest(t, srv.router, http.MethodPost, "/api/v1/manager/agent-keys/"+itoa(keyID)+"/revoke", nil, managerToken)
+	if resp.Code != http.StatusOK || decodeBodyMap(t, resp.Body.Bytes())["status"] != "revoked" {
+		t.Fatalf("revoke failed, status=%d body=%s", resp.Code, resp.Body.String())
+	}
+	if code, _ := agentKeyLogin(t, srv, rotated, "node-key-a"); code != http.StatusUnauthorized {
+		t.Fatalf("revoked key should be refused, got %d", code)
+	}
+	resp = doJSONRequest(t, srv.router, http.MethodPost, "/api/v1/agent/poll-jobs", map[string]any{"node_id": "node-key-a"}, agentToken)
+	if resp.Code != http.StatusUnauthorized {
+		t.Fatalf("sessions of a revoked key should end, got %d", resp.Code)
+	}
+}
+
+func TestAgentSessionBoundToNode(t *testing.T) {
+	srv, db := setupTestServer(t)
+	createActiveManager(t, db, "manager_node_bind", "passwordNodeBind123")
+	createActiveManager(t, db, "manager_node_bind_b", "passwordNodeBind123")
+	agentToken := loginAgentToken(t, srv, "manager_node_bind", "passwordNodeBind123", "node-bind-a")
+	loginAgentToken(t, srv, "manager_node_bind", "passwordNodeBind123", "node-bind-b")
+
+	clearRateLimits(srv)
+	resp := doJSONRequest(t, srv.router, http.MethodPost, "/api/v1/agent/poll-jobs", map[string]any{"node_id": "node-bind-b"}, agentToken)
+	if resp.Code != http.StatusForbidden {
+		t.Fatalf("a session may not poll as another node, got %d", resp.Code)
+	}
+	resp = doJSONRequest(t, srv.router, http.MethodPost, "/api/v1/agent/jobs/1/heartbeat", map[string]any{"node_id": "node-bind-b"}, agentToken)
+	if resp.Code != http.StatusForbidden {
+		t.Fatalf("a session may not report as another node, got %d", resp.Code)
+	}
+	pollAs(t, srv, agentToken, map[string]any{"node_id": "node-bind-a"})
+
+	// Another manager can neither log in as nor issue keys for the node.
+	otherToken := loginManagerToken(t, srv, "manager_node_bind_b", "passwordNodeBind123")
+	resp = doJSONRequest(t, srv.router, http.MethodPost, "/api/v1/manager/agent-keys", map[string]any{"node_id": "node-bind-a"}, otherToken)
+	if resp.Code != http.StatusConflict {
+		t.Fatalf("a key for another manager's node should be refused, got %d", resp.Code)
+	}
+	resp = doJSONRequest(t, srv.router, http.MethodPost, "/api/v1/agent/auth/login", map[string]any{
+		"username": "manager_node_bind_b",
+		"password": "passwordNodeBind123",
+		"node_id":  "node-bind-a",
+	}, "")
+	if resp.Code != http.StatusConflict {
+		t.Fatalf("login as another manager's node should be refused, got %d", resp.Code)
+	}
+	if node := findAgentNode(t, srv, "node-bind-a"); node.ManagerID == 0 || node.ManagerID != findAgentNode(t, srv, "node-bind-b").ManagerID {
+		t.Fatalf("node should stay with its manager, got %+v", node)
+	}
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"oas-cloud-go/internal/models"
+
+	"gorm.io/datatypes"
+)
+
+func agentLoginWithCapabilities(t *testing.T, srv *Server, username, password, nodeID string, caps map[string]any) (int, string) {
+	t.Helper()
+	resp := doJSONRequest(t, srv.router, http.MethodPost, "/api/v1/agent/auth/login", map[string]any{
+		"username":     username,
+		"password":     password,
+		"node_id":      nodeID,
+		"capabilities": caps,
+	}, "")
+	if resp.Code != http.StatusOK {
+		return resp.Code, ""
+	}
+	return resp.Code, extractTokenFromBody(t, resp.Body.Bytes())
+}
+
+func polledJobIDs(t *testing.T, srv *Server, token, nodeID string) []uint {
+	t.Helper()
+	jobs := pollAs(t, srv, token, map[string]any{"node_id": nodeID, "limit": 10})["jobs"].([]any)
+	ids := make([]uint, 0, len(jobs))
+	for _, job := range jobs {
+		ids = append(ids, uint(job.(map[string]any)["ID"].(float64)))
+	}
+	return ids
+}
+
+func TestPollHonoursAgentCapabilities(t *testing.T) {
+	srv, db := setupTestServer(t)
+	manager := createActiveManager(t, db, "manager_caps", "passwordCaps123")
+	managerToken := loginManagerToken(t, srv, "manager_caps", "passwordCaps123")
+	plain := createNotifyTestUser(t, srv, manager.ID, "U_CAPS_001", datatypes.JSONMap{})
+	pinned := createNotifyTestUser(t, srv, manager.ID, "U_CAPS_002", datatypes.JSONMap{})
+	other := createNotifyTestUser(t, srv, manager.ID, "U_CAPS_003", datatypes.JSONMap{})
+
+	resp := doJSONRequest(t, srv.router, http.MethodPatch, "/api/v1/manager/users/"+itoa(pinned.ID)+"/settings",
+		map[string]any{"required_labels": []string{"机房A", " 机房A"}}, managerToken)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("set user labels failed, status=%d body=%s", resp.Code, resp.Body.String())
+	}
+
+	at := time.Now().UTC().Add(-time.Minute)
+	plainJob := createAlertTestJob(t, srv, plain, "悬赏", models.JobStatusPending, at)
+	createAlertTestJob(t, srv, plain, "弥助", models.JobStatusPending, at)
+	pinnedJob := createAlertTestJob(t, srv, pinned, "悬赏", models.JobStatusPending, at)
+	labelledJob := createAlertTestJob(t, srv, other, "悬赏", models.JobStatusPending, at)
+	db.Model(&models.TaskJob{}).Where("id = ?", labelledJob.ID).Update("required_labels", "斗技")
+
+	if code, _ := agentLoginWithCapabilities(t, srv, "manager_caps", "passwordCaps123", "node-caps-x",
+		map[string]any{"task_types": []string{"不存在的任务"}}); code != http.StatusBadRequest {
+		t.Fatalf("unknown task type should be rejected, got %d", code)
+	}
+
+	// Only 悬赏, no labels: the pinned account and the 斗技 job are left out.
+	code, plainToken := agentLoginWithCapabilities(t, srv, "manager_caps", "passwordCaps123", "node-caps-a",
+		map[string]any{"task_types": []string{"悬赏"}, "max_concurrency": 3})
+	if code != http.StatusOK {
+		t.Fatalf("agent login failed, status=%d", code)
+	}
+	if ids := polledJobIDs(t, srv, plainToken, "node-caps-a"); len(ids) != 1 || ids[0] != plainJob.ID {
+		t.Fatalf("plain node should only get job %d, got %v", plainJob.ID, ids)
+	}
+
+	// Both labels, one slot: one job now, none while it is held.
+	code, labelToken := agentLoginWithCapabilities(t, srv, "manager_caps", "passwordCaps123", "node-caps-b",
+		map[string]any{"labels": []string{"斗技", "机房A"}, "max_concurrency": 1})
+	if code != http.StatusOK {
+		t.Fatalf("agent login failed, status=%d", code)
+	}
+	first := polledJobIDs(t, srv, labelToken, "node-caps-b")
+	if len(first) != 1 || (first[0] != pinnedJob.ID && first[0] != labelledJob.ID) {
+		t.Fatalf("labelled node should get one labelled job, got %v", first)
+	}
+	if ids := polledJobIDs(t, srv, labelToken, "node-caps-b"); len(ids) != 0 {
+		t.Fatalf("node at max_concurrency should get nothing, got %v", ids)
+	}
+
+	// Raising the limit on poll frees a slot for the other labelled job.
+	jobs := pollAs(t, srv, labelToken, map[string]any{
+		"node_id":      "node-caps-b",
+		"limit":        10,
+		"capabilities": map[string]any{"labels": []string{"斗技", "机房A"}, "max_concurrency": 2},
+	})["jobs"].([]any)
+	if len(jobs) != 1 || uint(jobs[0].(map[string]any)["ID"].(float64)) == first[0] {
+		t.Fatalf("expected the other labelled job, got %v", jobs)
+	}
+
+	resp = doJSONRequest(t, srv.router, http.MethodGet, "/api/v1/manager/agents", nil, managerToken)
+	for _, raw := range decodeBodyMap(t, resp.Body.Bytes())["items"].([]any) {
+		item := raw.(map[string]any)
+		if item["node_id"] != "node-caps-b" {
+			continue
+		}
+		labels := item["labels"].([]any)
+		if item["max_concurrency"] != float64(2) || len(labels) != 2 || labels[0] != "斗技" {
+			t.Fatalf("unexpected capabilities in listing: %v", item)
+		}
+	}
+}
+
+func TestTaskConfigRequiredLabelsReachJobs(t *testing.T) {
+	srv, db := setupTestServer(t)
+	manager := createActiveManager(t, db, "manager_job_labels", "passwordLabels123")
+	token := loginManagerToken(t, srv, "manager_job_labels", "passwordLabels123")
+	user := createNotifyTestUser(t, srv, manager.ID, "U_JOB_LABELS_001", datatypes.JSONMap{})
+	path := "/api/v1/manager/users/" + itoa(user.ID) + "/tasks"
+
+	resp := doJSONRequest(t, srv.router, http.MethodPut, path, map[string]any{
+		"task_config": map[string]any{"悬赏": map[string]any{"required_labels": []any{"a,b"}}},
+	}, token)
+	if resp.Code != http.StatusBadRequest {
+		t.Fatalf("label with a comma should be rejected, status=%d body=%s", resp.Code, resp.Body.String())
+	}
+	resp = doJSONRequest(t, srv.router, http.MethodPut, path, map[string]any{
+		"task_config": map[string]any{"悬赏": map[string]any{"required_labels": []any{"机房B", "机房A"}}},
+	}, token)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("valid labels should be accepted, status=%d body=%s", resp.Code, resp.Body.String())
+	}
+
+	resp = doJSONRequest(t, srv.router, http.MethodPost, path+"/run-now", map[string]any{"task_type": "悬赏"}, token)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("run now failed, status=%d body=%s", resp.Code, resp.Body.String())
+	}
+	var job models.TaskJob
+	if err := db.Where("id = ?", uint(decodeBodyMap(t, resp.Body.Bytes())["job_id"].(float64))).First(&job).Error; err != nil {
+		t.Fatalf("load job failed: %v", err)
+	}
+	if job.RequiredLabels != "机房A,机房B" {
+		t.Fatalf("job should carry the task's labels, got %q", job.RequiredLabels)
+	}
+}
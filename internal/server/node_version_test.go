@@ -0,0 +1,222 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"oas-cloud-go/internal/models"
+
+	"gorm.io/datatypes"
+)
+
+func TestCompareAgentVersions(t *testing.T) {
+	cases := []struct {
+		a, b string
+		want int
+	}{
+		{"1.2.3", "1.2.3", 0},
+		{"v1.2", "1.2.0", 0},
+		{"1.10.0", "1.9.9", 1},
+		{"1.2.3-beta.1", "1.2.3", -1},
+		{"1.2.3-beta.2", "1.2.3-beta.10", -1},
+		{"1.2.3-alpha", "1.2.3-beta", -1},
+		{"2.0.0+build.5", "2.0.0", 0},
+	}
+	for _, tc := range cases {
+		a, okA := parseAgentVersion(tc.a)
+		b, okB := parseAgentVersion(tc.b)
+		if !okA || !okB {
+			t.Fatalf("%q and %q should parse", tc.a, tc.b)
+		}
+		if got := compareAgentVersions(a, b); got != tc.want {
+			t.Fatalf("compare(%q, %q) = %d, want %d", tc.a, tc.b, got, tc.want)
+		}
+	}
+	for _, raw := range []string{"", "abc", "1..2", "1.2.3-", "1.2.3.4.5", "1.-2"} {
+		if _, ok := parseAgentVersion(raw); ok {
+			t.Fatalf("%q should not parse", raw)
+		}
+	}
+}
+
+func agentLoginWithVersion(t *testing.T, srv *Server, username, password, nodeID, version string) (int, map[string]any) {
+	t.Helper()
+	resp := doJSONRequest(t, srv.router, http.MethodPost, "/api/v1/agent/auth/login", map[string]any{
+		"username": username,
+		"password": password,
+		"node_id":  nodeID,
+		"version":  version,
+	}, "")
+	return resp.Code, decodeBodyMap(t, resp.Body.Bytes())
+}
+
+func TestAgentMinimumVersionEnforcement(t *testing.T) {
+	srv, db := setupTestServer(t)
+	manager := createActiveManager(t, db, "manager_version", "passwordVersion123")
+	user := createNotifyTestUser(t, srv, manager.ID, "U_VERSION_001", datatypes.JSONMap{})
+	managerToken := loginManagerToken(t, srv, "manager_version", "passwordVersion123")
+	const policyPath = "/api/v1/manager/agent-version-policy"
+
+	for _, body := range []map[string]any{
+		{"min_version": "abc"},
+		{"min_version": "1.2.0", "recommended_version": "1.1.0"},
+		{"recommended_version": "1.3.0", "manifest": map[string]any{"sha256": "x"}},
+		{"min_version": "1.2.0", "enforcement": "ignore"},
+	} {
+		if resp := doJSONRequest(t, srv.router, http.MethodPut, policyPath, body, managerToken); resp.Code != http.StatusBadRequest {
+			t.Fatalf("policy %v should be rejected, got %d", body, resp.Code)
+		}
+	}
+	resp := doJSONRequest(t, srv.router, http.MethodPut, policyPath, map[string]any{"min_version": "1.2.0"}, managerToken)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("save policy failed, status=%d body=%s", resp.Code, resp.Body.String())
+	}
+
+	code, body := agentLoginWithVersion(t, srv, "manager_version", "passwordVersion123", "node-version-a", "1.1.9")
+	if code != http.StatusUpgradeRequired || body["error_code"] != agentVersionOutdatedCode {
+		t.Fatalf("outdated agent should be refused, got %d %v", code, body)
+	}
+	if code, _ := agentLoginWithVersion(t, srv, "manager_version", "passwordVersion123", "node-version-b", ""); code != http.StatusUpgradeRequired {
+		t.Fatalf("agent without a version should be refused, got %d", code)
+	}
+	code, body = agentLoginWithVersion(t, srv, "manager_version", "passwordVersion123", "node-version-a", "1.2.0")
+	if code != http.StatusOK || body["version_status"] != agentVersionCurrent || body["upgrade"] != nil {
+		t.Fatalf("current agent should log in, got %d %v", code, body)
+	}
+	agentToken := body["token"].(string)
+
+	// Raising the minimum stops the node that is already logged in.
+	doJSONRequest(t, srv.router, http.MethodPut, policyPath, map[string]any{"min_version": "1.3.0"}, managerToken)
+	createAlertTestJob(t, srv, user, "悬赏", models.JobStatusPending, time.Now().UTC().Add(-time.Minute))
+	clearRateLimits(srv)
+	resp = doJSONRequest(t, srv.router, http.MethodPost, "/api/v1/agent/poll-jobs", map[string]any{"node_id": "node-version-a"}, agentToken)
+	if resp.Code != http.StatusUpgradeRequired || decodeBodyMap(t, resp.Body.Bytes())["error_code"] != agentVersionOutdatedCode {
+		t.Fatalf("outdated node should be refused jobs, got %d %s", resp.Code, resp.Body.String())
+	}
+
+	// Limited nodes stay connected but get no new jobs.
+	doJSONRequest(t, srv.router, http.MethodPut, policyPath, map[string]any{"min_version": "1.3.0", "enforcement": "limit"}, managerToken)
+	poll := pollAs(t, srv, agentToken, map[string]any{"node_id": "node-version-a"})
+	upgrade, _ := poll["upgrade"].(map[string]any)
+	if len(poll["jobs"].([]any)) != 0 || poll["version_status"] != agentVersionOutdated || upgrade["required"] != true {
+		t.Fatalf("limited node should get no jobs and an upgrade notice, got %v", poll)
+	}
+	code, body = agentLoginWithVersion(t, srv, "manager_version", "passwordVersion123", "node-version-a", "1.3.0")
+	if code != http.StatusOK {
+		t.Fatalf("upgraded agent should log in, got %d %v", code, body)
+	}
+	if jobs := pollAs(t, srv, body["token"].(string), map[string]any{"node_id": "node-version-a"})["jobs"].([]any); len(jobs) != 1 {
+		t.Fatalf("upgraded node should get the job, got %v", jobs)
+	}
+}
+
+func TestAgentUpgradeRollout(t *testing.T) {
+	srv, db := setupTestServer(t)
+	createActiveManager(t, db, "manager_rollout", "passwordRollout123")
+	managerToken := loginManagerToken(t, srv, "manager_rollout", "passwordRollout123")
+	nodes := []string{"node-rollout-a", "node-rollout-b", "node-rollout-c", "node-rollout-d", "node-rollout-e", "node-rollout-f"}
+	for _, nodeID := range nodes {
+		if code, body := agentLoginWithVersion(t, srv, "manager_rollout", "passwordRollout123", nodeID, "1.0.0"); code != http.StatusOK {
+			t.Fatalf("login failed, got %d %v", code, body)
+		}
+	}
+	manifest := map[string]any{"url": "https://example.com/agent-2.0.0.zip", "sha256": "abc"}
+	resp := doJSONRequest(t, srv.router, http.MethodPut, "/api/v1/manager/agent-version-policy", map[string]any{
+		"recommended_version": "2.0.0",
+		"rollout_percent":     50,
+		"manifest":            manifest,
+	}, managerToken)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("save policy failed, status=%d body=%s", resp.Code, resp.Body.String())
+	}
+	want := map[string]int{agentVersionUpgradeAvailable: 0, agentVersionRolloutPending: 0}
+	for _, nodeID := range nodes {
+		code, body := agentLoginWithVersion(t, srv, "manager_rollout", "passwordRollout123", nodeID, "1.0.0")
+		status := agentVersionRolloutPending
+		if agentRolloutBucket(nodeID) < 50 {
+			status = agentVersionUpgradeAvailable
+		}
+		want[status]++
+		if code != http.StatusOK || body["version_status"] != status {
+			t.Fatalf("%s should be %s, got %d %v", nodeID, status, code, body)
+		}
+		upgrade, _ := body["upgrade"].(map[string]any)
+		if (upgrade != nil) != (status == agentVersionUpgradeAvailable) {
+			t.Fatalf("only nodes in the rollout get the upgrade, %s got %v", nodeID, body["upgrade"])
+		}
+		if upgrade != nil && (upgrade["required"] != false || upgrade["manifest"].(map[string]any)["url"] != manifest["url"]) {
+			t.Fatalf("unexpected upgrade offer: %v", upgrade)
+		}
+	}
+
+	resp = doJSONRequest(t, srv.router, http.MethodGet, "/api/v1/manager/agent-version-policy", nil, managerToken)
+	view := decodeBodyMap(t, resp.Body.Bytes())
+	counts := view["nodes"].(map[string]any)
+	if counts[agentVersionUpgradeAvailable] != float64(want[agentVersionUpgradeAvailable]) ||
+		counts[agentVersionRolloutPending] != float64(want[agentVersionRolloutPending]) {
+		t.Fatalf("unexpected node counts %v, want %v", counts, want)
+	}
+	if view["effective"].(map[string]any)["rollout_percent"] != float64(50) {
+		t.Fatalf("unexpected effective policy: %v", view["effective"])
+	}
+
+	// A full rollout reaches every node, and upgraded nodes are current.
+	doJSONRequest(t, srv.router, http.MethodPut, "/api/v1/manager/agent-version-policy", map[string]any{
+		"recommended_version": "2.0.0",
+		"rollout_percent":     100,
+		"manifest":            manifest,
+	}, managerToken)
+	_, body := agentLoginWithVersion(t, srv, "manager_rollout", "passwordRollout123", nodes[0], "1.0.0")
+	if body["version_status"] != agentVersionUpgradeAvailable {
+		t.Fatalf("full rollout should reach every node, got %v", body)
+	}
+	_, body = agentLoginWithVersion(t, srv, "manager_rollout", "passwordRollout123", nodes[0], "2.0.0")
+	if body["version_status"] != agentVersionCurrent {
+		t.Fatalf("upgraded node should be current, got %v", body)
+	}
+}
+
+func TestGlobalAgentVersionPolicy(t *testing.T) {
+	srv, db := setupTestServer(t)
+	createSuperAdmin(t, db, "super_agent_version", "superPass123")
+	superResp := doJSONRequest(t, srv.router, http.MethodPost, "/api/v1/super/auth/login",
+		map[string]any{"username": "super_agent_version", "password": "superPass123"}, "")
+	superToken := extractTokenFromBody(t, superResp.Body.Bytes())
+	createActiveManager(t, db, "manager_global_ver", "passwordGlobalVer123")
+	managerToken := loginManagerToken(t, srv, "manager_global_ver", "passwordGlobalVer123")
+
+	resp := doJSONRequest(t, srv.router, http.MethodPut, "/api/v1/super/agent-version-policy", map[string]any{"min_version": "3.0.0"}, superToken)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("save global policy failed, status=%d body=%s", resp.Code, resp.Body.String())
+	}
+	// The global policy applies to every manager; do not leak it into other tests.
+	t.Cleanup(func() { db.Where("manager_id = ?", 0).Delete(&models.AgentVersionPolicy{}) })
+
+	// A manager cannot lower the global minimum.
+	doJSONRequest(t, srv.router, http.MethodPut, "/api/v1/manager/agent-version-policy", map[string]any{"min_version": "2.0.0"}, managerToken)
+	if code, _ := agentLoginWithVersion(t, srv, "manager_global_ver", "passwordGlobalVer123", "node-global-ver", "2.5.0"); code != http.StatusUpgradeRequired {
+		t.Fatalf("global minimum should apply, got %d", code)
+	}
+	resp = doJSONRequest(t, srv.router, http.MethodGet, "/api/v1/manager/agent-version-policy", nil, managerToken)
+	view := decodeBodyMap(t, resp.Body.Bytes())
+	if view["effective"].(map[string]any)["min_version"] != "3.0.0" || view["global"].(map[string]any)["min_version"] != "3.0.0" ||
+		view["policy"].(map[string]any)["min_version"] != "2.0.0" {
+		t.Fatalf("unexpected policy view: %v", view)
+	}
+	if code, _ := agentLoginWithVersion(t, srv, "manager_global_ver", "passwordGlobalVer123", "node-global-ver", "3.0.1"); code != http.StatusOK {
+		t.Fatalf("agent above the global minimum should log in, got %d", code)
+	}
+
+	// A higher manager minimum that only limits does not soften the global
+	// rejection for nodes below both.
+	doJSONRequest(t, srv.router, http.MethodPut, "/api/v1/manager/agent-version-policy", map[string]any{"min_version": "3.5.0", "enforcement": "limit"}, managerToken)
+	code, body := agentLoginWithVersion(t, srv, "manager_global_ver", "passwordGlobalVer123", "node-global-ver", "2.5.0")
+	if code != http.StatusUpgradeRequired || body["upgrade"].(map[string]any)["enforcement"] != models.AgentVersionReject {
+		t.Fatalf("node below the global minimum should still be refused, got %d %v", code, body)
+	}
+	code, body = agentLoginWithVersion(t, srv, "manager_global_ver", "passwordGlobalVer123", "node-global-ver", "3.2.0")
+	if code != http.StatusOK || body["version_status"] != agentVersionOutdated || body["upgrade"].(map[string]any)["enforcement"] != models.AgentVersionLimit {
+		t.Fatalf("node between the minimums should only be limited, got %d %v", code, body)
+	}
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gorm.io/datatypes"
+)
+
+func waitForJobsReadySubscription(t *testing.T, srv *Server) {
+	t.Helper()
+	store := srv.redisStore.(*inMemoryStore)
+	deadline := time.Now().Add(2 * time.Second)
+	for !store.jobsReadySubscribed() {
+		if time.Now().After(deadline) {
+			t.Fatalf("jobs ready listener did not subscribe")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLongPollWakesOnNewJob(t *testing.T) {
+	srv, db := setupTestServer(t)
+	manager := createActiveManager(t, db, "manager_long_poll", "passwordLongPoll123")
+	user := createNotifyTestUser(t, srv, manager.ID, "U_LONG_POLL_001", datatypes.JSONMap{})
+	agentToken := loginAgentToken(t, srv, "manager_long_poll", "passwordLongPoll123", "node-long-poll")
+	managerToken := loginManagerToken(t, srv, "manager_long_poll", "passwordLongPoll123")
+	waitForJobsReadySubscription(t, srv)
+
+	// Nothing due: the poll holds on until wait_seconds run out.
+	clearRateLimits(srv)
+	start := time.Now()
+	resp := doJSONRequest(t, srv.router, http.MethodPost, "/api/v1/agent/poll-jobs",
+		map[string]any{"node_id": "node-long-poll", "wait_seconds": 1}, agentToken)
+	if resp.Code != http.StatusOK || len(decodeBodyMap(t, resp.Body.Bytes())["jobs"].([]any)) != 0 {
+		t.Fatalf("idle long poll should return no jobs, status=%d body=%s", resp.Code, resp.Body.String())
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Fatalf("idle long poll returned after %s, before wait_seconds", elapsed)
+	}
+
+	clearRateLimits(srv)
+	done := make(chan *httptest.ResponseRecorder, 1)
+	start = time.Now()
+	go func() {
+		done <- doJSONRequest(t, srv.router, http.MethodPost, "/api/v1/agent/poll-jobs",
+			map[string]any{"node_id": "node-long-poll", "wait_seconds": 20}, agentToken)
+	}()
+	time.Sleep(200 * time.Millisecond)
+	runNow := doJSONRequest(t, srv.router, http.MethodPost, "/api/v1/manager/users/"+itoa(user.ID)+"/tasks/run-now",
+		map[string]any{"task_type": "悬赏"}, managerToken)
+	if runNow.Code != http.StatusOK {
+		t.Fatalf("run now failed, status=%d body=%s", runNow.Code, runNow.Body.String())
+	}
+	jobID := decodeBodyMap(t, runNow.Body.Bytes())["job_id"]
+
+	select {
+	case resp := <-done:
+		jobs := decodeBodyMap(t, resp.Body.Bytes())["jobs"].([]any)
+		if len(jobs) != 1 || jobs[0].(map[string]any)["ID"] != jobID {
+			t.Fatalf("woken poll should lease job %v, got %v", jobID, jobs)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Fatalf("woken poll took %s", elapsed)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("long poll was not woken by the new job")
+	}
+
+	clearRateLimits(srv)
+	resp = doJSONRequest(t, srv.router, http.MethodPost, "/api/v1/agent/poll-jobs",
+		map[string]any{"node_id": "node-long-poll", "wait_seconds": 60}, agentToken)
+	if resp.Code != http.StatusBadRequest {
+		t.Fatalf("wait_seconds above the limit should be rejected, got %d", resp.Code)
+	}
+}
+
+func TestJobWaitersWakeAndCancel(t *testing.T) {
+	waiters := newJobWaiters()
+	first, _ := waiters.wait(1)
+	_, cancel := waiters.wait(1)
+	other, _ := waiters.wait(2)
+	cancel()
+	if woken := waiters.wake(1); woken != 1 {
+		t.Fatalf("expected one waiter of manager 1, got %d", woken)
+	}
+	select {
+	case <-first:
+	default:
+		t.Fatalf("waiter of manager 1 should be released")
+	}
+	select {
+	case <-other:
+		t.Fatalf("waiter of manager 2 should keep waiting")
+	default:
+	}
+	if woken := waiters.wake(1); woken != 0 {
+		t.Fatalf("woken waiters should be gone, got %d", woken)
+	}
+}
@@ -0,0 +1,381 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"oas-cloud-go/internal/models"
+	"oas-cloud-go/internal/notify"
+	"oas-cloud-go/internal/taskmeta"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	alertScanBatch   = 500
+	alertMessageSize = 500
+)
+
+var alertKinds = []string{
+	models.AlertKindExpiring,
+	models.AlertKindArchiveInvalid,
+	models.AlertKindConsecutiveFailures,
+	models.AlertKindInactive,
+}
+
+// streakFailureEvents are the job events of a final failure that counts
+// towards the consecutive_failures streak.
+var streakFailureEvents = []string{"fail", "lease_expired"}
+
+type alertKey struct {
+	userID  uint
+	kind    string
+	subject string
+}
+
+// alertWorker periodically evaluates the time based account alerts (expiry
+// and inactivity). Archive and failure-streak alerts are raised inline when an
+// agent reports a job result.
+func (s *Server) alertWorker() {
+	interval := s.cfg.AlertInterval
+	if interval <= 0 {
+		interval = 10 * time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !s.leading() {
+			continue
+		}
+		s.evaluateAccountAlerts(time.Now().UTC())
+	}
+}
+
+func (s *Server) evaluateAccountAlerts(now time.Time) {
+	var users []models.User
+	err := s.db.Select("id, manager_id, expires_at, created_at").
+		Where("status = ?", models.UserStatusActive).
+		FindInBatches(&users, alertScanBatch, func(tx *gorm.DB, batch int) error {
+			open := s.openAlertSet(users, []string{models.AlertKindExpiring, models.AlertKindInactive})
+			s.evaluateExpiryAlerts(users, open, now)
+			s.evaluateInactivityAlerts(users, open, now)
+			return nil
+		}).Error
+	if err != nil {
+		slog.Warn("account alert scan failed", "error", err)
+	}
+
+	// Accounts that are no longer active are not expected to run jobs.
+	if err := s.db.Model(&models.AccountAlert{}).
+		Where("status = ? AND kind IN ?", models.AlertStatusOpen, []string{models.AlertKindExpiring, models.AlertKindInactive}).
+		Where("user_id IN (?)", s.db.Model(&models.User{}).Select("id").Where("status <> ?", models.UserStatusActive)).
+		Updates(map[string]any{"status": models.AlertStatusResolved, "resolved_at": now, "updated_at": now}).Error; err != nil {
+		slog.Warn("failed to resolve alerts of inactive accounts", "error", err)
+	}
+}
+
+// openAlertSet returns the open alerts of the given kinds for a batch of users.
+func (s *Server) openAlertSet(users []models.User, kinds []string) map[alertKey]struct{} {
+	ids := make([]uint, 0, len(users))
+	for _, user := range users {
+		ids = append(ids, user.ID)
+	}
+	var rows []models.AccountAlert
+	if err := s.db.Select("user_id, kind, subject").
+		Where("user_id IN ? AND kind IN ? AND status = ?", ids, kinds, models.AlertStatusOpen).
+		Find(&rows).Error; err != nil {
+		slog.Warn("failed to load open alerts", "error", err)
+	}
+	open := make(map[alertKey]struct{}, len(rows))
+	for _, row := range rows {
+		open[alertKey{row.UserID, row.Kind, row.Subject}] = struct{}{}
+	}
+	return open
+}
+
+// evaluateExpiryAlerts alerts accounts whose ExpiresAt falls within the next
+// AlertExpiryDays days. Renewed or already expired accounts are resolved.
+func (s *Server) evaluateExpiryAlerts(users []models.User, open map[alertKey]struct{}, now time.Time) {
+	days := s.cfg.AlertExpiryDays
+	if days <= 0 {
+		return
+	}
+	deadline := now.Add(time.Duration(days) * 24 * time.Hour)
+	for _, user := range users {
+		_, isOpen := open[alertKey{user.ID, models.AlertKindExpiring, ""}]
+		expiring := user.ExpiresAt != nil && user.ExpiresAt.After(now) && !user.ExpiresAt.After(deadline)
+		switch {
+		case expiring && !isOpen:
+			expiresAt := user.ExpiresAt.In(taskmeta.BJLoc).Format("2006-01-02 15:04")
+			s.raiseAccountAlert(user.ManagerID, user.ID, models.AlertKindExpiring, "",
+				fmt.Sprintf("账号将于 %s 到期，请及时续费", expiresAt),
+				datatypes.JSONMap{"expires_at": user.ExpiresAt.UTC(), "days": days}, now)
+		case !expiring && isOpen:
+			s.resolveAccountAlert(user.ID, models.AlertKindExpiring, "", now)
+		}
+	}
+}
+
+// evaluateInactivityAlerts alerts accounts that have not finished any job in
+// the last AlertInactiveHours hours. Accounts created inside the window are
+// not judged yet.
+func (s *Server) evaluateInactivityAlerts(users []models.User, open map[alertKey]struct{}, now time.Time) {
+	hours := s.cfg.AlertInactiveHours
+	if hours <= 0 {
+		return
+	}
+	cutoff := now.Add(-time.Duration(hours) * time.Hour)
+	ids := make([]uint, 0, len(users))
+	for _, user := range users {
+		ids = append(ids, user.ID)
+	}
+	var recent []uint
+	if err := s.db.Model(&models.TaskJob{}).
+		Where("user_id IN ? AND status IN ? AND updated_at >= ?", ids,
+			[]string{models.JobStatusRunning, models.JobStatusSuccess, models.JobStatusFailed}, cutoff).
+		Distinct("user_id").
+		Pluck("user_id", &recent).Error; err != nil {
+		slog.Warn("failed to load recent job activity", "error", err)
+		return
+	}
+	active := make(map[uint]struct{}, len(recent))
+	for _, id := range recent {
+		active[id] = struct{}{}
+	}
+
+	for _, user := range users {
+		_, isOpen := open[alertKey{user.ID, models.AlertKindInactive, ""}]
+		_, ran := active[user.ID]
+		expired := user.ExpiresAt != nil && !user.ExpiresAt.After(now)
+		idle := !ran && !expired && user.CreatedAt.Before(cutoff)
+		switch {
+		case idle && !isOpen:
+			s.raiseAccountAlert(user.ManagerID, user.ID, models.AlertKindInactive, "",
+				fmt.Sprintf("已超过 %d 小时没有执行任何任务，请检查账号状态和任务配置", hours),
+				datatypes.JSONMap{"hours": hours}, now)
+		case !idle && isOpen:
+			s.resolveAccountAlert(user.ID, models.AlertKindInactive, "", now)
+		}
+	}
+}
+
+// evaluateFailureStreak raises the consecutive_failures alert of a task type
+// once its last AlertFailureStreak finished jobs all failed, and resolves it
+// after the next success. Only failures the agent reported or that ran out of
+// attempts on a lease timeout count; jobs failed by a dependency cascade or
+// expired before running are skipped.
+func (s *Server) evaluateFailureStreak(jobID uint, message string, now time.Time) {
+	streak := s.cfg.AlertFailureStreak
+	if streak <= 0 {
+		return
+	}
+	var job models.TaskJob
+	if err := s.db.Select("id, manager_id, user_id, task_type").Where("id = ?", jobID).First(&job).Error; err != nil {
+		return
+	}
+	var statuses []string
+	if err := s.db.Model(&models.TaskJob{}).
+		Where("user_id = ? AND task_type = ?", job.UserID, job.TaskType).
+		Where("status = ? OR (status = ? AND EXISTS (SELECT 1 FROM task_job_events WHERE task_job_events.job_id = task_jobs.id AND task_job_events.event_type IN ?))",
+			models.JobStatusSuccess, models.JobStatusFailed, streakFailureEvents).
+		Order("updated_at DESC, id DESC").
+		Limit(streak).
+		Pluck("status", &statuses).Error; err != nil || len(statuses) == 0 {
+		return
+	}
+	if statuses[0] == models.JobStatusSuccess {
+		s.resolveAccountAlert(job.UserID, models.AlertKindConsecutiveFailures, job.TaskType, now)
+		return
+	}
+	if len(statuses) < streak {
+		return
+	}
+	for _, status := range statuses {
+		if status != models.JobStatusFailed {
+			return
+		}
+	}
+	text := fmt.Sprintf("任务「%s」已连续失败 %d 次", job.TaskType, streak)
+	if message != "" {
+		text += "\n最近错误: " + message
+	}
+	s.raiseAccountAlert(job.ManagerID, job.UserID, models.AlertKindConsecutiveFailures, job.TaskType, text,
+		datatypes.JSONMap{"streak": streak, "job_id": job.ID, "last_error": message}, now)
+}
+
+// onArchiveStatusReported raises the archive_invalid alert when an agent
+// flips the account archive to invalid and resolves it once it is normal.
+func (s *Server) onArchiveStatusReported(previous models.User, archiveStatus string, now time.Time) {
+	switch archiveStatus {
+	case "invalid":
+		if previous.ArchiveStatus == "invalid" {
+			return
+		}
+		s.raiseAccountAlert(previous.ManagerID, previous.ID, models.AlertKindArchiveInvalid, "",
+			"账号存档已失效，任务将无法执行，请重新上传存档或扫码登录",
+			datatypes.JSONMap{"previous": previous.ArchiveStatus}, now)
+	case "normal":
+		s.resolveAccountAlert(previous.ID, models.AlertKindArchiveInvalid, "", now)
+	}
+}
+
+// raiseAccountAlert opens an alert and notifies the user through the outbox.
+// Nothing happens while the same alert is still open: the partial unique
+// index on open alerts lets only one of concurrent raises insert, and only
+// that one notifies.
+func (s *Server) raiseAccountAlert(managerID, userID uint, kind, subject, message string, detail datatypes.JSONMap, now time.Time) {
+	stored := message
+	if runes := []rune(stored); len(runes) > alertMessageSize {
+		stored = string(runes[:alertMessageSize])
+	}
+	alert := models.AccountAlert{
+		ManagerID: managerID,
+		UserID:    userID,
+		Kind:      kind,
+		Subject:   subject,
+		Status:    models.AlertStatusOpen,
+		Message:   stored,
+		Detail:    detail,
+		FiredAt:   now,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	result := s.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&alert)
+	if result.Error != nil {
+		slog.Error("failed to create account alert", "user_id", userID, "kind", kind, "error", result.Error)
+		return
+	}
+	if result.RowsAffected == 0 {
+		return
+	}
+	s.enqueueNotification(context.Background(), managerID, 0, notify.NotifyRequest{
+		UserID:    userID,
+		TaskType:  subject,
+		EventType: notify.EventAlert,
+		Message:   message,
+	})
+}
+
+func (s *Server) resolveAccountAlert(userID uint, kind, subject string, now time.Time) {
+	if err := s.db.Model(&models.AccountAlert{}).
+		Where("user_id = ? AND kind = ? AND subject = ? AND status = ?", userID, kind, subject, models.AlertStatusOpen).
+		Updates(map[string]any{"status": models.AlertStatusResolved, "resolved_at": now, "updated_at": now}).Error; err != nil {
+		slog.Warn("failed to resolve account alert", "user_id", userID, "kind", kind, "error", err)
+	}
+}
+
+// managerListAlerts is the roll-up of account alerts across all of the
+// manager's users, with open counts per kind.
+func (s *Server) managerListAlerts(c *gin.Context) {
+	managerID := getUint(c, ctxActorIDKey)
+	pg := readPagination(c, 50, 200)
+
+	query := s.db.Model(&models.AccountAlert{}).Where("manager_id = ?", managerID)
+	switch status := strings.TrimSpace(c.DefaultQuery("status", models.AlertStatusOpen)); status {
+	case models.AlertStatusOpen, models.AlertStatusResolved:
+		query = query.Where("status = ?", status)
+	case "all":
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"detail": "status 仅支持 open / resolved / all"})
+		return
+	}
+	if kind := strings.TrimSpace(c.Query("kind")); kind != "" {
+		if !slices.Contains(alertKinds, kind) {
+			c.JSON(http.StatusBadRequest, gin.H{"detail": "未知的提醒类型"})
+			return
+		}
+		query = query.Where("kind = ?", kind)
+	}
+	if raw := strings.TrimSpace(c.Query("user_id")); raw != "" {
+		userID, err := strconv.ParseUint(raw, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"detail": "user_id 无效"})
+			return
+		}
+		query = query.Where("user_id = ?", userID)
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "查询账号提醒失败"})
+		return
+	}
+	var alerts []models.AccountAlert
+	if err := query.Order("fired_at DESC, id DESC").Offset(pg.Offset).Limit(pg.PageSize).Find(&alerts).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "查询账号提醒失败"})
+		return
+	}
+
+	userIDs := make([]uint, 0, len(alerts))
+	for _, alert := range alerts {
+		userIDs = append(userIDs, alert.UserID)
+	}
+	var users []models.User
+	if len(userIDs) > 0 {
+		if err := s.db.Select("id, account_no, username").Where("id IN ?", userIDs).Find(&users).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"detail": "查询用户失败"})
+			return
+		}
+	}
+	userByID := make(map[uint]models.User, len(users))
+	for _, user := range users {
+		userByID[user.ID] = user
+	}
+	items := make([]gin.H, 0, len(alerts))
+	for _, alert := range alerts {
+		user := userByID[alert.UserID]
+		items = append(items, gin.H{
+			"id":          alert.ID,
+			"user_id":     alert.UserID,
+			"account_no":  user.AccountNo,
+			"username":    user.Username,
+			"kind":        alert.Kind,
+			"subject":     alert.Subject,
+			"status":      alert.Status,
+			"message":     alert.Message,
+			"detail":      alert.Detail,
+			"fired_at":    alert.FiredAt,
+			"resolved_at": alert.ResolvedAt,
+		})
+	}
+
+	var counts []struct {
+		Kind  string
+		Total int64
+	}
+	if err := s.db.Model(&models.AccountAlert{}).
+		Select("kind, COUNT(*) AS total").
+		Where("manager_id = ? AND status = ?", managerID, models.AlertStatusOpen).
+		Group("kind").
+		Scan(&counts).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "查询账号提醒失败"})
+		return
+	}
+	summary := gin.H{}
+	var openTotal int64
+	for _, kind := range alertKinds {
+		summary[kind] = int64(0)
+	}
+	for _, row := range counts {
+		summary[row.Kind] = row.Total
+		openTotal += row.Total
+	}
+	summary["total"] = openTotal
+
+	c.JSON(http.StatusOK, gin.H{
+		"summary":   summary,
+		"items":     items,
+		"total":     total,
+		"page":      pg.Page,
+		"page_size": pg.PageSize,
+	})
+}
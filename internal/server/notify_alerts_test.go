@@ -0,0 +1,286 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"oas-cloud-go/internal/models"
+	"oas-cloud-go/internal/notify"
+
+	"gorm.io/datatypes"
+)
+
+func createAlertTestJob(t *testing.T, srv *Server, user models.User, taskType, status string, at time.Time) models.TaskJob {
+	t.Helper()
+	job := models.TaskJob{
+		ManagerID:   user.ManagerID,
+		UserID:      user.ID,
+		TaskType:    taskType,
+		ScheduledAt: at,
+		Status:      status,
+		CreatedAt:   at,
+		UpdatedAt:   at,
+	}
+	if err := srv.db.Create(&job).Error; err != nil {
+		t.Fatalf("create job failed: %v", err)
+	}
+	if status == models.JobStatusFailed {
+		createAlertTestJobEvent(t, srv, job, "fail")
+	}
+	return job
+}
+
+func createAlertTestJobEvent(t *testing.T, srv *Server, job models.TaskJob, eventType string) {
+	t.Helper()
+	event := models.TaskJobEvent{JobID: job.ID, EventType: eventType, EventAt: job.UpdatedAt}
+	if err := srv.db.Create(&event).Error; err != nil {
+		t.Fatalf("create job event failed: %v", err)
+	}
+}
+
+func loadUserAlerts(t *testing.T, srv *Server, userID uint, kind string) []models.AccountAlert {
+	t.Helper()
+	var alerts []models.AccountAlert
+	if err := srv.db.Where("user_id = ? AND kind = ?", userID, kind).Order("id ASC").Find(&alerts).Error; err != nil {
+		t.Fatalf("load alerts failed: %v", err)
+	}
+	return alerts
+}
+
+func TestFailureStreakAlertRaisedOnceAndResolved(t *testing.T) {
+	srv, db := setupTestServer(t)
+	srv.cfg.AlertFailureStreak = 3
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer hook.Close()
+
+	manager := createActiveManager(t, db, "manager_alert_streak", "passwordAlert123")
+	user := createNotifyTestUser(t, srv, manager.ID, "U_ALERT_STREAK_001", datatypes.JSONMap{
+		"channels": map[string]any{
+			"webhook": map[string]any{"enabled": true, "url": hook.URL},
+		},
+	})
+
+	base := time.Now().UTC().Add(-time.Hour)
+	createAlertTestJob(t, srv, user, "探索突破", models.JobStatusSuccess, base)
+	var last models.TaskJob
+	for i := 1; i <= 2; i++ {
+		last = createAlertTestJob(t, srv, user, "探索突破", models.JobStatusFailed, base.Add(time.Duration(i)*time.Minute))
+	}
+	srv.evaluateFailureStreak(last.ID, "体力不足", time.Now().UTC())
+	if alerts := loadUserAlerts(t, srv, user.ID, models.AlertKindConsecutiveFailures); len(alerts) != 0 {
+		t.Fatalf("two failures after a success should not alert, got %d", len(alerts))
+	}
+
+	last = createAlertTestJob(t, srv, user, "探索突破", models.JobStatusFailed, base.Add(3*time.Minute))
+	srv.evaluateFailureStreak(last.ID, "体力不足", time.Now().UTC())
+	srv.evaluateFailureStreak(last.ID, "体力不足", time.Now().UTC())
+
+	alerts := loadUserAlerts(t, srv, user.ID, models.AlertKindConsecutiveFailures)
+	if len(alerts) != 1 || alerts[0].Status != models.AlertStatusOpen || alerts[0].Subject != "探索突破" {
+		t.Fatalf("expected one open streak alert, got %+v", alerts)
+	}
+	if !strings.Contains(alerts[0].Message, "已连续失败 3 次") || !strings.Contains(alerts[0].Message, "体力不足") {
+		t.Fatalf("unexpected alert message: %q", alerts[0].Message)
+	}
+	var queued int64
+	db.Model(&models.NotificationOutbox{}).Where("user_id = ? AND event_type = ?", user.ID, notify.EventAlert).Count(&queued)
+	if queued != 1 {
+		t.Fatalf("expected one alert notification, got %d", queued)
+	}
+
+	success := createAlertTestJob(t, srv, user, "探索突破", models.JobStatusSuccess, base.Add(4*time.Minute))
+	srv.evaluateFailureStreak(success.ID, "", time.Now().UTC())
+	alerts = loadUserAlerts(t, srv, user.ID, models.AlertKindConsecutiveFailures)
+	if len(alerts) != 1 || alerts[0].Status != models.AlertStatusResolved || alerts[0].ResolvedAt == nil {
+		t.Fatalf("success should resolve the streak alert, got %+v", alerts)
+	}
+}
+
+func TestFailureStreakIgnoresDependencyCascade(t *testing.T) {
+	srv, db := setupTestServer(t)
+	srv.cfg.AlertFailureStreak = 3
+	manager := createActiveManager(t, db, "manager_alert_cascade", "passwordAlert123")
+	user := createNotifyTestUser(t, srv, manager.ID, "U_ALERT_CASCADE_001", datatypes.JSONMap{})
+
+	base := time.Now().UTC().Add(-time.Hour)
+	createAlertTestJob(t, srv, user, "探索突破", models.JobStatusSuccess, base)
+	last := createAlertTestJob(t, srv, user, "探索突破", models.JobStatusFailed, base.Add(time.Minute))
+	for i := 2; i <= 4; i++ {
+		cascaded := models.TaskJob{
+			ManagerID:   user.ManagerID,
+			UserID:      user.ID,
+			TaskType:    "探索突破",
+			ScheduledAt: base.Add(time.Duration(i) * time.Minute),
+			Status:      models.JobStatusFailed,
+			CreatedAt:   base.Add(time.Duration(i) * time.Minute),
+			UpdatedAt:   base.Add(time.Duration(i) * time.Minute),
+		}
+		if err := db.Create(&cascaded).Error; err != nil {
+			t.Fatalf("create cascaded job failed: %v", err)
+		}
+		eventType := "dependency_failed"
+		if i == 4 {
+			eventType = "expired"
+		}
+		createAlertTestJobEvent(t, srv, cascaded, eventType)
+	}
+
+	srv.evaluateFailureStreak(last.ID, "体力不足", time.Now().UTC())
+	if alerts := loadUserAlerts(t, srv, user.ID, models.AlertKindConsecutiveFailures); len(alerts) != 0 {
+		t.Fatalf("cascaded and expired jobs should not count towards the streak, got %d alerts", len(alerts))
+	}
+}
+
+func TestConcurrentAlertRaisesOpenOneAlert(t *testing.T) {
+	srv, db := setupTestServer(t)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer hook.Close()
+	manager := createActiveManager(t, db, "manager_alert_race", "passwordAlert123")
+	user := createNotifyTestUser(t, srv, manager.ID, "U_ALERT_RACE_001", datatypes.JSONMap{
+		"channels": map[string]any{
+			"webhook": map[string]any{"enabled": true, "url": hook.URL},
+		},
+	})
+
+	now := time.Now().UTC()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			srv.raiseAccountAlert(manager.ID, user.ID, models.AlertKindInactive, "", "账号长时间未执行任务", datatypes.JSONMap{}, now)
+		}()
+	}
+	wg.Wait()
+
+	if alerts := loadUserAlerts(t, srv, user.ID, models.AlertKindInactive); len(alerts) != 1 {
+		t.Fatalf("expected one open alert, got %d", len(alerts))
+	}
+	var queued int64
+	db.Model(&models.NotificationOutbox{}).Where("user_id = ? AND event_type = ?", user.ID, notify.EventAlert).Count(&queued)
+	if queued != 1 {
+		t.Fatalf("expected one alert notification, got %d", queued)
+	}
+	duplicate := models.AccountAlert{ManagerID: manager.ID, UserID: user.ID, Kind: models.AlertKindInactive, Status: models.AlertStatusOpen,
+		Detail: datatypes.JSONMap{}, FiredAt: now, CreatedAt: now, UpdatedAt: now}
+	if err := db.Create(&duplicate).Error; err == nil {
+		t.Fatalf("a second open alert for the same condition should violate the unique index")
+	}
+}
+
+func TestArchiveInvalidAlertFollowsAgentResult(t *testing.T) {
+	srv, db := setupTestServer(t)
+	manager := createActiveManager(t, db, "manager_alert_archive", "passwordAlert123")
+	user := createNotifyTestUser(t, srv, manager.ID, "U_ALERT_ARCHIVE_001", datatypes.JSONMap{})
+	job := createAlertTestJob(t, srv, user, "签到", models.JobStatusFailed, time.Now().UTC())
+
+	srv.syncAgentResult(job.ID, map[string]any{"account_status": "invalid"}, time.Now().UTC())
+	srv.syncAgentResult(job.ID, map[string]any{"account_status": "invalid"}, time.Now().UTC())
+	alerts := loadUserAlerts(t, srv, user.ID, models.AlertKindArchiveInvalid)
+	if len(alerts) != 1 || alerts[0].Status != models.AlertStatusOpen {
+		t.Fatalf("expected one open archive alert, got %+v", alerts)
+	}
+
+	srv.syncAgentResult(job.ID, map[string]any{"account_status": "normal"}, time.Now().UTC())
+	alerts = loadUserAlerts(t, srv, user.ID, models.AlertKindArchiveInvalid)
+	if len(alerts) != 1 || alerts[0].Status != models.AlertStatusResolved {
+		t.Fatalf("normal archive should resolve the alert, got %+v", alerts)
+	}
+}
+
+func TestEvaluateAccountAlertsExpiryAndInactivity(t *testing.T) {
+	srv, db := setupTestServer(t)
+	srv.cfg.AlertExpiryDays = 3
+	srv.cfg.AlertInactiveHours = 24
+	manager := createActiveManager(t, db, "manager_alert_scan", "passwordAlert123")
+
+	now := time.Now().UTC()
+	expiring := createNotifyTestUser(t, srv, manager.ID, "U_ALERT_EXPIRING_001", datatypes.JSONMap{})
+	idle := createNotifyTestUser(t, srv, manager.ID, "U_ALERT_IDLE_001", datatypes.JSONMap{})
+	fresh := createNotifyTestUser(t, srv, manager.ID, "U_ALERT_FRESH_001", datatypes.JSONMap{})
+	db.Model(&models.User{}).Where("id IN ?", []uint{expiring.ID, idle.ID}).Update("created_at", now.Add(-48*time.Hour))
+	db.Model(&models.User{}).Where("id = ?", expiring.ID).Update("expires_at", now.Add(24*time.Hour))
+	createAlertTestJob(t, srv, expiring, "签到", models.JobStatusSuccess, now.Add(-time.Hour))
+	createAlertTestJob(t, srv, idle, "签到", models.JobStatusSuccess, now.Add(-30*time.Hour))
+
+	srv.evaluateAccountAlerts(now)
+	srv.evaluateAccountAlerts(now)
+
+	if alerts := loadUserAlerts(t, srv, expiring.ID, models.AlertKindExpiring); len(alerts) != 1 || alerts[0].Status != models.AlertStatusOpen {
+		t.Fatalf("expected one open expiry alert, got %+v", alerts)
+	}
+	if alerts := loadUserAlerts(t, srv, expiring.ID, models.AlertKindInactive); len(alerts) != 0 {
+		t.Fatalf("account with a recent job should not be inactive, got %+v", alerts)
+	}
+	if alerts := loadUserAlerts(t, srv, idle.ID, models.AlertKindInactive); len(alerts) != 1 || alerts[0].Status != models.AlertStatusOpen {
+		t.Fatalf("expected one open inactivity alert, got %+v", alerts)
+	}
+	if alerts := loadUserAlerts(t, srv, idle.ID, models.AlertKindExpiring); len(alerts) != 0 {
+		t.Fatalf("account expiring in 7 days should not alert, got %+v", alerts)
+	}
+	if alerts := loadUserAlerts(t, srv, fresh.ID, models.AlertKindInactive); len(alerts) != 0 {
+		t.Fatalf("newly created account should not be inactive yet, got %+v", alerts)
+	}
+
+	db.Model(&models.User{}).Where("id = ?", expiring.ID).Update("expires_at", now.Add(30*24*time.Hour))
+	createAlertTestJob(t, srv, idle, "签到", models.JobStatusSuccess, now)
+	srv.evaluateAccountAlerts(now)
+	if alerts := loadUserAlerts(t, srv, expiring.ID, models.AlertKindExpiring); len(alerts) != 1 || alerts[0].Status != models.AlertStatusResolved {
+		t.Fatalf("renewal should resolve the expiry alert, got %+v", alerts)
+	}
+	if alerts := loadUserAlerts(t, srv, idle.ID, models.AlertKindInactive); len(alerts) != 1 || alerts[0].Status != models.AlertStatusResolved {
+		t.Fatalf("a new job should resolve the inactivity alert, got %+v", alerts)
+	}
+}
+
+func TestManagerListAlertsRollup(t *testing.T) {
+	srv, db := setupTestServer(t)
+	manager := createActiveManager(t, db, "manager_alert_list", "passwordAlert123")
+	createActiveManager(t, db, "manager_alert_list_other", "passwordAlert123")
+	first := createNotifyTestUser(t, srv, manager.ID, "U_ALERT_LIST_001", datatypes.JSONMap{})
+	second := createNotifyTestUser(t, srv, manager.ID, "U_ALERT_LIST_002", datatypes.JSONMap{})
+
+	now := time.Now().UTC()
+	srv.raiseAccountAlert(manager.ID, first.ID, models.AlertKindArchiveInvalid, "", "存档失效", nil, now)
+	srv.raiseAccountAlert(manager.ID, first.ID, models.AlertKindConsecutiveFailures, "签到", "连续失败", nil, now.Add(time.Second))
+	srv.raiseAccountAlert(manager.ID, second.ID, models.AlertKindInactive, "", "没有执行", nil, now.Add(2*time.Second))
+	srv.resolveAccountAlert(second.ID, models.AlertKindInactive, "", now.Add(3*time.Second))
+
+	token := loginManagerToken(t, srv, "manager_alert_list", "passwordAlert123")
+	resp := doJSONRequest(t, srv.router, http.MethodGet, "/api/v1/manager/alerts", nil, token)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("list alerts failed, status=%d body=%s", resp.Code, resp.Body.String())
+	}
+	body := decodeBodyMap(t, resp.Body.Bytes())
+	items, _ := body["items"].([]any)
+	if len(items) != 2 || items[0].(map[string]any)["kind"] != models.AlertKindConsecutiveFailures ||
+		items[0].(map[string]any)["account_no"] != "U_ALERT_LIST_001" {
+		t.Fatalf("unexpected open alerts: %v", body["items"])
+	}
+	summary, _ := body["summary"].(map[string]any)
+	if summary["total"] != float64(2) || summary[models.AlertKindArchiveInvalid] != float64(1) || summary[models.AlertKindInactive] != float64(0) {
+		t.Fatalf("unexpected summary: %v", summary)
+	}
+
+	resp = doJSONRequest(t, srv.router, http.MethodGet, "/api/v1/manager/alerts?status=all&kind=inactive", nil, token)
+	body = decodeBodyMap(t, resp.Body.Bytes())
+	if items, _ := body["items"].([]any); len(items) != 1 || items[0].(map[string]any)["status"] != models.AlertStatusResolved {
+		t.Fatalf("expected the resolved inactivity alert, got %v", body["items"])
+	}
+
+	resp = doJSONRequest(t, srv.router, http.MethodGet, "/api/v1/manager/alerts?kind=unknown", nil, token)
+	if resp.Code != http.StatusBadRequest {
+		t.Fatalf("unknown kind should be rejected, status=%d", resp.Code)
+	}
+
+	otherToken := loginManagerToken(t, srv, "manager_alert_list_other", "passwordAlert123")
+	resp = doJSONRequest(t, srv.router, http.MethodGet, "/api/v1/manager/alerts?status=all", nil, otherToken)
+	body = decodeBodyMap(t, resp.Body.Bytes())
+	if body["total"] != float64(0) {
+		t.Fatalf("other manager should not see these alerts, got %v", body)
+	}
+}
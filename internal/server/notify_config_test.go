@@ -0,0 +1,104 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"oas-cloud-go/internal/models"
+)
+
+func TestUserPutProfileNotifyChannels(t *testing.T) {
+	srv, db := setupTestServer(t)
+
+	manager := createActiveManager(t, db, "manager_notify_cfg", "passwordNotify123")
+	user := models.User{
+		AccountNo: "U_NOTIFY_CFG_001",
+		ManagerID: manager.ID,
+		UserType:  models.UserTypeDaily,
+		Status:    models.UserStatusActive,
+		ExpiresAt: ptrTime(time.Now().UTC().Add(7 * 24 * time.Hour)),
+		CreatedBy: "manager_create",
+		CreatedAt: time.Now().UTC(),
+		UpdatedAt: time.Now().UTC(),
+	}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatalf("create user failed: %v", err)
+	}
+	rawToken, _, err := srv.issueUserToken(user.ID, "test-device")
+	if err != nil {
+		t.Fatalf("issue user token failed: %v", err)
+	}
+
+	badResp := doJSONRequest(t, srv.router, http.MethodPut, "/api/v1/user/me/profile", map[string]any{
+		"notify_config": map[string]any{
+			"wechat_enabled": true,
+		},
+	}, rawToken)
+	if badResp.Code != http.StatusBadRequest {
+		t.Fatalf("wechat without miao code should be rejected, got status=%d body=%s", badResp.Code, badResp.Body.String())
+	}
+
+	okResp := doJSONRequest(t, srv.router, http.MethodPut, "/api/v1/user/me/profile", map[string]any{
+		"notify_config": map[string]any{
+			"wechat_enabled":   true,
+			"wechat_miao_code": "abc123",
+			"channels": map[string]any{
+				"pushplus": map[string]any{"enabled": true, "token": "tok123"},
+			},
+		},
+	}, rawToken)
+	if okResp.Code != http.StatusOK {
+		t.Fatalf("update profile failed, status=%d body=%s", okResp.Code, okResp.Body.String())
+	}
+
+	var stored models.User
+	if err := db.First(&stored, user.ID).Error; err != nil {
+		t.Fatalf("reload user failed: %v", err)
+	}
+	if stored.NotifyConfig["wechat_miao_code"] != "abc123" {
+		t.Fatalf("legacy wechat key not stored: %v", stored.NotifyConfig)
+	}
+	channels, _ := stored.NotifyConfig["channels"].(map[string]any)
+	pushplus, _ := channels["pushplus"].(map[string]any)
+	if pushplus["token"] != "tok123" || pushplus["enabled"] != true {
+		t.Fatalf("pushplus channel not stored: %v", stored.NotifyConfig)
+	}
+
+	// Clients that only send the flat keys keep the stored channels and rules.
+	legacyResp := doJSONRequest(t, srv.router, http.MethodPut, "/api/v1/user/me/profile", map[string]any{
+		"notify_config": map[string]any{
+			"email_enabled":    false,
+			"email":            "",
+			"wechat_enabled":   false,
+			"wechat_miao_code": "abc123",
+		},
+	}, rawToken)
+	if legacyResp.Code != http.StatusOK {
+		t.Fatalf("legacy profile update failed, status=%d body=%s", legacyResp.Code, legacyResp.Body.String())
+	}
+	stored = models.User{}
+	db.First(&stored, user.ID)
+	channels, _ = stored.NotifyConfig["channels"].(map[string]any)
+	if _, ok := channels["pushplus"]; !ok || stored.NotifyConfig["wechat_enabled"] != false {
+		t.Fatalf("legacy update should keep channels and apply flat keys: %v", stored.NotifyConfig)
+	}
+	rules, _ := stored.NotifyConfig["rules"].(map[string]any)
+	if rules["digest"] != "off" {
+		t.Fatalf("default rules should be stored: %v", stored.NotifyConfig)
+	}
+
+	listResp := doJSONRequest(t, srv.router, http.MethodGet, "/api/v1/user/me/notify-channels", nil, rawToken)
+	if listResp.Code != http.StatusOK {
+		t.Fatalf("list channels failed, status=%d body=%s", listResp.Code, listResp.Body.String())
+	}
+	items, _ := decodeBodyMap(t, listResp.Body.Bytes())["items"].([]any)
+	available := map[string]bool{}
+	for _, raw := range items {
+		item := raw.(map[string]any)
+		available[item["name"].(string)] = item["available"].(bool)
+	}
+	if !available["webhook"] || !available["miaotixing"] || available["email"] {
+		t.Fatalf("unexpected channel availability: %v", available)
+	}
+}
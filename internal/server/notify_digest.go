@@ -0,0 +1,144 @@
+package server
+
+import (
+	"log/slog"
+	"time"
+
+	"oas-cloud-go/internal/models"
+	"oas-cloud-go/internal/notify"
+
+	"gorm.io/gorm"
+)
+
+const notifyDigestRecentFailures = 3
+
+// notifyDigestWorker queues hourly and daily digests. Digest windows only
+// change on the hour, so users are scanned once per hour; the digest_period
+// key on outbox rows keeps a restart from sending the same digest twice.
+func (s *Server) notifyDigestWorker() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	var lastHour time.Time
+	for {
+		now := time.Now().UTC()
+		if hour := now.Truncate(time.Hour); !hour.Equal(lastHour) && s.leading() {
+			s.runNotifyDigests(now)
+			lastHour = hour
+		}
+		<-ticker.C
+	}
+}
+
+func (s *Server) runNotifyDigests(now time.Time) {
+	var users []models.User
+	err := s.db.Select("id, manager_id, notify_config").
+		Where("status = ?", models.UserStatusActive).
+		FindInBatches(&users, 500, func(tx *gorm.DB, batch int) error {
+			for _, user := range users {
+				s.queueUserDigest(user, now)
+			}
+			return nil
+		}).Error
+	if err != nil {
+		slog.Warn("notify digest scan failed", "error", err)
+	}
+}
+
+// queueUserDigest aggregates the user's job outcomes for the digest window
+// due at now and queues one digest per enabled channel.
+func (s *Server) queueUserDigest(user models.User, now time.Time) {
+	rules := notify.ParseRules(user.NotifyConfig)
+	start, end, period, ok := rules.DigestWindow(now)
+	if !ok || len(s.notifier.Targets(user.NotifyConfig)) == 0 {
+		return
+	}
+
+	var existing int64
+	if err := s.db.Model(&models.NotificationOutbox{}).
+		Where("user_id = ? AND digest_period = ?", user.ID, period).
+		Count(&existing).Error; err != nil || existing > 0 {
+		return
+	}
+
+	eventTypes := []string{"success", "fail"}
+	if rules.FailuresOnly {
+		eventTypes = []string{"fail"}
+	}
+	base := func() *gorm.DB {
+		query := s.db.Model(&models.TaskJobEvent{}).
+			Joins("JOIN task_jobs ON task_jobs.id = task_job_events.job_id").
+			Where("task_jobs.user_id = ?", user.ID).
+			Where("task_job_events.event_type IN ?", eventTypes).
+			Where("task_job_events.event_at >= ? AND task_job_events.event_at < ?", start, end)
+		if len(rules.TaskTypes) > 0 {
+			query = query.Where("task_jobs.task_type IN ?", rules.TaskTypes)
+		}
+		return query
+	}
+
+	var counts []struct {
+		TaskType  string
+		EventType string
+		Total     int
+	}
+	if err := base().
+		Select("task_jobs.task_type AS task_type, task_job_events.event_type AS event_type, COUNT(*) AS total").
+		Group("task_jobs.task_type, task_job_events.event_type").
+		Scan(&counts).Error; err != nil {
+		slog.Warn("notify digest aggregate failed", "user_id", user.ID, "error", err)
+		return
+	}
+	if len(counts) == 0 {
+		return
+	}
+	byTask := map[string]*notify.DigestEntry{}
+	for _, row := range counts {
+		entry, ok := byTask[row.TaskType]
+		if !ok {
+			entry = &notify.DigestEntry{TaskType: row.TaskType}
+			byTask[row.TaskType] = entry
+		}
+		if row.EventType == "fail" {
+			entry.Fail += row.Total
+		} else {
+			entry.Success += row.Total
+		}
+	}
+	entries := make([]notify.DigestEntry, 0, len(byTask))
+	for _, entry := range byTask {
+		entries = append(entries, *entry)
+	}
+
+	var failures []struct {
+		TaskType string
+		Message  string
+	}
+	if err := base().
+		Where("task_job_events.event_type = ?", "fail").
+		Select("task_jobs.task_type AS task_type, task_job_events.message AS message").
+		Order("task_job_events.event_at DESC").
+		Limit(notifyDigestRecentFailures).
+		Scan(&failures).Error; err != nil {
+		slog.Warn("notify digest recent failures failed", "user_id", user.ID, "error", err)
+	}
+	recent := make([]string, 0, len(failures))
+	for _, failure := range failures {
+		item := failure.TaskType
+		if failure.Message != "" {
+			item += ": " + failure.Message
+		}
+		recent = append(recent, item)
+	}
+
+	req := notify.NotifyRequest{
+		UserID:    user.ID,
+		EventType: notify.EventDigest,
+		Message:   notify.BuildDigestMessage(start, end, entries, recent),
+	}
+	rows := s.buildOutboxRows(user.ManagerID, 0, period, req, user.NotifyConfig, now)
+	if err := s.db.Create(&rows).Error; err != nil {
+		slog.Error("failed to enqueue notify digest", "user_id", user.ID, "period", period, "error", err)
+		return
+	}
+	s.wakeNotifyDispatcher()
+}
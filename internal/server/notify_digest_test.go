@@ -0,0 +1,167 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"oas-cloud-go/internal/models"
+	"oas-cloud-go/internal/notify"
+	"oas-cloud-go/internal/taskmeta"
+
+	"gorm.io/datatypes"
+)
+
+func createSendingOutboxRow(t *testing.T, srv *Server, user models.User, taskType, eventType string) models.NotificationOutbox {
+	t.Helper()
+	now := time.Now().UTC()
+	row := models.NotificationOutbox{
+		ManagerID:     user.ManagerID,
+		UserID:        user.ID,
+		Channel:       "webhook",
+		TaskType:      taskType,
+		EventType:     eventType,
+		Status:        models.NotifyStatusSending,
+		MaxAttempts:   3,
+		NextAttemptAt: now,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+	if err := srv.db.Create(&row).Error; err != nil {
+		t.Fatalf("create outbox row failed: %v", err)
+	}
+	return row
+}
+
+func TestDeliverNotificationAppliesRules(t *testing.T) {
+	srv, db := setupTestServer(t)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer hook.Close()
+
+	manager := createActiveManager(t, db, "manager_notify_rules", "passwordRules123")
+	user := createNotifyTestUser(t, srv, manager.ID, "U_NOTIFY_RULES_001", datatypes.JSONMap{
+		"channels": map[string]any{
+			"webhook": map[string]any{"enabled": true, "url": hook.URL},
+		},
+		"rules": map[string]any{
+			"task_types":    []any{"探索突破"},
+			"failures_only": true,
+		},
+	})
+
+	cases := []struct {
+		taskType   string
+		eventType  string
+		wantStatus string
+		wantError  string
+	}{
+		{"探索突破", "success", models.NotifyStatusSkipped, "failures only"},
+		{"签到", "fail", models.NotifyStatusSkipped, "task type 签到 not selected"},
+		{"探索突破", "fail", models.NotifyStatusSent, ""},
+	}
+	for _, tc := range cases {
+		row := createSendingOutboxRow(t, srv, user, tc.taskType, tc.eventType)
+		srv.deliverNotification(row)
+		var stored models.NotificationOutbox
+		db.First(&stored, row.ID)
+		if stored.Status != tc.wantStatus || !strings.Contains(stored.LastError, tc.wantError) {
+			t.Fatalf("%s/%s: got status=%s last_error=%q", tc.taskType, tc.eventType, stored.Status, stored.LastError)
+		}
+	}
+}
+
+func TestDeliverNotificationDefersDuringQuietHours(t *testing.T) {
+	srv, db := setupTestServer(t)
+	manager := createActiveManager(t, db, "manager_notify_quiet", "passwordQuiet123")
+
+	bjNow := time.Now().In(taskmeta.BJLoc)
+	start := bjNow.Add(-time.Hour).Format("15:04")
+	end := bjNow.Add(time.Hour).Format("15:04")
+	user := createNotifyTestUser(t, srv, manager.ID, "U_NOTIFY_QUIET_001", datatypes.JSONMap{
+		"channels": map[string]any{
+			"webhook": map[string]any{"enabled": true, "url": "http://127.0.0.1:1/unused"},
+		},
+		"rules": map[string]any{
+			"quiet_hours": map[string]any{"enabled": true, "start": start, "end": end},
+		},
+	})
+
+	row := createSendingOutboxRow(t, srv, user, "签到", "fail")
+	srv.deliverNotification(row)
+
+	var stored models.NotificationOutbox
+	db.First(&stored, row.ID)
+	if stored.Status != models.NotifyStatusPending || stored.Attempts != 0 {
+		t.Fatalf("quiet hours should defer without an attempt, got status=%s attempts=%d", stored.Status, stored.Attempts)
+	}
+	wait := stored.NextAttemptAt.Sub(time.Now())
+	if wait < 58*time.Minute || wait > 61*time.Minute {
+		t.Fatalf("expected deferral to the end of quiet hours (~1h), got %s", wait)
+	}
+}
+
+func TestQueueUserDigestAggregatesEventsOnce(t *testing.T) {
+	srv, db := setupTestServer(t)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer hook.Close()
+
+	manager := createActiveManager(t, db, "manager_notify_digest", "passwordDigest123")
+	user := createNotifyTestUser(t, srv, manager.ID, "U_NOTIFY_DIGEST_001", datatypes.JSONMap{
+		"channels": map[string]any{
+			"webhook": map[string]any{"enabled": true, "url": hook.URL},
+		},
+		"rules": map[string]any{"digest": "hourly"},
+	})
+
+	now := time.Date(2026, 3, 10, 9, 5, 0, 0, taskmeta.BJLoc).UTC()
+	windowStart := time.Date(2026, 3, 10, 8, 0, 0, 0, taskmeta.BJLoc).UTC()
+	outcomes := []struct {
+		taskType  string
+		eventType string
+		at        time.Time
+		message   string
+	}{
+		{"探索突破", "success", windowStart.Add(5 * time.Minute), ""},
+		{"探索突破", "fail", windowStart.Add(20 * time.Minute), "体力不足"},
+		{"签到", "success", windowStart.Add(30 * time.Minute), ""},
+		{"签到", "success", windowStart.Add(-10 * time.Minute), ""}, // previous window
+	}
+	for _, outcome := range outcomes {
+		job := models.TaskJob{
+			ManagerID:   manager.ID,
+			UserID:      user.ID,
+			TaskType:    outcome.taskType,
+			ScheduledAt: outcome.at,
+			Status:      outcome.eventType,
+			CreatedAt:   outcome.at,
+			UpdatedAt:   outcome.at,
+		}
+		if err := db.Create(&job).Error; err != nil {
+			t.Fatalf("create job failed: %v", err)
+		}
+		event := models.TaskJobEvent{JobID: job.ID, EventType: outcome.eventType, Message: outcome.message, EventAt: outcome.at}
+		if err := db.Create(&event).Error; err != nil {
+			t.Fatalf("create event failed: %v", err)
+		}
+	}
+
+	srv.queueUserDigest(user, now)
+	srv.queueUserDigest(user, now)
+
+	var rows []models.NotificationOutbox
+	db.Where("user_id = ? AND event_type = ?", user.ID, notify.EventDigest).Find(&rows)
+	if len(rows) != 1 {
+		t.Fatalf("expected exactly one digest row, got %d", len(rows))
+	}
+	row := rows[0]
+	if row.DigestPeriod != "hourly:2026-03-10 09:00" || row.Channel != "webhook" {
+		t.Fatalf("unexpected digest row: %+v", row)
+	}
+	for _, want := range []string{"成功 2 次, 失败 1 次", "- 探索突破: 成功 1 / 失败 1", "- 签到: 成功 1 / 失败 0", "探索突破: 体力不足"} {
+		if !strings.Contains(row.Message, want) {
+			t.Fatalf("digest message missing %q:\n%s", want, row.Message)
+		}
+	}
+}
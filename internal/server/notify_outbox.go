@@ -0,0 +1,462 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"oas-cloud-go/internal/metrics"
+	"oas-cloud-go/internal/models"
+	"oas-cloud-go/internal/notify"
+	"oas-cloud-go/internal/tracing"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+)
+
+const (
+	notifyPollInterval   = 2 * time.Second
+	notifyClaimBatch     = 100
+	notifyStuckAfter     = 5 * time.Minute
+	notifyRateLimitDelay = 15 * time.Second // when a channel does not say how long
+	notifyLastErrorLimit = 500
+)
+
+// triggerTaskNotification queues notifications for a completed/failed job.
+func (s *Server) triggerTaskNotification(ctx context.Context, jobID uint, eventType string, message string) {
+	var job models.TaskJob
+	if err := s.db.WithContext(ctx).Select("id, manager_id, user_id, task_type").Where("id = ?", jobID).First(&job).Error; err != nil {
+		return
+	}
+
+	s.enqueueNotification(ctx, job.ManagerID, job.ID, notify.NotifyRequest{
+		UserID:    job.UserID,
+		TaskType:  job.TaskType,
+		EventType: eventType,
+		Message:   message,
+	})
+}
+
+// enqueueNotification writes one outbox row per channel the user has enabled.
+// Channels that cannot be used (e.g. email without SMTP) are recorded as
+// skipped so managers can see why nothing was delivered. The rows carry the
+// trace of ctx so that their delivery joins it.
+func (s *Server) enqueueNotification(ctx context.Context, managerID uint, jobID uint, req notify.NotifyRequest) {
+	db := s.db.WithContext(ctx)
+	var user models.User
+	if err := db.Select("id, notify_config").Where("id = ?", req.UserID).First(&user).Error; err != nil {
+		slog.Warn("failed to load user for notification", "user_id", req.UserID, "error", err)
+		return
+	}
+
+	rows := s.buildOutboxRows(managerID, jobID, "", req, user.NotifyConfig, time.Now().UTC())
+	if len(rows) == 0 {
+		return
+	}
+	traceParent := tracing.TraceParent(ctx)
+	for i := range rows {
+		rows[i].TraceParent = traceParent
+	}
+	if err := db.Create(&rows).Error; err != nil {
+		slog.Error("failed to enqueue notification", "user_id", req.UserID, "job_id", jobID, "error", err)
+		return
+	}
+	s.wakeNotifyDispatcher()
+}
+
+func (s *Server) buildOutboxRows(managerID uint, jobID uint, digestPeriod string, req notify.NotifyRequest, nc map[string]any, now time.Time) []models.NotificationOutbox {
+	targets := s.notifier.Targets(nc)
+	maxAttempts := s.cfg.NotifyMaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = 1
+	}
+	rows := make([]models.NotificationOutbox, 0, len(targets))
+	for _, target := range targets {
+		row := models.NotificationOutbox{
+			ManagerID:     managerID,
+			UserID:        req.UserID,
+			JobID:         jobID,
+			Channel:       target.Channel,
+			TaskType:      req.TaskType,
+			EventType:     req.EventType,
+			Message:       req.Message,
+			Status:        models.NotifyStatusPending,
+			MaxAttempts:   maxAttempts,
+			NextAttemptAt: now,
+			DigestPeriod:  digestPeriod,
+			CreatedAt:     now,
+			UpdatedAt:     now,
+		}
+		if target.Reason != "" {
+			row.Status = models.NotifyStatusSkipped
+			row.LastError = target.Reason
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+func (s *Server) wakeNotifyDispatcher() {
+	select {
+	case s.notifyWake <- struct{}{}:
+	default:
+	}
+}
+
+// notifyDispatcher claims due outbox rows and hands them to notifyWorker.
+func (s *Server) notifyDispatcher() {
+	ticker := time.NewTicker(notifyPollInterval)
+	defer ticker.Stop()
+	for {
+		s.recoverStuckNotifications(time.Now().UTC())
+		for s.dispatchDueNotifications(time.Now().UTC()) == notifyClaimBatch {
+		}
+		select {
+		case <-ticker.C:
+		case <-s.notifyWake:
+		}
+	}
+}
+
+// recoverStuckNotifications returns rows left in sending (e.g. by a crash
+// mid-delivery) to pending so they are retried.
+func (s *Server) recoverStuckNotifications(now time.Time) {
+	if err := s.db.Model(&models.NotificationOutbox{}).
+		Where("status = ? AND updated_at < ?", models.NotifyStatusSending, now.Add(-notifyStuckAfter)).
+		Updates(map[string]any{
+			"status":          models.NotifyStatusPending,
+			"next_attempt_at": now,
+			"updated_at":      now,
+		}).Error; err != nil {
+		slog.Warn("failed to recover stuck notifications", "error", err)
+	}
+}
+
+// dispatchDueNotifications claims up to notifyClaimBatch due rows and queues
+// them for delivery. It returns the number of candidate rows found.
+func (s *Server) dispatchDueNotifications(now time.Time) int {
+	var rows []models.NotificationOutbox
+	if err := s.db.Where("status = ? AND next_attempt_at <= ?", models.NotifyStatusPending, now).
+		Order("next_attempt_at ASC").
+		Limit(notifyClaimBatch).
+		Find(&rows).Error; err != nil {
+		slog.Warn("failed to load due notifications", "error", err)
+		return 0
+	}
+	// Stored at the database's precision so that workers can match it.
+	claimedAt := now.Truncate(time.Microsecond)
+	for _, row := range rows {
+		result := s.db.Model(&models.NotificationOutbox{}).
+			Where("id = ? AND status = ?", row.ID, models.NotifyStatusPending).
+			Updates(map[string]any{"status": models.NotifyStatusSending, "updated_at": claimedAt})
+		if result.Error != nil || result.RowsAffected == 0 {
+			continue
+		}
+		row.Status = models.NotifyStatusSending
+		row.UpdatedAt = claimedAt
+		s.notifyQueue <- row
+	}
+	return len(rows)
+}
+
+// notifyWorker delivers claimed outbox rows. A row is first taken over by
+// refreshing its updated_at, which only succeeds while it still carries the
+// claim it was queued with: a row that waited in notifyQueue long enough for
+// recoverStuckNotifications to hand it out again is dropped here instead of
+// being sent twice, and a taken row is not seen as stuck while it is sent.
+func (s *Server) notifyWorker() {
+	for row := range s.notifyQueue {
+		pickedAt := time.Now().UTC().Truncate(time.Microsecond)
+		result := s.db.Model(&models.NotificationOutbox{}).
+			Where("id = ? AND status = ? AND updated_at = ?", row.ID, models.NotifyStatusSending, row.UpdatedAt).
+			Update("updated_at", pickedAt)
+		if result.Error != nil || result.RowsAffected == 0 {
+			continue
+		}
+		row.UpdatedAt = pickedAt
+		s.deliverNotification(row)
+	}
+}
+
+// deliverNotification evaluates the user's notify rules and sends one row.
+// Outcomes filtered by the rules (task types, failures only, digest mode) are
+// skipped; digests and account alerts bypass those filters. Rows hitting quiet
+// hours are deferred to the end of the window.
+func (s *Server) deliverNotification(row models.NotificationOutbox) {
+	ctx, span := tracing.Start(tracing.WithTraceParent(context.Background(), row.TraceParent), "notify.deliver",
+		attribute.Int64("notify.outbox_id", int64(row.ID)),
+		attribute.String("notify.channel", row.Channel),
+		attribute.Int("notify.attempt", row.Attempts+1),
+	)
+	defer span.End()
+
+	var user models.User
+	if err := s.db.WithContext(ctx).Select("id, account_no, username, notify_config").
+		Where("id = ?", row.UserID).First(&user).Error; err != nil {
+		s.finishNotification(ctx, row, err, time.Now().UTC())
+		return
+	}
+
+	now := time.Now().UTC()
+	rules := notify.ParseRules(user.NotifyConfig)
+	if row.EventType != notify.EventDigest && row.EventType != notify.EventAlert {
+		if err := rules.Allows(row.TaskType, row.EventType); err != nil {
+			s.finishNotification(ctx, row, err, now)
+			return
+		}
+	}
+	if until, quiet := rules.QuietUntil(now); quiet {
+		s.deferNotification(ctx, row, until, now)
+		return
+	}
+
+	req := notify.NotifyRequest{
+		UserID:    user.ID,
+		AccountNo: user.AccountNo,
+		Username:  user.Username,
+		TaskType:  row.TaskType,
+		EventType: row.EventType,
+		Message:   row.Message,
+	}
+	sendCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	sendErr := s.notifier.SendTo(sendCtx, row.Channel, user.NotifyConfig, req)
+	cancel()
+	if sendErr != nil && !errors.Is(sendErr, notify.ErrRateLimited) {
+		slog.Warn("notification send failed", "outbox_id", row.ID, "user_id", row.UserID, "channel", row.Channel, "attempt", row.Attempts+1, "error", sendErr)
+	}
+	s.finishNotification(ctx, row, sendErr, time.Now().UTC())
+}
+
+// deferNotification puts a claimed row back to pending until the user's quiet
+// hours end, without consuming an attempt.
+func (s *Server) deferNotification(ctx context.Context, row models.NotificationOutbox, until time.Time, now time.Time) {
+	if err := s.db.WithContext(ctx).Model(&models.NotificationOutbox{}).
+		Where("id = ? AND status = ?", row.ID, models.NotifyStatusSending).
+		Updates(map[string]any{
+			"status":          models.NotifyStatusPending,
+			"next_attempt_at": until,
+			"last_error":      "deferred by quiet hours",
+			"updated_at":      now,
+		}).Error; err != nil {
+		slog.Error("failed to defer notification", "outbox_id", row.ID, "error", err)
+	}
+}
+
+// finishNotification records the outcome of one delivery attempt: sent,
+// skipped (nothing to retry), pending with backoff, or dead once the row has
+// used up its attempts. A rate-limited send waits out the limit without
+// using an attempt.
+func (s *Server) finishNotification(ctx context.Context, row models.NotificationOutbox, sendErr error, now time.Time) {
+	attempts := row.Attempts + 1
+	updates := map[string]any{
+		"attempts":   attempts,
+		"updated_at": now,
+	}
+	switch {
+	case sendErr == nil:
+		updates["status"] = models.NotifyStatusSent
+		updates["sent_at"] = now
+		updates["last_error"] = ""
+	case errors.Is(sendErr, notify.ErrRateLimited):
+		updates["attempts"] = row.Attempts
+		updates["status"] = models.NotifyStatusPending
+		updates["next_attempt_at"] = now.Add(notify.RetryAfter(sendErr, notifyRateLimitDelay))
+		updates["last_error"] = truncateNotifyError(sendErr)
+	case errors.Is(sendErr, notify.ErrChannelDisabled),
+		errors.Is(sendErr, notify.ErrFilteredByRule),
+		errors.Is(sendErr, gorm.ErrRecordNotFound):
+		updates["status"] = models.NotifyStatusSkipped
+		updates["last_error"] = truncateNotifyError(sendErr)
+	case attempts >= row.MaxAttempts:
+		updates["status"] = models.NotifyStatusDead
+		updates["last_error"] = truncateNotifyError(sendErr)
+	default:
+		updates["status"] = models.NotifyStatusPending
+		updates["next_attempt_at"] = now.Add(s.notifyRetryDelay(attempts))
+		updates["last_error"] = truncateNotifyError(sendErr)
+	}
+	if err := s.db.WithContext(ctx).Model(&models.NotificationOutbox{}).
+		Where("id = ? AND status = ?", row.ID, models.NotifyStatusSending).
+		Updates(updates).Error; err != nil {
+		slog.Error("failed to record notification result", "outbox_id", row.ID, "error", err)
+	}
+	result := updates["status"].(string)
+	if errors.Is(sendErr, notify.ErrRateLimited) {
+		result = "rate_limited"
+	} else if result == models.NotifyStatusPending {
+		result = "retry"
+	}
+	metrics.NotificationDeliveries.WithLabelValues(row.Channel, result).Inc()
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(attribute.String("notify.result", result))
+	if result == "retry" || result == models.NotifyStatusDead {
+		span.SetStatus(codes.Error, truncateNotifyError(sendErr))
+	}
+}
+
+// notifyRetryDelay returns the exponential backoff after the given number of
+// failed attempts, capped at NotifyRetryMax.
+func (s *Server) notifyRetryDelay(attempts int) time.Duration {
+	base := s.cfg.NotifyRetryBase
+	if base <= 0 {
+		base = 30 * time.Second
+	}
+	maxDelay := s.cfg.NotifyRetryMax
+	if maxDelay < base {
+		maxDelay = base
+	}
+	delay := base
+	for i := 1; i < attempts && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	return delay
+}
+
+func truncateNotifyError(err error) string {
+	msg := err.Error()
+	if len(msg) > notifyLastErrorLimit {
+		msg = msg[:notifyLastErrorLimit]
+	}
+	return msg
+}
+
+func notificationOutboxItem(row models.NotificationOutbox) gin.H {
+	return gin.H{
+		"id":              row.ID,
+		"job_id":          row.JobID,
+		"channel":         row.Channel,
+		"task_type":       row.TaskType,
+		"event_type":      row.EventType,
+		"message":         row.Message,
+		"status":          row.Status,
+		"attempts":        row.Attempts,
+		"max_attempts":    row.MaxAttempts,
+		"next_attempt_at": row.NextAttemptAt,
+		"last_error":      row.LastError,
+		"sent_at":         row.SentAt,
+		"created_at":      row.CreatedAt,
+	}
+}
+
+func (s *Server) queryUserNotificationsPaginated(c *gin.Context, userID uint) ([]gin.H, int64, paginationParams, error) {
+	pg := readPagination(c, 50, 200)
+	query := s.db.Model(&models.NotificationOutbox{}).Where("user_id = ?", userID)
+	if status := strings.TrimSpace(c.Query("status")); status != "" {
+		query = query.Where("status = ?", status)
+	}
+	if channel := strings.TrimSpace(c.Query("channel")); channel != "" {
+		query = query.Where("channel = ?", channel)
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, pg, err
+	}
+	var rows []models.NotificationOutbox
+	if err := query.Order("created_at DESC, id DESC").Offset(pg.Offset).Limit(pg.PageSize).Find(&rows).Error; err != nil {
+		return nil, 0, pg, err
+	}
+	items := make([]gin.H, 0, len(rows))
+	for _, row := range rows {
+		items = append(items, notificationOutboxItem(row))
+	}
+	return items, total, pg, nil
+}
+
+func (s *Server) userGetMeNotifications(c *gin.Context) {
+	userID := getUint(c, ctxUserIDKey)
+	items, total, pg, err := s.queryUserNotificationsPaginated(c, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "查询通知记录失败"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"items":     items,
+		"total":     total,
+		"page":      pg.Page,
+		"page_size": pg.PageSize,
+	})
+}
+
+func (s *Server) managerGetUserNotifications(c *gin.Context) {
+	managerID := getUint(c, ctxActorIDKey)
+	userID, ok := parseUintParam(c, "user_id")
+	if !ok {
+		return
+	}
+	if !s.managerOwnsUser(c, managerID, userID) {
+		return
+	}
+
+	var user models.User
+	if err := s.db.Select("id, notify_config").Where("id = ?", userID).First(&user).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "查询用户失败"})
+		return
+	}
+	items, total, pg, err := s.queryUserNotificationsPaginated(c, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "查询通知记录失败"})
+		return
+	}
+	targets := s.notifier.Targets(user.NotifyConfig)
+	if targets == nil {
+		targets = []notify.Target{}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"targets":   targets,
+		"items":     items,
+		"total":     total,
+		"page":      pg.Page,
+		"page_size": pg.PageSize,
+	})
+}
+
+func (s *Server) managerRetryUserNotification(c *gin.Context) {
+	managerID := getUint(c, ctxActorIDKey)
+	userID, ok := parseUintParam(c, "user_id")
+	if !ok {
+		return
+	}
+	outboxID, ok := parseUintParam(c, "id")
+	if !ok {
+		return
+	}
+	if !s.managerOwnsUser(c, managerID, userID) {
+		return
+	}
+
+	now := time.Now().UTC()
+	result := s.db.Model(&models.NotificationOutbox{}).
+		Where("id = ? AND user_id = ? AND status IN ?", outboxID, userID,
+			[]string{models.NotifyStatusDead, models.NotifyStatusSkipped}).
+		Updates(map[string]any{
+			"status":          models.NotifyStatusPending,
+			"attempts":        0,
+			"next_attempt_at": now,
+			"updated_at":      now,
+		})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "重试通知失败"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"detail": "通知记录不存在或不可重试"})
+		return
+	}
+	s.wakeNotifyDispatcher()
+
+	s.audit(models.ActorTypeManager, managerID, "manager_retry_notification", "notification_outbox", outboxID, datatypes.JSONMap{
+		"user_id": userID,
+	}, c.ClientIP())
+	c.JSON(http.StatusOK, gin.H{"message": "已重新加入发送队列"})
+}
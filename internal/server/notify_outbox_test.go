@@ -0,0 +1,274 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"oas-cloud-go/internal/models"
+	"oas-cloud-go/internal/notify"
+
+	"gorm.io/datatypes"
+)
+
+func createNotifyTestUser(t *testing.T, srv *Server, managerID uint, accountNo string, notifyConfig datatypes.JSONMap) models.User {
+	t.Helper()
+	now := time.Now().UTC()
+	user := models.User{
+		AccountNo:    accountNo,
+		ManagerID:    managerID,
+		LoginID:      accountNo,
+		UserType:     models.UserTypeDaily,
+		Status:       models.UserStatusActive,
+		ExpiresAt:    ptrTime(now.Add(7 * 24 * time.Hour)),
+		NotifyConfig: notifyConfig,
+		CreatedBy:    "manager_create",
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	}
+	if err := srv.db.Create(&user).Error; err != nil {
+		t.Fatalf("create user failed: %v", err)
+	}
+	return user
+}
+
+func TestTaskNotificationDeliveredThroughOutbox(t *testing.T) {
+	srv, db := setupTestServer(t)
+
+	var mu sync.Mutex
+	var bodies []string
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		bodies = append(bodies, string(body))
+		mu.Unlock()
+	}))
+	defer hook.Close()
+
+	manager := createActiveManager(t, db, "manager_outbox_send", "passwordOutbox123")
+	user := createNotifyTestUser(t, srv, manager.ID, "U_OUTBOX_SEND_001", datatypes.JSONMap{
+		"email_enabled": true,
+		"email":         "user@example.com",
+		"channels": map[string]any{
+			"webhook": map[string]any{"enabled": true, "url": hook.URL},
+		},
+	})
+	job := models.TaskJob{
+		ManagerID:   manager.ID,
+		UserID:      user.ID,
+		TaskType:    "签到",
+		ScheduledAt: time.Now().UTC(),
+		Status:      models.JobStatusFailed,
+		CreatedAt:   time.Now().UTC(),
+		UpdatedAt:   time.Now().UTC(),
+	}
+	if err := db.Create(&job).Error; err != nil {
+		t.Fatalf("create job failed: %v", err)
+	}
+
+	srv.triggerTaskNotification(context.Background(), job.ID, "fail", "boom")
+
+	var rows []models.NotificationOutbox
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		rows = nil
+		if err := db.Where("user_id = ?", user.ID).Order("id ASC").Find(&rows).Error; err != nil {
+			t.Fatalf("load outbox failed: %v", err)
+		}
+		if len(rows) == 2 && rows[1].Status == models.NotifyStatusSent {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("webhook notification was not delivered: %+v", rows)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// Email is enabled by the user but SMTP is not configured in tests.
+	if rows[0].Channel != "email" || rows[0].Status != models.NotifyStatusSkipped || rows[0].LastError == "" {
+		t.Fatalf("expected skipped email row with reason, got %+v", rows[0])
+	}
+	if rows[1].Channel != "webhook" || rows[1].Attempts != 1 || rows[1].SentAt == nil || rows[1].JobID != job.ID {
+		t.Fatalf("unexpected webhook row: %+v", rows[1])
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(bodies) != 1 || !strings.Contains(bodies[0], "U_OUTBOX_SEND_001") {
+		t.Fatalf("unexpected webhook deliveries: %v", bodies)
+	}
+}
+
+func TestFinishNotificationRetriesThenDeadLetters(t *testing.T) {
+	srv, db := setupTestServer(t)
+	manager := createActiveManager(t, db, "manager_outbox_retry", "passwordOutbox123")
+	user := createNotifyTestUser(t, srv, manager.ID, "U_OUTBOX_RETRY_001", datatypes.JSONMap{})
+
+	now := time.Now().UTC()
+	row := models.NotificationOutbox{
+		ManagerID:     manager.ID,
+		UserID:        user.ID,
+		Channel:       "webhook",
+		EventType:     "fail",
+		Status:        models.NotifyStatusSending,
+		MaxAttempts:   2,
+		NextAttemptAt: now,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+	if err := db.Create(&row).Error; err != nil {
+		t.Fatalf("create outbox row failed: %v", err)
+	}
+
+	srv.finishNotification(context.Background(), row, errors.New("webhook http status 502"), now)
+	var stored models.NotificationOutbox
+	db.First(&stored, row.ID)
+	if stored.Status != models.NotifyStatusPending || stored.Attempts != 1 {
+		t.Fatalf("expected pending retry, got status=%s attempts=%d", stored.Status, stored.Attempts)
+	}
+	if got := stored.NextAttemptAt.Sub(now); got != 30*time.Second {
+		t.Fatalf("expected 30s backoff, got %s", got)
+	}
+	if stored.LastError != "webhook http status 502" {
+		t.Fatalf("unexpected last_error: %q", stored.LastError)
+	}
+
+	// Simulate the dispatcher claiming the row again.
+	db.Model(&stored).Update("status", models.NotifyStatusSending)
+	srv.finishNotification(context.Background(), stored, errors.New("webhook http status 502"), now)
+	db.First(&stored, row.ID)
+	if stored.Status != models.NotifyStatusDead || stored.Attempts != 2 {
+		t.Fatalf("expected dead after max attempts, got status=%s attempts=%d", stored.Status, stored.Attempts)
+	}
+
+	// A rate-limited send waits for the limiter and keeps its attempts.
+	db.Model(&stored).Updates(map[string]any{"status": models.NotifyStatusSending, "attempts": 1})
+	limited := &notify.RateLimitedError{RetryAfter: 12 * time.Second}
+	srv.finishNotification(context.Background(), models.NotificationOutbox{ID: row.ID, Attempts: 1, MaxAttempts: 2}, limited, now)
+	db.First(&stored, row.ID)
+	if stored.Status != models.NotifyStatusPending || stored.Attempts != 1 || stored.NextAttemptAt.Sub(now) != 12*time.Second {
+		t.Fatalf("rate limited send should wait without using an attempt, got status=%s attempts=%d next=%s",
+			stored.Status, stored.Attempts, stored.NextAttemptAt.Sub(now))
+	}
+}
+
+func TestNotifyWorkerDropsRecoveredClaim(t *testing.T) {
+	srv, db := setupTestServer(t)
+	manager := createActiveManager(t, db, "manager_outbox_stale", "passwordOutbox123")
+	user := createNotifyTestUser(t, srv, manager.ID, "U_OUTBOX_STALE_001", datatypes.JSONMap{})
+
+	past := time.Now().UTC().Add(-time.Hour)
+	row := models.NotificationOutbox{
+		ManagerID:     manager.ID,
+		UserID:        user.ID,
+		Channel:       "webhook",
+		EventType:     "fail",
+		Status:        models.NotifyStatusPending,
+		MaxAttempts:   2,
+		NextAttemptAt: past,
+		CreatedAt:     past,
+		UpdatedAt:     past,
+	}
+	if err := db.Create(&row).Error; err != nil {
+		t.Fatalf("create outbox row failed: %v", err)
+	}
+	// Claim the row without a worker to take it, as if the queue were backed up.
+	claimedAt := past.Add(time.Minute).Truncate(time.Microsecond)
+	db.Model(&row).Updates(map[string]any{"status": models.NotifyStatusSending, "updated_at": claimedAt})
+	srv.recoverStuckNotifications(time.Now().UTC())
+	db.Model(&row).Updates(map[string]any{"status": models.NotifyStatusSending, "updated_at": time.Now().UTC().Truncate(time.Microsecond)})
+
+	// The first, stale copy reaches the worker; it must not be delivered.
+	queue := make(chan models.NotificationOutbox, 1)
+	queue <- models.NotificationOutbox{ID: row.ID, UserID: user.ID, Channel: "webhook", Status: models.NotifyStatusSending, MaxAttempts: 2, UpdatedAt: claimedAt}
+	close(queue)
+	stale := &Server{db: srv.db, notifyQueue: queue, notifier: srv.notifier, cfg: srv.cfg}
+	stale.notifyWorker()
+
+	var stored models.NotificationOutbox
+	db.First(&stored, row.ID)
+	if stored.Status != models.NotifyStatusSending || stored.Attempts != 0 {
+		t.Fatalf("stale claim should be dropped, got status=%s attempts=%d", stored.Status, stored.Attempts)
+	}
+}
+
+func TestNotifyRetryDelayBackoff(t *testing.T) {
+	srv, _ := setupTestServer(t)
+	srv.cfg.NotifyRetryBase = 10 * time.Second
+	srv.cfg.NotifyRetryMax = time.Minute
+	want := []time.Duration{10 * time.Second, 20 * time.Second, 40 * time.Second, time.Minute, time.Minute}
+	for i, expected := range want {
+		if got := srv.notifyRetryDelay(i + 1); got != expected {
+			t.Fatalf("attempt %d: expected %s, got %s", i+1, expected, got)
+		}
+	}
+}
+
+func TestManagerUserNotificationHistoryAndRetry(t *testing.T) {
+	srv, db := setupTestServer(t)
+	manager := createActiveManager(t, db, "manager_outbox_list", "passwordOutbox123")
+	createActiveManager(t, db, "manager_outbox_other", "passwordOutbox123")
+	user := createNotifyTestUser(t, srv, manager.ID, "U_OUTBOX_LIST_001", datatypes.JSONMap{
+		"email_enabled": true,
+		"email":         "user@example.com",
+	})
+
+	now := time.Now().UTC()
+	dead := models.NotificationOutbox{
+		ManagerID:     manager.ID,
+		UserID:        user.ID,
+		Channel:       "miaotixing",
+		EventType:     "fail",
+		Status:        models.NotifyStatusDead,
+		Attempts:      5,
+		MaxAttempts:   5,
+		NextAttemptAt: now,
+		LastError:     "miaotixing error code=101 msg=invalid id",
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+	if err := db.Create(&dead).Error; err != nil {
+		t.Fatalf("create outbox row failed: %v", err)
+	}
+
+	token := loginManagerToken(t, srv, "manager_outbox_list", "passwordOutbox123")
+	listResp := doJSONRequest(t, srv.router, http.MethodGet, "/api/v1/manager/users/"+itoa(user.ID)+"/notifications?status=dead", nil, token)
+	if listResp.Code != http.StatusOK {
+		t.Fatalf("list notifications failed, status=%d body=%s", listResp.Code, listResp.Body.String())
+	}
+	body := decodeBodyMap(t, listResp.Body.Bytes())
+	items, _ := body["items"].([]any)
+	if len(items) != 1 || items[0].(map[string]any)["last_error"] != dead.LastError {
+		t.Fatalf("unexpected items: %v", body["items"])
+	}
+	targets, _ := body["targets"].([]any)
+	if len(targets) != 1 || targets[0].(map[string]any)["channel"] != "email" || targets[0].(map[string]any)["reason"] == "" {
+		t.Fatalf("expected email target with reason, got %v", body["targets"])
+	}
+
+	otherToken := loginManagerToken(t, srv, "manager_outbox_other", "passwordOutbox123")
+	forbidden := doJSONRequest(t, srv.router, http.MethodGet, "/api/v1/manager/users/"+itoa(user.ID)+"/notifications", nil, otherToken)
+	if forbidden.Code != http.StatusForbidden {
+		t.Fatalf("other manager should be forbidden, got %d", forbidden.Code)
+	}
+
+	retryResp := doJSONRequest(t, srv.router, http.MethodPost, "/api/v1/manager/users/"+itoa(user.ID)+"/notifications/"+itoa(dead.ID)+"/retry", nil, token)
+	if retryResp.Code != http.StatusOK {
+		t.Fatalf("retry failed, status=%d body=%s", retryResp.Code, retryResp.Body.String())
+	}
+	var stored models.NotificationOutbox
+	db.First(&stored, dead.ID)
+	if stored.Status == models.NotifyStatusDead || stored.Attempts >= stored.MaxAttempts {
+		t.Fatalf("retry should requeue the row, got status=%s attempts=%d", stored.Status, stored.Attempts)
+	}
+
+	again := doJSONRequest(t, srv.router, http.MethodPost, "/api/v1/manager/users/"+itoa(user.ID)+"/notifications/999999/retry", nil, token)
+	if again.Code != http.StatusNotFound {
+		t.Fatalf("retry of unknown row should 404, got %d", again.Code)
+	}
+}
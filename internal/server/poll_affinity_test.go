@@ -0,0 +1,127 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"oas-cloud-go/internal/models"
+
+	"gorm.io/datatypes"
+)
+
+// clearRateLimits lets a test poll repeatedly within one rate limit window.
+func clearRateLimits(srv *Server) {
+	store := srv.redisStore.(*inMemoryStore)
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.rateLimits = map[string]rateLimitRecord{}
+}
+
+func loginAgentToken(t *testing.T, srv *Server, username, password, nodeID string) string {
+	t.Helper()
+	resp := doJSONRequest(t, srv.router, http.MethodPost, "/api/v1/agent/auth/login", map[string]any{
+		"username": username,
+		"password": password,
+		"node_id":  nodeID,
+	}, "")
+	if resp.Code != http.StatusOK {
+		t.Fatalf("agent login failed, status=%d body=%s", resp.Code, resp.Body.String())
+	}
+	return extractTokenFromBody(t, resp.Body.Bytes())
+}
+
+func pollAs(t *testing.T, srv *Server, token string, body map[string]any) map[string]any {
+	t.Helper()
+	clearRateLimits(srv)
+	resp := doJSONRequest(t, srv.router, http.MethodPost, "/api/v1/agent/poll-jobs", body, token)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("poll failed, status=%d body=%s", resp.Code, resp.Body.String())
+	}
+	return decodeBodyMap(t, resp.Body.Bytes())
+}
+
+func TestPollKeepsAccountOnOneNode(t *testing.T) {
+	srv, db := setupTestServer(t)
+	manager := createActiveManager(t, db, "manager_affinity", "passwordAff123")
+	user := createNotifyTestUser(t, srv, manager.ID, "U_AFFINITY_001", datatypes.JSONMap{})
+	other := createNotifyTestUser(t, srv, manager.ID, "U_AFFINITY_002", datatypes.JSONMap{})
+	tokenA := loginAgentToken(t, srv, "manager_affinity", "passwordAff123", "node-affinity-a")
+	tokenB := loginAgentToken(t, srv, "manager_affinity", "passwordAff123", "node-affinity-b")
+
+	at := time.Now().UTC().Add(-time.Minute)
+	first := createAlertTestJob(t, srv, user, "悬赏", models.JobStatusPending, at)
+	second := createAlertTestJob(t, srv, user, "弥助", models.JobStatusPending, at)
+	otherJob := createAlertTestJob(t, srv, other, "悬赏", models.JobStatusPending, at)
+	db.Model(&models.TaskJob{}).Where("id = ?", first.ID).Update("priority", 90)
+	db.Model(&models.TaskJob{}).Where("id = ?", second.ID).Update("priority", 80)
+
+	jobs := pollAs(t, srv, tokenA, map[string]any{"node_id": "node-affinity-a", "limit": 1})["jobs"].([]any)
+	if len(jobs) != 1 || jobs[0].(map[string]any)["ID"] != float64(first.ID) {
+		t.Fatalf("node A should get the highest priority job, got %v", jobs)
+	}
+
+	jobs = pollAs(t, srv, tokenB, map[string]any{"node_id": "node-affinity-b", "limit": 10})["jobs"].([]any)
+	if len(jobs) != 1 || jobs[0].(map[string]any)["ID"] != float64(otherJob.ID) {
+		t.Fatalf("node B should only get the other account's job, got %v", jobs)
+	}
+
+	jobs = pollAs(t, srv, tokenA, map[string]any{"node_id": "node-affinity-a", "limit": 10})["jobs"].([]any)
+	if len(jobs) != 1 || jobs[0].(map[string]any)["ID"] != float64(second.ID) {
+		t.Fatalf("node A should get the account's remaining job, got %v", jobs)
+	}
+
+	// Once node A is done, the account is free for any node.
+	for _, jobID := range []uint{first.ID, second.ID} {
+		clearRateLimits(srv)
+		resp := doJSONRequest(t, srv.router, http.MethodPost, "/api/v1/agent/jobs/"+itoa(jobID)+"/complete", map[string]any{
+			"node_id": "node-affinity-a",
+		}, tokenA)
+		if resp.Code != http.StatusOK {
+			t.Fatalf("complete failed, status=%d body=%s", resp.Code, resp.Body.String())
+		}
+	}
+	third := createAlertTestJob(t, srv, user, "勾协", models.JobStatusPending, at)
+	jobs = pollAs(t, srv, tokenB, map[string]any{"node_id": "node-affinity-b", "limit": 10})["jobs"].([]any)
+	if len(jobs) != 1 || jobs[0].(map[string]any)["ID"] != float64(third.ID) {
+		t.Fatalf("node B should get the account after node A finished, got %v", jobs)
+	}
+}
+
+func TestPollUserBatchMode(t *testing.T) {
+	srv, db := setupTestServer(t)
+	manager := createActiveManager(t, db, "manager_batch", "passwordBatch123")
+	first := createNotifyTestUser(t, srv, manager.ID, "U_BATCH_001", datatypes.JSONMap{})
+	second := createNotifyTestUser(t, srv, manager.ID, "U_BATCH_002", datatypes.JSONMap{})
+	token := loginAgentToken(t, srv, "manager_batch", "passwordBatch123", "node-batch")
+
+	at := time.Now().UTC().Add(-time.Minute)
+	top := createAlertTestJob(t, srv, first, "悬赏", models.JobStatusPending, at)
+	db.Model(&models.TaskJob{}).Where("id = ?", top.ID).Update("priority", 99)
+	for _, taskType := range []string{"弥助", "勾协"} {
+		createAlertTestJob(t, srv, first, taskType, models.JobStatusPending, at)
+	}
+	createAlertTestJob(t, srv, second, "悬赏", models.JobStatusPending, at)
+
+	body := pollAs(t, srv, token, map[string]any{"node_id": "node-batch", "mode": "user_batch"})
+	batches := body["batches"].([]any)
+	if len(batches) != 1 {
+		t.Fatalf("default batch poll should return one account, got %v", batches)
+	}
+	batch := batches[0].(map[string]any)
+	if batch["user_id"] != float64(first.ID) || len(batch["jobs"].([]any)) != 3 {
+		t.Fatalf("batch should hold every due job of the top account, got %v", batch)
+	}
+	if jobs := body["jobs"].([]any); len(jobs) != 3 {
+		t.Fatalf("jobs should list the same leased jobs, got %v", jobs)
+	}
+
+	clearRateLimits(srv)
+	resp := doJSONRequest(t, srv.router, http.MethodPost, "/api/v1/agent/poll-jobs", map[string]any{
+		"node_id": "node-batch",
+		"mode":    "accounts",
+	}, token)
+	if resp.Code != http.StatusBadRequest {
+		t.Fatalf("unknown mode should be rejected, status=%d", resp.Code)
+	}
+}
@@ -0,0 +1,323 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"oas-cloud-go/internal/models"
+	"oas-cloud-go/internal/scheduler"
+	"oas-cloud-go/internal/taskmeta"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+)
+
+var restReasonLabels = map[string]string{
+	scheduler.RestReasonDateOff: "休息日期",
+	scheduler.RestReasonDayOff:  "每周休息日",
+	scheduler.RestReasonDaily:   "每日休息",
+	scheduler.RestReasonPeriod:  "休息时段",
+}
+
+var restSourceLabels = map[string]string{
+	scheduler.RestSourceUser:    "用户设置",
+	scheduler.RestSourceManager: "管理员默认",
+	scheduler.RestSourceGlobal:  "系统默认",
+}
+
+// restStates evaluates the effective rest policy of each user at now.
+func (s *Server) restStates(userIDs []uint, now time.Time) (map[uint]scheduler.RestState, error) {
+	states := make(map[uint]scheduler.RestState, len(userIDs))
+	if len(userIDs) == 0 {
+		return states, nil
+	}
+	var users []models.User
+	if err := s.db.Select("id, manager_id, rest_config").Where("id IN ?", userIDs).Find(&users).Error; err != nil {
+		return nil, err
+	}
+	policies, err := scheduler.LoadRestPolicies(s.db, users, s.globalRest, s.cfg.SchedulerSpread)
+	if err != nil {
+		return nil, err
+	}
+	for _, user := range users {
+		states[user.ID] = policies[user.ID].StateAt(user.ID, now)
+	}
+	return states, nil
+}
+
+// restingPendingUsers returns the users of a manager that have pending jobs
+// but are resting at now, so their jobs are held instead of leased.
+func (s *Server) restingPendingUsers(managerID uint, now time.Time) (map[uint]scheduler.RestState, error) {
+	var userIDs []uint
+	if err := s.db.Model(&models.TaskJob{}).
+		Where("manager_id = ? AND status = ?", managerID, models.JobStatusPending).
+		Distinct("user_id").
+		Pluck("user_id", &userIDs).Error; err != nil {
+		return nil, err
+	}
+	states, err := s.restStates(userIDs, now)
+	if err != nil {
+		return nil, err
+	}
+	for userID, state := range states {
+		if !state.Resting {
+			delete(states, userID)
+		}
+	}
+	return states, nil
+}
+
+func restStateItem(state scheduler.RestState) gin.H {
+	item := gin.H{
+		"resting": state.Resting,
+		"source":  state.Source,
+		"reason":  state.Reason,
+		"until":   nil,
+		"message": "",
+	}
+	if state.Resting {
+		item["until"] = state.Until
+		item["message"] = restHoldMessage(state)
+	}
+	return item
+}
+
+func restHoldMessage(state scheduler.RestState) string {
+	return fmt.Sprintf("休息中（%s，%s），预计 %s 恢复",
+		restSourceLabels[state.Source], restReasonLabels[state.Reason],
+		state.Until.In(taskmeta.BJLoc).Format("01-02 15:04"))
+}
+
+func (s *Server) userRestConfigView(user models.User, now time.Time) (gin.H, error) {
+	policies, err := scheduler.LoadRestPolicies(s.db, []models.User{user}, s.globalRest, s.cfg.SchedulerSpread)
+	if err != nil {
+		return nil, err
+	}
+	policy := policies[user.ID]
+	restConfig := user.RestConfig
+	if restConfig == nil {
+		restConfig = datatypes.JSONMap{}
+	}
+	return gin.H{
+		"user_id":     user.ID,
+		"rest_config": restConfig,
+		"effective": gin.H{
+			"source":                policy.Source,
+			"rest_config":           policy.Config.Map(),
+			"spread_offset_minutes": int(policy.Offset / time.Minute),
+		},
+		"state": restStateItem(policy.StateAt(user.ID, now)),
+	}, nil
+}
+
+// saveUserRestConfig validates and stores a user's rest config and returns
+// the refreshed view. The error result is already written to the response.
+func (s *Server) saveUserRestConfig(c *gin.Context, user models.User) (gin.H, bool) {
+	var req putRestConfigRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"detail": err.Error()})
+		return nil, false
+	}
+	normalized, err := scheduler.ValidateRestConfig(req.RestConfig)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"detail": err.Error()})
+		return nil, false
+	}
+	now := time.Now().UTC()
+	if err := s.db.Model(&models.User{}).Where("id = ?", user.ID).Updates(map[string]any{
+		"rest_config": datatypes.JSONMap(normalized),
+		"updated_at":  now,
+	}).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "更新休息配置失败"})
+		return nil, false
+	}
+	// Due tasks held back for the old rest are looked at again.
+	_, _ = scheduler.RebuildDueIndex(s.db, now, func(q *gorm.DB) *gorm.DB {
+		return q.Where("user_id = ?", user.ID)
+	})
+	user.RestConfig = datatypes.JSONMap(normalized)
+	view, err := s.userRestConfigView(user, now)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "加载休息配置失败"})
+		return nil, false
+	}
+	return view, true
+}
+
+func (s *Server) managerGetRestConfig(c *gin.Context) {
+	managerID := getUint(c, ctxActorIDKey)
+	var manager models.Manager
+	if err := s.db.Select("id, rest_config").Where("id = ?", managerID).First(&manager).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"detail": "管理员不存在"})
+		return
+	}
+	restConfig := manager.RestConfig
+	if restConfig == nil {
+		restConfig = datatypes.JSONMap{}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"rest_config": restConfig,
+		"global":      s.globalRest.Map(),
+	})
+}
+
+func (s *Server) managerPutRestConfig(c *gin.Context) {
+	managerID := getUint(c, ctxActorIDKey)
+	var req putRestConfigRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"detail": err.Error()})
+		return
+	}
+	normalized, err := scheduler.ValidateRestConfig(req.RestConfig)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"detail": err.Error()})
+		return
+	}
+	now := time.Now().UTC()
+	if err := s.db.Model(&models.Manager{}).Where("id = ?", managerID).Updates(map[string]any{
+		"rest_config": datatypes.JSONMap(normalized),
+		"updated_at":  now,
+	}).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "更新默认休息配置失败"})
+		return
+	}
+	_, _ = scheduler.RebuildDueIndex(s.db, now, func(q *gorm.DB) *gorm.DB {
+		return q.Where("user_id IN (?)", s.db.Model(&models.User{}).Select("id").Where("manager_id = ?", managerID))
+	})
+	s.audit(models.ActorTypeManager, managerID, "manager_update_rest_config", "manager", managerID, datatypes.JSONMap{
+		"rest_config": normalized,
+	}, c.ClientIP())
+	c.JSON(http.StatusOK, gin.H{
+		"rest_config": normalized,
+		"global":      s.globalRest.Map(),
+	})
+}
+
+func (s *Server) managerGetUserRestConfig(c *gin.Context) {
+	managerID := getUint(c, ctxActorIDKey)
+	userID, ok := parseUintParam(c, "user_id")
+	if !ok {
+		return
+	}
+	if !s.managerOwnsUser(c, managerID, userID) {
+		return
+	}
+	var user models.User
+	if err := s.db.Select("id, manager_id, rest_config").Where("id = ?", userID).First(&user).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"detail": "用户不存在"})
+		return
+	}
+	view, err := s.userRestConfigView(user, time.Now().UTC())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "加载休息配置失败"})
+		return
+	}
+	c.JSON(http.StatusOK, view)
+}
+
+func (s *Server) managerPutUserRestConfig(c *gin.Context) {
+	managerID := getUint(c, ctxActorIDKey)
+	userID, ok := parseUintParam(c, "user_id")
+	if !ok {
+		return
+	}
+	if !s.managerOwnsUser(c, managerID, userID) {
+		return
+	}
+	var user models.User
+	if err := s.db.Select("id, manager_id, rest_config").Where("id = ?", userID).First(&user).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"detail": "用户不存在"})
+		return
+	}
+	view, ok := s.saveUserRestConfig(c, user)
+	if !ok {
+		return
+	}
+	s.audit(models.ActorTypeManager, managerID, "manager_update_user_rest_config", "user", userID, datatypes.JSONMap{
+		"rest_config": view["rest_config"],
+	}, c.ClientIP())
+	c.JSON(http.StatusOK, view)
+}
+
+func (s *Server) userGetMeRestConfig(c *gin.Context) {
+	userID := getUint(c, ctxUserIDKey)
+	var user models.User
+	if err := s.db.Select("id, manager_id, rest_config").Where("id = ?", userID).First(&user).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"detail": "用户不存在"})
+		return
+	}
+	view, err := s.userRestConfigView(user, time.Now().UTC())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "加载休息配置失败"})
+		return
+	}
+	c.JSON(http.StatusOK, view)
+}
+
+func (s *Server) userPutMeRestConfig(c *gin.Context) {
+	userID := getUint(c, ctxUserIDKey)
+	var user models.User
+	if err := s.db.Select("id, manager_id, rest_config").Where("id = ?", userID).First(&user).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"detail": "用户不存在"})
+		return
+	}
+	view, ok := s.saveUserRestConfig(c, user)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, view)
+}
+
+// managerSpread returns the spread window of a manager's users.
+func (s *Server) managerSpread(managerID uint) time.Duration {
+	var manager models.Manager
+	if err := s.db.Select("id, schedule_spread").Where("id = ?", managerID).First(&manager).Error; err != nil {
+		return taskmeta.ResolveSpread(nil, s.cfg.SchedulerSpread)
+	}
+	return taskmeta.ResolveSpread(manager.ScheduleSpread, s.cfg.SchedulerSpread)
+}
+
+func (s *Server) scheduleSpreadView(manager models.Manager) gin.H {
+	return gin.H{
+		"spread_minutes":           manager.ScheduleSpread,
+		"effective_spread_minutes": int(taskmeta.ResolveSpread(manager.ScheduleSpread, s.cfg.SchedulerSpread) / time.Minute),
+		"global_spread_minutes":    int(taskmeta.ResolveSpread(nil, s.cfg.SchedulerSpread) / time.Minute),
+	}
+}
+
+func (s *Server) managerGetScheduleSpread(c *gin.Context) {
+	managerID := getUint(c, ctxActorIDKey)
+	var manager models.Manager
+	if err := s.db.Select("id, schedule_spread").Where("id = ?", managerID).First(&manager).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"detail": "管理员不存在"})
+		return
+	}
+	c.JSON(http.StatusOK, s.scheduleSpreadView(manager))
+}
+
+func (s *Server) managerPutScheduleSpread(c *gin.Context) {
+	managerID := getUint(c, ctxActorIDKey)
+	var req putScheduleSpreadRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"detail": err.Error()})
+		return
+	}
+	maxMinutes := int(taskmeta.MaxScheduleSpread / time.Minute)
+	if req.SpreadMinutes != nil && (*req.SpreadMinutes < 0 || *req.SpreadMinutes > maxMinutes) {
+		c.JSON(http.StatusBadRequest, gin.H{"detail": fmt.Sprintf("spread_minutes 必须是 0-%d 的整数", maxMinutes)})
+		return
+	}
+	if err := s.db.Model(&models.Manager{}).Where("id = ?", managerID).Updates(map[string]any{
+		"schedule_spread": req.SpreadMinutes,
+		"updated_at":      time.Now().UTC(),
+	}).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "更新错峰配置失败"})
+		return
+	}
+	s.audit(models.ActorTypeManager, managerID, "manager_update_schedule_spread", "manager", managerID, datatypes.JSONMap{
+		"spread_minutes": req.SpreadMinutes,
+	}, c.ClientIP())
+	c.JSON(http.StatusOK, s.scheduleSpreadView(models.Manager{ID: managerID, ScheduleSpread: req.SpreadMinutes}))
+}
@@ -0,0 +1,237 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"oas-cloud-go/internal/models"
+	"oas-cloud-go/internal/taskmeta"
+
+	"gorm.io/datatypes"
+)
+
+var everyDayOff = map[string]any{
+	"enabled":   true,
+	"days_off":  []any{0, 1, 2, 3, 4, 5, 6},
+	"mode":      "fixed",
+	"dates_off": []any{},
+}
+
+func TestManagerRestConfigDefaultsAndUserOverride(t *testing.T) {
+	srv, db := setupTestServer(t)
+	manager := createActiveManager(t, db, "manager_rest_cfg", "passwordRest123")
+	token := loginManagerToken(t, srv, "manager_rest_cfg", "passwordRest123")
+	user := createNotifyTestUser(t, srv, manager.ID, "U_REST_CFG_001", datatypes.JSONMap{})
+
+	resp := doJSONRequest(t, srv.router, http.MethodPut, "/api/v1/manager/rest-config", map[string]any{
+		"rest_config": map[string]any{"enabled": true, "mode": "weekly"},
+	}, token)
+	if resp.Code != http.StatusBadRequest {
+		t.Fatalf("invalid mode should be rejected, status=%d body=%s", resp.Code, resp.Body.String())
+	}
+
+	resp = doJSONRequest(t, srv.router, http.MethodPut, "/api/v1/manager/rest-config", map[string]any{
+		"rest_config": map[string]any{"enabled": true, "periods": []any{map[string]any{"start": "23:00", "end": "07:00"}}},
+	}, token)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("put manager rest config failed, status=%d body=%s", resp.Code, resp.Body.String())
+	}
+
+	userPath := "/api/v1/manager/users/" + itoa(user.ID) + "/rest-config"
+	resp = doJSONRequest(t, srv.router, http.MethodGet, userPath, nil, token)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("get user rest config failed, status=%d body=%s", resp.Code, resp.Body.String())
+	}
+	effective := decodeBodyMap(t, resp.Body.Bytes())["effective"].(map[string]any)
+	if effective["source"] != "manager" {
+		t.Fatalf("user without own config should inherit the manager default: %v", effective)
+	}
+
+	resp = doJSONRequest(t, srv.router, http.MethodPut, userPath, map[string]any{"rest_config": everyDayOff}, token)
+	if resp.Code != http.StatusBadRequest {
+		t.Fatalf("resting every day should be rejected, status=%d body=%s", resp.Code, resp.Body.String())
+	}
+	resp = doJSONRequest(t, srv.router, http.MethodPut, userPath, map[string]any{
+		"rest_config": map[string]any{"enabled": false},
+	}, token)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("put user rest config failed, status=%d body=%s", resp.Code, resp.Body.String())
+	}
+	body := decodeBodyMap(t, resp.Body.Bytes())
+	effective = body["effective"].(map[string]any)
+	state := body["state"].(map[string]any)
+	if effective["source"] != "user" || state["resting"] != false {
+		t.Fatalf("disabled user config should override the default: %v", body)
+	}
+
+	other := createActiveManager(t, db, "manager_rest_other", "passwordRest123")
+	otherToken := loginManagerToken(t, srv, other.Username, "passwordRest123")
+	resp = doJSONRequest(t, srv.router, http.MethodGet, userPath, nil, otherToken)
+	if resp.Code != http.StatusNotFound && resp.Code != http.StatusForbidden {
+		t.Fatalf("other manager should not read the user, status=%d", resp.Code)
+	}
+}
+
+func TestUserMeRestConfig(t *testing.T) {
+	srv, db := setupTestServer(t)
+	manager := createActiveManager(t, db, "manager_rest_me", "passwordRest123")
+	user := createNotifyTestUser(t, srv, manager.ID, "U_REST_ME_001", datatypes.JSONMap{})
+	rawToken, _, err := srv.issueUserToken(user.ID, "test-device")
+	if err != nil {
+		t.Fatalf("issue user token failed: %v", err)
+	}
+
+	resp := doJSONRequest(t, srv.router, http.MethodGet, "/api/v1/user/me/rest-config", nil, rawToken)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("get me rest config failed, status=%d body=%s", resp.Code, resp.Body.String())
+	}
+	if source := decodeBodyMap(t, resp.Body.Bytes())["effective"].(map[string]any)["source"]; source != "global" {
+		t.Fatalf("expected global fallback, got %v", source)
+	}
+
+	resp = doJSONRequest(t, srv.router, http.MethodPut, "/api/v1/user/me/rest-config", map[string]any{
+		"rest_config": map[string]any{"enabled": true, "dates_off": []any{"2026-13-01"}},
+	}, rawToken)
+	if resp.Code != http.StatusBadRequest {
+		t.Fatalf("invalid date should be rejected, status=%d body=%s", resp.Code, resp.Body.String())
+	}
+
+	resp = doJSONRequest(t, srv.router, http.MethodPut, "/api/v1/user/me/rest-config", map[string]any{
+		"rest_config": map[string]any{"enabled": true, "mode": "random", "rest_start": "02:00", "rest_duration": 3, "random_range": 30},
+	}, rawToken)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("put me rest config failed, status=%d body=%s", resp.Code, resp.Body.String())
+	}
+	var stored models.User
+	db.Where("id = ?", user.ID).First(&stored)
+	if stored.RestConfig["mode"] != "random" || stored.RestConfig["rest_start"] != "02:00" {
+		t.Fatalf("rest config not stored: %v", stored.RestConfig)
+	}
+
+	resp = doJSONRequest(t, srv.router, http.MethodPut, "/api/v1/user/me/rest-config", map[string]any{"rest_config": nil}, rawToken)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("clearing rest config failed, status=%d body=%s", resp.Code, resp.Body.String())
+	}
+	if source := decodeBodyMap(t, resp.Body.Bytes())["effective"].(map[string]any)["source"]; source != "global" {
+		t.Fatalf("cleared config should inherit again, got %v", source)
+	}
+}
+
+func TestRestingUserJobsHeldFromPollAndExplained(t *testing.T) {
+	srv, db := setupTestServer(t)
+	manager := createActiveManager(t, db, "manager_rest_hold", "passwordRest123")
+	token := loginManagerToken(t, srv, "manager_rest_hold", "passwordRest123")
+	awake := createNotifyTestUser(t, srv, manager.ID, "U_REST_HOLD_AWAKE", datatypes.JSONMap{})
+	resting := createNotifyTestUser(t, srv, manager.ID, "U_REST_HOLD_SLEEP", datatypes.JSONMap{})
+	if err := db.Model(&models.User{}).Where("id = ?", resting.ID).
+		Update("rest_config", datatypes.JSONMap(everyDayOff)).Error; err != nil {
+		t.Fatalf("update rest config failed: %v", err)
+	}
+
+	at := time.Now().UTC().Add(-time.Minute)
+	awakeJob := createAlertTestJob(t, srv, awake, "签到", models.JobStatusPending, at)
+	heldJob := createAlertTestJob(t, srv, resting, "签到", models.JobStatusPending, at)
+
+	resp := doJSONRequest(t, srv.router, http.MethodGet, "/api/v1/manager/task-pool?status=pending", nil, token)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("task-pool failed, status=%d body=%s", resp.Code, resp.Body.String())
+	}
+	body := decodeBodyMap(t, resp.Body.Bytes())
+	if held := body["summary"].(map[string]any)["rest_held"]; held != float64(1) {
+		t.Fatalf("expected rest_held=1, got %v", held)
+	}
+	for _, raw := range body["items"].([]any) {
+		item := raw.(map[string]any)
+		hold, hasHold := item["rest_hold"].(map[string]any)
+		switch uint(item["id"].(float64)) {
+		case heldJob.ID:
+			if !hasHold || hold["reason"] != "day_off" || hold["source"] != "user" || hold["message"] == "" {
+				t.Fatalf("held job should explain the rest: %v", item)
+			}
+		case awakeJob.ID:
+			if hasHold {
+				t.Fatalf("awake job should not be held: %v", item)
+			}
+		}
+	}
+
+	loginResp := doJSONRequest(t, srv.router, http.MethodPost, "/api/v1/agent/auth/login", map[string]any{
+		"username": "manager_rest_hold",
+		"password": "passwordRest123",
+		"node_id":  "node-rest-hold",
+	}, "")
+	if loginResp.Code != http.StatusOK {
+		t.Fatalf("agent login failed, status=%d body=%s", loginResp.Code, loginResp.Body.String())
+	}
+	agentToken := extractTokenFromBody(t, loginResp.Body.Bytes())
+	resp = doJSONRequest(t, srv.router, http.MethodPost, "/api/v1/agent/poll-jobs", map[string]any{
+		"node_id": "node-rest-hold",
+		"limit":   10,
+	}, agentToken)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("poll failed, status=%d body=%s", resp.Code, resp.Body.String())
+	}
+
+	var heldAfter, awakeAfter models.TaskJob
+	db.Where("id = ?", heldJob.ID).First(&heldAfter)
+	if heldAfter.Status != models.JobStatusPending {
+		t.Fatalf("resting user's job should stay pending, got %s", heldAfter.Status)
+	}
+	db.Where("id = ?", awakeJob.ID).First(&awakeAfter)
+	if awakeAfter.Status != models.JobStatusLeased {
+		t.Fatalf("awake user's job should be leased, got %s", awakeAfter.Status)
+	}
+}
+
+func TestManagerScheduleSpreadSpreadsNextTime(t *testing.T) {
+	srv, db := setupTestServer(t)
+	manager := createActiveManager(t, db, "manager_spread", "passwordSpread123")
+	token := loginManagerToken(t, srv, "manager_spread", "passwordSpread123")
+	user := createNotifyTestUser(t, srv, manager.ID, "U_SPREAD_001", datatypes.JSONMap{})
+
+	resp := doJSONRequest(t, srv.router, http.MethodPut, "/api/v1/manager/schedule-spread", map[string]any{"spread_minutes": 241}, token)
+	if resp.Code != http.StatusBadRequest {
+		t.Fatalf("spread above 4h should be rejected, status=%d body=%s", resp.Code, resp.Body.String())
+	}
+	resp = doJSONRequest(t, srv.router, http.MethodPut, "/api/v1/manager/schedule-spread", map[string]any{"spread_minutes": 60}, token)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("put spread failed, status=%d body=%s", resp.Code, resp.Body.String())
+	}
+	if body := decodeBodyMap(t, resp.Body.Bytes()); body["effective_spread_minutes"] != float64(60) {
+		t.Fatalf("unexpected spread view: %v", body)
+	}
+
+	if _, err := srv.mergeTaskConfig(user.ID, map[string]any{"签到": map[string]any{"enabled": true}}); err != nil {
+		t.Fatalf("seed task config failed: %v", err)
+	}
+	now := time.Now().UTC()
+	job := createAlertTestJob(t, srv, user, "签到", models.JobStatusRunning, now)
+	srv.updateTaskNextTime(job.ID, "success", now)
+
+	var cfg models.UserTaskConfig
+	if err := db.Where("user_id = ?", user.ID).First(&cfg).Error; err != nil {
+		t.Fatalf("load task config failed: %v", err)
+	}
+	want := taskmeta.CalcNextTimeForUser("daily_reset", now, user.ID, time.Hour).Format("2006-01-02 15:04")
+	if got := cfg.TaskConfig["签到"].(map[string]any)["next_time"]; got != want {
+		t.Fatalf("next_time should include the user's spread offset: want %s, got %v", want, got)
+	}
+
+	userPath := "/api/v1/manager/users/" + itoa(user.ID) + "/rest-config"
+	resp = doJSONRequest(t, srv.router, http.MethodGet, userPath, nil, token)
+	effective := decodeBodyMap(t, resp.Body.Bytes())["effective"].(map[string]any)
+	if effective["spread_offset_minutes"] != float64(taskmeta.SpreadOffset(user.ID, time.Hour)/time.Minute) {
+		t.Fatalf("unexpected spread offset: %v", effective)
+	}
+
+	resp = doJSONRequest(t, srv.router, http.MethodPut, "/api/v1/manager/schedule-spread", map[string]any{"spread_minutes": nil}, token)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("reset spread failed, status=%d body=%s", resp.Code, resp.Body.String())
+	}
+	var stored models.Manager
+	db.Where("id = ?", manager.ID).First(&stored)
+	if stored.ScheduleSpread != nil {
+		t.Fatalf("null should clear the manager spread, got %v", *stored.ScheduleSpread)
+	}
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"oas-cloud-go/internal/retention"
+	"oas-cloud-go/internal/tracing"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// retentionWorker purges old jobs, events and audit logs on the configured
+// interval. See internal/retention for what each policy removes.
+func (s *Server) retentionWorker() {
+	interval := s.cfg.RetentionInterval
+	if interval <= 0 {
+		interval = time.Hour
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !s.leading() {
+			continue
+		}
+		s.runRetention(time.Now().UTC())
+	}
+}
+
+func (s *Server) runRetention(now time.Time) retention.Result {
+	ctx, span := tracing.Start(context.Background(), "retention.run")
+	result, err := retention.Run(ctx, s.db, retention.PolicyFromConfig(s.cfg), now)
+	span.SetAttributes(
+		attribute.Int64("retention.jobs", result.Jobs),
+		attribute.Int64("retention.events", result.Events),
+		attribute.Int64("retention.audit_logs", result.AuditLogs),
+		attribute.Int64("retention.agent_logs", result.AgentLogs),
+	)
+	tracing.End(span, err)
+
+	attrs := []any{
+		"jobs", result.Jobs,
+		"events", result.Events,
+		"audit_logs", result.AuditLogs,
+		"agent_logs", result.AgentLogs,
+		"exported_files", result.ExportedFiles,
+	}
+	if err != nil {
+		slog.Warn("retention run failed", append(attrs, "error", err)...)
+	} else if result.Jobs+result.Events+result.AuditLogs+result.AgentLogs > 0 {
+		slog.Info("retention run finished", attrs...)
+	}
+
+	s.retentionMu.Lock()
+	s.lastRetention = &result
+	s.retentionMu.Unlock()
+	return result
+}
+
+func (s *Server) superRetentionStatus(c *gin.Context) {
+	s.retentionMu.Lock()
+	last := s.lastRetention
+	s.retentionMu.Unlock()
+	c.JSON(http.StatusOK, gin.H{
+		"enabled":  s.cfg.RetentionEnabled,
+		"interval": s.cfg.RetentionInterval.String(),
+		"policy":   retention.PolicyFromConfig(s.cfg),
+		"last_run": last,
+	})
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"oas-cloud-go/internal/models"
+)
+
+func TestRetentionKeepsPurgedJobsInOverview(t *testing.T) {
+	srv, db := setupTestServer(t)
+	srv.cfg.RetentionJobDays = 30
+
+	manager := createActiveManager(t, db, "manager_retention", "passwordRetention123")
+	user := createNotifyTestUser(t, srv, manager.ID, "U_RETENTION_001", nil)
+	now := time.Now().UTC()
+	old := now.AddDate(0, 0, -40)
+	jobs := []models.TaskJob{
+		{ManagerID: manager.ID, UserID: user.ID, TaskType: "sign_in", ScheduledAt: old, Status: models.JobStatusSuccess, MaxAttempts: 3, CreatedAt: old, UpdatedAt: old},
+		{ManagerID: manager.ID, UserID: user.ID, TaskType: "sign_in", ScheduledAt: now, Status: models.JobStatusSuccess, MaxAttempts: 3, CreatedAt: now, UpdatedAt: now},
+	}
+	if err := db.Create(&jobs).Error; err != nil {
+		t.Fatalf("create jobs failed: %v", err)
+	}
+
+	// The test database is shared, so the run may purge jobs of other tests too.
+	result := srv.runRetention(now)
+	if result.Error != "" || result.Jobs < 1 {
+		t.Fatalf("expected the old job to be purged, got %+v", result)
+	}
+	var left int64
+	db.Model(&models.TaskJob{}).Where("manager_id = ?", manager.ID).Count(&left)
+	if left != 1 {
+		t.Fatalf("expected 1 job left, got %d", left)
+	}
+
+	token := loginManagerToken(t, srv, manager.Username, "passwordRetention123")
+	resp := doJSONRequest(t, srv.router, http.MethodGet, "/api/v1/manager/overview", nil, token)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("overview failed, status=%d body=%s", resp.Code, resp.Body.String())
+	}
+	jobStats := decodeBodyMap(t, resp.Body.Bytes())["job_stats"].(map[string]any)
+	if int(jobStats["success"].(float64)) != 2 {
+		t.Fatalf("overview should count the rolled up job, got %+v", jobStats)
+	}
+
+	createSuperAdmin(t, db, "super_retention", "superPass123")
+	superResp := doJSONRequest(t, srv.router, http.MethodPost, "/api/v1/super/auth/login",
+		map[string]any{"username": "super_retention", "password": "superPass123"}, "")
+	superToken := extractTokenFromBody(t, superResp.Body.Bytes())
+	statusResp := doJSONRequest(t, srv.router, http.MethodGet, "/api/v1/super/retention", nil, superToken)
+	if statusResp.Code != http.StatusOK {
+		t.Fatalf("retention status failed, status=%d body=%s", statusResp.Code, statusResp.Body.String())
+	}
+	payload := decodeBodyMap(t, statusResp.Body.Bytes())
+	policy := payload["policy"].(map[string]any)
+	lastRun, ok := payload["last_run"].(map[string]any)
+	if int(policy["job_days"].(float64)) != 30 || !ok || int64(lastRun["jobs"].(float64)) != result.Jobs {
+		t.Fatalf("unexpected retention status: %+v", payload)
+	}
+}
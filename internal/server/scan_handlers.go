@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"oas-cloud-go/internal/models"
+	"oas-cloud-go/internal/tracing"
 
 	"github.com/gin-gonic/gin"
 	"gorm.io/datatypes"
@@ -325,6 +326,9 @@ func (s *Server) agentScanPoll(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"detail": err.Error()})
 		return
 	}
+	if !agentNodeMatches(c, req.NodeID) {
+		return
+	}
 
 	managerID := getUint(c, ctxManagerIDKey)
 	ctx := c.Request.Context()
@@ -434,6 +438,9 @@ func (s *Server) agentScanStart(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"detail": err.Error()})
 		return
 	}
+	if !agentNodeMatches(c, req.NodeID) {
+		return
+	}
 
 	ctx := c.Request.Context()
 	now := time.Now().UTC()
@@ -456,9 +463,10 @@ func (s *Server) agentScanStart(c *gin.Context) {
 	}
 
 	s.db.Model(&models.ScanJob{}).Where("id = ?", scanJobID).Updates(map[string]any{
-		"status":     models.ScanStatusRunning,
-		"phase":      models.ScanPhaseLaunching,
-		"updated_at": now,
+		"status":           models.ScanStatusRunning,
+		"phase":            models.ScanPhaseLaunching,
+		"phase_started_at": now,
+		"updated_at":       now,
 	})
 
 	// Notify user using pre-loaded UserID
@@ -481,6 +489,9 @@ func (s *Server) agentScanPhase(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"detail": err.Error()})
 		return
 	}
+	if !agentNodeMatches(c, req.NodeID) {
+		return
+	}
 
 	ctx := c.Request.Context()
 	now := time.Now().UTC()
@@ -497,7 +508,7 @@ func (s *Server) agentScanPhase(c *gin.Context) {
 
 	// Load job once to get user_id and screenshots (avoids 2 redundant SELECTs)
 	var job models.ScanJob
-	if err := s.db.Select("id, user_id, screenshots").Where("id = ?", scanJobID).First(&job).Error; err != nil {
+	if err := s.db.Select("id, user_id, phase, phase_started_at, screenshots").Where("id = ?", scanJobID).First(&job).Error; err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"detail": "扫码任务不存在"})
 		return
 	}
@@ -506,6 +517,10 @@ func (s *Server) agentScanPhase(c *gin.Context) {
 		"phase":      req.Phase,
 		"updated_at": now,
 	}
+	if req.Phase != job.Phase {
+		observeScanPhase(job.Phase, job.PhaseStartedAt, now)
+		updates["phase_started_at"] = now
+	}
 
 	// Store screenshot if provided (using pre-loaded job.Screenshots)
 	if req.Screenshot != "" && req.ScreenshotKey != "" {
@@ -560,6 +575,9 @@ func (s *Server) agentScanGetChoice(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"detail": "缺少node_id"})
 		return
 	}
+	if !agentNodeMatches(c, nodeID) {
+		return
+	}
 
 	ctx := c.Request.Context()
 
@@ -617,6 +635,9 @@ func (s *Server) agentScanHeartbeat(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"detail": err.Error()})
 		return
 	}
+	if !agentNodeMatches(c, req.NodeID) {
+		return
+	}
 
 	ctx := c.Request.Context()
 	now := time.Now().UTC()
@@ -658,6 +679,9 @@ func (s *Server) agentScanComplete(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"detail": err.Error()})
 		return
 	}
+	if !agentNodeMatches(c, req.NodeID) {
+		return
+	}
 
 	ctx := c.Request.Context()
 	now := time.Now().UTC()
@@ -674,10 +698,11 @@ func (s *Server) agentScanComplete(c *gin.Context) {
 
 	// Load UserID once before update
 	var job models.ScanJob
-	if err := s.db.Select("id, user_id").Where("id = ?", scanJobID).First(&job).Error; err != nil {
+	if err := s.db.Select("id, user_id, phase, phase_started_at").Where("id = ?", scanJobID).First(&job).Error; err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"detail": "扫码任务不存在"})
 		return
 	}
+	observeScanPhase(job.Phase, job.PhaseStartedAt, now)
 
 	s.db.Model(&models.ScanJob{}).Where("id = ?", scanJobID).Updates(map[string]any{
 		"status":     models.ScanStatusSuccess,
@@ -708,6 +733,9 @@ func (s *Server) agentScanFail(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"detail": err.Error()})
 		return
 	}
+	if !agentNodeMatches(c, req.NodeID) {
+		return
+	}
 
 	ctx := c.Request.Context()
 	now := time.Now().UTC()
@@ -728,6 +756,7 @@ func (s *Server) agentScanFail(c *gin.Context) {
 		return
 	}
 
+	observeScanPhase(job.Phase, job.PhaseStartedAt, now)
 	job.Attempts++
 	errMsg := req.Message
 	if errMsg == "" {
@@ -773,12 +802,16 @@ func (s *Server) scanJobTimeoutWorker() {
 	ticker := time.NewTicker(15 * time.Second)
 	defer ticker.Stop()
 	for range ticker.C {
+		if !s.leading() {
+			continue
+		}
 		now := time.Now().UTC()
-		ctx := context.Background()
+		ctx, span := tracing.Start(context.Background(), "scan.timeout_sweep")
+		db := s.db.WithContext(ctx)
 
 		// 1. Lease timeout: leased/running jobs with expired lease
 		var expiredLeases []models.ScanJob
-		s.db.Where("status IN ? AND lease_until IS NOT NULL AND lease_until < ?",
+		db.Where("status IN ? AND lease_until IS NOT NULL AND lease_until < ?",
 			[]string{models.ScanStatusLeased, models.ScanStatusRunning}, now).
 			Find(&expiredLeases)
 		if len(expiredLeases) > 0 {
@@ -795,7 +828,7 @@ func (s *Server) scanJobTimeoutWorker() {
 				}
 			}
 			if len(retryIDs) > 0 {
-				s.db.Model(&models.ScanJob{}).Where("id IN ?", retryIDs).Updates(map[string]any{
+				db.Model(&models.ScanJob{}).Where("id IN ?", retryIDs).Updates(map[string]any{
 					"status":         models.ScanStatusPending,
 					"phase":          models.ScanPhaseWaiting,
 					"leased_by_node": "",
@@ -805,7 +838,7 @@ func (s *Server) scanJobTimeoutWorker() {
 				})
 			}
 			if len(expiredIDs) > 0 {
-				s.db.Model(&models.ScanJob{}).Where("id IN ?", expiredIDs).Updates(map[string]any{
+				db.Model(&models.ScanJob{}).Where("id IN ?", expiredIDs).Updates(map[string]any{
 					"status":         models.ScanStatusExpired,
 					"error_message":  "租约超时",
 					"leased_by_node": "",
@@ -822,7 +855,7 @@ func (s *Server) scanJobTimeoutWorker() {
 		// 2. User heartbeat timeout (60 seconds)
 		heartbeatDeadline := now.Add(-60 * time.Second)
 		var noHeartbeat []models.ScanJob
-		s.db.Where("status = ? AND user_heartbeat IS NOT NULL AND user_heartbeat < ?",
+		db.Where("status = ? AND user_heartbeat IS NOT NULL AND user_heartbeat < ?",
 			models.ScanStatusRunning, heartbeatDeadline).
 			Find(&noHeartbeat)
 		if len(noHeartbeat) > 0 {
@@ -830,7 +863,7 @@ func (s *Server) scanJobTimeoutWorker() {
 			for _, job := range noHeartbeat {
 				hbIDs = append(hbIDs, job.ID)
 			}
-			s.db.Model(&models.ScanJob{}).Where("id IN ?", hbIDs).Updates(map[string]any{
+			db.Model(&models.ScanJob{}).Where("id IN ?", hbIDs).Updates(map[string]any{
 				"status":        models.ScanStatusCancelled,
 				"error_message": "用户离开扫码页面",
 				"updated_at":    now,
@@ -845,12 +878,13 @@ func (s *Server) scanJobTimeoutWorker() {
 
 		// 3. Total timeout (15 minutes)
 		totalDeadline := now.Add(-15 * time.Minute)
-		s.db.Model(&models.ScanJob{}).
+		db.Model(&models.ScanJob{}).
 			Where("status IN ? AND created_at < ?", scanActiveStatuses, totalDeadline).
 			Updates(map[string]any{
 				"status":        models.ScanStatusExpired,
 				"error_message": "总超时",
 				"updated_at":    now,
 			})
+		span.End()
 	}
 }
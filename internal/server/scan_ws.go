@@ -76,6 +76,13 @@ func (h *ScanWSHub) Unregister(userID uint) {
 	}
 }
 
+// Count returns the number of open connections.
+func (h *ScanWSHub) Count() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.clients)
+}
+
 // NotifyUser sends a message to the given user's WebSocket connection.
 func (h *ScanWSHub) NotifyUser(userID uint, msg ScanWSMessage) {
 	h.mu.RLock()
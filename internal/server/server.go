@@ -8,7 +8,6 @@ import (
 	"log/slog"
 	"math/rand"
 	"net/http"
-	"net/mail"
 	"os"
 	"os/signal"
 	"path/filepath"
@@ -21,13 +20,19 @@ import (
 	"oas-cloud-go/internal/auth"
 	"oas-cloud-go/internal/cache"
 	"oas-cloud-go/internal/config"
+	"oas-cloud-go/internal/metrics"
 	"oas-cloud-go/internal/models"
 	"oas-cloud-go/internal/notify"
+	"oas-cloud-go/internal/retention"
 	"oas-cloud-go/internal/scheduler"
 	"oas-cloud-go/internal/taskmeta"
+	"oas-cloud-go/internal/tracing"
 
 	"github.com/gin-contrib/gzip"
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"gorm.io/datatypes"
 	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
@@ -41,13 +46,22 @@ type Server struct {
 	db               *gorm.DB
 	redisStore       cache.Store
 	generator        *scheduler.Generator
+	elector          *scheduler.Elector // nil when leader election is off
+	globalRest       scheduler.RestConfig
 	tokenManager     *auth.TokenManager
 	router           *gin.Engine
 	auditCh          chan models.AuditLog
 	auditOverflowSem chan struct{}
-	notifyCh         chan notify.NotifyRequest
+	notifyQueue      chan models.NotificationOutbox
+	notifyWake       chan struct{}
 	notifier         *notify.Notifier
 	scanWSHub        *ScanWSHub
+	jobWaiters       *jobWaiters
+	agentLogCh       chan models.AgentLog
+	agentLogTail     *agentLogTail
+	metricsRegistry  *prometheus.Registry
+	retentionMu      sync.Mutex
+	lastRetention    *retention.Result
 }
 
 var errInvalidTaskConfigPatch = errors.New("invalid task config patch")
@@ -57,26 +71,56 @@ func New(cfg config.Config, db *gorm.DB, redisStore cache.Store) *Server {
 		cfg:              cfg,
 		db:               db,
 		redisStore:       redisStore,
+		globalRest:       scheduler.GlobalRestConfig(cfg.DefaultRestWindow),
 		tokenManager:     auth.NewTokenManager(cfg.JWTSecret),
 		router:           gin.New(),
 		auditCh:          make(chan models.AuditLog, 1024),
 		auditOverflowSem: make(chan struct{}, 10),
-		notifyCh:         make(chan notify.NotifyRequest, 1024),
-		notifier:         notify.NewNotifier(),
+		notifyQueue:      make(chan models.NotificationOutbox, notifyClaimBatch),
+		notifyWake:       make(chan struct{}, 1),
+		notifier:         notify.NewNotifier(cfg),
 		scanWSHub:        newScanWSHub(),
+		jobWaiters:       newJobWaiters(),
+		agentLogCh:       make(chan models.AgentLog, agentLogQueueSize),
+		agentLogTail:     newAgentLogTail(),
+	}
+	app.metricsRegistry = app.newMetricsRegistry()
+	// The scheduler, the scan timeout sweep, agent offline detection, alerts,
+	// digests and retention run on the elected replica only. Audit writes,
+	// agent log writes and notification delivery drain per-replica queues and
+	// run everywhere, as do the jobs-ready listener that wakes the long polls
+	// held by this replica and the agent log listener that feeds its live
+	// tails.
+	if cfg.LeaderElection {
+		app.elector = scheduler.NewElector(redisStore, scheduler.LeaderName, cfg.InstanceID, cfg.LeaderLeaseTTL)
+		app.elector.Start()
 	}
 	if cfg.SchedulerEnabled {
 		app.generator = scheduler.NewGenerator(cfg, db, redisStore)
+		app.generator.UseElector(app.elector)
+		app.generator.HandleFailedJobs(app.finishExpiredJob)
 		app.generator.Start()
 	}
 	go app.auditWorker()
+	go app.agentLogWorker()
+	go app.notifyDispatcher()
+	go app.notifyDigestWorker()
+	go app.alertWorker()
 	for i := 0; i < 8; i++ {
 		go app.notifyWorker()
 	}
 	go app.scanJobTimeoutWorker()
-	app.router.Use(gin.LoggerWithConfig(gin.LoggerConfig{
-		SkipPaths: []string{"/health"},
-	}), gin.Recovery(), gzip.Gzip(gzip.BestSpeed))
+	go app.agentOfflineWorker()
+	go app.jobsReadyListener()
+	go app.agentLogsListener()
+	if cfg.RetentionEnabled {
+		go app.retentionWorker()
+	}
+	// Tracing goes first so that its span covers the 500 written by Recovery.
+	// Event streams are flushed line by line and skip gzip.
+	app.router.Use(tracing.Middleware("/health", "/metrics"), gin.LoggerWithConfig(gin.LoggerConfig{
+		SkipPaths: []string{"/health", "/metrics"},
+	}), gin.Recovery(), app.metricsMiddleware(), gzip.Gzip(gzip.BestSpeed, gzip.WithExcludedPathsRegexs([]string{`/agent-logs/stream$`})))
 	app.mountRoutes()
 	return app
 }
@@ -112,6 +156,9 @@ func (s *Server) Run() error {
 	if s.generator != nil {
 		s.generator.Stop()
 	}
+	if s.elector != nil {
+		s.elector.Stop()
+	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
@@ -178,6 +225,7 @@ func (s *Server) mountRoutes() {
 
 		c.JSON(httpStatus, status)
 	})
+	s.router.GET("/metrics", s.metricsHandler())
 	s.router.GET("/super/console", s.superConsole)
 
 	api := s.router.Group("/api/v1")
@@ -185,6 +233,7 @@ func (s *Server) mountRoutes() {
 		api.GET("/bootstrap/status", s.bootstrapStatus)
 		api.GET("/scheduler/status", s.schedulerStatus)
 		api.GET("/task-templates", s.taskTemplates)
+		api.GET("/task-templates/next-time-preview", s.previewNextTimeRule)
 		api.POST("/bootstrap/init", s.bootstrapInit)
 
 		// Auth endpoints with stricter rate limiting (20 req/min per IP)
@@ -211,6 +260,9 @@ func (s *Server) mountRoutes() {
 		superGroup.DELETE("/manager-renewal-keys/:id", s.superDeleteManagerRenewalKey)
 		superGroup.POST("/manager-renewal-keys/batch-delete", s.superBatchDeleteRenewalKeys)
 		superGroup.GET("/audit-logs", s.superListAuditLogs)
+		superGroup.GET("/retention", s.superRetentionStatus)
+		superGroup.GET("/agent-version-policy", s.superGetAgentVersionPolicy)
+		superGroup.PUT("/agent-version-policy", s.superPutAgentVersionPolicy)
 		superGroup.POST("/bloggers", s.superCreateBlogger)
 		superGroup.GET("/bloggers", s.superListBloggers)
 		superGroup.DELETE("/bloggers/:id", s.superDeleteBlogger)
@@ -229,6 +281,31 @@ func (s *Server) mountRoutes() {
 		managerGroup.GET("/overview", s.managerOverview)
 		managerGroup.PUT("/me/alias", s.managerPutMeAlias)
 		managerGroup.GET("/task-pool", s.managerListTaskPool)
+		managerGroup.POST("/task-pool/jobs/:job_id/cancel", s.managerJobAction(jobActionCancel))
+		managerGroup.POST("/task-pool/jobs/:job_id/revoke", s.managerJobAction(jobActionRevoke))
+		managerGroup.PUT("/task-pool/jobs/:job_id/priority", s.managerJobAction(jobActionPriority))
+		managerGroup.POST("/task-pool/jobs/:job_id/requeue", s.managerJobAction(jobActionRequeue))
+		managerGroup.POST("/task-pool/batch-cancel", s.managerBatchJobAction(jobActionCancel))
+		managerGroup.POST("/task-pool/batch-revoke", s.managerBatchJobAction(jobActionRevoke))
+		managerGroup.POST("/task-pool/batch-priority", s.managerBatchJobAction(jobActionPriority))
+		managerGroup.POST("/task-pool/batch-requeue", s.managerBatchJobAction(jobActionRequeue))
+		managerGroup.GET("/alerts", s.managerListAlerts)
+		managerGroup.GET("/agents", s.managerListAgentNodes)
+		managerGroup.PATCH("/agents/:id/drain", s.managerPatchAgentDrain)
+		managerGroup.POST("/agents/:id/revoke", s.managerRevokeAgentNode)
+		managerGroup.GET("/agents/:id/commands", s.managerListAgentCommands)
+		managerGroup.POST("/agents/:id/commands", s.managerCreateAgentCommand)
+		managerGroup.POST("/agents/:id/commands/:command_id/cancel", s.managerCancelAgentCommand)
+		managerGroup.GET("/agent-version-policy", s.managerGetAgentVersionPolicy)
+		managerGroup.PUT("/agent-version-policy", s.managerPutAgentVersionPolicy)
+		managerGroup.GET("/agent-keys", s.managerListAgentKeys)
+		managerGroup.POST("/agent-keys", s.managerCreateAgentKey)
+		managerGroup.POST("/agent-keys/:id/rotate", s.managerRotateAgentKey)
+		managerGroup.POST("/agent-keys/:id/revoke", s.managerRevokeAgentKey)
+		managerGroup.GET("/rest-config", s.managerGetRestConfig)
+		managerGroup.PUT("/rest-config", s.managerPutRestConfig)
+		managerGroup.GET("/schedule-spread", s.managerGetScheduleSpread)
+		managerGroup.PUT("/schedule-spread", s.managerPutScheduleSpread)
 		managerGroup.POST("/activation-codes", s.managerCreateActivationCode)
 		managerGroup.GET("/activation-codes", s.managerListActivationCodes)
 		managerGroup.PATCH("/activation-codes/:id/status", s.managerPatchActivationCodeStatus)
@@ -239,8 +316,15 @@ func (s *Server) mountRoutes() {
 		managerGroup.PUT("/users/:user_id/assets", s.managerPutUserAssets)
 		managerGroup.GET("/users/:user_id/tasks", s.managerGetUserTasks)
 		managerGroup.PUT("/users/:user_id/tasks", s.managerPutUserTasks)
+		managerGroup.POST("/users/:user_id/tasks/run-now", s.managerRunTaskNow)
+		managerGroup.GET("/users/:user_id/rest-config", s.managerGetUserRestConfig)
+		managerGroup.PUT("/users/:user_id/rest-config", s.managerPutUserRestConfig)
 		managerGroup.GET("/users/:user_id/logs", s.managerGetUserLogs)
 		managerGroup.DELETE("/users/:user_id/logs", s.managerDeleteUserLogs)
+		managerGroup.GET("/agent-logs", s.managerListAgentLogs)
+		managerGroup.GET("/agent-logs/stream", s.managerStreamAgentLogs)
+		managerGroup.GET("/users/:user_id/notifications", s.managerGetUserNotifications)
+		managerGroup.POST("/users/:user_id/notifications/:id/retry", s.managerRetryUserNotification)
 		managerGroup.PATCH("/users/:user_id/settings", s.managerPatchUserSettings)
 		managerGroup.POST("/users/batch-lifecycle", s.managerBatchUserLifecycle)
 		managerGroup.POST("/users/batch-assets", s.managerBatchUserAssets)
@@ -263,10 +347,19 @@ func (s *Server) mountRoutes() {
 		userGroup.POST("/auth/redeem-code", s.userRedeemCode)
 		userGroup.GET("/me/profile", s.userGetMeProfile)
 		userGroup.PUT("/me/profile", s.userPutMeProfile)
+		userGroup.GET("/me/notify-channels", s.userGetNotifyChannels)
+		userGroup.GET("/me/notifications", s.userGetMeNotifications)
 		userGroup.GET("/me/assets", s.userGetMeAssets)
 		userGroup.GET("/me/tasks", s.userGetMeTasks)
 		userGroup.PUT("/me/tasks", s.userPutMeTasks)
+		userGroup.POST("/me/tasks/run-now", s.rateLimitByUser("user_run_now", 5, time.Minute), s.userRunTaskNow)
+		userGroup.GET("/me/jobs", s.userGetMeJobs)
+		userGroup.POST("/me/jobs/:job_id/cancel", s.userCancelMeJob)
+		userGroup.GET("/me/rest-config", s.userGetMeRestConfig)
+		userGroup.PUT("/me/rest-config", s.userPutMeRestConfig)
 		userGroup.GET("/me/logs", s.userGetMeLogs)
+		userGroup.GET("/me/agent-logs", s.userListAgentLogs)
+		userGroup.GET("/me/agent-logs/stream", s.userStreamAgentLogs)
 		userGroup.GET("/me/lineup", s.userGetMeLineup)
 		userGroup.PUT("/me/lineup", s.userPutMeLineup)
 		userGroup.POST("/scan/create", s.userScanCreate)
@@ -307,6 +400,8 @@ func (s *Server) mountRoutes() {
 		agentGroup.POST("/jobs/:job_id/heartbeat", s.agentJobHeartbeat)
 		agentGroup.POST("/jobs/:job_id/complete", s.agentJobComplete)
 		agentGroup.POST("/jobs/:job_id/fail", s.agentJobFail)
+		agentGroup.POST("/commands/:command_id/ack", s.agentAckCommand)
+		agentGroup.POST("/commands/:command_id/result", s.agentReportCommandResult)
 		agentGroup.GET("/users/:user_id/full-config", s.agentGetUserFullConfig)
 		agentGroup.PATCH("/users/:user_id/game-profile", s.agentUpdateUserGameProfile)
 		agentGroup.PUT("/users/:user_id/explore-progress", s.agentUpdateExploreProgress)
@@ -324,10 +419,15 @@ func (s *Server) mountRoutes() {
 }
 
 func (s *Server) schedulerStatus(c *gin.Context) {
+	leader := gin.H{"enabled": false}
+	if s.elector != nil {
+		leader = gin.H{"enabled": true, "status": s.elector.Status(c.Request.Context())}
+	}
 	if s.generator == nil {
 		c.JSON(http.StatusOK, gin.H{
 			"enabled": false,
 			"status":  "disabled",
+			"leader":  leader,
 		})
 		return
 	}
@@ -335,9 +435,21 @@ func (s *Server) schedulerStatus(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{
 		"enabled": true,
 		"status":  snapshot,
+		"leader":  leader,
 	})
 }
 
+// leading reports whether this replica runs the singleton workers right now.
+// Without leader election every replica does.
+func (s *Server) leading() bool {
+	if s.elector == nil {
+		return true
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	return s.elector.Confirm(ctx)
+}
+
 func (s *Server) taskTemplates(c *gin.Context) {
 	rawType := strings.TrimSpace(c.Query("user_type"))
 	if rawType != "" && !models.IsValidUserType(rawType) {
@@ -356,6 +468,61 @@ func (s *Server) taskTemplates(c *gin.Context) {
 	})
 }
 
+// previewNextTimeRule lists the upcoming runs of a next_time_rule, either
+// given directly or taken from a task type's default.
+func (s *Server) previewNextTimeRule(c *gin.Context) {
+	expr := strings.TrimSpace(c.Query("rule"))
+	if expr == "" {
+		taskType := strings.TrimSpace(c.Query("task_type"))
+		expr = taskmeta.GetNextTimeRule(taskType)
+		if expr == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"detail": "需要提供 rule 或有效的 task_type"})
+			return
+		}
+	}
+	rule, err := taskmeta.ParseNextTimeRule(expr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"detail": err.Error()})
+		return
+	}
+	count := 5
+	if raw := strings.TrimSpace(c.Query("count")); raw != "" {
+		value, err := strconv.Atoi(raw)
+		if err != nil || value < 1 || value > 50 {
+			c.JSON(http.StatusBadRequest, gin.H{"detail": "count 必须是 1-50 的整数"})
+			return
+		}
+		count = value
+	}
+	from := time.Now()
+	if raw := strings.TrimSpace(c.Query("from")); raw != "" {
+		parsed, err := time.ParseInLocation("2006-01-02 15:04", raw, taskmeta.BJLoc)
+		if err != nil {
+			if parsed, err = time.Parse(time.RFC3339, raw); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"detail": "from 格式应为 YYYY-MM-DD HH:MM"})
+				return
+			}
+		}
+		from = parsed
+	}
+
+	const layout = "2006-01-02 15:04"
+	items := make([]gin.H, 0, count)
+	for _, fire := range rule.Preview(from, count) {
+		items = append(items, gin.H{
+			"earliest": fire.Earliest.Format(layout),
+			"latest":   fire.Latest.Format(layout),
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"rule":       rule.String(),
+		"expression": rule.Expression(),
+		"on_demand":  rule.OnDemand(),
+		"from":       from.In(taskmeta.BJLoc).Format(layout),
+		"items":      items,
+	})
+}
+
 func (s *Server) superConsole(c *gin.Context) {
 	content, err := staticFS.ReadFile("static/super_console.html")
 	if err != nil {
@@ -691,9 +858,9 @@ func (s *Server) superListManagers(c *gin.Context) {
 
 	// Summary counts using single query with conditional aggregation
 	type managerSummary struct {
-		TotalAll     int64 `gorm:"column:total_all"`
-		ActiveAll    int64 `gorm:"column:active_all"`
-		Expiring7d   int64 `gorm:"column:expiring_7d"`
+		TotalAll   int64 `gorm:"column:total_all"`
+		ActiveAll  int64 `gorm:"column:active_all"`
+		Expiring7d int64 `gorm:"column:expiring_7d"`
 	}
 	var ms managerSummary
 	s.db.Model(&models.Manager{}).Select(
@@ -1538,21 +1705,22 @@ func (s *Server) managerListUsers(c *gin.Context) {
 		user.UserType = models.NormalizeUserType(user.UserType)
 		isExpired := user.ExpiresAt == nil || !user.ExpiresAt.After(now)
 		items = append(items, gin.H{
-			"id":             user.ID,
-			"account_no":     user.AccountNo,
-			"login_id":       user.LoginID,
-			"manager_id":     user.ManagerID,
-			"user_type":      user.UserType,
-			"status":         user.Status,
-			"archive_status": user.ArchiveStatus,
-			"server":         user.Server,
-			"username":       user.Username,
-			"is_expired":     isExpired,
-			"expires_at":     user.ExpiresAt,
-			"created_by":     user.CreatedBy,
-			"created_at":     user.CreatedAt,
-			"updated_at":     user.UpdatedAt,
-			"can_view_logs":  user.CanViewLogs,
+			"id":              user.ID,
+			"account_no":      user.AccountNo,
+			"login_id":        user.LoginID,
+			"manager_id":      user.ManagerID,
+			"user_type":       user.UserType,
+			"status":          user.Status,
+			"archive_status":  user.ArchiveStatus,
+			"server":          user.Server,
+			"username":        user.Username,
+			"is_expired":      isExpired,
+			"expires_at":      user.ExpiresAt,
+			"created_by":      user.CreatedBy,
+			"created_at":      user.CreatedAt,
+			"updated_at":      user.UpdatedAt,
+			"can_view_logs":   user.CanViewLogs,
+			"required_labels": taskmeta.SplitLabels(user.RequiredLabels),
 		})
 	}
 	c.JSON(http.StatusOK, gin.H{
@@ -1612,8 +1780,30 @@ func (s *Server) managerOverview(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"detail": "查询任务概览失败"})
 		return
 	}
+	// Jobs purged by retention still count through their daily rollups.
+	var archived struct {
+		Succeeded int64
+		Failed    int64
+		Cancelled int64
+	}
+	if err := s.db.Model(&models.TaskJobDailyStat{}).
+		Select("COALESCE(SUM(succeeded), 0) AS succeeded, COALESCE(SUM(failed), 0) AS failed, COALESCE(SUM(cancelled), 0) AS cancelled").
+		Where("manager_id = ?", managerID).Scan(&archived).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "查询任务概览失败"})
+		return
+	}
+	counts := map[string]int64{
+		models.JobStatusSuccess:   archived.Succeeded,
+		models.JobStatusFailed:    archived.Failed,
+		models.JobStatusCancelled: archived.Cancelled,
+	}
 	for _, r := range jobAggs {
-		jobStats[r.Status] = r.Cnt
+		counts[r.Status] += r.Cnt
+	}
+	for status, cnt := range counts {
+		if cnt > 0 {
+			jobStats[status] = cnt
+		}
 	}
 
 	var recentFailures int64
@@ -1659,6 +1849,8 @@ func (s *Server) managerListTaskPool(c *gin.Context) {
 		UserType     string     `json:"user_type"`
 		Server       string     `json:"server"`
 		Username     string     `json:"username"`
+		RestHold     gin.H      `json:"rest_hold,omitempty" gorm:"-"`
+		WaitingFor   []gin.H    `json:"waiting_for,omitempty" gorm:"-"`
 	}
 
 	baseQuery := s.db.Table("task_jobs").
@@ -1688,7 +1880,7 @@ func (s *Server) managerListTaskPool(c *gin.Context) {
 		return
 	}
 
-	summary := gin.H{"pending": int64(0), "leased": int64(0), "running": int64(0)}
+	summary := gin.H{"pending": int64(0), "leased": int64(0), "running": int64(0), "rest_held": int64(0), "dependency_held": int64(0)}
 	type poolSummaryAgg struct {
 		Status string `gorm:"column:status"`
 		Cnt    int64  `gorm:"column:cnt"`
@@ -1699,6 +1891,42 @@ func (s *Server) managerListTaskPool(c *gin.Context) {
 		summary[r.Status] = r.Cnt
 	}
 
+	// Explain pending jobs that agents will not pick up because the user is resting.
+	if resting, err := s.restingPendingUsers(managerID, time.Now().UTC()); err == nil && len(resting) > 0 {
+		restingIDs := make([]uint, 0, len(resting))
+		for userID := range resting {
+			restingIDs = append(restingIDs, userID)
+		}
+		var held int64
+		s.db.Model(&models.TaskJob{}).Where("manager_id = ? AND status = ? AND user_id IN ?", managerID, models.JobStatusPending, restingIDs).Count(&held)
+		summary["rest_held"] = held
+		for i := range rows {
+			if state, ok := resting[rows[i].UserID]; ok && rows[i].Status == models.JobStatusPending {
+				rows[i].RestHold = restStateItem(state)
+			}
+		}
+	}
+
+	// Explain pending jobs that wait for a prerequisite job of the same cycle.
+	var dependencyHeld int64
+	s.db.Table("task_jobs").
+		Where("task_jobs.manager_id = ? AND task_jobs.status = ?", managerID, models.JobStatusPending).
+		Where("EXISTS (SELECT 1 FROM task_job_dependencies d JOIN task_jobs p ON p.id = d.depends_on_job_id WHERE d.job_id = task_jobs.id AND p.status <> ?)", models.JobStatusSuccess).
+		Count(&dependencyHeld)
+	summary["dependency_held"] = dependencyHeld
+	if dependencyHeld > 0 {
+		pendingIDs := make([]uint, 0, len(rows))
+		for _, row := range rows {
+			if row.Status == models.JobStatusPending {
+				pendingIDs = append(pendingIDs, row.ID)
+			}
+		}
+		waiting := s.unmetJobDependencies(pendingIDs)
+		for i := range rows {
+			rows[i].WaitingFor = waiting[rows[i].ID]
+		}
+	}
+
 	c.JSON(http.StatusOK, gin.H{
 		"items":     rows,
 		"summary":   summary,
@@ -1708,6 +1936,34 @@ func (s *Server) managerListTaskPool(c *gin.Context) {
 	})
 }
 
+// unmetJobDependencies lists, per job, the prerequisite jobs that have not
+// succeeded yet.
+func (s *Server) unmetJobDependencies(jobIDs []uint) map[uint][]gin.H {
+	result := make(map[uint][]gin.H)
+	if len(jobIDs) == 0 {
+		return result
+	}
+	type unmetRow struct {
+		JobID    uint   `gorm:"column:job_id"`
+		ID       uint   `gorm:"column:id"`
+		TaskType string `gorm:"column:task_type"`
+		Status   string `gorm:"column:status"`
+	}
+	var rows []unmetRow
+	if err := s.db.Table("task_job_dependencies AS d").
+		Select("d.job_id, p.id, p.task_type, p.status").
+		Joins("JOIN task_jobs p ON p.id = d.depends_on_job_id").
+		Where("d.job_id IN ? AND p.status <> ?", jobIDs, models.JobStatusSuccess).
+		Order("d.job_id asc, p.id asc").
+		Scan(&rows).Error; err != nil {
+		return result
+	}
+	for _, row := range rows {
+		result[row.JobID] = append(result[row.JobID], gin.H{"job_id": row.ID, "task_type": row.TaskType, "status": row.Status})
+	}
+	return result
+}
+
 func (s *Server) managerGetUserTasks(c *gin.Context) {
 	managerID := getUint(c, ctxActorIDKey)
 	userID, ok := parseUintParam(c, "user_id")
@@ -1902,6 +2158,26 @@ func (s *Server) managerPutUserTasks(c *gin.Context) {
 			c.JSON(http.StatusBadRequest, gin.H{"detail": "任务配置包含该用户类型不允许的任务"})
 			return
 		}
+		var ruleErr *taskmeta.NextTimeRuleError
+		if errors.As(err, &ruleErr) {
+			c.JSON(http.StatusBadRequest, gin.H{"detail": ruleErr.Error()})
+			return
+		}
+		var depErr *taskmeta.TaskDependencyError
+		if errors.As(err, &depErr) {
+			c.JSON(http.StatusBadRequest, gin.H{"detail": depErr.Error()})
+			return
+		}
+		var retryErr *taskmeta.RetryPolicyError
+		if errors.As(err, &retryErr) {
+			c.JSON(http.StatusBadRequest, gin.H{"detail": retryErr.Error()})
+			return
+		}
+		var labelErr *taskmeta.LabelError
+		if errors.As(err, &labelErr) {
+			c.JSON(http.StatusBadRequest, gin.H{"detail": labelErr.Error()})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"detail": "更新任务配置失败"})
 		return
 	}
@@ -1950,14 +2226,29 @@ func (s *Server) managerDeleteUserLogs(c *gin.Context) {
 	if !s.managerOwnsUser(c, managerID, userID) {
 		return
 	}
-	if err := s.db.Exec(
-		"DELETE FROM task_job_events WHERE job_id IN (SELECT id FROM task_jobs WHERE manager_id = ? AND user_id = ?)",
-		managerID, userID,
-	).Error; err != nil {
+	var events, agentLogs int64
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Exec(
+			"DELETE FROM task_job_events WHERE job_id IN (SELECT id FROM task_jobs WHERE manager_id = ? AND user_id = ?)",
+			managerID, userID,
+		)
+		if result.Error != nil {
+			return result.Error
+		}
+		events = result.RowsAffected
+		result = tx.Where("manager_id = ? AND user_id = ?", managerID, userID).Delete(&models.AgentLog{})
+		agentLogs = result.RowsAffected
+		return result.Error
+	})
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"detail": "删除日志失败"})
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"message": "logs cleared"})
+	s.audit(models.ActorTypeManager, managerID, "delete_user_logs", "user", userID, datatypes.JSONMap{
+		"events":     events,
+		"agent_logs": agentLogs,
+	}, c.ClientIP())
+	c.JSON(http.StatusOK, gin.H{"message": "logs cleared", "events": events, "agent_logs": agentLogs})
 }
 
 func (s *Server) managerPatchUserSettings(c *gin.Context) {
@@ -1975,23 +2266,31 @@ func (s *Server) managerPatchUserSettings(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"detail": err.Error()})
 		return
 	}
-	if req.CanViewLogs == nil {
+	if req.CanViewLogs == nil && req.RequiredLabels == nil {
 		c.JSON(http.StatusBadRequest, gin.H{"detail": "至少需要提供一个字段"})
 		return
 	}
 
 	updates := map[string]any{"updated_at": time.Now().UTC()}
+	auditDetail := datatypes.JSONMap{"can_view_logs": req.CanViewLogs}
 	if req.CanViewLogs != nil {
 		updates["can_view_logs"] = *req.CanViewLogs
 	}
+	if req.RequiredLabels != nil {
+		labels, err := taskmeta.NormalizeLabels(*req.RequiredLabels)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"detail": "required_labels 无效: " + err.Error()})
+			return
+		}
+		updates["required_labels"] = taskmeta.JoinLabels(labels)
+		auditDetail["required_labels"] = labels
+	}
 
 	if err := s.db.Model(&models.User{}).Where("id = ? AND manager_id = ?", userID, managerID).Updates(updates).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"detail": "更新用户设置失败"})
 		return
 	}
-	s.audit(models.ActorTypeManager, managerID, "patch_user_settings", "user", userID, datatypes.JSONMap{
-		"can_view_logs": req.CanViewLogs,
-	}, c.ClientIP())
+	s.audit(models.ActorTypeManager, managerID, "patch_user_settings", "user", userID, auditDetail, c.ClientIP())
 	c.JSON(http.StatusOK, gin.H{"message": "user settings updated"})
 }
 
@@ -2025,9 +2324,18 @@ func (s *Server) managerDeleteUser(c *gin.Context) {
 		if err := tx.Where("user_id = ?", userID).Delete(&models.UserTaskConfig{}).Error; err != nil {
 			return err
 		}
+		if err := tx.Where("user_id = ?", userID).Delete(&models.UserTaskSchedule{}).Error; err != nil {
+			return err
+		}
 		if err := tx.Where("user_id = ?", userID).Delete(&models.UserToken{}).Error; err != nil {
 			return err
 		}
+		if err := tx.Where("user_id = ? AND manager_id = ?", userID, managerID).Delete(&models.NotificationOutbox{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ? AND manager_id = ?", userID, managerID).Delete(&models.AccountAlert{}).Error; err != nil {
+			return err
+		}
 		if err := tx.Where("id = ? AND manager_id = ?", userID, managerID).Delete(&models.User{}).Error; err != nil {
 			return err
 		}
@@ -2063,9 +2371,18 @@ func (s *Server) managerBatchDeleteUsers(c *gin.Context) {
 		if err := tx.Where("user_id IN ?", req.UserIDs).Delete(&models.UserTaskConfig{}).Error; err != nil {
 			return err
 		}
+		if err := tx.Where("user_id IN ?", req.UserIDs).Delete(&models.UserTaskSchedule{}).Error; err != nil {
+			return err
+		}
 		if err := tx.Where("user_id IN ?", req.UserIDs).Delete(&models.UserToken{}).Error; err != nil {
 			return err
 		}
+		if err := tx.Where("user_id IN ? AND manager_id = ?", req.UserIDs, managerID).Delete(&models.NotificationOutbox{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id IN ? AND manager_id = ?", req.UserIDs, managerID).Delete(&models.AccountAlert{}).Error; err != nil {
+			return err
+		}
 		result := tx.Where("id IN ? AND manager_id = ?", req.UserIDs, managerID).Delete(&models.User{})
 		if result.Error != nil {
 			return result.Error
@@ -2584,44 +2901,25 @@ func (s *Server) userPutMeProfile(c *gin.Context) {
 		updates["username"] = u
 	}
 	if req.NotifyConfig != nil {
-		nc := *req.NotifyConfig
-		emailEnabled, _ := nc["email_enabled"].(bool)
-		email, _ := nc["email"].(string)
-		if len(email) > 254 {
-			email = email[:254]
-		}
-		if emailEnabled && email != "" {
-			if _, err := mail.ParseAddress(email); err != nil {
-				c.JSON(http.StatusBadRequest, gin.H{"detail": "邮箱格式不正确"})
-				return
-			}
-		}
-
-		wechatEnabled, _ := nc["wechat_enabled"].(bool)
-		wechatMiaoCode, _ := nc["wechat_miao_code"].(string)
-		wechatMiaoCode = strings.TrimSpace(wechatMiaoCode)
-		if len(wechatMiaoCode) > 64 {
-			wechatMiaoCode = wechatMiaoCode[:64]
+		input := *req.NotifyConfig
+		// Sections the client did not send keep their stored value, so older
+		// clients that only know the flat email/wechat keys don't wipe them.
+		var current models.User
+		if err := s.db.Select("id, notify_config").Where("id = ?", userID).First(&current).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"detail": "查询用户失败"})
+			return
 		}
-		if wechatMiaoCode != "" {
-			for _, r := range wechatMiaoCode {
-				if !((r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9')) {
-					c.JSON(http.StatusBadRequest, gin.H{"detail": "喵码只能包含字母和数字"})
-					return
-				}
+		for _, key := range []string{"channels", "rules"} {
+			if _, sent := input[key]; !sent {
+				input[key] = current.NotifyConfig[key]
 			}
 		}
-		if wechatEnabled && wechatMiaoCode == "" {
-			c.JSON(http.StatusBadRequest, gin.H{"detail": "启用微信通知需要填写喵码"})
+		nc, err := s.notifier.ValidateConfig(input)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"detail": err.Error()})
 			return
 		}
-
-		updates["notify_config"] = datatypes.JSONMap{
-			"email_enabled":    emailEnabled,
-			"email":            email,
-			"wechat_enabled":   wechatEnabled,
-			"wechat_miao_code": wechatMiaoCode,
-		}
+		updates["notify_config"] = datatypes.JSONMap(nc)
 	}
 	if len(updates) == 0 {
 		c.JSON(http.StatusBadRequest, gin.H{"detail": "没有可更新的字段"})
@@ -2637,6 +2935,10 @@ func (s *Server) userPutMeProfile(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"message": "更新成功"})
 }
 
+func (s *Server) userGetNotifyChannels(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"items": s.notifier.Channels()})
+}
+
 func (s *Server) userGetMeAssets(c *gin.Context) {
 	userID := getUint(c, ctxUserIDKey)
 
@@ -2709,6 +3011,26 @@ func (s *Server) userPutMeTasks(c *gin.Context) {
 			c.JSON(http.StatusBadRequest, gin.H{"detail": "任务配置包含该用户类型不允许的任务"})
 			return
 		}
+		var ruleErr *taskmeta.NextTimeRuleError
+		if errors.As(err, &ruleErr) {
+			c.JSON(http.StatusBadRequest, gin.H{"detail": ruleErr.Error()})
+			return
+		}
+		var depErr *taskmeta.TaskDependencyError
+		if errors.As(err, &depErr) {
+			c.JSON(http.StatusBadRequest, gin.H{"detail": depErr.Error()})
+			return
+		}
+		var retryErr *taskmeta.RetryPolicyError
+		if errors.As(err, &retryErr) {
+			c.JSON(http.StatusBadRequest, gin.H{"detail": retryErr.Error()})
+			return
+		}
+		var labelErr *taskmeta.LabelError
+		if errors.As(err, &labelErr) {
+			c.JSON(http.StatusBadRequest, gin.H{"detail": labelErr.Error()})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"detail": "更新任务配置失败"})
 		return
 	}
@@ -2724,17 +3046,25 @@ func (s *Server) userPutMeTasks(c *gin.Context) {
 	})
 }
 
-func (s *Server) userGetMeLogs(c *gin.Context) {
-	userID := getUint(c, ctxUserIDKey)
-	managerID := getUint(c, ctxManagerIDKey)
-
+// userCanViewLogs answers 404 or 403 itself and returns false unless the
+// manager has opened log access for the user.
+func (s *Server) userCanViewLogs(c *gin.Context, userID uint) bool {
 	var user models.User
 	if err := s.db.Select("can_view_logs").Where("id = ?", userID).First(&user).Error; err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"detail": "用户不存在"})
-		return
+		return false
 	}
 	if !user.CanViewLogs {
 		c.JSON(http.StatusForbidden, gin.H{"detail": "管理员未开放日志查看权限"})
+		return false
+	}
+	return true
+}
+
+func (s *Server) userGetMeLogs(c *gin.Context) {
+	userID := getUint(c, ctxUserIDKey)
+	managerID := getUint(c, ctxManagerIDKey)
+	if !s.userCanViewLogs(c, userID) {
 		return
 	}
 
@@ -2883,21 +3213,59 @@ func (s *Server) agentLogin(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"detail": err.Error()})
 		return
 	}
-	var manager models.Manager
-	if err := s.db.Where("username = ?", req.Username).First(&manager).Error; err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"detail": "账号或密码错误"})
+	if err := normalizeAgentCapabilities(req.Capabilities); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"detail": err.Error()})
 		return
 	}
-	if !auth.VerifyPassword(req.Password, manager.PasswordHash) {
-		c.JSON(http.StatusUnauthorized, gin.H{"detail": "账号或密码错误"})
+	now := time.Now().UTC()
+	var manager models.Manager
+	var key *models.AgentKey
+	switch {
+	case req.APIKey != "":
+		var ok bool
+		if key, manager, ok = s.authenticateAgentKey(c, req.APIKey, req.NodeID, now); !ok {
+			return
+		}
+	case req.Username != "" && req.Password != "":
+		if err := s.db.Where("username = ?", req.Username).First(&manager).Error; err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"detail": "账号或密码错误"})
+			return
+		}
+		if !auth.VerifyPassword(req.Password, manager.PasswordHash) {
+			c.JSON(http.StatusUnauthorized, gin.H{"detail": "账号或密码错误"})
+			return
+		}
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"detail": "请提供 api_key 或账号密码"})
 		return
 	}
-	now := time.Now().UTC()
 	if manager.ExpiresAt == nil || !manager.ExpiresAt.After(now) {
 		c.JSON(http.StatusForbidden, gin.H{"detail": "管理员账号未激活或已过期"})
 		return
 	}
-	if err := s.upsertAgentNode(manager.ID, req.NodeID, req.Version, now); err != nil {
+	policy, err := s.loadAgentVersionPolicy(s.db, manager.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "查询版本策略失败"})
+		return
+	}
+	// A login without a version keeps the one the node reported before.
+	version := req.Version
+	if version == "" {
+		var known models.AgentNode
+		if err := s.db.Select("version").Where("node_id = ? AND manager_id = ?", req.NodeID, manager.ID).First(&known).Error; err == nil {
+			version = known.Version
+		}
+	}
+	versionStatus := policy.status(req.NodeID, version)
+	if versionStatus == agentVersionOutdated && policy.enforcement(version) == models.AgentVersionReject {
+		policy.rejectOutdatedAgent(c, version)
+		return
+	}
+	if _, err := s.upsertAgentNode(manager.ID, req.NodeID, req.Version, req.Capabilities, now); err != nil {
+		if errors.Is(err, errAgentNodeTaken) {
+			c.JSON(http.StatusConflict, gin.H{"detail": "该节点已属于其他管理员"})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"detail": "更新节点信息失败"})
 		return
 	}
@@ -2916,7 +3284,17 @@ func (s *Server) agentLogin(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"detail": "保存Redis Agent会话失败"})
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"token": token, "manager_id": manager.ID, "node_id": req.NodeID, "manager_type": manager.ManagerType})
+	if key != nil {
+		s.markAgentKeyUsed(key.ID, c.ClientIP(), now)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"token":          token,
+		"manager_id":     manager.ID,
+		"node_id":        req.NodeID,
+		"manager_type":   manager.ManagerType,
+		"version_status": versionStatus,
+		"upgrade":        policy.upgrade(version, versionStatus),
+	})
 }
 
 func (s *Server) agentPollJobs(c *gin.Context) {
@@ -2925,10 +3303,29 @@ func (s *Server) agentPollJobs(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"detail": err.Error()})
 		return
 	}
+	if !agentNodeMatches(c, req.NodeID) {
+		return
+	}
 	managerID := getUint(c, ctxManagerIDKey)
 	ctx := c.Request.Context()
+	batchMode := false
+	switch strings.TrimSpace(req.Mode) {
+	case "", pollModeJobs:
+	case pollModeUserBatch:
+		batchMode = true
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"detail": "mode 仅支持 jobs 或 user_batch"})
+		return
+	}
+	if err := normalizeAgentCapabilities(req.Capabilities); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"detail": err.Error()})
+		return
+	}
 	if req.Limit <= 0 {
 		req.Limit = 5
+		if batchMode {
+			req.Limit = 1
+		}
 	}
 	if req.Limit > s.cfg.MaxPollLimit {
 		req.Limit = s.cfg.MaxPollLimit
@@ -2937,53 +3334,202 @@ func (s *Server) agentPollJobs(c *gin.Context) {
 		req.LeaseSeconds = s.cfg.DefaultLeaseSecond
 	}
 
-	now := time.Now().UTC()
-	leaseTTL := time.Duration(req.LeaseSeconds) * time.Second
-	leaseUntil := now.Add(leaseTTL)
+	db := s.db.WithContext(ctx)
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("agent.node_id", req.NodeID))
 
 	// Upsert agent node (outside main transaction)
-	_ = s.upsertAgentNodeTx(s.db, managerID, req.NodeID, "", now)
+	node, err := s.upsertAgentNodeTx(db, managerID, req.NodeID, "", req.Capabilities, time.Now().UTC())
+	metrics.AgentPolls.WithLabelValues(req.NodeID).Inc()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "更新节点信息失败"})
+		return
+	}
+	policy, err := s.loadAgentVersionPolicy(db, managerID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"detail": "查询版本策略失败"})
+		return
+	}
+	versionStatus := policy.status(node.NodeID, node.Version)
+	if versionStatus == agentVersionOutdated {
+		if policy.enforcement(node.Version) == models.AgentVersionReject {
+			policy.rejectOutdatedAgent(c, node.Version)
+			return
+		}
+		// Limited: the node finishes what it holds and still gets commands,
+		// but is handed no new jobs, as if draining.
+		node.Draining = true
+	}
+
+	// Long poll: while there is nothing to lease or deliver, sleep until the
+	// manager gets new jobs or commands or wait_seconds run out, then try again.
+	deadline := time.Now().Add(time.Duration(req.WaitSeconds) * time.Second)
+	for {
+		var wake <-chan struct{}
+		cancel := func() {}
+		if req.WaitSeconds > 0 {
+			// Registered before the attempt so that a wake-up in between is kept.
+			wake, cancel = s.jobWaiters.wait(managerID)
+		}
+		now := time.Now().UTC()
+		leaseUntil := now.Add(time.Duration(req.LeaseSeconds) * time.Second)
+		leasedJobs, err := s.leasePollJobs(ctx, managerID, req, node, batchMode, now)
+		if err != nil {
+			cancel()
+			c.JSON(http.StatusInternalServerError, gin.H{"detail": "获取任务失败"})
+			return
+		}
+		commands := s.deliverAgentCommands(ctx, managerID, req.NodeID, now)
+		remaining := time.Until(deadline)
+		if len(leasedJobs) > 0 || len(commands) > 0 || remaining <= 0 {
+			cancel()
+			resp := pollJobsResponse(leasedJobs, leaseUntil, batchMode)
+			resp["commands"] = commands
+			resp["version_status"] = versionStatus
+			resp["upgrade"] = policy.upgrade(node.Version, versionStatus)
+			c.JSON(http.StatusOK, resp)
+			return
+		}
+		metrics.AgentPollsWaiting.Inc()
+		timer := time.NewTimer(remaining)
+		select {
+		case <-wake:
+		case <-timer.C:
+		case <-ctx.Done():
+		}
+		timer.Stop()
+		cancel()
+		metrics.AgentPollsWaiting.Dec()
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// leasePollJobs runs one poll attempt for a node: it picks the pending jobs
+// the node may run and leases them to it. Nothing is leased to a draining
+// node.
+func (s *Server) leasePollJobs(ctx context.Context, managerID uint, req agentPollJobsRequest, node models.AgentNode, batchMode bool, now time.Time) ([]models.TaskJob, error) {
+	if node.Draining {
+		return nil, nil
+	}
+	leaseTTL := time.Duration(req.LeaseSeconds) * time.Second
+	leaseUntil := now.Add(leaseTTL)
 
 	// Phase 1: Reset expired leases (outside main transaction to reduce lock scope)
 	s.resetExpiredJobLeases(ctx, managerID, now)
 
+	db := s.db.WithContext(ctx)
+
+	// Only jobs the node's capabilities cover, up to its free slots.
+	scope, err := s.nodePollScope(db, managerID, node)
+	if err != nil {
+		return nil, err
+	}
+	if scope.slots == 0 {
+		return nil, nil
+	}
+	if !batchMode && scope.slots > 0 && req.Limit > scope.slots {
+		req.Limit = scope.slots
+	}
+
+	// Jobs of users who are resting stay pending until the rest ends.
+	resting, err := s.restingPendingUsers(managerID, now)
+	if err != nil {
+		return nil, err
+	}
+	for userID := range resting {
+		scope.restingIDs = append(scope.restingIDs, userID)
+	}
+
 	// Phase 2: Acquire candidates with SKIP LOCKED (short transaction)
 	candidates := make([]models.TaskJob, 0, req.Limit)
-	err := s.db.Transaction(func(tx *gorm.DB) error {
-		query := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
-			Where("task_jobs.manager_id = ? AND task_jobs.status = ? AND task_jobs.scheduled_at <= ?", managerID, models.JobStatusPending, now)
-		if len(req.UserTypes) > 0 {
-			query = query.Joins("JOIN users ON users.id = task_jobs.user_id").
-				Where("users.user_type IN ?", req.UserTypes)
+	phaseCtx, span := tracing.Start(ctx, "poll.select_candidates")
+	err = s.db.WithContext(phaseCtx).Transaction(func(tx *gorm.DB) error {
+		query := s.pollCandidateQuery(tx, managerID, req, scope, now).
+			Order("task_jobs.priority desc").Order("task_jobs.scheduled_at asc")
+		if !batchMode {
+			return query.Limit(req.Limit).Find(&candidates).Error
+		}
+		// User batch: the best candidates pick the accounts, then every due
+		// job of those accounts is taken together.
+		var heads []models.TaskJob
+		if err := query.Limit(s.cfg.MaxPollLimit * pollBatchScanFactor).Find(&heads).Error; err != nil {
+			return err
 		}
-		return query.Order("task_jobs.priority desc").Order("task_jobs.scheduled_at asc").Limit(req.Limit).Find(&candidates).Error
+		userIDs := make([]uint, 0, req.Limit)
+		seen := make(map[uint]struct{}, req.Limit)
+		for _, job := range heads {
+			if _, ok := seen[job.UserID]; ok {
+				continue
+			}
+			if len(userIDs) == req.Limit {
+				break
+			}
+			seen[job.UserID] = struct{}{}
+			userIDs = append(userIDs, job.UserID)
+		}
+		if len(userIDs) == 0 {
+			return nil
+		}
+		var batch []models.TaskJob
+		if err := s.pollCandidateQuery(tx, managerID, req, scope, now).
+			Where("task_jobs.user_id IN ?", userIDs).
+			Order("task_jobs.priority desc").Order("task_jobs.scheduled_at asc").
+			Find(&batch).Error; err != nil {
+			return err
+		}
+		// Keep the account order chosen above, cut at the node's free slots.
+		for _, userID := range userIDs {
+			for _, job := range batch {
+				if job.UserID == userID && (scope.slots < 0 || len(candidates) < scope.slots) {
+					candidates = append(candidates, job)
+				}
+			}
+		}
+		return nil
 	})
+	span.SetAttributes(attribute.Int("poll.candidates", len(candidates)))
+	tracing.End(span, err)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"detail": "获取任务失败"})
-		return
+		return nil, err
 	}
 
-	// Phase 3: Try Redis leases (outside DB transaction)
+	// Phase 3: Try Redis leases (outside DB transaction). The account lease
+	// keeps two nodes from logging in to the same game account at once.
 	type leasedCandidate struct {
 		job models.TaskJob
 	}
 	var leased []leasedCandidate
+	accountLeased := make(map[uint]bool)
+	phaseCtx, span = tracing.Start(ctx, "poll.acquire_leases")
 	for _, job := range candidates {
-		acquired, err := s.redisStore.AcquireJobLease(ctx, managerID, job.ID, req.NodeID, leaseTTL)
+		ok, checked := accountLeased[job.UserID]
+		if !checked {
+			acquired, err := s.redisStore.AcquireAccountLease(phaseCtx, managerID, job.UserID, req.NodeID, leaseTTL)
+			ok = err == nil && acquired
+			accountLeased[job.UserID] = ok
+		}
+		if !ok {
+			continue
+		}
+		acquired, err := s.redisStore.AcquireJobLease(phaseCtx, managerID, job.ID, req.NodeID, leaseTTL)
 		if err != nil || !acquired {
 			continue
 		}
 		leased = append(leased, leasedCandidate{job: job})
 	}
+	span.SetAttributes(attribute.Int("poll.leased", len(leased)))
+	tracing.End(span, nil)
 
 	if len(leased) == 0 {
-		c.JSON(http.StatusOK, gin.H{"jobs": []models.TaskJob{}, "lease_until": leaseUntil})
-		return
+		s.releaseIdleAccountLeases(ctx, managerID, req.NodeID, accountLeased, nil)
+		return nil, nil
 	}
 
 	// Phase 4: Update leased jobs in DB (short transaction)
 	leasedJobs := make([]models.TaskJob, 0, len(leased))
-	err = s.db.Transaction(func(tx *gorm.DB) error {
+	phaseCtx, span = tracing.Start(ctx, "poll.update_jobs")
+	err = s.db.WithContext(phaseCtx).Transaction(func(tx *gorm.DB) error {
 		for _, lc := range leased {
 			job := lc.job
 			updateResult := tx.Model(&models.TaskJob{}).Where("id = ? AND status = ?", job.ID, models.JobStatusPending).Updates(map[string]any{
@@ -3013,42 +3559,141 @@ func (s *Server) agentPollJobs(c *gin.Context) {
 		}
 		return nil
 	})
+	tracing.End(span, err)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"detail": "获取任务失败"})
+		s.releaseIdleAccountLeases(ctx, managerID, req.NodeID, accountLeased, nil)
+		return nil, err
+	}
+	s.releaseIdleAccountLeases(ctx, managerID, req.NodeID, accountLeased, leasedJobs)
+	metrics.AgentJobsLeased.WithLabelValues(req.NodeID).Add(float64(len(leasedJobs)))
+	return leasedJobs, nil
+}
+
+// pollBatchScanFactor bounds how many candidates a user batch poll scans to
+// pick its accounts.
+const pollBatchScanFactor = 4
+
+// pollCandidateQuery selects the pending jobs a node may lease now.
+func (s *Server) pollCandidateQuery(tx *gorm.DB, managerID uint, req agentPollJobsRequest, scope pollScope, now time.Time) *gorm.DB {
+	query := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+		Where("task_jobs.manager_id = ? AND task_jobs.status = ? AND task_jobs.scheduled_at <= ?", managerID, models.JobStatusPending, now)
+	if len(scope.restingIDs) > 0 {
+		query = query.Where("task_jobs.user_id NOT IN ?", scope.restingIDs)
+	}
+	if len(scope.taskTypes) > 0 {
+		query = query.Where("task_jobs.task_type IN ?", scope.taskTypes)
+	}
+	if len(scope.jobLabelSets) > 0 {
+		query = query.Where("task_jobs.required_labels NOT IN ?", scope.jobLabelSets)
+	}
+	if len(scope.userLabelSets) > 0 {
+		query = query.Where("task_jobs.user_id NOT IN (SELECT id FROM users WHERE manager_id = ? AND required_labels IN ?)", managerID, scope.userLabelSets)
+	}
+	// Jobs wait until every job they depend on has succeeded.
+	query = query.Where("NOT EXISTS (SELECT 1 FROM task_job_dependencies d JOIN task_jobs p ON p.id = d.depends_on_job_id WHERE d.job_id = task_jobs.id AND p.status <> ?)", models.JobStatusSuccess)
+	// Account affinity: while another node works on an account, its other
+	// jobs stay pending until that node is done.
+	query = query.Where("NOT EXISTS (SELECT 1 FROM task_jobs o WHERE o.user_id = task_jobs.user_id AND o.status IN ? AND o.leased_by_node <> ?)",
+		[]string{models.JobStatusLeased, models.JobStatusRunning}, req.NodeID)
+	if len(req.UserTypes) > 0 {
+		query = query.Joins("JOIN users ON users.id = task_jobs.user_id").
+			Where("users.user_type IN ?", req.UserTypes)
+	}
+	return query
+}
+
+// releaseIdleAccountLeases gives back the account leases a poll took for
+// accounts that ended up with no leased job.
+func (s *Server) releaseIdleAccountLeases(ctx context.Context, managerID uint, nodeID string, accountLeased map[uint]bool, leasedJobs []models.TaskJob) {
+	busy := make(map[uint]struct{}, len(leasedJobs))
+	for _, job := range leasedJobs {
+		busy[job.UserID] = struct{}{}
+	}
+	for userID, ok := range accountLeased {
+		if _, isBusy := busy[userID]; !ok || isBusy {
+			continue
+		}
+		if s.nodeHoldsAccountJobs(managerID, nodeID, userID) {
+			continue
+		}
+		_ = s.redisStore.ReleaseAccountLease(ctx, managerID, userID, nodeID)
+	}
+}
+
+// releaseAccountAfterJob frees the account lease of nodeID once it holds no
+// other job of the user.
+func (s *Server) releaseAccountAfterJob(ctx context.Context, managerID uint, nodeID string, userID uint) {
+	if s.nodeHoldsAccountJobs(managerID, nodeID, userID) {
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"jobs": leasedJobs, "lease_until": leaseUntil})
+	_ = s.redisStore.ReleaseAccountLease(ctx, managerID, userID, nodeID)
+	// The account's other jobs, including those that waited on this one,
+	// are open to every node now.
+	s.wakeAgents(ctx, managerID)
 }
 
-// resetExpiredJobLeases resets expired leased/running jobs back to pending.
-func (s *Server) resetExpiredJobLeases(ctx context.Context, managerID uint, now time.Time) {
-	var expiredJobs []models.TaskJob
-	if err := s.db.Where("manager_id = ? AND status IN ? AND lease_until < ?", managerID, []string{models.JobStatusLeased, models.JobStatusRunning}, now).
-		Find(&expiredJobs).Error; err != nil || len(expiredJobs) == 0 {
-		return
-	}
-	expiredIDs := make([]uint, 0, len(expiredJobs))
-	for _, item := range expiredJobs {
-		expiredIDs = append(expiredIDs, item.ID)
-	}
-	_ = s.db.Model(&models.TaskJob{}).
-		Where("id IN ?", expiredIDs).
-		Updates(map[string]any{"status": models.JobStatusPending, "leased_by_node": "", "lease_until": nil, "updated_at": now, "attempts": gorm.Expr("attempts + 1")}).Error
-	for _, id := range expiredIDs {
-		_ = s.redisStore.ClearJobLease(ctx, managerID, id)
-	}
-	// Record lease_expired events for audit trail
-	events := make([]models.TaskJobEvent, 0, len(expiredIDs))
-	for _, id := range expiredIDs {
-		events = append(events, models.TaskJobEvent{
-			JobID:     id,
-			EventType: "lease_expired",
-			Message:   "租约超时，自动重置为待执行",
-			EventAt:   now,
-		})
+// finalizeJob runs what follows a job's final success or failure: next_time
+// moves on, the agent's result is synced, the user is notified and failure
+// streaks are evaluated.
+func (s *Server) finalizeJob(ctx context.Context, jobID uint, eventType string, message string, result map[string]any, now time.Time) {
+	s.updateTaskNextTime(jobID, eventType, now)
+	if result != nil {
+		s.syncAgentResult(jobID, result, now)
+	}
+	s.triggerTaskNotification(ctx, jobID, eventType, message)
+	s.evaluateFailureStreak(jobID, message, now)
+}
+
+// finishExpiredJob finalizes a job whose lease ran out on its last attempt
+// like an agent's final failure report.
+func (s *Server) finishExpiredJob(ctx context.Context, job models.TaskJob, message string, now time.Time) {
+	if job.LeasedByNode != "" {
+		s.releaseAccountAfterJob(ctx, job.ManagerID, job.LeasedByNode, job.UserID)
+	}
+	s.finalizeJob(ctx, job.ID, "fail", message, nil, now)
+}
+
+// nodeHoldsAccountJobs reports whether nodeID still has leased or running
+// jobs of the user.
+func (s *Server) nodeHoldsAccountJobs(managerID uint, nodeID string, userID uint) bool {
+	var count int64
+	if err := s.db.Model(&models.TaskJob{}).
+		Where("manager_id = ? AND user_id = ? AND leased_by_node = ? AND status IN ?", managerID, userID, nodeID,
+			[]string{models.JobStatusLeased, models.JobStatusRunning}).
+		Count(&count).Error; err != nil {
+		return true
+	}
+	return count > 0
+}
+
+func pollJobsResponse(jobs []models.TaskJob, leaseUntil time.Time, batchMode bool) gin.H {
+	if jobs == nil {
+		jobs = []models.TaskJob{}
+	}
+	resp := gin.H{"jobs": jobs, "lease_until": leaseUntil}
+	if !batchMode {
+		return resp
 	}
-	if len(events) > 0 {
-		_ = s.db.Create(&events).Error
+	batches := make([]gin.H, 0)
+	index := make(map[uint]int)
+	for _, job := range jobs {
+		i, ok := index[job.UserID]
+		if !ok {
+			i = len(batches)
+			index[job.UserID] = i
+			batches = append(batches, gin.H{"user_id": job.UserID, "jobs": []models.TaskJob{}})
+		}
+		batches[i]["jobs"] = append(batches[i]["jobs"].([]models.TaskJob), job)
+	}
+	resp["batches"] = batches
+	return resp
+}
+
+// resetExpiredJobLeases requeues or fails the manager's leased/running jobs
+// whose lease has expired, following each task's retry policy.
+func (s *Server) resetExpiredJobLeases(ctx context.Context, managerID uint, now time.Time) {
+	if _, _, err := scheduler.ExpireJobLeases(ctx, s.db, s.redisStore, managerID, now, s.finishExpiredJob); err != nil {
+		slog.Warn("reset expired job leases failed", "manager_id", managerID, "error", err)
 	}
 }
 
@@ -3074,6 +3719,9 @@ func (s *Server) updateJobStatusByAgent(c *gin.Context, eventType string, nextSt
 		c.JSON(http.StatusBadRequest, gin.H{"detail": err.Error()})
 		return
 	}
+	if !agentNodeMatches(c, req.NodeID) {
+		return
+	}
 	jobID, ok := parseUintParam(c, "job_id")
 	if !ok {
 		return
@@ -3098,7 +3746,9 @@ func (s *Server) updateJobStatusByAgent(c *gin.Context, eventType string, nextSt
 		return
 	}
 
-	err = s.db.Transaction(func(tx *gorm.DB) error {
+	var jobUserID uint
+	var retryAt *time.Time
+	err = s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
 		var job models.TaskJob
 		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ? AND manager_id = ?", jobID, managerID).First(&job).Error; err != nil {
 			return err
@@ -3106,6 +3756,7 @@ func (s *Server) updateJobStatusByAgent(c *gin.Context, eventType string, nextSt
 		if job.LeasedByNode != req.NodeID {
 			return fmt.Errorf("node does not own this job")
 		}
+		jobUserID = job.UserID
 
 		updates := map[string]any{"updated_at": now}
 		if nextStatus != "" {
@@ -3114,16 +3765,44 @@ func (s *Server) updateJobStatusByAgent(c *gin.Context, eventType string, nextSt
 		if eventType == "heartbeat" || eventType == "start" {
 			updates["lease_until"] = leaseUntil
 		}
+		var retryEvent *models.TaskJobEvent
 		if eventType == "fail" {
-			updates["attempts"] = gorm.Expr("attempts + 1")
+			attempts := job.Attempts + 1
+			updates["attempts"] = attempts
+			policies, err := scheduler.LoadJobRetryPolicies(tx, []models.TaskJob{job})
+			if err != nil {
+				return err
+			}
+			if retry, delay := policies[job.ID].Decide(attempts, job.MaxAttempts, req.ErrorCode); retry {
+				at := now.Add(delay)
+				retryAt = &at
+				updates["status"] = models.JobStatusPending
+				updates["scheduled_at"] = at
+				updates["leased_by_node"] = ""
+				updates["lease_until"] = nil
+				retryEvent = &models.TaskJobEvent{
+					JobID:     job.ID,
+					EventType: "retry_scheduled",
+					Message:   fmt.Sprintf("第 %d/%d 次尝试失败，%s后重试", attempts, job.MaxAttempts, taskmeta.FormatRetryDelay(delay)),
+					ErrorCode: req.ErrorCode,
+					EventAt:   now,
+				}
+			}
 		}
 		if err := tx.Model(&models.TaskJob{}).Where("id = ?", job.ID).Updates(updates).Error; err != nil {
 			return err
 		}
 		event := models.TaskJobEvent{JobID: job.ID, EventType: eventType, Message: req.Message, ErrorCode: req.ErrorCode, EventAt: now}
+		if retryEvent != nil {
+			// Only the last attempt's failure counts as the job failing.
+			event.EventType = "attempt_failed"
+		}
 		if err := tx.Create(&event).Error; err != nil {
 			return err
 		}
+		if retryEvent != nil {
+			return tx.Create(retryEvent).Error
+		}
 		return nil
 	})
 	if err != nil {
@@ -3138,6 +3817,9 @@ func (s *Server) updateJobStatusByAgent(c *gin.Context, eventType string, nextSt
 		c.JSON(http.StatusBadRequest, gin.H{"detail": err.Error()})
 		return
 	}
+	// A node busy with long jobs may not poll for a while; its reports keep
+	// it from being taken for offline.
+	s.touchAgentNode(ctx, managerID, req.NodeID, now)
 
 	if eventType == "heartbeat" || eventType == "start" {
 		refreshed, leaseErr := s.redisStore.RefreshJobLease(ctx, managerID, jobID, req.NodeID, leaseTTL)
@@ -3149,25 +3831,37 @@ func (s *Server) updateJobStatusByAgent(c *gin.Context, eventType string, nextSt
 			c.JSON(http.StatusConflict, gin.H{"detail": "Redis租约刷新冲突"})
 			return
 		}
+		_, _ = s.redisStore.AcquireAccountLease(ctx, managerID, jobUserID, req.NodeID, leaseTTL)
 	}
 
 	if eventType == "success" || eventType == "fail" {
+		s.releaseAccountAfterJob(ctx, managerID, req.NodeID, jobUserID)
 		if leaseErr := s.redisStore.ReleaseJobLease(ctx, managerID, jobID, req.NodeID); leaseErr != nil {
 			c.JSON(http.StatusOK, gin.H{"message": "ok", "lease_warning": leaseErr.Error()})
 			return
 		}
 	}
 
-	// Update next_time in UserTaskConfig after success or fail
-	if eventType == "success" || eventType == "fail" {
-		s.updateTaskNextTime(jobID, eventType, now)
+	// A failure that will be retried is not final: next_time, notifications
+	// and failure streaks wait for the job's last attempt.
+	if retryAt != nil {
 		if req.Result != nil {
 			s.syncAgentResult(jobID, req.Result, now)
 		}
-		s.triggerTaskNotification(jobID, eventType, req.Message)
+		c.JSON(http.StatusOK, gin.H{"message": "ok", "retry_at": retryAt})
+		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "ok"})
+	if eventType == "success" || eventType == "fail" {
+		s.finalizeJob(ctx, jobID, eventType, req.Message, req.Result, now)
+	}
+
+	resp := gin.H{"message": "ok"}
+	if eventType == "heartbeat" {
+		// A node busy with a long job may not poll until it is done.
+		resp["commands"] = s.deliverAgentCommands(ctx, managerID, req.NodeID, now)
+	}
+	c.JSON(http.StatusOK, resp)
 }
 
 // updateTaskNextTime updates the next_time in UserTaskConfig after job success or fail.
@@ -3198,11 +3892,11 @@ func (s *Server) updateTaskNextTime(jobID uint, eventType string, now time.Time)
 
 	var newNextTime time.Time
 	if eventType == "success" {
-		rule := taskmeta.GetNextTimeRule(job.TaskType)
-		if rule == "" || rule == "on_demand" {
+		rule := taskmeta.EffectiveNextTimeRule(job.TaskType, taskMap)
+		if rule == "" || rule == taskmeta.RuleOnDemand {
 			return
 		}
-		newNextTime = taskmeta.CalcNextTime(rule, now)
+		newNextTime = taskmeta.CalcNextTimeForUser(rule, now, job.UserID, s.managerSpread(job.ManagerID))
 	} else if eventType == "fail" {
 		failDelay := taskmeta.ParseAssetInt(taskMap["fail_delay"], 30)
 		if failDelay <= 0 {
@@ -3218,13 +3912,21 @@ func (s *Server) updateTaskNextTime(jobID uint, eventType string, now time.Time)
 	taskMap["next_time"] = newNextTime.In(taskmeta.BJLoc).Format("2006-01-02 15:04")
 	taskConfig[job.TaskType] = taskMap
 
-	_ = s.db.Model(&models.UserTaskConfig{}).
-		Where("id = ?", cfg.ID).
-		Updates(map[string]any{
-			"task_config": datatypes.JSONMap(taskConfig),
-			"updated_at":  now,
-			"version":     gorm.Expr("version + 1"),
-		}).Error
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.UserTaskConfig{}).
+			Where("id = ?", cfg.ID).
+			Updates(map[string]any{
+				"task_config": datatypes.JSONMap(taskConfig),
+				"updated_at":  now,
+				"version":     gorm.Expr("version + 1"),
+			}).Error; err != nil {
+			return err
+		}
+		return scheduler.SyncDueEntries(tx, job.UserID, taskConfig, []string{job.TaskType}, now)
+	})
+	if err != nil {
+		slog.Error("failed to update task next_time", "job_id", job.ID, "task_type", job.TaskType, "error", err)
+	}
 }
 
 // syncAgentResult syncs the agent-reported result (assets, status, explore_progress) back to the User record.
@@ -3243,7 +3945,7 @@ func (s *Server) syncAgentResult(jobID uint, result map[string]any, now time.Tim
 			updates["archive_status"] = "normal"
 		case "invalid":
 			updates["archive_status"] = "invalid"
-		// 其他非法值忽略，不写入 archive_status
+			// 其他非法值忽略，不写入 archive_status
 		}
 	}
 
@@ -3255,10 +3957,22 @@ func (s *Server) syncAgentResult(jobID uint, result map[string]any, now time.Tim
 		updates["explore_progress"] = datatypes.JSONMap(progress)
 	}
 
+	var previous models.User
+	archiveStatus, archiveReported := updates["archive_status"].(string)
+	if archiveReported {
+		if err := s.db.Select("id, manager_id, archive_status").Where("id = ?", job.UserID).First(&previous).Error; err != nil {
+			archiveReported = false
+		}
+	}
+
 	if len(updates) > 1 {
 		_ = s.db.Model(&models.User{}).Where("id = ?", job.UserID).Updates(updates).Error
 	}
 
+	if archiveReported {
+		s.onArchiveStatusReported(previous, archiveStatus, now)
+	}
+
 	// Apply agent-reported task_next_times for on_demand tasks (e.g. 放卡)
 	if taskNextTimes, ok := result["task_next_times"].(map[string]any); ok && len(taskNextTimes) > 0 {
 		s.applyTaskNextTimes(job.UserID, taskNextTimes, now)
@@ -3279,15 +3993,24 @@ func (s *Server) applyTaskNextTimes(userID uint, taskNextTimes map[string]any, n
 		return
 	}
 
-	changed := false
+	var changed []string
 	for taskName, rawNextTime := range taskNextTimes {
 		nextTimeStr, ok := rawNextTime.(string)
 		if !ok || nextTimeStr == "" {
 			continue
 		}
 
+		rawTaskCfg, exists := taskConfig[taskName]
+		if !exists {
+			continue
+		}
+		taskMap, ok := rawTaskCfg.(map[string]any)
+		if !ok {
+			continue
+		}
+
 		// Only allow agent-overridable tasks to be updated
-		if !taskmeta.IsAgentNextTimeAllowed(taskName) {
+		if !taskmeta.IsAgentNextTimeAllowed(taskName, taskMap) {
 			continue
 		}
 
@@ -3302,89 +4025,30 @@ func (s *Server) applyTaskNextTimes(userID uint, taskNextTimes map[string]any, n
 			continue
 		}
 
-		rawTaskCfg, exists := taskConfig[taskName]
-		if !exists {
-			continue
-		}
-		taskMap, ok := rawTaskCfg.(map[string]any)
-		if !ok {
-			continue
-		}
-
 		taskMap["next_time"] = nextTimeStr
 		taskConfig[taskName] = taskMap
-		changed = true
-	}
-
-	if changed {
-		_ = s.db.Model(&models.UserTaskConfig{}).
-			Where("id = ?", cfg.ID).
-			Updates(map[string]any{
-				"task_config": datatypes.JSONMap(taskConfig),
-				"updated_at":  now,
-				"version":     gorm.Expr("version + 1"),
-			}).Error
-	}
-}
-
-// notifyWorker consumes NotifyRequests from notifyCh and sends notifications.
-func (s *Server) notifyWorker() {
-	for req := range s.notifyCh {
-		var user models.User
-		if err := s.db.Select("id, account_no, username, notify_config").
-			Where("id = ?", req.UserID).First(&user).Error; err != nil {
-			slog.Warn("failed to load user for notification", "user_id", req.UserID, "error", err)
-			continue
-		}
-
-		nc := map[string]any(user.NotifyConfig)
-		if nc == nil {
-			continue
-		}
-
-		req.AccountNo = user.AccountNo
-		req.Username = user.Username
-
-		wechatEnabled, _ := nc["wechat_enabled"].(bool)
-		miaoCode, _ := nc["wechat_miao_code"].(string)
-		if wechatEnabled && miaoCode != "" {
-			text := notify.BuildNotificationText(req)
-			if err := s.notifier.SendMiaoTiXing(miaoCode, text); err != nil {
-				slog.Warn("wechat notification send failed", "user_id", req.UserID, "error", err)
+		changed = append(changed, taskName)
+	}
+
+	if len(changed) > 0 {
+		err := s.db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Model(&models.UserTaskConfig{}).
+				Where("id = ?", cfg.ID).
+				Updates(map[string]any{
+					"task_config": datatypes.JSONMap(taskConfig),
+					"updated_at":  now,
+					"version":     gorm.Expr("version + 1"),
+				}).Error; err != nil {
+				return err
 			}
+			return scheduler.SyncDueEntries(tx, userID, taskConfig, changed, now)
+		})
+		if err != nil {
+			slog.Error("failed to sync agent next_time", "user_id", userID, "error", err)
 		}
 	}
 }
 
-// triggerTaskNotification sends a non-blocking notification request for a completed/failed job.
-func (s *Server) triggerTaskNotification(jobID uint, eventType string, message string) {
-	var job models.TaskJob
-	if err := s.db.Select("id, user_id, task_type").Where("id = ?", jobID).First(&job).Error; err != nil {
-		return
-	}
-
-	req := notify.NotifyRequest{
-		UserID:    job.UserID,
-		TaskType:  job.TaskType,
-		EventType: eventType,
-		Message:   message,
-	}
-
-	select {
-	case s.notifyCh <- req:
-	default:
-		// Retry once after short delay rather than dropping immediately
-		go func() {
-			time.Sleep(2 * time.Second)
-			select {
-			case s.notifyCh <- req:
-			default:
-				slog.Warn("notify channel still full after retry, dropping notification", "job_id", jobID)
-			}
-		}()
-	}
-}
-
 func (s *Server) agentGetUserFullConfig(c *gin.Context) {
 	userID, ok := parseUintParam(c, "user_id")
 	if !ok {
@@ -3496,54 +4160,6 @@ func (s *Server) agentUpdateExploreProgress(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"message": "ok"})
 }
 
-func (s *Server) agentReportLogs(c *gin.Context) {
-	userID, ok := parseUintParam(c, "user_id")
-	if !ok {
-		return
-	}
-	managerID := getUint(c, ctxManagerIDKey)
-
-	var req struct {
-		Logs []struct {
-			Type    string `json:"type"`
-			Level   string `json:"level"`
-			Message string `json:"message"`
-			Ts      string `json:"ts"`
-		} `json:"logs"`
-	}
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"detail": err.Error()})
-		return
-	}
-
-	// Verify user belongs to this manager
-	var count int64
-	if err := s.db.Model(&models.User{}).Where("id = ? AND manager_id = ?", userID, managerID).Count(&count).Error; err != nil || count == 0 {
-		c.JSON(http.StatusNotFound, gin.H{"detail": "用户不存在"})
-		return
-	}
-
-	now := time.Now().UTC()
-	if len(req.Logs) > 0 {
-		entries := make([]models.AuditLog, 0, len(req.Logs))
-		for _, logEntry := range req.Logs {
-			entries = append(entries, models.AuditLog{
-				ActorType:  "agent",
-				ActorID:    managerID,
-				Action:     logEntry.Type,
-				TargetType: "user",
-				TargetID:   userID,
-				Detail:     datatypes.JSONMap{"level": logEntry.Level, "message": logEntry.Message, "ts": logEntry.Ts},
-				CreatedAt:  now,
-			})
-		}
-		if err := s.db.Create(&entries).Error; err != nil {
-			slog.Error("batch audit log insert failed", "error", err)
-		}
-	}
-	c.JSON(http.StatusOK, gin.H{"message": "ok", "count": len(req.Logs)})
-}
-
 func (s *Server) createUserByActivationCode(tx *gorm.DB, code *models.UserActivationCode, createdBy string, now time.Time) (*models.User, error) {
 	if code.Status != models.CodeStatusUnused {
 		return nil, fmt.Errorf("activation code already consumed")
@@ -3590,6 +4206,9 @@ func (s *Server) createUserByActivationCode(tx *gorm.DB, code *models.UserActiva
 	if err := tx.Create(&cfg).Error; err != nil {
 		return nil, err
 	}
+	if err := scheduler.SyncDueIndex(tx, user.ID, map[string]any(cfg.TaskConfig), now); err != nil {
+		return nil, err
+	}
 	return &user, nil
 }
 
@@ -3660,27 +4279,62 @@ func (s *Server) issueUserToken(userID uint, deviceInfo string) (string, time.Ti
 	return raw, exp, nil
 }
 
-func (s *Server) upsertAgentNode(managerID uint, nodeID, version string, now time.Time) error {
-	return s.upsertAgentNodeTx(s.db, managerID, nodeID, version, now)
+func (s *Server) upsertAgentNode(managerID uint, nodeID, version string, caps *agentCapabilities, now time.Time) (models.AgentNode, error) {
+	return s.upsertAgentNodeTx(s.db, managerID, nodeID, version, caps, now)
 }
 
-func (s *Server) upsertAgentNodeTx(tx *gorm.DB, managerID uint, nodeID, version string, now time.Time) error {
+// errAgentNodeTaken is returned for a node ID registered under another
+// manager. Node IDs are unique across managers, and a node never changes hands.
+var errAgentNodeTaken = errors.New("agent node belongs to another manager")
+
+// upsertAgentNodeTx records a sign of life from a node. An empty version, as
+// sent by polls, keeps the one reported at login, and nil caps keep the
+// capabilities declared before.
+func (s *Server) upsertAgentNodeTx(tx *gorm.DB, managerID uint, nodeID, version string, caps *agentCapabilities, now time.Time) (models.AgentNode, error) {
 	var node models.AgentNode
 	err := tx.Where("node_id = ?", nodeID).First(&node).Error
+	if err == nil && node.ManagerID != managerID {
+		return node, errAgentNodeTaken
+	}
 	if errors.Is(err, gorm.ErrRecordNotFound) {
-		node = models.AgentNode{ManagerID: managerID, NodeID: nodeID, LastHeartbeat: now, Status: "online", Version: version, CreatedAt: now, UpdatedAt: now}
-		return tx.Create(&node).Error
+		node = models.AgentNode{ManagerID: managerID, NodeID: nodeID, LastHeartbeat: now, Status: models.AgentStatusOnline, Version: version, CreatedAt: now, UpdatedAt: now}
+		if caps != nil {
+			node.TaskTypes = taskmeta.JoinLabels(caps.TaskTypes)
+			node.MaxConcurrency = caps.MaxConcurrency
+			node.Labels = taskmeta.JoinLabels(caps.Labels)
+		}
+		return node, tx.Create(&node).Error
 	}
 	if err != nil {
-		return err
+		return node, err
 	}
-	return tx.Model(&models.AgentNode{}).Where("id = ?", node.ID).Updates(map[string]any{
-		"manager_id":     managerID,
+	updates := map[string]any{
 		"last_heartbeat": now,
-		"status":         "online",
-		"version":        version,
+		"status":         models.AgentStatusOnline,
 		"updated_at":     now,
-	}).Error
+	}
+	if version != "" {
+		updates["version"] = version
+	}
+	if caps != nil {
+		updates["task_types"] = taskmeta.JoinLabels(caps.TaskTypes)
+		updates["max_concurrency"] = caps.MaxConcurrency
+		updates["labels"] = taskmeta.JoinLabels(caps.Labels)
+	}
+	if err := tx.Model(&models.AgentNode{}).Where("id = ?", node.ID).Updates(updates).Error; err != nil {
+		return node, err
+	}
+	node.LastHeartbeat = now
+	node.Status = models.AgentStatusOnline
+	if version != "" {
+		node.Version = version
+	}
+	if caps != nil {
+		node.TaskTypes = taskmeta.JoinLabels(caps.TaskTypes)
+		node.MaxConcurrency = caps.MaxConcurrency
+		node.Labels = taskmeta.JoinLabels(caps.Labels)
+	}
+	return node, nil
 }
 
 func (s *Server) managerOwnsUser(c *gin.Context, managerID, userID uint) bool {
@@ -3716,6 +4370,7 @@ func (s *Server) getOrCreateTaskConfig(userID uint) (*models.UserTaskConfig, err
 		if err := s.db.Create(&cfg).Error; err != nil {
 			return nil, err
 		}
+		_ = scheduler.SyncDueIndex(s.db, userID, map[string]any(cfg.TaskConfig), now)
 		return &cfg, nil
 	}
 	if err != nil {
@@ -3727,11 +4382,13 @@ func (s *Server) getOrCreateTaskConfig(userID uint) (*models.UserTaskConfig, err
 		cfg.TaskConfig = datatypes.JSONMap(normalized)
 		cfg.Version = cfg.Version + 1
 		cfg.UpdatedAt = time.Now().UTC()
-		_ = s.db.Model(&models.UserTaskConfig{}).Where("id = ?", cfg.ID).Updates(map[string]any{
+		if err := s.db.Model(&models.UserTaskConfig{}).Where("id = ?", cfg.ID).Updates(map[string]any{
 			"task_config": cfg.TaskConfig,
 			"updated_at":  cfg.UpdatedAt,
 			"version":     cfg.Version,
-		}).Error
+		}).Error; err == nil {
+			_ = scheduler.SyncDueIndex(s.db, userID, normalized, cfg.UpdatedAt)
+		}
 	} else {
 		cfg.TaskConfig = datatypes.JSONMap(normalized)
 	}
@@ -3751,6 +4408,15 @@ func (s *Server) mergeTaskConfig(userID uint, patch map[string]any) (*models.Use
 		if err != nil {
 			return fmt.Errorf("%w: %v", errInvalidTaskConfigPatch, err)
 		}
+		if err := taskmeta.NormalizeNextTimeRules(filteredPatch); err != nil {
+			return err
+		}
+		if err := taskmeta.NormalizeTaskDependencies(filteredPatch); err != nil {
+			return err
+		}
+		if err := taskmeta.NormalizeRequiredLabels(filteredPatch); err != nil {
+			return err
+		}
 
 		var cfg models.UserTaskConfig
 		err = tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("user_id = ?", userID).First(&cfg).Error
@@ -3785,6 +4451,12 @@ func (s *Server) mergeTaskConfig(userID uint, patch map[string]any) (*models.Use
 		}
 
 		merged := deepMergeMap(base, filteredPatch)
+		if err := taskmeta.ValidateTaskDependencies(merged); err != nil {
+			return err
+		}
+		if err := taskmeta.NormalizeRetryPolicies(merged); err != nil {
+			return err
+		}
 
 		// Detect next_time or enabled changes and expire stale pending tasks
 		var changedTaskTypes []string
@@ -3839,6 +4511,9 @@ func (s *Server) mergeTaskConfig(userID uint, patch map[string]any) (*models.Use
 		}).Error; err != nil {
 			return err
 		}
+		if err := scheduler.SyncDueIndex(tx, userID, merged, now); err != nil {
+			return err
+		}
 		result = cfg
 		return nil
 	})
@@ -3859,7 +4534,10 @@ func (s *Server) ensureTaskConfigForTypeTx(tx *gorm.DB, userID uint, userType st
 			UpdatedAt:  now,
 			Version:    1,
 		}
-		return tx.Create(&cfg).Error
+		if err := tx.Create(&cfg).Error; err != nil {
+			return err
+		}
+		return scheduler.SyncDueIndex(tx, userID, map[string]any(cfg.TaskConfig), now)
 	}
 	if err != nil {
 		return err
@@ -3868,11 +4546,14 @@ func (s *Server) ensureTaskConfigForTypeTx(tx *gorm.DB, userID uint, userType st
 	cfg.TaskConfig = datatypes.JSONMap(normalized)
 	cfg.UpdatedAt = now
 	cfg.Version = cfg.Version + 1
-	return tx.Model(&models.UserTaskConfig{}).Where("id = ?", cfg.ID).Updates(map[string]any{
+	if err := tx.Model(&models.UserTaskConfig{}).Where("id = ?", cfg.ID).Updates(map[string]any{
 		"task_config": cfg.TaskConfig,
 		"updated_at":  cfg.UpdatedAt,
 		"version":     cfg.Version,
-	}).Error
+	}).Error; err != nil {
+		return err
+	}
+	return scheduler.SyncDueIndex(tx, userID, normalized, now)
 }
 
 func generateChineseDescription(eventType, message, errorCode, leasedByNode string) string {
@@ -3895,6 +4576,12 @@ func generateChineseDescription(eventType, message, errorCode, leasedByNode stri
 			desc += "：" + chineseErrorCode(errorCode)
 		}
 		return desc
+	case "attempt_failed":
+		desc := "本次尝试失败"
+		if errorCode != "" {
+			desc += "：" + chineseErrorCode(errorCode)
+		}
+		return desc
 	default:
 		if message != "" {
 			return message
@@ -4083,9 +4770,12 @@ func (s *Server) auditWorker() {
 		if len(batch) == 0 {
 			return
 		}
-		if err := s.db.Create(&batch).Error; err != nil {
+		ctx, span := tracing.Start(context.Background(), "audit.flush", attribute.Int("audit.entries", len(batch)))
+		err := s.db.WithContext(ctx).Create(&batch).Error
+		if err != nil {
 			slog.Error("audit batch insert failed", "error", err)
 		}
+		tracing.End(span, err)
 		batch = batch[:0]
 	}
 
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"oas-cloud-go/internal/models"
+
+	"gorm.io/datatypes"
+)
+
+func TestDependentJobWaitsForPrerequisite(t *testing.T) {
+	srv, db := setupTestServer(t)
+	manager := createActiveManager(t, db, "manager_depends", "passwordDeps123")
+	token := loginManagerToken(t, srv, "manager_depends", "passwordDeps123")
+	user := createNotifyTestUser(t, srv, manager.ID, "U_DEPENDS_001", datatypes.JSONMap{})
+
+	at := time.Now().UTC().Add(-time.Minute)
+	explore := createAlertTestJob(t, srv, user, "探索突破", models.JobStatusPending, at)
+	card := createAlertTestJob(t, srv, user, "结界卡合成", models.JobStatusPending, at)
+	if err := db.Model(&models.TaskJob{}).Where("id = ?", card.ID).Update("priority", 100).Error; err != nil {
+		t.Fatalf("raise priority failed: %v", err)
+	}
+	if err := db.Create(&models.TaskJobDependency{JobID: card.ID, DependsOnJobID: explore.ID, CreatedAt: at}).Error; err != nil {
+		t.Fatalf("create dependency failed: %v", err)
+	}
+
+	resp := doJSONRequest(t, srv.router, http.MethodGet, "/api/v1/manager/task-pool", nil, token)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("task-pool failed, status=%d body=%s", resp.Code, resp.Body.String())
+	}
+	body := decodeBodyMap(t, resp.Body.Bytes())
+	if held := body["summary"].(map[string]any)["dependency_held"]; held != float64(1) {
+		t.Fatalf("expected dependency_held=1, got %v", held)
+	}
+	for _, raw := range body["items"].([]any) {
+		item := raw.(map[string]any)
+		if item["id"] != float64(card.ID) {
+			continue
+		}
+		waiting, _ := item["waiting_for"].([]any)
+		if len(waiting) != 1 || waiting[0].(map[string]any)["task_type"] != "探索突破" {
+			t.Fatalf("dependent job should explain what it waits for: %v", item)
+		}
+	}
+
+	loginResp := doJSONRequest(t, srv.router, http.MethodPost, "/api/v1/agent/auth/login", map[string]any{
+		"username": "manager_depends",
+		"password": "passwordDeps123",
+		"node_id":  "node-depends",
+	}, "")
+	if loginResp.Code != http.StatusOK {
+		t.Fatalf("agent login failed, status=%d body=%s", loginResp.Code, loginResp.Body.String())
+	}
+	agentToken := extractTokenFromBody(t, loginResp.Body.Bytes())
+	poll := func() []any {
+		resp := doJSONRequest(t, srv.router, http.MethodPost, "/api/v1/agent/poll-jobs", map[string]any{
+			"node_id": "node-depends",
+			"limit":   10,
+		}, agentToken)
+		if resp.Code != http.StatusOK {
+			t.Fatalf("poll failed, status=%d body=%s", resp.Code, resp.Body.String())
+		}
+		return decodeBodyMap(t, resp.Body.Bytes())["jobs"].([]any)
+	}
+
+	jobs := poll()
+	if len(jobs) != 1 || jobs[0].(map[string]any)["TaskType"] != "探索突破" {
+		t.Fatalf("only the prerequisite should be leased first, got %v", jobs)
+	}
+	var waiting models.TaskJob
+	if err := db.Where("id = ?", card.ID).First(&waiting).Error; err != nil || waiting.Status != models.JobStatusPending {
+		t.Fatalf("dependent job should stay pending, got %s err=%v", waiting.Status, err)
+	}
+
+	if err := db.Model(&models.TaskJob{}).Where("id = ?", explore.ID).Update("status", models.JobStatusSuccess).Error; err != nil {
+		t.Fatalf("complete prerequisite failed: %v", err)
+	}
+	jobs = poll()
+	if len(jobs) != 1 || jobs[0].(map[string]any)["ID"] != float64(card.ID) {
+		t.Fatalf("dependent job should be leased after the prerequisite succeeded, got %v", jobs)
+	}
+}
+
+func TestTaskConfigDependsOnValidation(t *testing.T) {
+	srv, db := setupTestServer(t)
+	manager := createActiveManager(t, db, "manager_depends_cfg", "passwordDeps123")
+	token := loginManagerToken(t, srv, "manager_depends_cfg", "passwordDeps123")
+	user := createNotifyTestUser(t, srv, manager.ID, "U_DEPENDS_CFG_001", datatypes.JSONMap{})
+	path := "/api/v1/manager/users/" + itoa(user.ID) + "/tasks"
+
+	resp := doJSONRequest(t, srv.router, http.MethodPut, path, map[string]any{
+		"task_config": map[string]any{"探索突破": map[string]any{"depends_on": []any{"结界卡合成"}}},
+	}, token)
+	if resp.Code != http.StatusBadRequest || !strings.Contains(resp.Body.String(), "循环依赖") {
+		t.Fatalf("cycle should be rejected, status=%d body=%s", resp.Code, resp.Body.String())
+	}
+
+	resp = doJSONRequest(t, srv.router, http.MethodPut, path, map[string]any{
+		"task_config": map[string]any{"签到": map[string]any{"after": []any{"领取邮件"}}},
+	}, token)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("after alias should be accepted, status=%d body=%s", resp.Code, resp.Body.String())
+	}
+	taskConfig := decodeBodyMap(t, resp.Body.Bytes())["task_config"].(map[string]any)
+	signIn := taskConfig["签到"].(map[string]any)
+	if deps, _ := signIn["depends_on"].([]any); len(deps) != 1 || deps[0] != "领取邮件" {
+		t.Fatalf("after should be stored as depends_on, got %v", signIn)
+	}
+	if _, ok := signIn["after"]; ok {
+		t.Fatalf("after should not be stored: %v", signIn)
+	}
+	if deps, _ := taskConfig["结界卡合成"].(map[string]any)["depends_on"].([]any); len(deps) != 1 || deps[0] != "探索突破" {
+		t.Fatalf("default depends_on should be kept, got %v", taskConfig["结界卡合成"])
+	}
+}
@@ -22,8 +22,9 @@ import (
 
 type inMemoryStore struct {
 	mu              sync.Mutex
-	agentSessions   map[string]uint
+	agentSessions   map[string]agentSessionRecord
 	jobLeases       map[string]leaseRecord
+	accountLeases   map[string]leaseRecord
 	scheduleSlots   map[string]time.Time
 	managerExpiries map[uint]time.Time
 	scanLeases      map[uint]leaseRecord
@@ -32,6 +33,10 @@ type inMemoryStore struct {
 	scanHeartbeats  map[uint]time.Time
 	userTokenCache  map[string]userTokenCacheRecord
 	rateLimits      map[string]rateLimitRecord
+	leaders         map[string]leaseRecord
+	leaderFences    map[string]int64
+	jobsReady       []func(managerID uint)
+	agentLogs       []func(payload []byte)
 }
 
 type userTokenCacheRecord struct {
@@ -53,6 +58,11 @@ type cooldownRecord struct {
 	lastAt time.Time
 }
 
+type agentSessionRecord struct {
+	managerID uint
+	nodeID    string
+}
+
 type leaseRecord struct {
 	nodeID   string
 	expireAt time.Time
@@ -60,8 +70,9 @@ type leaseRecord struct {
 
 func newInMemoryStore() *inMemoryStore {
 	return &inMemoryStore{
-		agentSessions:   map[string]uint{},
+		agentSessions:   map[string]agentSessionRecord{},
 		jobLeases:       map[string]leaseRecord{},
+		accountLeases:   map[string]leaseRecord{},
 		scheduleSlots:   map[string]time.Time{},
 		managerExpiries: map[uint]time.Time{},
 		scanLeases:      map[uint]leaseRecord{},
@@ -70,6 +81,8 @@ func newInMemoryStore() *inMemoryStore {
 		scanHeartbeats:  map[uint]time.Time{},
 		userTokenCache:  map[string]userTokenCacheRecord{},
 		rateLimits:      map[string]rateLimitRecord{},
+		leaders:         map[string]leaseRecord{},
+		leaderFences:    map[string]int64{},
 	}
 }
 
@@ -80,15 +93,28 @@ func (s *inMemoryStore) Ping(ctx context.Context) error { return nil }
 func (s *inMemoryStore) SaveAgentSession(ctx context.Context, token string, managerID uint, nodeID string, ttl time.Duration) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.agentSessions[token] = managerID
+	s.agentSessions[token] = agentSessionRecord{managerID: managerID, nodeID: nodeID}
 	return nil
 }
 
-func (s *inMemoryStore) ValidateAgentSession(ctx context.Context, token string, managerID uint) (bool, error) {
+func (s *inMemoryStore) ValidateAgentSession(ctx context.Context, token string, managerID uint) (string, bool, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	value, ok := s.agentSessions[token]
-	return ok && value == managerID, nil
+	return value.nodeID, ok && value.managerID == managerID, nil
+}
+
+func (s *inMemoryStore) RevokeAgentSessions(ctx context.Context, managerID uint, nodeID string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	revoked := 0
+	for token, session := range s.agentSessions {
+		if session.managerID == managerID && session.nodeID == nodeID {
+			delete(s.agentSessions, token)
+			revoked++
+		}
+	}
+	return revoked, nil
 }
 
 func (s *inMemoryStore) leaseKey(managerID uint, jobID uint) string {
@@ -159,6 +185,108 @@ func (s *inMemoryStore) ClearJobLease(ctx context.Context, managerID uint, jobID
 	return nil
 }
 
+func (s *inMemoryStore) AcquireAccountLease(ctx context.Context, managerID uint, userID uint, nodeID string, ttl time.Duration) (bool, error) {
+	if ttl <= 0 {
+		ttl = 30 * time.Second
+	}
+	key := s.leaseKey(managerID, userID)
+	now := time.Now().UTC()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if record, ok := s.accountLeases[key]; ok && record.expireAt.After(now) && record.nodeID != nodeID {
+		return false, nil
+	}
+	s.accountLeases[key] = leaseRecord{nodeID: nodeID, expireAt: now.Add(ttl)}
+	return true, nil
+}
+
+func (s *inMemoryStore) ReleaseAccountLease(ctx context.Context, managerID uint, userID uint, nodeID string) error {
+	key := s.leaseKey(managerID, userID)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if record, ok := s.accountLeases[key]; ok && record.nodeID == nodeID {
+		delete(s.accountLeases, key)
+	}
+	return nil
+}
+
+func (s *inMemoryStore) AcquireLeadership(ctx context.Context, name string, holderID string, ttl time.Duration) (int64, error) {
+	now := time.Now().UTC()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record, ok := s.leaders[name]
+	if ok && now.Before(record.expireAt) && record.nodeID != holderID {
+		return 0, nil
+	}
+	if !ok || !now.Before(record.expireAt) {
+		s.leaderFences[name]++
+	}
+	s.leaders[name] = leaseRecord{nodeID: holderID, expireAt: now.Add(ttl)}
+	return s.leaderFences[name], nil
+}
+
+func (s *inMemoryStore) ReleaseLeadership(ctx context.Context, name string, holderID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if record, ok := s.leaders[name]; ok && record.nodeID == holderID {
+		delete(s.leaders, name)
+	}
+	return nil
+}
+
+func (s *inMemoryStore) GetLeadership(ctx context.Context, name string) (string, int64, error) {
+	now := time.Now().UTC()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record, ok := s.leaders[name]
+	if !ok || !now.Before(record.expireAt) {
+		return "", s.leaderFences[name], nil
+	}
+	return record.nodeID, s.leaderFences[name], nil
+}
+
+func (s *inMemoryStore) PublishJobsReady(ctx context.Context, managerID uint) error {
+	s.mu.Lock()
+	handlers := append([]func(uint){}, s.jobsReady...)
+	s.mu.Unlock()
+	for _, handle := range handlers {
+		handle(managerID)
+	}
+	return nil
+}
+
+func (s *inMemoryStore) SubscribeJobsReady(ctx context.Context, handle func(managerID uint)) error {
+	s.mu.Lock()
+	s.jobsReady = append(s.jobsReady, handle)
+	s.mu.Unlock()
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (s *inMemoryStore) PublishAgentLogs(ctx context.Context, payload []byte) error {
+	s.mu.Lock()
+	handlers := append([]func([]byte){}, s.agentLogs...)
+	s.mu.Unlock()
+	for _, handle := range handlers {
+		handle(payload)
+	}
+	return nil
+}
+
+func (s *inMemoryStore) SubscribeAgentLogs(ctx context.Context, handle func(payload []byte)) error {
+	s.mu.Lock()
+	s.agentLogs = append(s.agentLogs, handle)
+	s.mu.Unlock()
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (s *inMemoryStore) jobsReadySubscribed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.jobsReady) > 0
+}
+
 func (s *inMemoryStore) AcquireScheduleSlot(
 	ctx context.Context,
 	managerID uint,
@@ -182,6 +310,14 @@ func (s *inMemoryStore) AcquireScheduleSlot(
 	return true, nil
 }
 
+func (s *inMemoryStore) ReleaseScheduleSlot(ctx context.Context, managerID uint, userID uint, taskType string, slot string) error {
+	key := strconv.FormatUint(uint64(managerID), 10) + ":" + strconv.FormatUint(uint64(userID), 10) + ":" + taskType + ":" + slot
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.scheduleSlots, key)
+	return nil
+}
+
 func (s *inMemoryStore) GetManagerExpiry(ctx context.Context, managerID uint) (time.Time, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -397,6 +533,8 @@ func setupTestServer(t *testing.T) (*Server, *gorm.DB) {
 		SchedulerInterval:  5 * time.Second,
 		SchedulerScanLimit: 100,
 		SchedulerSlotTTL:   90 * time.Second,
+		// Webhook receivers in tests listen on loopback.
+		NotifyAllowPrivate: true,
 	}
 	server := New(cfg, db, newInMemoryStore())
 	return server, db
@@ -42,6 +42,16 @@ type putTaskConfigRequest struct {
 	TaskConfig map[string]any `json:"task_config" binding:"required"`
 }
 
+// putRestConfigRequest replaces a rest config; null or {} clears it so the
+// manager default (or the global window) applies again.
+type putRestConfigRequest struct {
+	RestConfig map[string]any `json:"rest_config"`
+}
+
+type putScheduleSpreadRequest struct {
+	SpreadMinutes *int `json:"spread_minutes"` // null falls back to SCHEDULER_SPREAD
+}
+
 type managerPatchUserLifecycleRequest struct {
 	ExpiresAt     string `json:"expires_at"`
 	ExtendDays    int    `json:"extend_days"`
@@ -50,7 +60,8 @@ type managerPatchUserLifecycleRequest struct {
 }
 
 type managerPatchUserSettingsRequest struct {
-	CanViewLogs *bool `json:"can_view_logs"`
+	CanViewLogs    *bool     `json:"can_view_logs"`
+	RequiredLabels *[]string `json:"required_labels"` // 该账号的任务只派给具备全部标签的节点，[] 清除
 }
 
 type superPatchManagerLifecycleRequest struct {
@@ -80,11 +91,31 @@ type userRedeemCodeRequest struct {
 	Code string `json:"code" binding:"required,min=6,max=64"`
 }
 
+// agentLoginRequest takes either an agent API key or, for older agents, the
+// manager's username and password.
 type agentLoginRequest struct {
-	Username string `json:"username" binding:"required,min=3,max=64"`
-	Password string `json:"password" binding:"required,min=6,max=128"`
+	APIKey   string `json:"api_key" binding:"omitempty,max=128"`
+	Username string `json:"username" binding:"omitempty,min=3,max=64"`
+	Password string `json:"password" binding:"omitempty,min=6,max=128"`
 	NodeID   string `json:"node_id" binding:"required,min=3,max=128"`
 	Version  string `json:"version"`
+	// 可选，声明节点能力；省略时沿用上次声明
+	Capabilities *agentCapabilities `json:"capabilities"`
+}
+
+// agentCapabilities is what a node declares it can run. Only jobs whose task
+// type and required labels it covers are dispatched to it.
+type agentCapabilities struct {
+	TaskTypes      []string `json:"task_types" binding:"max=64"`              // 空为全部任务类型
+	MaxConcurrency int      `json:"max_concurrency" binding:"min=0,max=1000"` // 0 为不限
+	Labels         []string `json:"labels" binding:"max=16"`
+}
+
+type createAgentKeyRequest struct {
+	NodeID        string   `json:"node_id" binding:"required,min=3,max=128"`
+	Name          string   `json:"name" binding:"max=64"`
+	AllowedIPs    []string `json:"allowed_ips" binding:"max=32"`
+	ExpiresInDays int      `json:"expires_in_days" binding:"min=0,max=3650"` // 0 为永不过期
 }
 
 type agentPollJobsRequest struct {
@@ -92,8 +123,18 @@ type agentPollJobsRequest struct {
 	Limit        int      `json:"limit"`
 	LeaseSeconds int      `json:"lease_seconds"`
 	UserTypes    []string `json:"user_types"` // 可选，按用户类型过滤
+	Mode         string   `json:"mode"`       // 可选，jobs（默认）或 user_batch
+	// 可选，长轮询：没有可领取的任务时最多等待的秒数，0 为立即返回
+	WaitSeconds int `json:"wait_seconds" binding:"min=0,max=25"`
+	// 可选，声明节点能力；省略时沿用上次声明
+	Capabilities *agentCapabilities `json:"capabilities"`
 }
 
+const (
+	pollModeJobs      = "jobs"
+	pollModeUserBatch = "user_batch"
+)
+
 type agentJobUpdateRequest struct {
 	NodeID       string         `json:"node_id" binding:"required,min=3,max=128"`
 	Message      string         `json:"message"`
@@ -102,6 +143,57 @@ type agentJobUpdateRequest struct {
 	Result       map[string]any `json:"result"`
 }
 
+type putJobPriorityRequest struct {
+	Priority int `json:"priority" binding:"min=0,max=1000"`
+}
+
+type runTaskNowRequest struct {
+	TaskType string `json:"task_type" binding:"required,max=64"`
+}
+
+type patchAgentDrainRequest struct {
+	Draining *bool `json:"draining" binding:"required"`
+}
+
+type createAgentCommandRequest struct {
+	Command          string         `json:"command" binding:"required,oneof=restart_emulator screenshot reload_config pause_polling resume_polling upload_diagnostics"`
+	Args             map[string]any `json:"args"`
+	ExpiresInSeconds int            `json:"expires_in_seconds" binding:"min=0,max=86400"` // 0 为默认 10 分钟
+}
+
+type agentCommandAckRequest struct {
+	NodeID string `json:"node_id" binding:"required,min=3,max=128"`
+}
+
+type agentCommandResultRequest struct {
+	NodeID  string         `json:"node_id" binding:"required,min=3,max=128"`
+	Success *bool          `json:"success" binding:"required"`
+	Message string         `json:"message" binding:"max=2000"`
+	Result  map[string]any `json:"result"`
+}
+
+type putAgentVersionPolicyRequest struct {
+	MinVersion         string         `json:"min_version" binding:"max=32"`
+	Enforcement        string         `json:"enforcement" binding:"omitempty,oneof=reject limit"` // 默认 reject
+	RecommendedVersion string         `json:"recommended_version" binding:"max=32"`
+	RolloutPercent     *int           `json:"rollout_percent" binding:"omitempty,min=0,max=100"` // 省略为 100
+	Manifest           map[string]any `json:"manifest"`
+}
+
+type agentReportLogsRequest struct {
+	NodeID string         `json:"node_id" binding:"max=128"` // 可选，上报日志的节点
+	Logs   []agentLogLine `json:"logs" binding:"max=500,dive"`
+}
+
+type agentLogLine struct {
+	Type    string         `json:"type" binding:"max=64"`
+	Level   string         `json:"level"` // debug、info、warn、error，其他按 info 记录
+	Message string         `json:"message" binding:"max=8000"`
+	Ts      string         `json:"ts"`
+	JobID   uint           `json:"job_id"` // 可选，产生日志的任务
+	Fields  map[string]any `json:"fields"` // 可选，结构化字段
+}
+
 // ── Batch request types ───────────────────────────────
 
 type batchUserLifecycleRequest struct {
@@ -120,6 +212,11 @@ type batchCodeRevokeRequest struct {
 	CodeIDs []uint `json:"code_ids" binding:"required,min=1,max=500"`
 }
 
+type batchJobControlRequest struct {
+	JobIDs   []uint `json:"job_ids" binding:"required,min=1,max=500"`
+	Priority int    `json:"priority" binding:"min=0,max=1000"` // 仅 batch-priority 使用
+}
+
 type batchManagerLifecycleRequest struct {
 	ManagerIDs []uint `json:"manager_ids" binding:"required,min=1,max=200"`
 	ExpiresAt  string `json:"expires_at"`
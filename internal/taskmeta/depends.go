@@ -0,0 +1,256 @@
+package taskmeta
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// DependsOnKey is the task config key listing the tasks that must succeed
+// before this task is leased. "after" is accepted as an alias in patches.
+const DependsOnKey = "depends_on"
+
+const dependsOnAliasKey = "after"
+
+// TaskDependencyError reports an invalid depends_on in a task config.
+type TaskDependencyError struct {
+	TaskType string
+	Err      error
+}
+
+func (e *TaskDependencyError) Error() string {
+	return fmt.Sprintf("任务「%s」的 depends_on 无效: %v", e.TaskType, e.Err)
+}
+
+func (e *TaskDependencyError) Unwrap() error { return e.Err }
+
+// TaskDependencies returns the tasks a task config depends on, in order and
+// without duplicates. Malformed values yield no dependencies.
+func TaskDependencies(taskMap map[string]any) []string {
+	deps, err := parseDependencyList(taskMap[DependsOnKey])
+	if err != nil {
+		return nil
+	}
+	return deps
+}
+
+// NormalizeTaskDependencies rewrites "after" to depends_on and normalizes the
+// dependency lists of a task config patch in place. Whether the referenced
+// tasks exist is checked on the merged config by ValidateTaskDependencies.
+func NormalizeTaskDependencies(patch map[string]any) error {
+	for taskName, rawCfg := range patch {
+		taskMap, ok := rawCfg.(map[string]any)
+		if !ok {
+			continue
+		}
+		alias, hasAlias := taskMap[dependsOnAliasKey]
+		raw, hasDeps := taskMap[DependsOnKey]
+		if hasAlias && hasDeps {
+			return &TaskDependencyError{TaskType: taskName, Err: fmt.Errorf("depends_on 和 after 不能同时设置")}
+		}
+		if hasAlias {
+			raw, hasDeps = alias, true
+			delete(taskMap, dependsOnAliasKey)
+		}
+		if !hasDeps {
+			continue
+		}
+		deps, err := parseDependencyList(raw)
+		if err != nil {
+			return &TaskDependencyError{TaskType: taskName, Err: err}
+		}
+		items := make([]any, 0, len(deps))
+		for _, dep := range deps {
+			if dep == taskName {
+				return &TaskDependencyError{TaskType: taskName, Err: fmt.Errorf("不能依赖自身")}
+			}
+			items = append(items, dep)
+		}
+		taskMap[DependsOnKey] = items
+	}
+	return nil
+}
+
+// ValidateTaskDependencies checks a merged task config: every dependency must
+// be a task of the same config and the dependencies must not form a cycle.
+func ValidateTaskDependencies(config map[string]any) error {
+	names := sortedTaskNames(config)
+	for _, taskName := range names {
+		taskMap, _ := config[taskName].(map[string]any)
+		deps, err := parseDependencyList(taskMap[DependsOnKey])
+		if err != nil {
+			return &TaskDependencyError{TaskType: taskName, Err: err}
+		}
+		for _, dep := range deps {
+			if _, ok := config[dep]; !ok {
+				return &TaskDependencyError{TaskType: taskName, Err: fmt.Errorf("任务「%s」不在该用户的任务池中", dep)}
+			}
+		}
+	}
+	if _, cycle := orderTasks(config, names); len(cycle) > 0 {
+		return &TaskDependencyError{TaskType: cycle[0], Err: fmt.Errorf("存在循环依赖: %s", strings.Join(cycle, " → "))}
+	}
+	return nil
+}
+
+// OrderTasksByDependencies returns the task names of a config so that every
+// task comes after the tasks it depends on. Ties follow the default task
+// order. Tasks caught in a cycle are appended last.
+func OrderTasksByDependencies(config map[string]any) []string {
+	ordered, cycle := orderTasks(config, sortedTaskNames(config))
+	if len(cycle) == 0 {
+		return ordered
+	}
+	placed := make(map[string]struct{}, len(ordered))
+	for _, name := range ordered {
+		placed[name] = struct{}{}
+	}
+	for _, name := range sortedTaskNames(config) {
+		if _, ok := placed[name]; !ok {
+			ordered = append(ordered, name)
+		}
+	}
+	return ordered
+}
+
+// orderTasks runs a topological sort over names. When a cycle remains it
+// returns the tasks of one cycle, starting and ending with the same task.
+func orderTasks(config map[string]any, names []string) ([]string, []string) {
+	pending := make(map[string][]string, len(names))
+	for _, name := range names {
+		taskMap, _ := config[name].(map[string]any)
+		deps := make([]string, 0)
+		for _, dep := range TaskDependencies(taskMap) {
+			if _, ok := config[dep]; ok {
+				deps = append(deps, dep)
+			}
+		}
+		pending[name] = deps
+	}
+
+	ordered := make([]string, 0, len(names))
+	done := make(map[string]struct{}, len(names))
+	for len(ordered) < len(names) {
+		progressed := false
+		for _, name := range names {
+			if _, ok := done[name]; ok {
+				continue
+			}
+			ready := true
+			for _, dep := range pending[name] {
+				if _, ok := done[dep]; !ok {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				ordered = append(ordered, name)
+				done[name] = struct{}{}
+				progressed = true
+			}
+		}
+		if !progressed {
+			return ordered, findCycle(pending, done, names)
+		}
+	}
+	return ordered, nil
+}
+
+func findCycle(pending map[string][]string, done map[string]struct{}, names []string) []string {
+	for _, start := range names {
+		if _, ok := done[start]; ok {
+			continue
+		}
+		path := []string{start}
+		seen := map[string]int{start: 0}
+		current := start
+		for {
+			next := ""
+			for _, dep := range pending[current] {
+				if _, ok := done[dep]; !ok {
+					next = dep
+					break
+				}
+			}
+			if next == "" {
+				break
+			}
+			if idx, ok := seen[next]; ok {
+				return append(path[idx:], next)
+			}
+			seen[next] = len(path)
+			path = append(path, next)
+			current = next
+		}
+	}
+	return nil
+}
+
+func parseDependencyList(raw any) ([]string, error) {
+	var items []string
+	switch typed := raw.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		items = strings.Split(typed, ",")
+	case []string:
+		items = typed
+	case []any:
+		for _, item := range typed {
+			text, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("必须是任务名列表")
+			}
+			items = append(items, text)
+		}
+	default:
+		return nil, fmt.Errorf("必须是任务名列表")
+	}
+
+	deps := make([]string, 0, len(items))
+	seen := make(map[string]struct{}, len(items))
+	for _, item := range items {
+		name := strings.TrimSpace(item)
+		if name == "" {
+			continue
+		}
+		if _, ok := seen[name]; ok {
+			continue
+		}
+		if _, ok := defaultTaskConfig[name]; !ok {
+			return nil, fmt.Errorf("未知任务「%s」", name)
+		}
+		seen[name] = struct{}{}
+		deps = append(deps, name)
+	}
+	return deps, nil
+}
+
+var taskOrderIndex = func() map[string]int {
+	index := make(map[string]int, len(allTaskOrder))
+	for i, name := range allTaskOrder {
+		index[name] = i
+	}
+	return index
+}()
+
+// sortedTaskNames lists the tasks of a config in the default task order,
+// unknown names last and alphabetically.
+func sortedTaskNames(config map[string]any) []string {
+	names := make([]string, 0, len(config))
+	for name := range config {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		left, leftKnown := taskOrderIndex[names[i]]
+		right, rightKnown := taskOrderIndex[names[j]]
+		if leftKnown != rightKnown {
+			return leftKnown
+		}
+		if leftKnown && left != right {
+			return left < right
+		}
+		return names[i] < names[j]
+	})
+	return names
+}
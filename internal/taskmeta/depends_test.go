@@ -0,0 +1,75 @@
+package taskmeta
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeTaskDependencies(t *testing.T) {
+	patch := map[string]any{
+		"每周商店": map[string]any{"after": "领取邮件, 签到 ,领取邮件"},
+		"签到":   map[string]any{"depends_on": []any{}},
+	}
+	if err := NormalizeTaskDependencies(patch); err != nil {
+		t.Fatalf("normalize failed: %v", err)
+	}
+	shop := patch["每周商店"].(map[string]any)
+	if _, ok := shop["after"]; ok {
+		t.Fatalf("after should be rewritten to depends_on: %v", shop)
+	}
+	if deps := TaskDependencies(shop); len(deps) != 2 || deps[0] != "领取邮件" || deps[1] != "签到" {
+		t.Fatalf("unexpected dependencies %v", deps)
+	}
+
+	cases := []struct {
+		patch map[string]any
+		want  string
+	}{
+		{map[string]any{"签到": map[string]any{"depends_on": []any{"签到"}}}, "自身"},
+		{map[string]any{"签到": map[string]any{"depends_on": []any{"不存在"}}}, "未知任务"},
+		{map[string]any{"签到": map[string]any{"depends_on": 3}}, "任务名列表"},
+		{map[string]any{"签到": map[string]any{"depends_on": "悬赏", "after": "弥助"}}, "不能同时"},
+	}
+	for _, tc := range cases {
+		err := NormalizeTaskDependencies(tc.patch)
+		var depErr *TaskDependencyError
+		if !errors.As(err, &depErr) || !strings.Contains(err.Error(), tc.want) {
+			t.Fatalf("%v: expected error containing %q, got %v", tc.patch, tc.want, err)
+		}
+	}
+}
+
+func TestValidateAndOrderTaskDependencies(t *testing.T) {
+	config := BuildDefaultTaskConfigByType(UserTypeDaily)
+	if err := ValidateTaskDependencies(config); err != nil {
+		t.Fatalf("default config should be valid: %v", err)
+	}
+	order := OrderTasksByDependencies(config)
+	position := make(map[string]int, len(order))
+	for i, name := range order {
+		position[name] = i
+	}
+	if len(order) != len(config) {
+		t.Fatalf("order should list every task, got %d of %d", len(order), len(config))
+	}
+	if position["结界卡合成"] < position["探索突破"] || position["每周商店"] < position["领取邮件"] {
+		t.Fatalf("prerequisites should come first: %v", order)
+	}
+
+	config["领取邮件"].(map[string]any)["depends_on"] = []any{"签到"}
+	config["签到"].(map[string]any)["depends_on"] = []any{"每周商店"}
+	err := ValidateTaskDependencies(config)
+	if err == nil || !strings.Contains(err.Error(), "循环依赖") {
+		t.Fatalf("expected a cycle error, got %v", err)
+	}
+	if order := OrderTasksByDependencies(config); len(order) != len(config) {
+		t.Fatalf("tasks in a cycle should still be listed, got %d of %d", len(order), len(config))
+	}
+
+	foster := BuildDefaultTaskConfigByType(UserTypeFoster)
+	foster["放卡"].(map[string]any)["depends_on"] = []any{"探索突破"}
+	if err := ValidateTaskDependencies(foster); err == nil || !strings.Contains(err.Error(), "任务池") {
+		t.Fatalf("dependency outside the pool should be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,141 @@
+package taskmeta
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// RequiredLabelsKey is the task config key listing the agent labels a node
+// must have declared to run the task, e.g. {"required_labels": ["斗技"]}.
+const RequiredLabelsKey = "required_labels"
+
+const (
+	maxLabels      = 16
+	maxLabelLength = 32
+)
+
+// LabelError reports an invalid required_labels in a task config patch.
+type LabelError struct {
+	TaskType string
+	Err      error
+}
+
+func (e *LabelError) Error() string {
+	return fmt.Sprintf("任务「%s」的 required_labels 无效: %v", e.TaskType, e.Err)
+}
+
+func (e *LabelError) Unwrap() error { return e.Err }
+
+// NormalizeLabels trims, deduplicates and sorts a label list given as
+// []string or a decoded JSON array. Labels are stored comma-joined, so they
+// may not contain commas.
+func NormalizeLabels(raw any) ([]string, error) {
+	var items []string
+	switch value := raw.(type) {
+	case nil:
+		return []string{}, nil
+	case []string:
+		items = value
+	case []any:
+		items = make([]string, 0, len(value))
+		for _, item := range value {
+			text, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("标签必须是字符串")
+			}
+			items = append(items, text)
+		}
+	default:
+		return nil, fmt.Errorf("标签必须是字符串列表")
+	}
+	seen := make(map[string]struct{}, len(items))
+	labels := make([]string, 0, len(items))
+	for _, item := range items {
+		label := strings.TrimSpace(item)
+		if label == "" {
+			continue
+		}
+		if len([]rune(label)) > maxLabelLength || strings.Contains(label, ",") {
+			return nil, fmt.Errorf("标签 %q 无效，最长 %d 个字符且不能包含逗号", label, maxLabelLength)
+		}
+		if _, dup := seen[label]; dup {
+			continue
+		}
+		seen[label] = struct{}{}
+		labels = append(labels, label)
+	}
+	if len(labels) > maxLabels {
+		return nil, fmt.Errorf("最多 %d 个标签", maxLabels)
+	}
+	sort.Strings(labels)
+	return labels, nil
+}
+
+// JoinLabels returns the stored form of normalized labels. Equal sets give
+// equal strings, so requirements can be compared as plain values.
+func JoinLabels(labels []string) string {
+	return strings.Join(labels, ",")
+}
+
+// SplitLabels is the inverse of JoinLabels.
+func SplitLabels(stored string) []string {
+	if stored == "" {
+		return []string{}
+	}
+	return strings.Split(stored, ",")
+}
+
+// LabelsSatisfied reports whether every label of required is in available,
+// both in stored form.
+func LabelsSatisfied(required string, available string) bool {
+	if required == "" {
+		return true
+	}
+	have := make(map[string]struct{})
+	for _, label := range SplitLabels(available) {
+		have[label] = struct{}{}
+	}
+	for _, label := range SplitLabels(required) {
+		if _, ok := have[label]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// RequiredLabels returns the stored form of a task config's required_labels.
+// Malformed values require nothing; patches are checked by
+// NormalizeRequiredLabels.
+func RequiredLabels(taskMap map[string]any) string {
+	labels, err := NormalizeLabels(taskMap[RequiredLabelsKey])
+	if err != nil {
+		return ""
+	}
+	return JoinLabels(labels)
+}
+
+// NormalizeRequiredLabels checks and normalizes the required_labels of a task
+// config patch in place.
+func NormalizeRequiredLabels(patch map[string]any) error {
+	for taskName, rawCfg := range patch {
+		taskMap, ok := rawCfg.(map[string]any)
+		if !ok {
+			continue
+		}
+		raw, exists := taskMap[RequiredLabelsKey]
+		if !exists {
+			continue
+		}
+		labels, err := NormalizeLabels(raw)
+		if err != nil {
+			return &LabelError{TaskType: taskName, Err: err}
+		}
+		items := make([]any, 0, len(labels))
+		for _, label := range labels {
+			items = append(items, label)
+		}
+		taskMap[RequiredLabelsKey] = items
+	}
+	return nil
+}
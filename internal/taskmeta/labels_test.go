@@ -0,0 +1,61 @@
+package taskmeta
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNormalizeLabels(t *testing.T) {
+	labels, err := NormalizeLabels([]any{" 机房A ", "斗技", "机房A", ""})
+	if err != nil || JoinLabels(labels) != "斗技,机房A" {
+		t.Fatalf("labels should be trimmed, deduplicated and sorted, got %v %v", labels, err)
+	}
+	if _, err := NormalizeLabels([]any{"a,b"}); err == nil {
+		t.Fatalf("comma should be rejected")
+	}
+	if _, err := NormalizeLabels([]any{1}); err == nil {
+		t.Fatalf("non-string label should be rejected")
+	}
+	if _, err := NormalizeLabels("机房A"); err == nil {
+		t.Fatalf("a bare string should be rejected")
+	}
+}
+
+func TestLabelsSatisfied(t *testing.T) {
+	cases := []struct {
+		required  string
+		available string
+		want      bool
+	}{
+		{"", "", true},
+		{"", "机房A", true},
+		{"机房A", "", false},
+		{"机房A", "斗技,机房A", true},
+		{"斗技,机房A", "机房A", false},
+	}
+	for _, tc := range cases {
+		if got := LabelsSatisfied(tc.required, tc.available); got != tc.want {
+			t.Fatalf("LabelsSatisfied(%q, %q) = %v, want %v", tc.required, tc.available, got, tc.want)
+		}
+	}
+}
+
+func TestNormalizeRequiredLabels(t *testing.T) {
+	patch := map[string]any{"悬赏": map[string]any{RequiredLabelsKey: []any{"机房B", "机房A"}}}
+	if err := NormalizeRequiredLabels(patch); err != nil {
+		t.Fatalf("valid labels rejected: %v", err)
+	}
+	taskMap := patch["悬赏"].(map[string]any)
+	if got := RequiredLabels(taskMap); got != "机房A,机房B" {
+		t.Fatalf("unexpected stored labels %q", got)
+	}
+
+	err := NormalizeRequiredLabels(map[string]any{"悬赏": map[string]any{RequiredLabelsKey: "机房A"}})
+	var labelErr *LabelError
+	if !errors.As(err, &labelErr) || labelErr.TaskType != "悬赏" {
+		t.Fatalf("expected a LabelError for 悬赏, got %v", err)
+	}
+	if got := RequiredLabels(map[string]any{RequiredLabelsKey: 3}); got != "" {
+		t.Fatalf("malformed labels should require nothing, got %q", got)
+	}
+}
@@ -1,6 +1,9 @@
 package taskmeta
 
-import "time"
+import (
+	"strings"
+	"time"
+)
 
 // BJLoc is Beijing timezone (UTC+8), exported for use by other packages.
 var BJLoc = time.FixedZone("Asia/Shanghai", 8*60*60)
@@ -21,78 +24,50 @@ func GetNextTimeRule(taskName string) string {
 
 // CalcNextTime computes the next execution time based on rule and current time.
 // Returns the result in Beijing timezone for human-readable storage.
-// Returns zero time for "on_demand" or unknown rules.
+// Returns zero time for "on_demand" or invalid rules.
 func CalcNextTime(rule string, now time.Time) time.Time {
-	bj := now.In(bjLoc)
-
-	switch rule {
-	case "daily_reset":
-		// Tomorrow Beijing time 00:01
-		tomorrow := time.Date(bj.Year(), bj.Month(), bj.Day()+1, 0, 1, 0, 0, bjLoc)
-		return tomorrow
-
-	case "weekly_monday":
-		// Next Monday Beijing time 00:01
-		daysUntilMonday := (8 - int(bj.Weekday())) % 7
-		if daysUntilMonday == 0 {
-			daysUntilMonday = 7
-		}
-		nextMon := time.Date(bj.Year(), bj.Month(), bj.Day()+daysUntilMonday, 0, 1, 0, 0, bjLoc)
-		return nextMon
-
-	case "interval_6h":
-		return now.Add(6 * time.Hour).In(bjLoc)
-
-	case "interval_8h":
-		return now.Add(8 * time.Hour).In(bjLoc)
-
-	case "interval_2h_window":
-		// 根据当前北京时间的窗口推算下一个窗口（对弈竞猜窗口: 10,12,14,16,18,20,22）
-		currentWindowHour := (bj.Hour() / 2) * 2
-		nextWindowHour := currentWindowHour + 2
-
-		if nextWindowHour > 22 || nextWindowHour < 10 {
-			// 超出有效窗口范围，推到次日 10:00 BJ
-			nextDay := time.Date(bj.Year(), bj.Month(), bj.Day()+1, 10, 0, 0, 0, bjLoc)
-			return nextDay
-		}
-		return time.Date(bj.Year(), bj.Month(), bj.Day(), nextWindowHour, 0, 0, 0, bjLoc)
-
-	case "coop_window":
-		// Next Beijing time 18:00 or 21:00
-		today18 := time.Date(bj.Year(), bj.Month(), bj.Day(), 18, 0, 0, 0, bjLoc)
-		today21 := time.Date(bj.Year(), bj.Month(), bj.Day(), 21, 0, 0, 0, bjLoc)
-		if now.Before(today18) {
-			return today18
-		}
-		if now.Before(today21) {
-			return today21
-		}
-		// Next day 18:00
-		tomorrow18 := time.Date(bj.Year(), bj.Month(), bj.Day()+1, 18, 0, 0, 0, bjLoc)
-		return tomorrow18
-
-	case "weekly_7d":
-		return now.Add(7 * 24 * time.Hour).In(bjLoc)
-
-	case "on_demand":
+	parsed, err := ParseNextTimeRule(rule)
+	if err != nil {
 		return time.Time{}
+	}
+	return parsed.Next(now)
+}
 
-	default:
+// CalcNextTimeForUser is CalcNextTime for a specific user, spreading
+// clock-aligned rules over the manager's spread window. The result is stable
+// for the same user, rule and time.
+func CalcNextTimeForUser(rule string, now time.Time, userID uint, spread time.Duration) time.Time {
+	parsed, err := ParseNextTimeRule(rule)
+	if err != nil {
 		return time.Time{}
 	}
+	return parsed.NextFor(now, userID, spread)
 }
 
-// agentOverridableRules lists next_time_rule values where the agent-reported
-// next_time should take precedence over the server-calculated value.
+// agentOverridableRules lists resolved next_time_rule expressions where the
+// agent-reported next_time should take precedence over the server-calculated
+// value.
 var agentOverridableRules = map[string]bool{
 	"on_demand":   true,
-	"interval_6h": true,
+	"interval:6h": true,
 }
 
 // IsAgentNextTimeAllowed returns true if the given task allows the agent
-// to override the next_time value (via task_next_times in result).
-func IsAgentNextTimeAllowed(taskName string) bool {
-	rule := GetNextTimeRule(taskName)
-	return agentOverridableRules[rule]
+// to override the next_time value (via task_next_times in result): its
+// default rule allows it whatever the user set, or its effective rule, as
+// stored in taskMap, resolves to an overridable expression.
+func IsAgentNextTimeAllowed(taskName string, taskMap map[string]any) bool {
+	return agentOverridableRule(GetNextTimeRule(taskName)) ||
+		agentOverridableRule(EffectiveNextTimeRule(taskName, taskMap))
+}
+
+// agentOverridableRule reports whether rule, modifiers aside, resolves to an
+// agent-overridable expression.
+func agentOverridableRule(rule string) bool {
+	parsed, err := ParseNextTimeRule(rule)
+	if err != nil {
+		return false
+	}
+	base, _, _ := strings.Cut(parsed.Expression(), ";")
+	return agentOverridableRules[base]
 }
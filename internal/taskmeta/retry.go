@@ -0,0 +1,249 @@
+package taskmeta
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Retry policy config of a task: "max_attempts" bounds the attempts of one
+// job and "retry" tunes the backoff between them, e.g.
+//
+//	{"max_attempts": 3, "retry": {"base_delay_seconds": 60, "max_delay_seconds": 1800, "non_retryable": ["LOCAL_ACCOUNT_NOT_MAPPED"]}}
+const (
+	DefaultMaxAttempts    = 3
+	MaxRetryAttempts      = 10
+	DefaultRetryBaseDelay = time.Minute
+	DefaultRetryMaxDelay  = 30 * time.Minute
+
+	minRetryDelay = 5 * time.Second
+	maxRetryDelay = 24 * time.Hour
+)
+
+// ErrorCodeLeaseTimeout is the error code recorded when a job's lease
+// expires without a report from the agent.
+const ErrorCodeLeaseTimeout = "LEASE_TIMEOUT"
+
+// defaultNonRetryableCodes are agent error codes that a retry cannot fix.
+var defaultNonRetryableCodes = []string{
+	"LOCAL_ACCOUNT_NOT_MAPPED",
+	"LOCAL_ACCOUNT_MISSING",
+	"TASK_TYPE_INVALID",
+}
+
+// RetryPolicy decides whether and when a failed job runs again.
+type RetryPolicy struct {
+	MaxAttempts  int
+	BaseDelay    time.Duration
+	MaxDelay     time.Duration
+	NonRetryable []string
+}
+
+// RetryPolicyFor returns the retry policy of a task: the user's task config
+// over the task's default config over the global defaults. Invalid values
+// fall back to the defaults.
+func RetryPolicyFor(taskName string, taskMap map[string]any) RetryPolicy {
+	policy := RetryPolicy{
+		MaxAttempts:  DefaultMaxAttempts,
+		BaseDelay:    DefaultRetryBaseDelay,
+		MaxDelay:     DefaultRetryMaxDelay,
+		NonRetryable: defaultNonRetryableCodes,
+	}
+	for _, source := range []map[string]any{defaultTaskConfig[taskName], taskMap} {
+		if source == nil {
+			continue
+		}
+		if n, ok := WholeNumber(source["max_attempts"]); ok && n >= 1 && n <= MaxRetryAttempts {
+			policy.MaxAttempts = n
+		}
+		if retry, ok := source["retry"].(map[string]any); ok {
+			if normalized, err := normalizeRetryConfig(retry); err == nil {
+				policy.apply(normalized)
+			}
+		}
+	}
+	return policy
+}
+
+func (p *RetryPolicy) apply(retry map[string]any) {
+	if n, ok := retry["base_delay_seconds"].(int); ok {
+		p.BaseDelay = time.Duration(n) * time.Second
+	}
+	if n, ok := retry["max_delay_seconds"].(int); ok {
+		p.MaxDelay = time.Duration(n) * time.Second
+	}
+	if codes, ok := retry["non_retryable"].([]any); ok {
+		p.NonRetryable = make([]string, 0, len(codes))
+		for _, code := range codes {
+			p.NonRetryable = append(p.NonRetryable, code.(string))
+		}
+	}
+	if p.MaxDelay < p.BaseDelay {
+		p.MaxDelay = p.BaseDelay
+	}
+}
+
+// Retryable reports whether a failure with errorCode may be retried.
+func (p RetryPolicy) Retryable(errorCode string) bool {
+	code := strings.ToUpper(strings.TrimSpace(errorCode))
+	for _, item := range p.NonRetryable {
+		if item == code {
+			return false
+		}
+	}
+	return true
+}
+
+// Backoff is the delay before the next attempt after failedAttempts
+// failures: the base delay doubled per earlier failure, capped at MaxDelay.
+func (p RetryPolicy) Backoff(failedAttempts int) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < failedAttempts && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	return delay
+}
+
+// Decide returns whether a job that has now failed failedAttempts times out
+// of maxAttempts should run again, and after which delay. maxAttempts is the
+// job's own limit; values below 1 mean a single attempt.
+func (p RetryPolicy) Decide(failedAttempts int, maxAttempts int, errorCode string) (bool, time.Duration) {
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	if failedAttempts >= maxAttempts || !p.Retryable(errorCode) {
+		return false, 0
+	}
+	return true, p.Backoff(failedAttempts)
+}
+
+// RetryPolicyError reports an invalid max_attempts or retry in a task config patch.
+type RetryPolicyError struct {
+	TaskType string
+	Err      error
+}
+
+func (e *RetryPolicyError) Error() string {
+	return fmt.Sprintf("任务「%s」的重试策略无效: %v", e.TaskType, e.Err)
+}
+
+func (e *RetryPolicyError) Unwrap() error { return e.Err }
+
+// NormalizeRetryPolicies validates max_attempts and retry of a task config
+// in place. Run it on the merged config so that a partial retry patch is
+// checked together with the values it is merged into.
+func NormalizeRetryPolicies(patch map[string]any) error {
+	for taskName, rawCfg := range patch {
+		taskMap, ok := rawCfg.(map[string]any)
+		if !ok {
+			continue
+		}
+		if raw, exists := taskMap["max_attempts"]; exists {
+			n, ok := WholeNumber(raw)
+			if !ok || n < 1 || n > MaxRetryAttempts {
+				return &RetryPolicyError{TaskType: taskName, Err: fmt.Errorf("max_attempts 必须是 1-%d 的整数", MaxRetryAttempts)}
+			}
+			taskMap["max_attempts"] = n
+		}
+		raw, exists := taskMap["retry"]
+		if !exists {
+			continue
+		}
+		retry, ok := raw.(map[string]any)
+		if !ok {
+			return &RetryPolicyError{TaskType: taskName, Err: fmt.Errorf("retry 必须是对象")}
+		}
+		normalized, err := normalizeRetryConfig(retry)
+		if err != nil {
+			return &RetryPolicyError{TaskType: taskName, Err: err}
+		}
+		taskMap["retry"] = normalized
+	}
+	return nil
+}
+
+func normalizeRetryConfig(retry map[string]any) (map[string]any, error) {
+	normalized := map[string]any{}
+	for key, raw := range retry {
+		switch key {
+		case "base_delay_seconds", "max_delay_seconds":
+			n, ok := WholeNumber(raw)
+			if !ok || time.Duration(n)*time.Second < minRetryDelay || time.Duration(n)*time.Second > maxRetryDelay {
+				return nil, fmt.Errorf("%s 必须是 %d-%d 的整数", key, int(minRetryDelay.Seconds()), int(maxRetryDelay.Seconds()))
+			}
+			normalized[key] = n
+		case "non_retryable":
+			list, ok := raw.([]any)
+			if !ok {
+				return nil, fmt.Errorf("non_retryable 必须是错误码列表")
+			}
+			seen := map[string]struct{}{}
+			codes := make([]string, 0, len(list))
+			for _, item := range list {
+				text, ok := item.(string)
+				code := strings.ToUpper(strings.TrimSpace(text))
+				if !ok || code == "" || len(code) > 64 {
+					return nil, fmt.Errorf("non_retryable 必须是错误码列表")
+				}
+				if _, dup := seen[code]; dup {
+					continue
+				}
+				seen[code] = struct{}{}
+				codes = append(codes, code)
+			}
+			sort.Strings(codes)
+			items := make([]any, 0, len(codes))
+			for _, code := range codes {
+				items = append(items, code)
+			}
+			normalized[key] = items
+		default:
+			return nil, fmt.Errorf("未知字段 %s", key)
+		}
+	}
+	baseDelay, hasBase := normalized["base_delay_seconds"].(int)
+	maxDelay, hasMax := normalized["max_delay_seconds"].(int)
+	if hasBase && hasMax && maxDelay < baseDelay {
+		return nil, fmt.Errorf("max_delay_seconds 不能小于 base_delay_seconds")
+	}
+	return normalized, nil
+}
+
+// WholeNumber accepts the integer shapes a JSON number can take after
+// decoding from a request body or a jsonb column.
+func WholeNumber(value any) (int, bool) {
+	switch v := value.(type) {
+	case int:
+		return v, true
+	case float64:
+		if v != float64(int(v)) {
+			return 0, false
+		}
+		return int(v), true
+	case json.Number:
+		n, err := v.Int64()
+		return int(n), err == nil
+	}
+	return 0, false
+}
+
+// FormatRetryDelay renders a retry delay for job event messages, e.g. 30秒,
+// 2分钟 or 1小时30分钟.
+func FormatRetryDelay(d time.Duration) string {
+	if d < time.Minute {
+		return fmt.Sprintf("%d秒", int(d.Seconds()))
+	}
+	minutes := int(d.Minutes())
+	if minutes < 60 {
+		return fmt.Sprintf("%d分钟", minutes)
+	}
+	if minutes%60 == 0 {
+		return fmt.Sprintf("%d小时", minutes/60)
+	}
+	return fmt.Sprintf("%d小时%d分钟", minutes/60, minutes%60)
+}
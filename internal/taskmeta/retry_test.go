@@ -0,0 +1,111 @@
+package taskmeta
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyFor(t *testing.T) {
+	policy := RetryPolicyFor("悬赏", nil)
+	if policy.MaxAttempts != DefaultMaxAttempts || policy.BaseDelay != DefaultRetryBaseDelay || policy.MaxDelay != DefaultRetryMaxDelay {
+		t.Fatalf("unexpected default policy %+v", policy)
+	}
+	if policy.Retryable("local_account_not_mapped") || !policy.Retryable("LOCAL_BATCH_FAILED") {
+		t.Fatalf("default non-retryable codes not applied: %+v", policy)
+	}
+
+	if policy := RetryPolicyFor("对弈竞猜", nil); policy.BaseDelay != 30*time.Second || policy.MaxDelay != 5*time.Minute {
+		t.Fatalf("task default should apply: %+v", policy)
+	}
+
+	// Values read back from a jsonb column decode as json.Number.
+	policy = RetryPolicyFor("悬赏", map[string]any{
+		"max_attempts": json.Number("5"),
+		"retry": map[string]any{
+			"base_delay_seconds": json.Number("10"),
+			"non_retryable":      []any{"ACCOUNT_BANNED"},
+		},
+	})
+	if policy.MaxAttempts != 5 || policy.BaseDelay != 10*time.Second || policy.MaxDelay != DefaultRetryMaxDelay {
+		t.Fatalf("user overrides should apply: %+v", policy)
+	}
+	if policy.Retryable("ACCOUNT_BANNED") || !policy.Retryable("TASK_TYPE_INVALID") {
+		t.Fatalf("non_retryable should replace the defaults: %+v", policy.NonRetryable)
+	}
+
+	if policy := RetryPolicyFor("悬赏", map[string]any{"max_attempts": 99, "retry": "fast"}); policy.MaxAttempts != DefaultMaxAttempts || policy.BaseDelay != DefaultRetryBaseDelay {
+		t.Fatalf("invalid values should fall back to the defaults: %+v", policy)
+	}
+}
+
+func TestRetryPolicyBackoffAndDecide(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 5, BaseDelay: time.Minute, MaxDelay: 5 * time.Minute, NonRetryable: []string{"FATAL"}}
+	want := []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 5 * time.Minute, 5 * time.Minute}
+	for i, expected := range want {
+		if got := policy.Backoff(i + 1); got != expected {
+			t.Fatalf("backoff after %d failures: want %v, got %v", i+1, expected, got)
+		}
+	}
+
+	if retry, delay := policy.Decide(2, 3, "LOCAL_BATCH_FAILED"); !retry || delay != 2*time.Minute {
+		t.Fatalf("second failure of three should retry after 2m, got %v %v", retry, delay)
+	}
+	if retry, _ := policy.Decide(3, 3, "LOCAL_BATCH_FAILED"); retry {
+		t.Fatalf("reaching max attempts should be terminal")
+	}
+	if retry, _ := policy.Decide(1, 3, "fatal"); retry {
+		t.Fatalf("non-retryable code should be terminal")
+	}
+	if retry, _ := policy.Decide(1, 0, ""); retry {
+		t.Fatalf("a job without max attempts gets a single attempt")
+	}
+}
+
+func TestNormalizeRetryPolicies(t *testing.T) {
+	config := map[string]any{
+		"悬赏": map[string]any{
+			"max_attempts": float64(4),
+			"retry":        map[string]any{"base_delay_seconds": float64(20), "non_retryable": []any{" fatal ", "FATAL", "banned"}},
+		},
+	}
+	if err := NormalizeRetryPolicies(config); err != nil {
+		t.Fatalf("normalize failed: %v", err)
+	}
+	task := config["悬赏"].(map[string]any)
+	if task["max_attempts"] != 4 {
+		t.Fatalf("max_attempts should be an int, got %#v", task["max_attempts"])
+	}
+	codes := task["retry"].(map[string]any)["non_retryable"].([]any)
+	if len(codes) != 2 || codes[0] != "BANNED" || codes[1] != "FATAL" {
+		t.Fatalf("codes should be normalized, got %v", codes)
+	}
+
+	cases := []struct {
+		task map[string]any
+		want string
+	}{
+		{map[string]any{"max_attempts": float64(0)}, "max_attempts"},
+		{map[string]any{"max_attempts": 1.5}, "max_attempts"},
+		{map[string]any{"retry": "fast"}, "必须是对象"},
+		{map[string]any{"retry": map[string]any{"base_delay_seconds": float64(1)}}, "base_delay_seconds"},
+		{map[string]any{"retry": map[string]any{"base_delay_seconds": float64(60), "max_delay_seconds": float64(30)}}, "不能小于"},
+		{map[string]any{"retry": map[string]any{"jitter": float64(3)}}, "未知字段"},
+		{map[string]any{"retry": map[string]any{"non_retryable": []any{3}}}, "错误码列表"},
+	}
+	for _, tc := range cases {
+		err := NormalizeRetryPolicies(map[string]any{"悬赏": tc.task})
+		var retryErr *RetryPolicyError
+		if !errors.As(err, &retryErr) || !strings.Contains(err.Error(), tc.want) {
+			t.Fatalf("%v: expected error containing %q, got %v", tc.task, tc.want, err)
+		}
+	}
+
+	for d, want := range map[time.Duration]string{30 * time.Second: "30秒", 4 * time.Minute: "4分钟", 2 * time.Hour: "2小时", 90 * time.Minute: "1小时30分钟"} {
+		if got := FormatRetryDelay(d); got != want {
+			t.Fatalf("FormatRetryDelay(%v): want %s, got %s", d, want, got)
+		}
+	}
+}
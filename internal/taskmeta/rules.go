@@ -0,0 +1,596 @@
+package taskmeta
+
+import (
+	"fmt"
+	"math/bits"
+	"math/rand/v2"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A next_time_rule is a base expression evaluated in Beijing time:
+//
+//	cron:<min> <hour> <dom> <month> <dow>  standard 5-field cron
+//	interval:<duration>                    e.g. interval:90m, interval:1d12h
+//	daily:HH:MM[,HH:MM...]                 fixed times every day
+//	window:HH:MM-HH:MM[,...]               a random moment inside the next window
+//	on_demand                              never rescheduled by the server
+//
+// optionally followed by ";"-separated modifiers:
+//
+//	days:<set>    only fire on these weekdays, e.g. days:1-5 or days:sat,sun
+//	jitter:<dur>  delay each run by a random amount of up to dur
+//
+// The historical rule names are aliases of such expressions.
+
+const RuleOnDemand = "on_demand"
+
+var ruleAliases = map[string]string{
+	"daily_reset":        "cron:1 0 * * *",
+	"weekly_monday":      "cron:1 0 * * 1",
+	"interval_6h":        "interval:6h",
+	"interval_8h":        "interval:8h",
+	"interval_2h_window": "cron:0 10-22/2 * * *",
+	"coop_window":        "cron:0 18,21 * * *",
+	"weekly_7d":          "interval:7d",
+}
+
+// windowedAliases fire at the opening of an in-game window that closes
+// before the next fire (the 2h 对弈竞猜 bet, the 18:00/21:00 co-op), so they
+// must not be pushed back by the schedule spread.
+var windowedAliases = map[string]struct{}{
+	"interval_2h_window": {},
+	"coop_window":        {},
+}
+
+// resetAliases run once per game day or week: a task that finishes between
+// 00:00 and the 00:01 fire must wait for the next reset, not run again today.
+var resetAliases = map[string]struct{}{
+	"daily_reset":   {},
+	"weekly_monday": {},
+}
+
+const (
+	maxRuleLength   = 200
+	maxDailyTimes   = 24
+	maxRuleWindows  = 8
+	minRuleInterval = time.Minute
+	maxRuleInterval = 30 * 24 * time.Hour
+	maxRuleJitter   = 12 * time.Hour
+	maxPreviewCount = 50
+)
+
+// NextTimeRule is a parsed next_time_rule.
+type NextTimeRule struct {
+	name       string // as written, aliases kept
+	expression string // alias resolved
+	onDemand   bool
+	interval   time.Duration
+	cron       *cronSchedule
+	times      []int        // daily: minutes after midnight, ascending
+	windows    []ruleWindow // window: ascending by start
+	days       uint8        // weekday bitmask, 0 means every day
+	jitter     time.Duration
+	windowed   bool // never delayed by the schedule spread
+	nextDay    bool // never fires again on the Beijing day of now
+}
+
+type ruleWindow struct {
+	start int // minutes after midnight
+	end   int // end <= start wraps past midnight
+}
+
+func (w ruleWindow) length() time.Duration {
+	minutes := w.end - w.start
+	if minutes <= 0 {
+		minutes += 24 * 60
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+// RuleFire is one upcoming run: it happens somewhere in [Earliest, Latest].
+type RuleFire struct {
+	Earliest time.Time
+	Latest   time.Time
+}
+
+// ParseNextTimeRule parses and validates a next_time_rule. Error messages are
+// meant for API responses.
+func ParseNextTimeRule(text string) (*NextTimeRule, error) {
+	text = strings.ToLower(strings.TrimSpace(text))
+	if text == "" {
+		return nil, fmt.Errorf("规则不能为空")
+	}
+	if len(text) > maxRuleLength {
+		return nil, fmt.Errorf("规则长度不能超过 %d", maxRuleLength)
+	}
+	clauses := strings.Split(text, ";")
+	for i := range clauses {
+		clauses[i] = strings.Join(strings.Fields(clauses[i]), " ")
+	}
+
+	rule := &NextTimeRule{}
+	base := clauses[0]
+	expression := base
+	if alias, ok := ruleAliases[base]; ok {
+		expression = alias
+	}
+	if err := rule.parseBase(expression); err != nil {
+		return nil, err
+	}
+	seen := map[string]struct{}{}
+	for _, clause := range clauses[1:] {
+		if rule.onDemand {
+			return nil, fmt.Errorf("on_demand 不支持修饰")
+		}
+		key, value, _ := strings.Cut(clause, ":")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if _, dup := seen[key]; dup {
+			return nil, fmt.Errorf("重复的修饰: %s", key)
+		}
+		seen[key] = struct{}{}
+		switch key {
+		case "days":
+			days, err := parseWeekdaySet(value)
+			if err != nil {
+				return nil, err
+			}
+			rule.days = days
+		case "jitter":
+			jitter, err := parseRuleDuration(value)
+			if err != nil || jitter < time.Minute || jitter > maxRuleJitter {
+				return nil, fmt.Errorf("jitter 时长无效，应在 1m 到 12h 之间")
+			}
+			rule.jitter = jitter
+		default:
+			return nil, fmt.Errorf("未知的修饰: %s", clause)
+		}
+		expression += ";" + clause
+	}
+	rule.name = strings.Join(clauses, ";")
+	rule.expression = expression
+	_, rule.windowed = windowedAliases[base]
+	rule.windowed = rule.windowed || len(rule.windows) > 0
+	_, rule.nextDay = resetAliases[base]
+
+	if !rule.onDemand {
+		if earliest, _ := rule.NextWindow(time.Now()); earliest.IsZero() {
+			return nil, fmt.Errorf("规则永远不会触发")
+		}
+	}
+	return rule, nil
+}
+
+func (r *NextTimeRule) parseBase(base string) error {
+	if base == RuleOnDemand {
+		r.onDemand = true
+		return nil
+	}
+	kind, value, found := strings.Cut(base, ":")
+	if !found {
+		return fmt.Errorf("无法识别的规则: %s", base)
+	}
+	value = strings.TrimSpace(value)
+	switch strings.TrimSpace(kind) {
+	case "cron":
+		schedule, err := parseCron(value)
+		if err != nil {
+			return err
+		}
+		r.cron = schedule
+	case "interval":
+		interval, err := parseRuleDuration(value)
+		if err != nil || interval < minRuleInterval || interval > maxRuleInterval {
+			return fmt.Errorf("interval 时长无效，应在 1m 到 30d 之间")
+		}
+		r.interval = interval
+	case "daily":
+		items := strings.Split(value, ",")
+		if len(items) > maxDailyTimes {
+			return fmt.Errorf("daily 最多设置 %d 个时间", maxDailyTimes)
+		}
+		seen := map[int]struct{}{}
+		for _, item := range items {
+			minute, ok := parseClockMinutes(item)
+			if !ok {
+				return fmt.Errorf("daily 时间格式应为 HH:MM")
+			}
+			if _, dup := seen[minute]; !dup {
+				seen[minute] = struct{}{}
+				r.times = append(r.times, minute)
+			}
+		}
+		sort.Ints(r.times)
+	case "window":
+		items := strings.Split(value, ",")
+		if len(items) > maxRuleWindows {
+			return fmt.Errorf("window 最多设置 %d 个时段", maxRuleWindows)
+		}
+		for _, item := range items {
+			startText, endText, _ := strings.Cut(item, "-")
+			start, startOK := parseClockMinutes(startText)
+			end, endOK := parseClockMinutes(endText)
+			if !startOK || !endOK || start == end {
+				return fmt.Errorf("window 格式应为 HH:MM-HH:MM，且开始和结束不能相同")
+			}
+			r.windows = append(r.windows, ruleWindow{start: start, end: end})
+		}
+		sort.Slice(r.windows, func(i, j int) bool { return r.windows[i].start < r.windows[j].start })
+	default:
+		return fmt.Errorf("无法识别的规则: %s", base)
+	}
+	return nil
+}
+
+// String returns the rule as written, with aliases kept.
+func (r *NextTimeRule) String() string { return r.name }
+
+// Expression returns the rule with aliases resolved.
+func (r *NextTimeRule) Expression() string { return r.expression }
+
+// OnDemand reports whether the server never reschedules the task.
+func (r *NextTimeRule) OnDemand() bool { return r.onDemand }
+
+// NextWindow returns the span in which the first run after now happens, in
+// Beijing time. Both values are zero for on_demand rules.
+func (r *NextTimeRule) NextWindow(now time.Time) (time.Time, time.Time) {
+	if r.onDemand {
+		return time.Time{}, time.Time{}
+	}
+	after := now
+	if r.nextDay {
+		if endOfDay := startOfDay(now).AddDate(0, 0, 1).Add(-time.Second); endOfDay.After(after) {
+			after = endOfDay
+		}
+	}
+	// A cron rule combined with days: may need to skip many occurrences.
+	for i := 0; i < 400; i++ {
+		earliest, latest := r.baseNext(after)
+		if earliest.IsZero() {
+			break
+		}
+		if r.allowsDay(earliest) {
+			return earliest.In(bjLoc), latest.Add(r.jitter).In(bjLoc)
+		}
+		day := startOfDay(earliest).AddDate(0, 0, 1)
+		if r.interval > 0 {
+			// Intervals resume at the start of the next allowed day.
+			for !r.allowsDay(day) {
+				day = day.AddDate(0, 0, 1)
+			}
+			return day, day.Add(r.jitter)
+		}
+		after = day.Add(-time.Second)
+	}
+	return time.Time{}, time.Time{}
+}
+
+// Next returns the next run time after now, with any jitter or window spread
+// applied at minute precision. It is zero for on_demand rules.
+func (r *NextTimeRule) Next(now time.Time) time.Time {
+	earliest, latest := r.NextWindow(now)
+	if earliest.IsZero() {
+		return earliest
+	}
+	if spread := int(latest.Sub(earliest) / time.Minute); spread > 0 {
+		earliest = earliest.Add(time.Duration(rand.IntN(spread+1)) * time.Minute)
+	}
+	return earliest
+}
+
+// NextFor is Next for one user: clock-aligned rules (cron, daily) are delayed
+// by the user's SpreadOffset, and the pick inside [earliest, latest] is
+// derived from the user instead of being random. Windowed rules are not
+// delayed; a window: rule already spreads users across its window.
+func (r *NextTimeRule) NextFor(now time.Time, userID uint, spread time.Duration) time.Time {
+	earliest, latest := r.NextWindow(now)
+	if earliest.IsZero() {
+		return earliest
+	}
+	if r.interval == 0 && !r.windowed {
+		offset := SpreadOffset(userID, spread)
+		earliest, latest = earliest.Add(offset), latest.Add(offset)
+	}
+	if span := uint64(latest.Sub(earliest) / time.Minute); span > 0 {
+		pick := stableHash("jitter", userID, earliest.UTC().Format(time.RFC3339)) % (span + 1)
+		earliest = earliest.Add(time.Duration(pick) * time.Minute)
+	}
+	return earliest
+}
+
+// Preview lists up to count upcoming runs after now. Each run is computed
+// from the earliest moment of the previous one.
+func (r *NextTimeRule) Preview(now time.Time, count int) []RuleFire {
+	if count > maxPreviewCount {
+		count = maxPreviewCount
+	}
+	fires := make([]RuleFire, 0, count)
+	after := now
+	for len(fires) < count {
+		earliest, latest := r.NextWindow(after)
+		if earliest.IsZero() {
+			break
+		}
+		fires = append(fires, RuleFire{Earliest: earliest, Latest: latest})
+		after = earliest
+	}
+	return fires
+}
+
+func (r *NextTimeRule) baseNext(after time.Time) (time.Time, time.Time) {
+	switch {
+	case r.interval > 0:
+		next := after.Add(r.interval)
+		return next, next
+	case r.cron != nil:
+		next := r.cron.next(after)
+		return next, next
+	case len(r.times) > 0:
+		today := startOfDay(after)
+		for _, day := range []time.Time{today, today.AddDate(0, 0, 1)} {
+			for _, minute := range r.times {
+				if at := day.Add(time.Duration(minute) * time.Minute); at.After(after) {
+					return at, at
+				}
+			}
+		}
+	case len(r.windows) > 0:
+		today := startOfDay(after)
+		for _, day := range []time.Time{today, today.AddDate(0, 0, 1)} {
+			for _, window := range r.windows {
+				if start := day.Add(time.Duration(window.start) * time.Minute); start.After(after) {
+					return start, start.Add(window.length() - time.Minute)
+				}
+			}
+		}
+	}
+	return time.Time{}, time.Time{}
+}
+
+func (r *NextTimeRule) allowsDay(t time.Time) bool {
+	return r.days == 0 || r.days&(1<<uint(t.In(bjLoc).Weekday())) != 0
+}
+
+func startOfDay(t time.Time) time.Time {
+	bj := t.In(bjLoc)
+	return time.Date(bj.Year(), bj.Month(), bj.Day(), 0, 0, 0, 0, bjLoc)
+}
+
+// EffectiveNextTimeRule returns the task's own next_time_rule when it is
+// valid, otherwise the default rule of the task type.
+func EffectiveNextTimeRule(taskName string, taskMap map[string]any) string {
+	if raw, ok := taskMap["next_time_rule"].(string); ok {
+		if rule, err := ParseNextTimeRule(raw); err == nil {
+			return rule.String()
+		}
+	}
+	return GetNextTimeRule(taskName)
+}
+
+// NextTimeRuleError reports an invalid next_time_rule in a task config patch.
+type NextTimeRuleError struct {
+	TaskType string
+	Err      error
+}
+
+func (e *NextTimeRuleError) Error() string {
+	return fmt.Sprintf("任务「%s」的 next_time_rule 无效: %v", e.TaskType, e.Err)
+}
+
+func (e *NextTimeRuleError) Unwrap() error { return e.Err }
+
+// NormalizeNextTimeRules validates the next_time_rule overrides of a task
+// config patch in place. An empty rule restores the task's default.
+func NormalizeNextTimeRules(patch map[string]any) error {
+	for taskName, rawCfg := range patch {
+		taskMap, ok := rawCfg.(map[string]any)
+		if !ok {
+			continue
+		}
+		raw, exists := taskMap["next_time_rule"]
+		if !exists {
+			continue
+		}
+		text, ok := raw.(string)
+		if !ok {
+			return &NextTimeRuleError{TaskType: taskName, Err: fmt.Errorf("必须是字符串")}
+		}
+		if strings.TrimSpace(text) == "" {
+			taskMap["next_time_rule"] = GetNextTimeRule(taskName)
+			continue
+		}
+		rule, err := ParseNextTimeRule(text)
+		if err != nil {
+			return &NextTimeRuleError{TaskType: taskName, Err: err}
+		}
+		taskMap["next_time_rule"] = rule.String()
+	}
+	return nil
+}
+
+var ruleDurationPattern = regexp.MustCompile(`^(\d+)d(.*)$`)
+
+// parseRuleDuration accepts Go durations plus a leading day count, e.g. 1d12h.
+func parseRuleDuration(text string) (time.Duration, error) {
+	text = strings.TrimSpace(text)
+	var total time.Duration
+	if m := ruleDurationPattern.FindStringSubmatch(text); m != nil {
+		days, err := strconv.Atoi(m[1])
+		if err != nil || days > 366 {
+			return 0, fmt.Errorf("invalid day count")
+		}
+		total = time.Duration(days) * 24 * time.Hour
+		text = m[2]
+		if text == "" {
+			return total, nil
+		}
+	}
+	rest, err := time.ParseDuration(text)
+	if err != nil || rest < 0 {
+		return 0, fmt.Errorf("invalid duration")
+	}
+	return total + rest, nil
+}
+
+func parseClockMinutes(text string) (int, bool) {
+	parsed, err := time.Parse("15:04", strings.TrimSpace(text))
+	if err != nil {
+		return 0, false
+	}
+	return parsed.Hour()*60 + parsed.Minute(), true
+}
+
+var weekdayNames = map[string]int{"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6}
+
+// parseWeekday returns 0-7, where both 0 and 7 are Sunday.
+func parseWeekday(text string) (int, bool) {
+	text = strings.TrimSpace(text)
+	if day, ok := weekdayNames[text]; ok {
+		return day, true
+	}
+	day, err := strconv.Atoi(text)
+	if err != nil || day < 0 || day > 7 {
+		return 0, false
+	}
+	return day, true
+}
+
+// parseWeekdaySet parses items like "1-5", "sat,sun" or "fri-mon" into a
+// bitmask. A range may wrap past Sunday.
+func parseWeekdaySet(text string) (uint8, error) {
+	var mask uint8
+	for _, item := range strings.Split(text, ",") {
+		fromText, toText, isRange := strings.Cut(item, "-")
+		from, ok := parseWeekday(fromText)
+		to := from
+		if ok && isRange {
+			to, ok = parseWeekday(toText)
+		}
+		if !ok {
+			return 0, fmt.Errorf("days 只能包含 0-7 或 sun-sat")
+		}
+		if to < from {
+			to += 7
+		}
+		for day := from; day <= to; day++ {
+			mask |= 1 << uint(day%7)
+		}
+	}
+	if bits.OnesCount8(mask) == 7 {
+		mask = 0
+	}
+	return mask, nil
+}
+
+// cronSchedule is a standard 5-field cron expression. When both day fields
+// are restricted a day matches if either does.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	domStar, dowStar              bool
+}
+
+func parseCron(text string) (*cronSchedule, error) {
+	fields := strings.Fields(text)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron 表达式需要 5 个字段（分 时 日 月 周）")
+	}
+	bounds := [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	var sets [5]uint64
+	for i, field := range fields {
+		set, err := parseCronField(field, bounds[i][0], bounds[i][1])
+		if err != nil {
+			return nil, fmt.Errorf("cron 字段 %q 无效", field)
+		}
+		sets[i] = set
+	}
+	if sets[4]&(1<<7) != 0 {
+		sets[4] |= 1 // 7 is also Sunday
+	}
+	return &cronSchedule{
+		minute:  sets[0],
+		hour:    sets[1],
+		dom:     sets[2],
+		month:   sets[3],
+		dow:     sets[4],
+		domStar: strings.HasPrefix(fields[2], "*"),
+		dowStar: strings.HasPrefix(fields[4], "*"),
+	}, nil
+}
+
+func parseCronField(field string, min, max int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		rangeText, stepText, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			value, err := strconv.Atoi(stepText)
+			if err != nil || value <= 0 {
+				return 0, fmt.Errorf("invalid step")
+			}
+			step = value
+		}
+		from, to := min, max
+		if rangeText != "*" {
+			fromText, toText, isRange := strings.Cut(rangeText, "-")
+			value, err := strconv.Atoi(fromText)
+			if err != nil {
+				return 0, err
+			}
+			from, to = value, value
+			if isRange {
+				if to, err = strconv.Atoi(toText); err != nil {
+					return 0, err
+				}
+			} else if hasStep {
+				to = max
+			}
+		}
+		if from < min || to > max || from > to {
+			return 0, fmt.Errorf("out of range")
+		}
+		for value := from; value <= to; value += step {
+			set |= 1 << uint(value)
+		}
+	}
+	return set, nil
+}
+
+func (c *cronSchedule) matchesDay(t time.Time) bool {
+	domMatch := c.dom&(1<<uint(t.Day())) != 0
+	dowMatch := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domStar || c.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+// next returns the first matching minute strictly after after, searching up
+// to five years ahead.
+func (c *cronSchedule) next(after time.Time) time.Time {
+	bj := after.In(bjLoc)
+	t := time.Date(bj.Year(), bj.Month(), bj.Day(), bj.Hour(), bj.Minute(), 0, 0, bjLoc).Add(time.Minute)
+	deadline := t.AddDate(5, 0, 0)
+	for t.Before(deadline) {
+		if c.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, bjLoc)
+			continue
+		}
+		if !c.matchesDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, bjLoc)
+			continue
+		}
+		if c.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, bjLoc)
+			continue
+		}
+		if c.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
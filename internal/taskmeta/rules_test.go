@@ -0,0 +1,253 @@
+package taskmeta
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func bj(month time.Month, day, hour, minute int) time.Time {
+	// 2026-03-02 is a Monday.
+	return time.Date(2026, month, day, hour, minute, 0, 0, bjLoc)
+}
+
+func TestCalcNextTimeAliases(t *testing.T) {
+	cases := []struct {
+		rule string
+		now  time.Time
+		want time.Time
+	}{
+		{"daily_reset", bj(3, 2, 15, 0), bj(3, 3, 0, 1)},
+		{"weekly_monday", bj(3, 2, 15, 0), bj(3, 9, 0, 1)},
+		{"weekly_monday", bj(3, 8, 23, 0), bj(3, 9, 0, 1)},
+		{"daily_reset", time.Date(2026, 3, 3, 0, 0, 30, 0, bjLoc), bj(3, 4, 0, 1)},
+		{"weekly_monday", time.Date(2026, 3, 2, 0, 0, 30, 0, bjLoc), bj(3, 9, 0, 1)},
+		{"interval_8h", bj(3, 2, 15, 30), bj(3, 2, 23, 30)},
+		{"weekly_7d", bj(3, 2, 15, 30), bj(3, 9, 15, 30)},
+		{"interval_2h_window", bj(3, 2, 10, 30), bj(3, 2, 12, 0)},
+		{"interval_2h_window", bj(3, 2, 22, 0), bj(3, 3, 10, 0)},
+		{"coop_window", bj(3, 2, 18, 0), bj(3, 2, 21, 0)},
+		{"coop_window", bj(3, 2, 21, 5), bj(3, 3, 18, 0)},
+	}
+	for _, tc := range cases {
+		if got := CalcNextTime(tc.rule, tc.now); !got.Equal(tc.want) {
+			t.Fatalf("%s at %v: want %v, got %v", tc.rule, tc.now, tc.want, got)
+		}
+	}
+	if got := CalcNextTime("on_demand", bj(3, 2, 15, 0)); !got.IsZero() {
+		t.Fatalf("on_demand should not reschedule, got %v", got)
+	}
+	if got := CalcNextTime("bogus", bj(3, 2, 15, 0)); !got.IsZero() {
+		t.Fatalf("unknown rule should not reschedule, got %v", got)
+	}
+}
+
+func TestNextTimeRuleCron(t *testing.T) {
+	rule, err := ParseNextTimeRule("cron:*/15 9-10 * * 1-5")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	fires := rule.Preview(bj(3, 6, 10, 50), 3) // Friday
+	want := []time.Time{bj(3, 9, 9, 0), bj(3, 9, 9, 15), bj(3, 9, 9, 30)}
+	for i, fire := range fires {
+		if !fire.Earliest.Equal(want[i]) || !fire.Latest.Equal(want[i]) {
+			t.Fatalf("fire %d: want %v, got %+v", i, want[i], fire)
+		}
+	}
+
+	// Day of month and weekday both restricted: either matches.
+	rule, err = ParseNextTimeRule("cron:0 8 15 * 0")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	if next := rule.Next(bj(3, 2, 9, 0)); !next.Equal(bj(3, 8, 8, 0)) {
+		t.Fatalf("expected Sunday 03-08, got %v", next)
+	}
+	if next := rule.Next(bj(3, 14, 9, 0)); !next.Equal(bj(3, 15, 8, 0)) {
+		t.Fatalf("expected 03-15, got %v", next)
+	}
+}
+
+func TestNextTimeRuleWindowsDaysAndJitter(t *testing.T) {
+	rule, err := ParseNextTimeRule("window:20:00-22:00, 09:00-10:00")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	earliest, latest := rule.NextWindow(bj(3, 2, 9, 30))
+	if !earliest.Equal(bj(3, 2, 20, 0)) || !latest.Equal(bj(3, 2, 21, 59)) {
+		t.Fatalf("unexpected window %v - %v", earliest, latest)
+	}
+	for i := 0; i < 20; i++ {
+		next := rule.Next(bj(3, 2, 9, 30))
+		if next.Before(earliest) || next.After(latest) {
+			t.Fatalf("next %v outside window", next)
+		}
+	}
+
+	rule, err = ParseNextTimeRule("daily:08:00; days:sat,sun; jitter:30m")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	if rule.String() != "daily:08:00;days:sat,sun;jitter:30m" {
+		t.Fatalf("unexpected normalized rule %q", rule.String())
+	}
+	earliest, latest = rule.NextWindow(bj(3, 2, 9, 0))
+	if !earliest.Equal(bj(3, 7, 8, 0)) || !latest.Equal(bj(3, 7, 8, 30)) {
+		t.Fatalf("expected Saturday 08:00-08:30, got %v - %v", earliest, latest)
+	}
+
+	rule, err = ParseNextTimeRule("interval_8h;days:1-5")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	if rule.Expression() != "interval:8h;days:1-5" {
+		t.Fatalf("alias should resolve, got %q", rule.Expression())
+	}
+	if next := rule.Next(bj(3, 6, 20, 0)); !next.Equal(bj(3, 9, 0, 0)) {
+		t.Fatalf("interval landing on the weekend should resume Monday, got %v", next)
+	}
+
+	if rule, err := ParseNextTimeRule("daily:08:00;days:fri-mon"); err != nil || rule.days != 0b1100011 {
+		t.Fatalf("wrapping weekday range failed: %v %v", rule, err)
+	}
+}
+
+func TestParseNextTimeRuleRejects(t *testing.T) {
+	cases := []struct {
+		rule string
+		want string
+	}{
+		{"", "不能为空"},
+		{"hourly", "无法识别"},
+		{"cron:* * *", "5 个字段"},
+		{"cron:61 * * * *", "cron 字段"},
+		{"cron:0 0 31 2 *", "永远不会触发"},
+		{"interval:30s", "interval"},
+		{"interval:31d", "interval"},
+		{"daily:25:00", "HH:MM"},
+		{"window:10:00-10:00", "window"},
+		{"daily:08:00;days:8", "days"},
+		{"daily:08:00;jitter:13h", "jitter"},
+		{"daily:08:00;jitter:5m;jitter:6m", "重复"},
+		{"daily:08:00;every:2", "未知的修饰"},
+		{"on_demand;jitter:5m", "on_demand"},
+	}
+	for _, tc := range cases {
+		if _, err := ParseNextTimeRule(tc.rule); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Fatalf("%q: expected error containing %q, got %v", tc.rule, tc.want, err)
+		}
+	}
+}
+
+func TestNormalizeNextTimeRules(t *testing.T) {
+	patch := map[string]any{
+		"签到":   map[string]any{"next_time_rule": " Daily:08:00 ; Jitter:10m "},
+		"探索突破": map[string]any{"next_time_rule": ""},
+		"悬赏":   map[string]any{"enabled": false},
+	}
+	if err := NormalizeNextTimeRules(patch); err != nil {
+		t.Fatalf("normalize failed: %v", err)
+	}
+	if rule := patch["签到"].(map[string]any)["next_time_rule"]; rule != "daily:08:00;jitter:10m" {
+		t.Fatalf("unexpected normalized rule %v", rule)
+	}
+	if rule := patch["探索突破"].(map[string]any)["next_time_rule"]; rule != "interval_8h" {
+		t.Fatalf("empty rule should restore the default, got %v", rule)
+	}
+
+	err := NormalizeNextTimeRules(map[string]any{"签到": map[string]any{"next_time_rule": "weekly"}})
+	var ruleErr *NextTimeRuleError
+	if !errors.As(err, &ruleErr) || ruleErr.TaskType != "签到" {
+		t.Fatalf("expected NextTimeRuleError, got %v", err)
+	}
+
+	if rule := EffectiveNextTimeRule("探索突破", map[string]any{"next_time_rule": "broken"}); rule != "interval_8h" {
+		t.Fatalf("invalid stored rule should fall back to the default, got %q", rule)
+	}
+	if !IsAgentNextTimeAllowed("探索突破", map[string]any{"next_time_rule": "on_demand"}) {
+		t.Fatalf("an on_demand override should let the agent set next_time")
+	}
+	if !IsAgentNextTimeAllowed("探索突破", map[string]any{"next_time_rule": "interval:6h;jitter:10m"}) {
+		t.Fatalf("an override equivalent to interval_6h should let the agent set next_time")
+	}
+	if !IsAgentNextTimeAllowed("寄养", map[string]any{"next_time_rule": "daily:08:00,20:00"}) {
+		t.Fatalf("寄养 reports its own next_time even with a custom rule")
+	}
+	if IsAgentNextTimeAllowed("探索突破", map[string]any{"next_time_rule": "interval:8h"}) {
+		t.Fatalf("interval:8h should keep the server-calculated next_time")
+	}
+}
+
+func TestSpreadOffsetIsStable(t *testing.T) {
+	spread := 30 * time.Minute
+	seen := map[time.Duration]struct{}{}
+	for userID := uint(1); userID <= 200; userID++ {
+		offset := SpreadOffset(userID, spread)
+		if offset < 0 || offset >= spread || offset%time.Minute != 0 {
+			t.Fatalf("offset %v out of range for user %d", offset, userID)
+		}
+		if offset != SpreadOffset(userID, spread) {
+			t.Fatalf("offset should be stable for user %d", userID)
+		}
+		seen[offset] = struct{}{}
+	}
+	if len(seen) < 20 {
+		t.Fatalf("200 users should cover most of a 30 minute window, got %d distinct offsets", len(seen))
+	}
+	if SpreadOffset(7, 0) != 0 || SpreadOffset(7, 30*time.Second) != 0 {
+		t.Fatalf("no spread should mean no offset")
+	}
+
+	minutes := 500
+	if got := ResolveSpread(&minutes, 30*time.Minute); got != MaxScheduleSpread {
+		t.Fatalf("spread should be capped, got %v", got)
+	}
+	if got := ResolveSpread(nil, 30*time.Minute); got != 30*time.Minute {
+		t.Fatalf("nil should use the global spread, got %v", got)
+	}
+}
+
+func TestCalcNextTimeForUser(t *testing.T) {
+	now := bj(3, 2, 15, 0)
+	spread := time.Hour
+	distinct := map[time.Time]struct{}{}
+	for userID := uint(1); userID <= 20; userID++ {
+		next := CalcNextTimeForUser("daily_reset", now, userID, spread)
+		if want := bj(3, 3, 0, 1).Add(SpreadOffset(userID, spread)); !next.Equal(want) {
+			t.Fatalf("user %d: want %v, got %v", userID, want, next)
+		}
+		distinct[next] = struct{}{}
+	}
+	if len(distinct) < 5 {
+		t.Fatalf("users should be spread out, got %d distinct times", len(distinct))
+	}
+
+	if next := CalcNextTimeForUser("interval_8h", now, 3, spread); !next.Equal(bj(3, 2, 23, 0)) {
+		t.Fatalf("interval rules should not be spread, got %v", next)
+	}
+
+	// Windowed rules keep their users inside the window whatever the spread.
+	for userID := uint(1); userID <= 50; userID++ {
+		next := CalcNextTimeForUser("interval_2h_window", now, userID, MaxScheduleSpread)
+		if !next.Equal(bj(3, 2, 16, 0)) {
+			t.Fatalf("对弈竞猜 for user %d should open with its window, got %v", userID, next)
+		}
+		if next := CalcNextTimeForUser("coop_window;days:1-7", now, userID, MaxScheduleSpread); !next.Equal(bj(3, 2, 18, 0)) {
+			t.Fatalf("coop_window for user %d should not be spread, got %v", userID, next)
+		}
+		if next := CalcNextTimeForUser("window:09:00-11:00", now, userID, MaxScheduleSpread); next.After(bj(3, 3, 10, 59)) {
+			t.Fatalf("window pick for user %d left the window: %v", userID, next)
+		}
+	}
+
+	first := CalcNextTimeForUser("window:09:00-11:00", now, 3, 0)
+	if first.Before(bj(3, 3, 9, 0)) || first.After(bj(3, 3, 10, 59)) {
+		t.Fatalf("pick %v outside window", first)
+	}
+	for i := 0; i < 5; i++ {
+		if again := CalcNextTimeForUser("window:09:00-11:00", now, 3, 0); !again.Equal(first) {
+			t.Fatalf("window pick should be reproducible: %v vs %v", first, again)
+		}
+	}
+}
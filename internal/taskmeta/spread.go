@@ -0,0 +1,46 @@
+package taskmeta
+
+import (
+	"fmt"
+	"hash/fnv"
+	"time"
+)
+
+// MaxScheduleSpread caps the per-manager spread window.
+const MaxScheduleSpread = 4 * time.Hour
+
+// SpreadOffset returns the stable delay of userID inside a spread window, in
+// whole minutes in [0, spread). The same user always gets the same offset so
+// schedules are reproducible.
+func SpreadOffset(userID uint, spread time.Duration) time.Duration {
+	if spread > MaxScheduleSpread {
+		spread = MaxScheduleSpread
+	}
+	minutes := uint64(spread / time.Minute)
+	if minutes == 0 {
+		return 0
+	}
+	return time.Duration(stableHash("spread", userID, "")%minutes) * time.Minute
+}
+
+func stableHash(kind string, userID uint, key string) uint64 {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s:%d:%s", kind, userID, key)
+	return h.Sum64()
+}
+
+// ResolveSpread returns a manager's spread window in minutes, or the global
+// default when the manager has none.
+func ResolveSpread(managerMinutes *int, global time.Duration) time.Duration {
+	spread := global
+	if managerMinutes != nil {
+		spread = time.Duration(*managerMinutes) * time.Minute
+	}
+	if spread < 0 {
+		return 0
+	}
+	if spread > MaxScheduleSpread {
+		return MaxScheduleSpread
+	}
+	return spread
+}
@@ -157,7 +157,7 @@ var defaultTaskConfig = map[string]map[string]any{
 	"弥助":      {"enabled": true, "next_time": "2020-01-01 00:00", "fail_delay": 30, "next_time_rule": "daily_reset"},
 	"勾协":      {"enabled": true, "next_time": "2020-01-01 00:00", "fail_delay": 30, "next_time_rule": "daily_reset"},
 	"探索突破":    {"enabled": true, "sub_explore": true, "sub_tupo": true, "stamina_threshold": 1000, "difficulty": "normal", "next_time": "2020-01-01 00:00", "fail_delay": 30, "next_time_rule": "interval_8h", "allowed_interrupts": []any{"寄养"}},
-	"结界卡合成":   {"enabled": true, "explore_count": 0, "next_time_rule": "daily_reset"},
+	"结界卡合成":   {"enabled": true, "explore_count": 0, "next_time_rule": "daily_reset", "depends_on": []any{"探索突破"}},
 	"放卡":      {"enabled": true, "next_time": "2020-01-01 00:00", "fail_delay": 30, "next_time_rule": "on_demand", "card_type": "taigu", "level_min": 1, "level_max": 6, "sort_order": "high_to_low"},
 	"加好友":     {"enabled": true, "next_time": "2020-01-01 00:00", "fail_delay": 30, "next_time_rule": "daily_reset"},
 	"领取登录礼包":  {"enabled": true, "next_time": "2020-01-01 00:00", "fail_delay": 30, "next_time_rule": "daily_reset"},
@@ -169,7 +169,7 @@ var defaultTaskConfig = map[string]map[string]any{
 	"寮商店":     {"enabled": true, "next_time": "2020-01-01 00:00", "buy_heisui": true, "buy_lanpiao": true, "fail_delay": 30, "next_time_rule": "daily_reset"},
 	"领取寮金币":   {"enabled": true, "next_time": "2020-01-01 00:00", "fail_delay": 30, "next_time_rule": "daily_reset"},
 	"每日一抽":    {"enabled": true, "next_time": "2020-01-01 00:00", "fail_delay": 30, "next_time_rule": "daily_reset"},
-	"每周商店":    {"enabled": true, "next_time": "2020-01-01 00:00", "buy_lanpiao": true, "buy_heidan": true, "buy_tili": true, "fail_delay": 30, "next_time_rule": "weekly_7d"},
+	"每周商店":    {"enabled": true, "next_time": "2020-01-01 00:00", "buy_lanpiao": true, "buy_heidan": true, "buy_tili": true, "fail_delay": 30, "next_time_rule": "weekly_7d", "depends_on": []any{"领取邮件"}},
 	"秘闻":      {"enabled": true, "next_time": "2020-01-01 00:00", "fail_delay": 30, "next_time_rule": "weekly_monday"},
 	"签到":      {"enabled": false, "next_time": "2020-01-01 00:00", "fail_delay": 30, "next_time_rule": "daily_reset"},
 	"御魂":      {"enabled": false, "run_count": 0, "remaining_count": 0, "unlocked_count": 0, "target_level": 10, "fail_delay": 2880, "next_time_rule": "on_demand"},
@@ -177,7 +177,7 @@ var defaultTaskConfig = map[string]map[string]any{
 	"召唤礼包":    {"enabled": true, "next_time": "2020-01-01 00:00", "fail_delay": 30, "next_time_rule": "daily_reset"},
 	"领取饭盒酒壶":  {"enabled": true, "next_time": "2020-01-01 00:00", "fail_delay": 30, "next_time_rule": "daily_reset"},
 	"斗技":      {"enabled": false, "start_hour": 12, "end_hour": 23, "mode": "honor", "target_score": 2000, "next_time": "2020-01-01 00:00", "fail_delay": 30, "next_time_rule": "coop_window"},
-	"对弈竞猜":    {"enabled": true, "next_time": "2020-01-01 00:00", "fail_delay": 30, "next_time_rule": "interval_2h_window"},
+	"对弈竞猜":    {"enabled": true, "next_time": "2020-01-01 00:00", "fail_delay": 30, "next_time_rule": "interval_2h_window", "retry": map[string]any{"base_delay_seconds": 30, "max_delay_seconds": 300}},
 	"起号_租借式神": {"enabled": true, "next_time": "2020-01-01 00:00", "fail_delay": 30, "next_time_rule": "daily_reset"},
 	"起号_领取奖励": {"enabled": true, "next_time": "2020-01-01 00:00", "fail_delay": 30, "next_time_rule": "daily_reset"},
 	"起号_新手任务": {"enabled": true, "next_time": "2020-01-01 00:00", "fail_delay": 30, "next_time_rule": "daily_reset"},
@@ -252,6 +252,17 @@ func DefaultTaskOrder() []string {
 	return cloneStrings(allTaskOrder)
 }
 
+// IsKnownTaskType reports whether name is one of the task types the cloud
+// schedules.
+func IsKnownTaskType(name string) bool {
+	for _, taskName := range allTaskOrder {
+		if taskName == name {
+			return true
+		}
+	}
+	return false
+}
+
 func BuildDefaultTaskConfig() map[string]any {
 	return buildDefaultTaskConfigByOrder(allTaskOrder)
 }
@@ -0,0 +1,98 @@
+package tracing
+
+import (
+	"errors"
+
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+const gormSpanKey = "tracing:span"
+
+type gormSpan struct {
+	span      trace.Span
+	operation string
+}
+
+// InstrumentGORM records each statement run with a traced context (see
+// db.WithContext) as a client span. The SQL is recorded with placeholders
+// only; bound values may hold tokens and password hashes.
+func InstrumentGORM(db *gorm.DB) error {
+	cb := db.Callback()
+	steps := []struct {
+		name      string
+		operation string
+		before    func(string, func(*gorm.DB)) error
+		after     func(string, func(*gorm.DB)) error
+	}{
+		{"create", "INSERT", cb.Create().Before("gorm:create").Register, cb.Create().After("gorm:create").Register},
+		{"query", "SELECT", cb.Query().Before("gorm:query").Register, cb.Query().After("gorm:query").Register},
+		{"update", "UPDATE", cb.Update().Before("gorm:update").Register, cb.Update().After("gorm:update").Register},
+		{"delete", "DELETE", cb.Delete().Before("gorm:delete").Register, cb.Delete().After("gorm:delete").Register},
+		{"row", "ROW", cb.Row().Before("gorm:row").Register, cb.Row().After("gorm:row").Register},
+		{"raw", "RAW", cb.Raw().Before("gorm:raw").Register, cb.Raw().After("gorm:raw").Register},
+	}
+	for _, step := range steps {
+		if err := step.before("tracing:before_"+step.name, startGORMSpan(step.operation)); err != nil {
+			return err
+		}
+		if err := step.after("tracing:after_"+step.name, endGORMSpan); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func startGORMSpan(operation string) func(*gorm.DB) {
+	return func(tx *gorm.DB) {
+		ctx := tx.Statement.Context
+		if !traced(ctx) {
+			return
+		}
+		ctx, span := Tracer().Start(ctx, operation,
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(
+				semconv.DBSystemNameKey.String(dbSystemName(tx.Dialector.Name())),
+				semconv.DBOperationName(operation),
+			),
+		)
+		tx.Statement.Context = ctx
+		tx.InstanceSet(gormSpanKey, gormSpan{span: span, operation: operation})
+	}
+}
+
+func endGORMSpan(tx *gorm.DB) {
+	value, ok := tx.InstanceGet(gormSpanKey)
+	if !ok {
+		return
+	}
+	started, ok := value.(gormSpan)
+	if !ok || started.span == nil {
+		return
+	}
+	// A statement can run more than once; the next run starts its own span.
+	tx.InstanceSet(gormSpanKey, gormSpan{})
+	span := started.span
+	defer span.End()
+	if table := tx.Statement.Table; table != "" {
+		span.SetName(started.operation + " " + table)
+		span.SetAttributes(semconv.DBCollectionName(table))
+	}
+	if sql := tx.Statement.SQL.String(); sql != "" {
+		span.SetAttributes(semconv.DBQueryText(sql))
+	}
+	span.SetAttributes(semconv.DBResponseReturnedRows(int(tx.Statement.RowsAffected)))
+	if err := tx.Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
+
+func dbSystemName(dialector string) string {
+	if dialector == "postgres" {
+		return "postgresql"
+	}
+	return dialector
+}
@@ -0,0 +1,101 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/glebarez/sqlite"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+type tracedRow struct {
+	ID   uint `gorm:"primaryKey"`
+	Name string
+}
+
+func setupRecorder(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() { _ = provider.Shutdown(context.Background()) })
+	return recorder
+}
+
+func TestMiddlewareContinuesTraceIntoGORM(t *testing.T) {
+	recorder := setupRecorder(t)
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("open sqlite failed: %v", err)
+	}
+	if err := InstrumentGORM(db); err != nil {
+		t.Fatalf("instrument gorm failed: %v", err)
+	}
+	if err := db.AutoMigrate(&tracedRow{}); err != nil {
+		t.Fatalf("auto migrate failed: %v", err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(Middleware("/health"))
+	router.GET("/rows/:id", func(c *gin.Context) {
+		var rows []tracedRow
+		_ = db.WithContext(c.Request.Context()).Where("id = ?", c.Param("id")).Find(&rows).Error
+		c.Status(http.StatusOK)
+	})
+	router.GET("/health", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	// Queries outside a trace are not recorded.
+	if err := db.Create(&tracedRow{Name: "a"}).Error; err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	if spans := recorder.Ended(); len(spans) != 0 {
+		t.Fatalf("untraced query should not record spans, got %d", len(spans))
+	}
+
+	const parent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	req := httptest.NewRequest(http.MethodGet, "/rows/1", nil)
+	req.Header.Set("traceparent", parent)
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/health", nil))
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("expected a query and a server span, got %d", len(spans))
+	}
+	query, server := spans[0], spans[1]
+	if server.Name() != "GET /rows/:id" || server.SpanKind() != trace.SpanKindServer {
+		t.Fatalf("unexpected server span %q kind %s", server.Name(), server.SpanKind())
+	}
+	if got := server.SpanContext().TraceID().String(); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Fatalf("server span should continue the incoming trace, got %s", got)
+	}
+	if query.Name() != "SELECT traced_rows" || query.Parent().SpanID() != server.SpanContext().SpanID() {
+		t.Fatalf("query span %q should be a child of the server span", query.Name())
+	}
+}
+
+func TestTraceParentRoundTrip(t *testing.T) {
+	setupRecorder(t)
+	if got := TraceParent(context.Background()); got != "" {
+		t.Fatalf("no span should give an empty traceparent, got %q", got)
+	}
+	ctx, span := Start(context.Background(), "enqueue")
+	traceParent := TraceParent(ctx)
+	span.End()
+
+	resumed, child := Start(WithTraceParent(context.Background(), traceParent), "deliver")
+	defer child.End()
+	if trace.SpanContextFromContext(resumed).TraceID() != span.SpanContext().TraceID() {
+		t.Fatalf("resumed span should join the stored trace")
+	}
+}